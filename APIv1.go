@@ -0,0 +1,746 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Alarms"
+	"BatteryMonitor6813V4/Auth"
+	"BatteryMonitor6813V4/CellAnalytics"
+	"BatteryMonitor6813V4/CellResistance"
+	"BatteryMonitor6813V4/Energy"
+	"BatteryMonitor6813V4/FuelGauge"
+	"BatteryMonitor6813V4/LTC6813/LTC6813"
+	"BatteryMonitor6813V4/OpenAPI"
+	"BatteryMonitor6813V4/Reports"
+	"BatteryMonitor6813V4/Retention"
+	"BatteryMonitor6813V4/StateOfCharge"
+	"BatteryMonitor6813V4/StateOfHealth"
+	"BatteryMonitor6813V4/Storage"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiBase = "/api/v1"
+const apiVersion = "1.0.0"
+const programVersion = "1.1"
+
+/**
+The response types of /api/v1. Changing a field name or type here changes the API, so add fields rather than
+changing them.
+*/
+type APIVersion struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	APIVersion string `json:"api_version"`
+}
+
+type APICell struct {
+	Cell        int      `json:"cell"`        // 1..38
+	Volts       float64  `json:"volts"`       // Volts
+	Temperature *float64 `json:"temperature"` // °C, null if the sensor is faulty
+}
+
+type APIBank struct {
+	Bank           int       `json:"bank"`
+	Volts          float64   `json:"volts"`
+	MaxTemperature float64   `json:"max_temperature"`
+	Cells          []APICell `json:"cells"`
+}
+
+type APIBattery struct {
+	Time             time.Time `json:"time"`
+	Devices          int       `json:"devices"` // LTC6813 devices found on the chain. 0 if it is not responding.
+	VoltageError     string    `json:"voltage_error,omitempty"`
+	TemperatureError string    `json:"temperature_error,omitempty"`
+	Banks            []APIBank `json:"banks"`
+}
+
+type APIFuelGaugeBank struct {
+	Bank           int        `json:"bank"`
+	On             bool       `json:"on"`
+	Current        float64    `json:"current"`  // Amps, positive when charging
+	SOC            float64    `json:"soc"`      // %
+	Charge         float64    `json:"charge"`   // Ah
+	Capacity       int        `json:"capacity"` // Ah
+	Watering       bool       `json:"watering"`
+	LastFullCharge *time.Time `json:"last_full_charge"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+type APIFuelGauge struct {
+	Banks            []APIFuelGaugeBank `json:"banks"`
+	BatteryFan       bool               `json:"battery_fan"`
+	GeneratorRunning bool               `json:"generator_running"`
+}
+
+type APISettings struct {
+	Capacity []int             `json:"capacity"` // Ah for each bank
+	Charging InverterSetpoints `json:"charging"`
+}
+
+type APISerialNumber struct {
+	Cell               int        `json:"cell"` // 1..38 and 101..138
+	SerialNumber       string     `json:"serial_number"`
+	InstallDate        *time.Time `json:"install_date"`
+	FullCharge         bool       `json:"full_charge"`
+	FullChargeDetected *time.Time `json:"full_charge_detected"`
+}
+
+type APICurrentPoint struct {
+	Time        time.Time `json:"time"`
+	Left        float64   `json:"left"`         // Amps
+	Right       float64   `json:"right"`        // Amps
+	ChargeLeft  float64   `json:"charge_left"`  // Ah
+	ChargeRight float64   `json:"charge_right"` // Ah
+}
+
+type APIVoltagePoint struct {
+	Time  time.Time `json:"time"`
+	Left  float64   `json:"left"`
+	Right float64   `json:"right"`
+}
+
+type APICellPoint struct {
+	Time    time.Time `json:"time"`
+	Volts   float64   `json:"volts"`
+	Current float64   `json:"current"`
+}
+
+type APICellResistance struct {
+	Latest [2][]*CellResistance.Estimate `json:"latest"`
+	Trends []CellResistance.Trend        `json:"trends"`
+}
+
+type APIEnergy struct {
+	Periods []Energy.Period `json:"periods"`
+	Total   Energy.Period   `json:"total"`
+}
+
+type APIReportRequest struct {
+	Kind  string `json:"kind"`  // daily, weekly or monthly
+	Email bool   `json:"email"` // Send it through the notifier as well
+}
+
+type APICapacityRequest struct {
+	Capacity int `json:"capacity"` // Ah. 0 uses the estimate from the capacity tests.
+}
+
+type APIWaterRequest struct {
+	Minutes uint64 `json:"minutes"` // 0 turns the water off
+}
+
+type APIOnOffRequest struct {
+	On bool `json:"on"`
+}
+
+type APIGeneratorRequest struct {
+	Run bool `json:"run"`
+}
+
+type APIResult struct {
+	Success bool `json:"success"`
+}
+
+type APICoil struct {
+	Coil uint16 `json:"coil"`
+	On   bool   `json:"on"`
+}
+
+type APIRegisterRequest struct {
+	Value uint16 `json:"value"`
+}
+
+type APII2CRegister struct {
+	Sensor   int    `json:"sensor"`
+	Register uint8  `json:"register"`
+	Value    uint16 `json:"value"`
+}
+
+/**
+An endpoint of the API with the role needed to use it
+*/
+type apiRoute struct {
+	OpenAPI.Operation
+	Role    Auth.Role
+	Handler http.HandlerFunc
+}
+
+var bankParameter = OpenAPI.PathParameter("bank", "integer", "0 (left) or 1 (right)")
+var reportParameter = OpenAPI.PathParameter("id", "integer", "Report id")
+var startParameter = OpenAPI.QueryParameter("start", "string", "Local time, yyyy-mm-dd hh:mm[:ss]")
+var endParameter = OpenAPI.QueryParameter("end", "string", "Local time, yyyy-mm-dd hh:mm[:ss]")
+
+func apiRoutes() []apiRoute {
+	serverError := []int{http.StatusInternalServerError}
+	command := []int{http.StatusBadRequest, http.StatusInternalServerError}
+	return []apiRoute{
+		{OpenAPI.Operation{Method: "GET", Path: "/version", Summary: "Program and API version", Tag: "system", Response: APIVersion{}},
+			Auth.Viewer, apiGetVersion},
+		{OpenAPI.Operation{Method: "GET", Path: "/battery", Summary: "Latest cell voltages and temperatures", Tag: "battery",
+			Response: APIBattery{}, Errors: []int{http.StatusServiceUnavailable}},
+			Auth.Viewer, apiGetBattery},
+		{OpenAPI.Operation{Method: "GET", Path: "/fuelgauge", Summary: "Bank current, state of charge and relay states", Tag: "battery",
+			Response: APIFuelGauge{}},
+			Auth.Viewer, apiGetFuelGauge},
+		{OpenAPI.Operation{Method: "GET", Path: "/inverter", Summary: "Latest values from the Sunny Island inverters", Tag: "inverter",
+			Response: &InverterValues{}},
+			Auth.Viewer, apiGetInverter},
+		{OpenAPI.Operation{Method: "GET", Path: "/status", Summary: "Current, state of charge and voltages averaged over a period", Tag: "battery",
+			Parameters: []OpenAPI.Parameter{OpenAPI.QueryParameter("avg", "integer", "Seconds to average over, default 300")},
+			Response:   BatteryStatus{}, Errors: []int{http.StatusBadRequest, http.StatusInternalServerError}},
+			Auth.Viewer, apiGetStatus},
+		{OpenAPI.Operation{Method: "GET", Path: "/settings", Summary: "Bank capacities and charging set points", Tag: "battery",
+			Response: APISettings{}},
+			Auth.Viewer, apiGetSettings},
+		{OpenAPI.Operation{Method: "GET", Path: "/serial-numbers", Summary: "Cell serial numbers and full charge state", Tag: "battery",
+			Response: []APISerialNumber(nil), Errors: serverError},
+			Auth.Viewer, apiGetSerialNumbers},
+		{OpenAPI.Operation{Method: "GET", Path: "/history", Summary: "Any logged series from the live and archive tables, raw or as bucket averages, minimums and maximums",
+			Description: "Ranges are limited to a day of raw rows, 7 days of 15s buckets, 31 days of 1m buckets, a year of 1h buckets and 10 years of 1d buckets.",
+			Tag:         "history",
+			Parameters: []OpenAPI.Parameter{
+				OpenAPI.QueryParameter("series", "string", "bank_volts, current, charge, cell_volts or temperature"),
+				OpenAPI.QueryParameter("cells", "string", "Comma separated cells for cell_volts and temperature, 1..38 in bank 0 and 101..138 in bank 1. Default all."),
+				startParameter, endParameter,
+				OpenAPI.QueryParameter("bucket", "string", "raw, 15s, 1m, 1h or 1d. Default 1m."),
+				OpenAPI.QueryParameter("limit", "integer", fmt.Sprintf("Most points to return, default %d, at most %d", Storage.DefaultHistoryLimit, Storage.MaxHistoryLimit))},
+			Response: Storage.HistoryResult{}, Errors: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Viewer, apiGetHistory},
+		{OpenAPI.Operation{Method: "GET", Path: "/history/current", Summary: "Bank current and charge history, in averages for more than an hour", Tag: "history",
+			Parameters: []OpenAPI.Parameter{startParameter, endParameter},
+			Response:   []APICurrentPoint(nil), Errors: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Viewer, apiGetCurrentHistory},
+		{OpenAPI.Operation{Method: "GET", Path: "/history/voltage", Summary: "Bank voltage history in averages of 15 seconds or more", Tag: "history",
+			Parameters: []OpenAPI.Parameter{startParameter, endParameter},
+			Response:   []APIVoltagePoint(nil), Errors: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Viewer, apiGetVoltageHistory},
+		{OpenAPI.Operation{Method: "GET", Path: "/banks/{bank}/cells/{cell}/history", Summary: "Cell voltage and bank current history in 15 second averages",
+			Tag: "history",
+			Parameters: []OpenAPI.Parameter{bankParameter, OpenAPI.PathParameter("cell", "integer", "1..38"), startParameter, endParameter,
+				OpenAPI.QueryParameter("minAmps", "number", "Only include times the bank current was above this"),
+				OpenAPI.QueryParameter("maxAmps", "number", "Only include times the bank current was below this")},
+			Response: []APICellPoint(nil), Errors: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Viewer, apiGetCellHistory},
+		{OpenAPI.Operation{Method: "GET", Path: "/alarms", Summary: "Alarms raised in a period, default the last 24 hours", Tag: "alarms",
+			Parameters: []OpenAPI.Parameter{startParameter, endParameter},
+			Response:   []Alarms.Alarm(nil), Errors: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetAlarms},
+		{OpenAPI.Operation{Method: "GET", Path: "/alarms/active", Summary: "Alarms that have not cleared", Tag: "alarms",
+			Response: []Alarms.Alarm(nil), Errors: []int{http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetActiveAlarms},
+		{OpenAPI.Operation{Method: "GET", Path: "/alarms/rules", Summary: "The alarm rules in use", Tag: "alarms",
+			Response: []Alarms.Rule(nil)},
+			Auth.Viewer, webGetAlarmRules},
+		{OpenAPI.Operation{Method: "POST", Path: "/alarms/{id}/acknowledge", Summary: "Acknowledge an alarm as the logged in user", Tag: "alarms",
+			Parameters: []OpenAPI.Parameter{OpenAPI.PathParameter("id", "integer", "Alarm id")},
+			Response:   Alarms.Alarm{}, Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError}},
+			Auth.Operator, webAcknowledgeAlarm},
+		{OpenAPI.Operation{Method: "GET", Path: "/cells/analytics", Summary: "Cell voltage spread, outliers and the weakest cells in each bank",
+			Tag: "battery", Response: CellAnalytics.Report{}, Errors: []int{http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetCellAnalytics},
+		{OpenAPI.Operation{Method: "GET", Path: "/cells/analytics/daily", Summary: "Daily weakest cell rankings, default the last 30 days", Tag: "history",
+			Parameters: []OpenAPI.Parameter{OpenAPI.QueryParameter("start", "string", "yyyy-mm-dd"), OpenAPI.QueryParameter("end", "string", "yyyy-mm-dd")},
+			Response:   []Storage.CellAnalyticsDay(nil), Errors: []int{http.StatusBadRequest, http.StatusInternalServerError}},
+			Auth.Viewer, webGetCellAnalyticsDaily},
+		{OpenAPI.Operation{Method: "GET", Path: "/cells/resistance", Summary: "Latest internal resistance of each cell and its trend over 90 days",
+			Tag: "battery", Response: APICellResistance{}, Errors: []int{http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetCellResistance},
+		{OpenAPI.Operation{Method: "GET", Path: "/cells/resistance/{cell}", Summary: "Internal resistance estimates of one cell, default the last 30 days",
+			Tag: "history", Parameters: []OpenAPI.Parameter{OpenAPI.PathParameter("cell", "integer", "1..38 in bank 0 and 101..138 in bank 1"), startParameter, endParameter},
+			Response: []Storage.CellResistance(nil), Errors: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetCellResistanceHistory},
+		{OpenAPI.Operation{Method: "GET", Path: "/soc", Summary: "Estimated state of charge of each bank with its uncertainty",
+			Description: "The fuel gauge count corrected by rest voltages and full charges. counter is the fuel gauge's own figure.",
+			Tag:         "battery", Response: []StateOfCharge.Estimate(nil), Errors: []int{http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetStateOfCharge},
+		{OpenAPI.Operation{Method: "GET", Path: "/banks/{bank}/drift", Summary: "Fuel gauge charge resets at full charge, most recent first",
+			Description: "Each reset records how far the counter had drifted from the capacity and the charging efficiency learned from the cycles between resets.",
+			Tag:         "history", Parameters: []OpenAPI.Parameter{bankParameter}, Response: []Storage.ChargeDrift(nil),
+			Errors: []int{http.StatusBadRequest, http.StatusInternalServerError}},
+			Auth.Viewer, webGetChargeDrift},
+		{OpenAPI.Operation{Method: "GET", Path: "/energy", Summary: "Energy in and out of each bank by day or month with the round trip efficiency",
+			Description: "The inverter's energy, from the battery voltage and current it reports, is there to check the banks' against.",
+			Tag:         "history", Parameters: []OpenAPI.Parameter{OpenAPI.QueryParameter("period", "string", "day (default) or month"),
+				OpenAPI.QueryParameter("start", "string", "yyyy-mm-dd"), OpenAPI.QueryParameter("end", "string", "yyyy-mm-dd")},
+			Response: APIEnergy{}, Errors: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetEnergy},
+		{OpenAPI.Operation{Method: "GET", Path: "/reports", Summary: "Saved daily, weekly and monthly reports, newest first, without their contents",
+			Tag: "reports", Parameters: []OpenAPI.Parameter{OpenAPI.QueryParameter("kind", "string", "daily, weekly or monthly"),
+				OpenAPI.QueryParameter("limit", "integer", "Most reports to return, default 50")},
+			Response: []Storage.SavedReport(nil), Errors: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetReports},
+		{OpenAPI.Operation{Method: "GET", Path: "/reports/{id}", Summary: "A saved report", Tag: "reports",
+			Parameters: []OpenAPI.Parameter{reportParameter}, Response: Reports.Report{},
+			Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetReport},
+		{OpenAPI.Operation{Method: "GET", Path: "/reports/{id}/html", Summary: "A saved report as a self-contained web page", Tag: "reports",
+			Parameters: []OpenAPI.Parameter{reportParameter},
+			Errors:     []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetReportHTML},
+		{OpenAPI.Operation{Method: "POST", Path: "/reports", Summary: "Make the report for the latest complete day, week or month now",
+			Description: "Replaces any report already saved for the period.",
+			Tag:         "reports", Request: APIReportRequest{}, Response: Storage.SavedReport{},
+			Errors: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Operator, apiMakeReport},
+		{OpenAPI.Operation{Method: "GET", Path: "/retention", Summary: "Progress of the job moving old readings to the archive tables and purging them",
+			Tag: "retention", Response: Retention.Status{}, Errors: []int{http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetRetention},
+		{OpenAPI.Operation{Method: "POST", Path: "/retention/run", Summary: "Run the retention job now rather than in the off-peak window",
+			Tag: "retention", Response: APIResult{}, Errors: []int{http.StatusConflict, http.StatusServiceUnavailable}},
+			Auth.Engineer, apiStartRetention},
+		{OpenAPI.Operation{Method: "GET", Path: "/capacity", Summary: "Measured capacity, state of health and equivalent full cycles of each bank",
+			Tag: "battery", Response: []StateOfHealth.BankHealth(nil), Errors: []int{http.StatusServiceUnavailable}},
+			Auth.Viewer, webGetCapacity},
+		{OpenAPI.Operation{Method: "POST", Path: "/banks/{bank}/capacity/approve", Summary: "Set the capacity the state of charge is worked out from",
+			Description: "A capacity of 0 uses the average of the latest capacity tests.",
+			Tag:         "control", Parameters: []OpenAPI.Parameter{bankParameter}, Request: APICapacityRequest{}, Response: APIResult{},
+			Errors: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Operator, apiApproveCapacity},
+		{OpenAPI.Operation{Method: "GET", Path: "/audit", Summary: "Commands sent to the relays and controllers, most recent first", Tag: "audit",
+			Parameters: []OpenAPI.Parameter{startParameter, endParameter,
+				OpenAPI.QueryParameter("source", "string", "web, mqtt or rule"),
+				OpenAPI.QueryParameter("user", "string", "User or rule name"),
+				OpenAPI.QueryParameter("action", "string", "For example switch_bank"),
+				OpenAPI.QueryParameter("limit", "integer", "Most entries to return, default 1000")},
+			Response: []Storage.AuditEntry(nil), Errors: []int{http.StatusBadRequest, http.StatusInternalServerError}},
+			Auth.Operator, webGetAudit},
+		{OpenAPI.Operation{Method: "POST", Path: "/banks/{bank}/water", Summary: "Turn on the watering system for the bank", Tag: "control",
+			Parameters: []OpenAPI.Parameter{bankParameter}, Request: APIWaterRequest{}, Response: APIResult{}, Errors: command},
+			Auth.Operator, apiWaterBank},
+		{OpenAPI.Operation{Method: "PUT", Path: "/banks/{bank}/switch", Summary: "Switch the bank on or off. Both banks cannot be off.", Tag: "control",
+			Parameters: []OpenAPI.Parameter{bankParameter}, Request: APIOnOffRequest{}, Response: APIResult{}, Errors: command},
+			Auth.Operator, apiSwitchBank},
+		{OpenAPI.Operation{Method: "PUT", Path: "/fan", Summary: "Turn the battery house fan on or off", Tag: "control",
+			Request: APIOnOffRequest{}, Response: APIResult{}, Errors: command},
+			Auth.Operator, apiBatteryFan},
+		{OpenAPI.Operation{Method: "PUT", Path: "/generator", Summary: "Start or stop the generator", Tag: "control",
+			Request: APIGeneratorRequest{}, Response: APIResult{}, Errors: command},
+			Auth.Operator, apiGenerator},
+		{OpenAPI.Operation{Method: "POST", Path: "/banks/{bank}/coils/{coil}/toggle", Summary: "Toggle a coil on the bank's fuel gauge controller",
+			Tag: "engineering", Parameters: []OpenAPI.Parameter{bankParameter, OpenAPI.PathParameter("coil", "integer", "Coil address, 1..16")},
+			Response: APICoil{}, Errors: command},
+			Auth.Engineer, apiToggleCoil},
+		{OpenAPI.Operation{Method: "PUT", Path: "/banks/{bank}/holding-registers/{register}", Summary: "Write a holding register on the bank's fuel gauge controller",
+			Tag: "engineering", Parameters: []OpenAPI.Parameter{bankParameter, OpenAPI.PathParameter("register", "integer", "Holding register address, 1..8")},
+			Request: APIRegisterRequest{}, Response: APIResult{}, Errors: command},
+			Auth.Engineer, apiSetHoldingRegister},
+		{OpenAPI.Operation{Method: "GET", Path: "/i2c/{sensor}/registers/{register}", Summary: "Read a 16 bit register of the LTC2944 on one of the LTC6813 I2C ports",
+			Tag: "engineering", Parameters: []OpenAPI.Parameter{OpenAPI.PathParameter("sensor", "integer", "LTC6813 device, from 0"),
+				OpenAPI.PathParameter("register", "integer", "LTC2944 register, 0..255")},
+			Response: APII2CRegister{}, Errors: []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusServiceUnavailable}},
+			Auth.Viewer, apiReadI2CRegister},
+	}
+}
+
+/**
+Register the API routes under /api/v1 with the OpenAPI description of them at /api/v1/openapi.json
+*/
+func registerAPI(router *mux.Router) {
+	doc := OpenAPI.New("Cedar Technology Battery Manager", apiVersion,
+		"Battery, fuel gauge and inverter data and control. Times are local. Errors return the JSONError body.", apiBase, JSONError{})
+	if authenticator != nil {
+		doc.AddSecurity(Auth.SessionCookie)
+	}
+	api := router.PathPrefix(apiBase).Subrouter()
+	for _, route := range apiRoutes() {
+		doc.Add(route.Operation)
+		api.HandleFunc(route.Path, authenticator.Require(route.Role, route.Handler)).Methods(route.Method)
+	}
+	api.Handle("/openapi.json", doc).Methods("GET")
+	// Anything else under /api/v1 is an error rather than a page from the web root
+	api.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ReturnJSONErrorString(w, "API", "no such endpoint "+r.Method+" "+r.URL.Path, http.StatusNotFound, false)
+	})
+}
+
+/**
+Decode the JSON request body into value
+*/
+func decodeRequest(w http.ResponseWriter, r *http.Request, device string, value interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		ReturnJSONError(w, device, fmt.Errorf("invalid request body - %v", err), http.StatusBadRequest, false)
+		return false
+	}
+	return true
+}
+
+func parseBankVar(w http.ResponseWriter, r *http.Request, device string) (int, bool) {
+	bank, err := strconv.ParseUint(mux.Vars(r)["bank"], 10, 8)
+	if err != nil || bank > 1 {
+		ReturnJSONError(w, device, FuelGauge.ErrInvalidBank, http.StatusBadRequest, false)
+		return 0, false
+	}
+	return int(bank), true
+}
+
+/**
+Parse the optional start and end times, defaulting to the period before now
+*/
+func parseTimeRange(r *http.Request, period time.Duration) (start time.Time, end time.Time, err error) {
+	end = time.Now()
+	if value := r.FormValue("end"); value != "" {
+		if end, err = parseWebTime(value); err != nil {
+			return
+		}
+	}
+	start = end.Add(-period)
+	if value := r.FormValue("start"); value != "" {
+		if start, err = parseWebTime(value); err != nil {
+			return
+		}
+	}
+	if start.After(end) {
+		err = errors.New("start must be before end")
+	}
+	return
+}
+
+func optionalTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func apiGetVersion(w http.ResponseWriter, _ *http.Request) {
+	returnJSON(w, APIVersion{Name: "Cedar Technology Battery Manager", Version: programVersion, APIVersion: apiVersion})
+}
+
+func apiGetBattery(w http.ResponseWriter, _ *http.Request) {
+	ltcLock.Lock()
+	defer ltcLock.Unlock()
+	if ltc == nil {
+		ReturnJSONErrorString(w, "Battery", "no LTC6813 devices", http.StatusServiceUnavailable, false)
+		return
+	}
+	battery := APIBattery{Time: time.Now(), Devices: nDevices, VoltageError: ltc.VoltageError(), TemperatureError: ltc.TemperatureError()}
+	for bank := 0; bank < 2; bank++ {
+		apiBank := APIBank{Bank: bank, Cells: make([]APICell, cellsPerBank)}
+		for cell := 0; cell < cellsPerBank; cell++ {
+			device, sensor := cellIndex(bank, cell)
+			apiBank.Cells[cell] = APICell{Cell: cell + 1, Volts: float64(ltc.GetVolts(device, sensor))}
+			apiBank.Volts += apiBank.Cells[cell].Volts
+			if temperature, err := ltc.GetTemperature(device, sensor); err == nil {
+				t := float64(temperature)
+				apiBank.Cells[cell].Temperature = &t
+				if t > apiBank.MaxTemperature {
+					apiBank.MaxTemperature = t
+				}
+			}
+		}
+		battery.Banks = append(battery.Banks, apiBank)
+	}
+	returnJSON(w, battery)
+}
+
+func apiGetFuelGauge(w http.ResponseWriter, _ *http.Request) {
+	result := APIFuelGauge{BatteryFan: fuelgauge.BatteryFanOn(), GeneratorRunning: fuelgauge.GeneratorRunning()}
+	currents := []float32{fuelgauge.CurrentLeft(), fuelgauge.CurrentRight()}
+	socs := []float32{fuelgauge.StateOfChargeLeft(), fuelgauge.StateOfChargeRight()}
+	for bank := 0; bank < 2; bank++ {
+		channel := fuelgauge.FgLeft
+		if bank == FuelGauge.RightBank {
+			channel = fuelgauge.FgRight
+		}
+		result.Banks = append(result.Banks, APIFuelGaugeBank{
+			Bank:           bank,
+			On:             fuelgauge.BankOn(bank),
+			Current:        float64(currents[bank]),
+			SOC:            float64(socs[bank]),
+			Charge:         float64(channel.Coulombs),
+			Capacity:       int(channel.Capacity),
+			Watering:       fuelgauge.Watering(bank),
+			LastFullCharge: optionalTime(channel.LastFullCharge),
+			LastError:      channel.ModbusData.LastError,
+		})
+	}
+	returnJSON(w, result)
+}
+
+func apiGetInverter(w http.ResponseWriter, _ *http.Request) {
+	returnJSON(w, &iValues)
+}
+
+func apiGetStatus(w http.ResponseWriter, r *http.Request) {
+	seconds := uint64(300)
+	if value := r.FormValue("avg"); value != "" {
+		var err error
+		if seconds, err = strconv.ParseUint(value, 10, 16); err != nil || seconds == 0 {
+			ReturnJSONErrorString(w, "Status", "avg must be a number of seconds from 1 to 65535", http.StatusBadRequest, false)
+			return
+		}
+	}
+	status, err := getBatteryStatus(seconds)
+	if err != nil {
+		ReturnJSONError(w, "Status", err, http.StatusInternalServerError, true)
+		return
+	}
+	returnJSON(w, status)
+}
+
+func apiGetSettings(w http.ResponseWriter, _ *http.Request) {
+	_, left, right := fuelgauge.Capacity()
+	returnJSON(w, APISettings{Capacity: []int{int(left), int(right)}, Charging: setpoints})
+}
+
+func apiGetSerialNumbers(w http.ResponseWriter, _ *http.Request) {
+	cells, err := store.GetSerialNumbers()
+	if err != nil {
+		ReturnJSONError(w, "Serial Numbers", err, http.StatusInternalServerError, true)
+		return
+	}
+	serialNumbers := make([]APISerialNumber, 0, len(cells))
+	for _, cell := range cells {
+		serialNumbers = append(serialNumbers, APISerialNumber{
+			Cell:               cell.CellNumber,
+			SerialNumber:       cell.SerialNumber,
+			InstallDate:        optionalTime(cell.InstallDate),
+			FullCharge:         cell.FullCharge != 0,
+			FullChargeDetected: optionalTime(cell.FullChargeDetected),
+		})
+	}
+	returnJSON(w, serialNumbers)
+}
+
+func apiGetHistory(w http.ResponseWriter, r *http.Request) {
+	query := Storage.HistoryQuery{Series: r.FormValue("series"), Bucket: time.Minute}
+	var err error
+	if query.Start, query.End, err = parseTimeRange(r, 24*time.Hour); err != nil {
+		ReturnJSONError(w, "History", err, http.StatusBadRequest, false)
+		return
+	}
+	if value := r.FormValue("bucket"); value != "" {
+		if query.Bucket, err = Storage.ParseBucket(value); err != nil {
+			returnHistoryError(w, "History", err)
+			return
+		}
+	}
+	if value := r.FormValue("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit < 1 {
+			ReturnJSONErrorString(w, "History", "limit must be a positive number", http.StatusBadRequest, false)
+			return
+		}
+	}
+	if value := r.FormValue("cells"); value != "" {
+		for _, sCell := range strings.Split(value, ",") {
+			cell, err := strconv.Atoi(strings.TrimSpace(sCell))
+			if err != nil {
+				ReturnJSONErrorString(w, "History", "cells must be a comma separated list of cell numbers", http.StatusBadRequest, false)
+				return
+			}
+			query.Cells = append(query.Cells, cell)
+		}
+	}
+	result, err := store.QueryHistory(query)
+	if err != nil {
+		returnHistoryError(w, "History", err)
+		return
+	}
+	returnJSON(w, result)
+}
+
+func apiGetCurrentHistory(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseTimeRange(r, time.Hour)
+	if err != nil {
+		ReturnJSONError(w, "Current Data", err, http.StatusBadRequest, false)
+		return
+	}
+	bucket := historyBucket(start, end, 0)
+	if err = Storage.ValidateTimeRange(start, end, Storage.MaxHistorySpan(bucket)); err != nil {
+		returnHistoryError(w, "Current Data", err)
+		return
+	}
+	points, err := store.GetCurrentHistory(start, end, bucket)
+	if err != nil {
+		returnHistoryError(w, "Current Data", err)
+		return
+	}
+	history := make([]APICurrentPoint, 0, len(points))
+	for _, point := range points {
+		history = append(history, APICurrentPoint{Time: unixTime(point.Logged), Left: point.Left, Right: point.Right,
+			ChargeLeft: point.SOCLeft, ChargeRight: point.SOCRight})
+	}
+	returnJSON(w, history)
+}
+
+func apiGetVoltageHistory(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseTimeRange(r, time.Hour)
+	if err != nil {
+		ReturnJSONError(w, "Voltage Data", err, http.StatusBadRequest, false)
+		return
+	}
+	bucket := historyBucket(start, end, 15*time.Second)
+	if err = Storage.ValidateTimeRange(start, end, Storage.MaxHistorySpan(bucket)); err != nil {
+		returnHistoryError(w, "Voltage Data", err)
+		return
+	}
+	points, err := store.GetBankVoltageHistory(start, end, bucket)
+	if err != nil {
+		returnHistoryError(w, "Voltage Data", err)
+		return
+	}
+	history := make([]APIVoltagePoint, 0, len(points))
+	for _, point := range points {
+		history = append(history, APIVoltagePoint{Time: unixTime(point.Logged), Left: point.Left, Right: point.Right})
+	}
+	returnJSON(w, history)
+}
+
+func apiGetCellHistory(w http.ResponseWriter, r *http.Request) {
+	bank, ok := parseBankVar(w, r, "Cell Data")
+	if !ok {
+		return
+	}
+	cell, err := strconv.ParseUint(mux.Vars(r)["cell"], 10, 8)
+	if err != nil || cell < 1 || cell > cellsPerBank {
+		ReturnJSONErrorString(w, "Cell Data", fmt.Sprintf("cell must be 1 to %d", cellsPerBank), http.StatusBadRequest, false)
+		return
+	}
+	start, end, err := parseTimeRange(r, time.Hour)
+	if err != nil {
+		ReturnJSONError(w, "Cell Data", err, http.StatusBadRequest, false)
+		return
+	}
+	var minAmps, maxAmps *float64
+	if (r.FormValue("minAmps") != "") || (r.FormValue("maxAmps") != "") {
+		min, errMin := strconv.ParseFloat(r.FormValue("minAmps"), 64)
+		max, errMax := strconv.ParseFloat(r.FormValue("maxAmps"), 64)
+		if errMin != nil || errMax != nil {
+			ReturnJSONErrorString(w, "Cell Data", "minAmps and maxAmps must both be given", http.StatusBadRequest, false)
+			return
+		}
+		minAmps = &min
+		maxAmps = &max
+	}
+	if err = Storage.ValidateTimeRange(start, end, Storage.MaxHistorySpan(15*time.Second)); err != nil {
+		returnHistoryError(w, "Cell Data", err)
+		return
+	}
+	points, err := store.GetCellHistory((bank*100)+int(cell), start, end, minAmps, maxAmps)
+	if err != nil {
+		returnHistoryError(w, "Cell Data", err)
+		return
+	}
+	history := make([]APICellPoint, 0, len(points))
+	for _, point := range points {
+		history = append(history, APICellPoint{Time: unixTime(point.Logged), Volts: point.Volts, Current: point.Current})
+	}
+	returnJSON(w, history)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+/**
+Return the result of a command. Refused commands are 400 and failures talking to the controllers are 500.
+*/
+func returnCommandResult(w http.ResponseWriter, device string, err error) {
+	if err != nil {
+		ReturnJSONError(w, device, err, FuelGauge.CommandStatus(err), false)
+		return
+	}
+	returnJSON(w, APIResult{Success: true})
+}
+
+func apiWaterBank(w http.ResponseWriter, r *http.Request) {
+	bank, ok := parseBankVar(w, r, "Watering")
+	if !ok {
+		return
+	}
+	var request APIWaterRequest
+	if decodeRequest(w, r, "Watering", &request) {
+		returnCommandResult(w, "Watering", fuelgauge.Water(FuelGauge.WebOrigin(r), uint64(bank), request.Minutes))
+	}
+}
+
+func apiSwitchBank(w http.ResponseWriter, r *http.Request) {
+	bank, ok := parseBankVar(w, r, "Bank Switch")
+	if !ok {
+		return
+	}
+	var request APIOnOffRequest
+	if decodeRequest(w, r, "Bank Switch", &request) {
+		returnCommandResult(w, "Bank Switch", fuelgauge.SwitchBattery(FuelGauge.WebOrigin(r), bank, request.On))
+	}
+}
+
+func apiBatteryFan(w http.ResponseWriter, r *http.Request) {
+	var request APIOnOffRequest
+	if decodeRequest(w, r, "Battery Fan", &request) {
+		returnCommandResult(w, "Battery Fan", fuelgauge.SetBatteryFan(FuelGauge.WebOrigin(r), request.On))
+	}
+}
+
+func apiGenerator(w http.ResponseWriter, r *http.Request) {
+	var request APIGeneratorRequest
+	if decodeRequest(w, r, "Generator", &request) {
+		returnCommandResult(w, "Generator", fuelgauge.SetGenerator(FuelGauge.WebOrigin(r), request.Run))
+	}
+}
+
+func apiToggleCoil(w http.ResponseWriter, r *http.Request) {
+	bank, ok := parseBankVar(w, r, "Coil")
+	if !ok {
+		return
+	}
+	coil, err := strconv.ParseUint(mux.Vars(r)["coil"], 10, 16)
+	if err != nil {
+		ReturnJSONError(w, "Coil", FuelGauge.ErrInvalidCoil, http.StatusBadRequest, false)
+		return
+	}
+	on, err := fuelgauge.ToggleCoil(FuelGauge.WebOrigin(r), bank, uint16(coil))
+	if err != nil {
+		ReturnJSONError(w, "Coil", err, FuelGauge.CommandStatus(err), false)
+		return
+	}
+	returnJSON(w, APICoil{Coil: uint16(coil), On: on})
+}
+
+func apiSetHoldingRegister(w http.ResponseWriter, r *http.Request) {
+	bank, ok := parseBankVar(w, r, "Holding Register")
+	if !ok {
+		return
+	}
+	register, err := strconv.ParseUint(mux.Vars(r)["register"], 10, 16)
+	if err != nil {
+		ReturnJSONError(w, "Holding Register", FuelGauge.ErrInvalidRegister, http.StatusBadRequest, false)
+		return
+	}
+	var request APIRegisterRequest
+	if decodeRequest(w, r, "Holding Register", &request) {
+		returnCommandResult(w, "Holding Register", fuelgauge.SetHoldingRegister(FuelGauge.WebOrigin(r), bank, uint16(register), request.Value))
+	}
+}
+
+func apiReadI2CRegister(w http.ResponseWriter, r *http.Request) {
+	ltcLock.Lock()
+	defer ltcLock.Unlock()
+	if ltc == nil {
+		ReturnJSONErrorString(w, "I2C", "no LTC6813 devices", http.StatusServiceUnavailable, false)
+		return
+	}
+	sensor, err := strconv.Atoi(mux.Vars(r)["sensor"])
+	if err != nil || sensor < 0 || sensor >= nDevices {
+		ReturnJSONErrorString(w, "I2C", fmt.Sprintf("sensor must be 0 to %d", nDevices-1), http.StatusBadRequest, false)
+		return
+	}
+	register, err := strconv.ParseUint(mux.Vars(r)["register"], 0, 8)
+	if err != nil {
+		ReturnJSONErrorString(w, "I2C", "register must be 0 to 255", http.StatusBadRequest, false)
+		return
+	}
+	value, err := ltc.ReadI2CWordData(sensor, LTC6813.LTC2944Address, uint8(register))
+	if err != nil {
+		ReturnJSONError(w, "I2C", err, http.StatusInternalServerError, true)
+		return
+	}
+	returnJSON(w, APII2CRegister{Sensor: sensor, Register: uint8(register), Value: value})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Alarms"
+	"BatteryMonitor6813V4/Auth"
+	"BatteryMonitor6813V4/FuelGauge"
+	websocket "BatteryMonitor6813V4/ModbusBatteryFuelGauge/webSocket"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	alarmEngine      *Alarms.Engine
+	alarmRules       []Alarms.Rule
+	alarmPool        *websocket.Pool
+	alarmEvents      chan []byte
+	lastModbusErrors [2]uint64
+)
+
+/**
+Load the alarm rules and start the websocket pool the alarm events are pushed to. The engine itself is created on the
+first evaluation so it can wait for the database.
+*/
+func startAlarms(rulesFile string) {
+	alarmRules = Alarms.DefaultRules()
+	if rulesFile != "" {
+		var err error
+		alarmRules, err = Alarms.LoadRules(rulesFile)
+		if err != nil {
+			log.Fatalf("Failed to load the alarm rules - %s - Sorry, I am giving up.", err)
+		}
+	}
+	alarmPool = websocket.NewPool()
+	go alarmPool.Start()
+	alarmEvents = make(chan []byte, 100)
+	go func() {
+		for event := range alarmEvents {
+			alarmPool.Broadcast <- event
+		}
+	}()
+}
+
+/**
+Send an alarm event to the websocket clients. Events are dropped rather than holding up the alarm engine if the
+clients cannot keep up.
+*/
+func pushAlarmEvent(event Alarms.Event) {
+	liveHub.PublishEvent(topicAlarms, event)
+	broker.publish(eventAlarm, event)
+	message, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Failed to send the alarm event -", err)
+		return
+	}
+	select {
+	case alarmEvents <- message:
+	default:
+		log.Println("Alarm websocket clients are not keeping up, dropped", event.Action, "event for alarm", event.Alarm.ID)
+	}
+}
+
+/**
+Gather the readings for the alarm rules
+*/
+func alarmSnapshot() *Alarms.Snapshot {
+	snapshot := &Alarms.Snapshot{
+		Time:         time.Now(),
+		SensorFaults: make(map[string]bool),
+		CommsLost:    make(map[string]bool),
+	}
+	snapshot.CommsLost["LTC6813 chain"] = nDevices == 0
+	if ltc != nil {
+		snapshot.SensorFaults["LTC6813 voltages"] = ltc.VoltageError() != ""
+		snapshot.SensorFaults["LTC6813 temperatures"] = ltc.TemperatureError() != ""
+		if nDevices != 0 {
+			for bank := 0; bank < 2; bank++ {
+				snapshot.CellVolts[bank] = cellVolts(bank)
+				snapshot.Temperatures[bank] = make([]float64, cellsPerBank)
+				for cell := 0; cell < cellsPerBank; cell++ {
+					temperature, err := ltc.GetTemperature(cellIndex(bank, cell))
+					snapshot.SensorFaults[fmt.Sprintf("bank %d sensor %d", bank, cell+1)] = err != nil
+					if err == nil {
+						snapshot.Temperatures[bank][cell] = float64(temperature)
+					}
+				}
+			}
+		}
+	}
+	if fuelgauge != nil {
+		snapshot.SOC[0] = float64(fuelgauge.StateOfChargeLeft())
+		snapshot.SOC[1] = float64(fuelgauge.StateOfChargeRight())
+		snapshot.BanksOff = !fuelgauge.BankOn(FuelGauge.LeftBank) && !fuelgauge.BankOn(FuelGauge.RightBank)
+		// Any failed Modbus transaction since the last look counts as lost communications
+		for i, slave := range []uint8{fuelgauge.FgLeft.SlaveAddress, fuelgauge.FgRight.SlaveAddress} {
+			errorCount := fuelgauge.ModbusErrors(slave)
+			snapshot.CommsLost[fmt.Sprintf("fuel gauge %s", fuelgaugeBanks[i])] = errorCount != lastModbusErrors[i]
+			lastModbusErrors[i] = errorCount
+		}
+	}
+	return snapshot
+}
+
+/**
+Run the alarm rules against the latest readings
+*/
+func evaluateAlarms() {
+	if alarmRules == nil {
+		return
+	}
+	if alarmEngine == nil {
+		var err error
+		if alarmEngine, err = Alarms.New(store, alarmRules); err != nil {
+			log.Println("Failed to start the alarm engine -", err)
+			return
+		}
+		alarmEngine.AddListener(pushAlarmEvent)
+		alarmEngine.AddListener(notifyAlarm)
+	}
+	alarmEngine.Evaluate(alarmSnapshot())
+}
+
+func returnJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println(err)
+	}
+}
+
+/**
+Alarms that have not cleared
+*/
+func webGetActiveAlarms(w http.ResponseWriter, _ *http.Request) {
+	setHeaders(w)
+	if alarmEngine == nil {
+		ReturnJSONErrorString(w, "Alarms", "the alarm engine is not running", http.StatusServiceUnavailable, false)
+		return
+	}
+	returnJSON(w, alarmEngine.Active())
+}
+
+/**
+All alarms raised between start and end (local time, yyyy-mm-dd hh:mm[:ss]). Defaults to the last 24 hours.
+/alarms?start=2021-06-01 00:00&end=2021-06-02 00:00
+*/
+func webGetAlarms(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	if alarmEngine == nil {
+		ReturnJSONErrorString(w, "Alarms", "the alarm engine is not running", http.StatusServiceUnavailable, false)
+		return
+	}
+	end := time.Now()
+	start := end.Add(-24 * time.Hour)
+	var err error
+	if value := r.FormValue("start"); value != "" {
+		if start, err = parseWebTime(value); err != nil {
+			ReturnJSONError(w, "Alarms", err, http.StatusBadRequest, false)
+			return
+		}
+	}
+	if value := r.FormValue("end"); value != "" {
+		if end, err = parseWebTime(value); err != nil {
+			ReturnJSONError(w, "Alarms", err, http.StatusBadRequest, false)
+			return
+		}
+	}
+	alarms, err := alarmEngine.History(start, end)
+	if err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusInternalServerError, true)
+		return
+	}
+	returnJSON(w, alarms)
+}
+
+func webGetAlarmRules(w http.ResponseWriter, _ *http.Request) {
+	setHeaders(w)
+	returnJSON(w, alarmRules)
+}
+
+/**
+Acknowledge an alarm as the logged in user. Without logins the user can be given as user=...
+/alarms/{id}/acknowledge
+*/
+func webAcknowledgeAlarm(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	if alarmEngine == nil {
+		ReturnJSONErrorString(w, "Alarms", "the alarm engine is not running", http.StatusServiceUnavailable, false)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		ReturnJSONErrorString(w, "Alarms", "invalid alarm id", http.StatusBadRequest, false)
+		return
+	}
+	user := Auth.FromRequest(r).Name
+	if authenticator == nil && r.FormValue("user") != "" {
+		// Without logins we have to take the caller's word for who they are
+		user = r.FormValue("user")
+	}
+	alarm, err := alarmEngine.Acknowledge(id, user)
+	if errors.Is(err, Alarms.ErrNotFound) {
+		ReturnJSONError(w, "Alarms", err, http.StatusNotFound, false)
+		return
+	} else if err != nil {
+		ReturnJSONError(w, "Alarms", err, http.StatusInternalServerError, true)
+		return
+	}
+	returnJSON(w, alarm)
+}
+
+/**
+Websocket sending every alarm event as it happens. The active alarms are sent first as {"action":"active","alarms":[...]}
+*/
+func startAlarmWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	active := struct {
+		Action string         `json:"action"`
+		Alarms []Alarms.Alarm `json:"alarms"`
+	}{Action: "active", Alarms: []Alarms.Alarm{}}
+	if alarmEngine != nil {
+		active.Alarms = alarmEngine.Active()
+	}
+	if err = conn.WriteJSON(active); err != nil {
+		log.Println("Failed to send the active alarms to the websocket -", err)
+		_ = conn.Close()
+		return
+	}
+	client := &websocket.Client{Conn: conn, Pool: alarmPool}
+	alarmPool.Register <- client
+	// Nothing is expected from the client but reading tells us when it goes away
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			alarmPool.Unregister <- client
+			_ = conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package Alarms
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Returned by Acknowledge if there is no such alarm or it has already been acknowledged
+var ErrNotFound = errors.New("no unacknowledged alarm with that id")
+
+// How long to wait before trying the alarms table again after it could not be written
+const storeRetryDelay = 30 * time.Second
+
+/**
+Snapshot holds the readings the rules are evaluated against. Cells or sensors reading zero are treated as not fitted
+and are skipped. The maps are keyed by the name of the sensor or device.
+*/
+type Snapshot struct {
+	Time         time.Time
+	CellVolts    [2][]float64
+	Temperatures [2][]float64
+	SOC          [2]float64
+	SensorFaults map[string]bool
+	CommsLost    map[string]bool
+	BanksOff     bool
+}
+
+/**
+Alarm as shown on the web pages and sent to the websocket clients
+*/
+type Alarm struct {
+	ID             int64      `json:"id"`
+	Rule           string     `json:"rule"`
+	Severity       string     `json:"severity"`
+	Source         string     `json:"source"`
+	Message        string     `json:"message"`
+	Value          float64    `json:"value"`
+	Threshold      float64    `json:"threshold"`
+	Raised         time.Time  `json:"raised"`
+	Cleared        *time.Time `json:"cleared,omitempty"`
+	Acknowledged   *time.Time `json:"acknowledged,omitempty"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty"`
+}
+
+// Event actions
+const (
+	Raised       = "raised"
+	Cleared      = "cleared"
+	Acknowledged = "acknowledged"
+)
+
+/**
+Event is sent to the listeners whenever an alarm is raised, cleared or acknowledged
+*/
+type Event struct {
+	Action string `json:"action"`
+	Alarm  Alarm  `json:"alarm"`
+}
+
+/**
+Engine evaluates the rules against each snapshot and keeps the alarms table up to date.
+*/
+type Engine struct {
+	mu         sync.Mutex
+	evaluating sync.Mutex // Held through Evaluate, which writes to the store without holding mu
+	store      Storage.Store
+	rules      []Rule
+	pending    map[string]time.Time // When each condition that has not yet become an alarm started
+	active     map[string]*Alarm    // Raised alarms not yet cleared, by rule and source
+	listeners  []func(Event)
+	retryAt    time.Time // Alarms are not written before this after the store has failed
+}
+
+/**
+alarmChange is an alarm to be raised or cleared once the store has recorded it
+*/
+type alarmChange struct {
+	key   string
+	alarm *Alarm
+	raise bool
+}
+
+func conditionKey(rule string, source string) string {
+	return rule + "|" + source
+}
+
+/**
+Create the engine. Alarms left active by the previous run are loaded so they can be cleared when the condition goes
+away.
+*/
+func New(store Storage.Store, rules []Rule) (*Engine, error) {
+	engine := new(Engine)
+	engine.store = store
+	engine.rules = rules
+	engine.pending = make(map[string]time.Time)
+	engine.active = make(map[string]*Alarm)
+	stored, err := store.GetActiveAlarms()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range stored {
+		alarm := fromStorage(s)
+		engine.active[conditionKey(alarm.Rule, alarm.Source)] = &alarm
+	}
+	if len(stored) > 0 {
+		log.Println(len(stored), "alarms are still active from before the restart")
+	}
+	return engine, nil
+}
+
+func fromStorage(s Storage.Alarm) Alarm {
+	alarm := Alarm{
+		ID:             s.ID,
+		Rule:           s.Rule,
+		Severity:       s.Severity,
+		Source:         s.Source,
+		Message:        s.Message,
+		Value:          s.Value,
+		Threshold:      s.Threshold,
+		Raised:         s.Raised,
+		AcknowledgedBy: s.AcknowledgedBy,
+	}
+	if s.Cleared.Valid {
+		alarm.Cleared = &s.Cleared.Time
+	}
+	if s.Acknowledged.Valid {
+		alarm.Acknowledged = &s.Acknowledged.Time
+	}
+	return alarm
+}
+
+/**
+Call the function for every alarm that is raised, cleared or acknowledged. Listeners are called with the engine locked
+so they must not call back into it.
+*/
+func (engine *Engine) AddListener(listener func(Event)) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	engine.listeners = append(engine.listeners, listener)
+}
+
+func (engine *Engine) notify(action string, alarm *Alarm) {
+	for _, listener := range engine.listeners {
+		listener(Event{Action: action, Alarm: *alarm})
+	}
+}
+
+func (engine *Engine) Rules() []Rule {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	return append([]Rule(nil), engine.rules...)
+}
+
+/**
+The values the rule applies to in the snapshot, by source
+*/
+func (rule *Rule) values(snapshot *Snapshot) map[string]float64 {
+	values := make(map[string]float64)
+	faults := func(flags map[string]bool) {
+		for source, fault := range flags {
+			if fault {
+				values[source] = 1
+			} else {
+				values[source] = 0
+			}
+		}
+	}
+	switch rule.Type {
+	case CellHigh, CellLow:
+		for bank, cells := range snapshot.CellVolts {
+			for cell, volts := range cells {
+				if volts != 0 {
+					values[fmt.Sprintf("bank %d cell %d", bank, cell+1)] = volts
+				}
+			}
+		}
+	case CellSpread:
+		for bank, cells := range snapshot.CellVolts {
+			low, high := math.Inf(1), math.Inf(-1)
+			for _, volts := range cells {
+				if volts != 0 {
+					low = math.Min(low, volts)
+					high = math.Max(high, volts)
+				}
+			}
+			if high >= low {
+				values[fmt.Sprintf("bank %d", bank)] = high - low
+			}
+		}
+	case TemperatureHigh:
+		for bank, sensors := range snapshot.Temperatures {
+			for sensor, temperature := range sensors {
+				if temperature != 0 {
+					values[fmt.Sprintf("bank %d sensor %d", bank, sensor+1)] = temperature
+				}
+			}
+		}
+	case SensorFault:
+		faults(snapshot.SensorFaults)
+	case CommsLoss:
+		faults(snapshot.CommsLost)
+	case BanksOff:
+		if snapshot.BanksOff {
+			values["batteries"] = 1
+		} else {
+			values["batteries"] = 0
+		}
+	case SOCLow:
+		for bank, soc := range snapshot.SOC {
+			values[fmt.Sprintf("bank %d", bank)] = soc
+		}
+	}
+	return values
+}
+
+func (rule *Rule) message(source string, value float64) string {
+	switch rule.Type {
+	case CellHigh, CellLow, CellSpread:
+		return fmt.Sprintf("%s - %s at %.3fV (limit %.3fV)", rule.Name, source, value, rule.Threshold)
+	case TemperatureHigh:
+		return fmt.Sprintf("%s - %s at %.1fC (limit %.1fC)", rule.Name, source, value, rule.Threshold)
+	case SOCLow:
+		return fmt.Sprintf("%s - %s at %.1f%% (limit %.1f%%)", rule.Name, source, value, rule.Threshold)
+	}
+	return fmt.Sprintf("%s - %s", rule.Name, source)
+}
+
+/**
+Evaluate every rule against the snapshot, raising and clearing alarms as needed. The alarms table is written without
+the engine locked, and if it cannot be written nothing is raised or cleared until it has been left alone for 30
+seconds, so a database outage does not hold up every measurement cycle.
+*/
+func (engine *Engine) Evaluate(snapshot *Snapshot) {
+	engine.evaluating.Lock()
+	defer engine.evaluating.Unlock()
+	changes := engine.changes(snapshot)
+	if len(changes) == 0 {
+		return
+	}
+	done := 0
+	for _, change := range changes {
+		if err := engine.record(change, snapshot.Time); err != nil {
+			log.Printf("Failed to record the alarm %s - trying again in %s - %v", change.alarm.Message, storeRetryDelay, err)
+			break
+		}
+		done++
+	}
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	if done < len(changes) {
+		engine.retryAt = snapshot.Time.Add(storeRetryDelay)
+	}
+	cleared := snapshot.Time
+	for _, change := range changes[:done] {
+		if change.raise {
+			delete(engine.pending, change.key)
+			engine.active[change.key] = change.alarm
+			log.Println("Alarm raised -", change.alarm.Message)
+			engine.notify(Raised, change.alarm)
+		} else {
+			change.alarm.Cleared = &cleared
+			delete(engine.active, change.key)
+			log.Println("Alarm cleared -", change.alarm.Message)
+			engine.notify(Cleared, change.alarm)
+		}
+	}
+}
+
+/**
+Return the alarms to raise and clear for the snapshot. Conditions are still timed while the store is being left alone.
+*/
+func (engine *Engine) changes(snapshot *Snapshot) []alarmChange {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	var changes []alarmChange
+	rules := make(map[string]bool)
+	seen := make(map[string]bool)
+	for i := range engine.rules {
+		rule := &engine.rules[i]
+		if rule.Disabled {
+			continue
+		}
+		rules[rule.Name] = true
+		values := rule.values(snapshot)
+		sources := make([]string, 0, len(values))
+		for source := range values {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+		for _, source := range sources {
+			seen[conditionKey(rule.Name, source)] = true
+			if change, found := engine.evaluate(rule, source, values[source], snapshot.Time); found {
+				changes = append(changes, change)
+			}
+		}
+	}
+	// A condition has to be seen continuously for its delay so start again if a reading goes missing
+	for key := range engine.pending {
+		if !seen[key] {
+			delete(engine.pending, key)
+		}
+	}
+	// Clear anything raised by a rule that has since been removed or disabled
+	for key, alarm := range engine.active {
+		if !rules[alarm.Rule] {
+			changes = append(changes, alarmChange{key: key, alarm: alarm})
+		}
+	}
+	if snapshot.Time.Before(engine.retryAt) {
+		return nil
+	}
+	return changes
+}
+
+func (engine *Engine) evaluate(rule *Rule, source string, value float64, now time.Time) (alarmChange, bool) {
+	key := conditionKey(rule.Name, source)
+	if alarm, found := engine.active[key]; found {
+		return alarmChange{key: key, alarm: alarm}, rule.cleared(value)
+	}
+	if !rule.triggered(value) {
+		delete(engine.pending, key)
+		return alarmChange{}, false
+	}
+	started, found := engine.pending[key]
+	if !found {
+		started = now
+		engine.pending[key] = now
+	}
+	if now.Sub(started) < time.Duration(rule.Delay)*time.Second {
+		return alarmChange{}, false
+	}
+	alarm := &Alarm{
+		Rule:      rule.Name,
+		Severity:  rule.Severity,
+		Source:    source,
+		Message:   rule.message(source, value),
+		Value:     value,
+		Threshold: rule.threshold(),
+		Raised:    now,
+	}
+	return alarmChange{key: key, alarm: alarm, raise: true}, true
+}
+
+/**
+Write the change to the alarms table. Only the ID of a new alarm is set here as the alarm is not yet shared.
+*/
+func (engine *Engine) record(change alarmChange, now time.Time) error {
+	alarm := change.alarm
+	if !change.raise {
+		return engine.store.ClearAlarm(alarm.ID, now)
+	}
+	id, err := engine.store.AddAlarm(Storage.Alarm{Rule: alarm.Rule, Severity: alarm.Severity, Source: alarm.Source,
+		Message: alarm.Message, Value: alarm.Value, Threshold: alarm.Threshold, Raised: alarm.Raised})
+	if err != nil {
+		return err
+	}
+	alarm.ID = id
+	return nil
+}
+
+/**
+Return the alarms that have not cleared, oldest first
+*/
+func (engine *Engine) Active() []Alarm {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	alarms := make([]Alarm, 0, len(engine.active))
+	for _, alarm := range engine.active {
+		alarms = append(alarms, *alarm)
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		return alarms[i].ID < alarms[j].ID
+	})
+	return alarms
+}
+
+/**
+Return all alarms raised between start and end, most recent first
+*/
+func (engine *Engine) History(start time.Time, end time.Time) ([]Alarm, error) {
+	stored, err := engine.store.GetAlarms(start, end)
+	if err != nil {
+		return nil, err
+	}
+	alarms := make([]Alarm, 0, len(stored))
+	for _, s := range stored {
+		alarms = append(alarms, fromStorage(s))
+	}
+	return alarms, nil
+}
+
+/**
+Acknowledge the alarm. Alarms can be acknowledged whether or not they have cleared.
+*/
+func (engine *Engine) Acknowledge(id int64, user string) (Alarm, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	now := time.Now()
+	if err := engine.store.AcknowledgeAlarm(id, user, now); err == sql.ErrNoRows {
+		return Alarm{}, ErrNotFound
+	} else if err != nil {
+		return Alarm{}, err
+	}
+	var alarm Alarm
+	for _, active := range engine.active {
+		if active.ID == id {
+			active.Acknowledged = &now
+			active.AcknowledgedBy = user
+			alarm = *active
+		}
+	}
+	if alarm.ID == 0 {
+		stored, err := engine.store.GetAlarm(id)
+		if err != nil {
+			return Alarm{}, err
+		}
+		alarm = fromStorage(stored)
+	}
+	engine.notify(Acknowledged, &alarm)
+	return alarm, nil
+}
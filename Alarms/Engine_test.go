@@ -0,0 +1,219 @@
+package Alarms
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+/**
+testStore keeps the alarms in memory. Anything else the engine calls panics on the nil Store. Writes fail with err if
+it is set.
+*/
+type testStore struct {
+	Storage.Store
+	alarms []Storage.Alarm
+	err    error
+	writes int
+}
+
+func (store *testStore) AddAlarm(alarm Storage.Alarm) (int64, error) {
+	store.writes++
+	if store.err != nil {
+		return 0, store.err
+	}
+	alarm.ID = int64(len(store.alarms) + 1)
+	store.alarms = append(store.alarms, alarm)
+	return alarm.ID, nil
+}
+
+func (store *testStore) ClearAlarm(id int64, when time.Time) error {
+	store.writes++
+	if store.err != nil {
+		return store.err
+	}
+	store.alarms[id-1].Cleared = sql.NullTime{Time: when, Valid: true}
+	return nil
+}
+
+func (store *testStore) GetActiveAlarms() ([]Storage.Alarm, error) {
+	var active []Storage.Alarm
+	for _, alarm := range store.alarms {
+		if !alarm.Cleared.Valid {
+			active = append(active, alarm)
+		}
+	}
+	return active, nil
+}
+
+/**
+A reading of the first cell in bank 0. Zero is a missing reading.
+*/
+type testReading struct {
+	after  time.Duration
+	volts  float64
+	action string // The event the reading should cause, if any
+}
+
+func TestEngineEvaluate(t *testing.T) {
+	rule := Rule{Name: "Cell voltage low", Type: CellLow, Severity: Critical, Threshold: 1.0, Hysteresis: 0.05, Delay: 30}
+	tests := []struct {
+		name     string
+		readings []testReading
+	}{
+		{"raised after the delay", []testReading{
+			{0, 0.9, ""},
+			{29 * time.Second, 0.9, ""},
+			{30 * time.Second, 0.9, Raised},
+			{40 * time.Second, 0.9, ""},
+		}},
+		{"not raised if the condition goes away", []testReading{
+			{0, 0.9, ""},
+			{20 * time.Second, 1.01, ""},
+			{30 * time.Second, 0.9, ""},
+			{59 * time.Second, 0.9, ""},
+			{60 * time.Second, 0.9, Raised},
+		}},
+		{"not raised if the reading is missing", []testReading{
+			{0, 0.9, ""},
+			{20 * time.Second, 0, ""},
+			{30 * time.Second, 0.9, ""},
+			{59 * time.Second, 0.9, ""},
+			{60 * time.Second, 0.9, Raised},
+		}},
+		{"cleared only past the hysteresis", []testReading{
+			{0, 0.9, ""},
+			{30 * time.Second, 0.9, Raised},
+			{40 * time.Second, 1.0, ""},
+			{50 * time.Second, 1.04, ""},
+			{60 * time.Second, 1.05, Cleared},
+			{70 * time.Second, 1.05, ""},
+		}},
+		{"raised again after clearing", []testReading{
+			{0, 0.9, ""},
+			{30 * time.Second, 0.9, Raised},
+			{40 * time.Second, 1.2, Cleared},
+			{50 * time.Second, 0.9, ""},
+			{80 * time.Second, 0.9, Raised},
+		}},
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine, err := New(new(testStore), []Rule{rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var events []Event
+			engine.AddListener(func(event Event) {
+				events = append(events, event)
+			})
+			for _, reading := range test.readings {
+				// The second cell stays healthy so only the first can raise an alarm
+				engine.Evaluate(&Snapshot{Time: start.Add(reading.after), CellVolts: [2][]float64{{reading.volts, 1.3}}})
+				action := ""
+				if len(events) > 0 {
+					action = events[0].Action
+					if events[0].Alarm.Source != "bank 0 cell 1" {
+						t.Errorf("at %s the alarm is for %s", reading.after, events[0].Alarm.Source)
+					}
+				}
+				if len(events) > 1 || action != reading.action {
+					t.Fatalf("at %s with %vV got %v, want %q", reading.after, reading.volts, events, reading.action)
+				}
+				events = nil
+			}
+		})
+	}
+}
+
+func TestDisabledRuleClears(t *testing.T) {
+	store := new(testStore)
+	raised := time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	for _, rule := range []string{"Disabled", "Removed", "Kept"} {
+		if _, err := store.AddAlarm(Storage.Alarm{Rule: rule, Severity: Warning, Source: "bank 0", Raised: raised}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules := []Rule{
+		{Name: "Disabled", Type: SOCLow, Severity: Warning, Threshold: 20, Hysteresis: 5, Disabled: true},
+		{Name: "Kept", Type: SOCLow, Severity: Warning, Threshold: 20, Hysteresis: 5},
+	}
+	engine, err := New(store, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active := engine.Active(); len(active) != 3 {
+		t.Fatalf("%d alarms were loaded as active, want 3", len(active))
+	}
+	cleared := make(map[string]bool)
+	engine.AddListener(func(event Event) {
+		if event.Action == Cleared {
+			cleared[event.Alarm.Rule] = true
+		}
+	})
+	// Bank 0 is still low so the kept rule's alarm stays
+	now := raised.Add(time.Minute)
+	engine.Evaluate(&Snapshot{Time: now, SOC: [2]float64{10, 100}})
+	if !cleared["Disabled"] || !cleared["Removed"] || cleared["Kept"] {
+		t.Errorf("cleared %v, want the disabled and removed rules' alarms", cleared)
+	}
+	active := engine.Active()
+	if len(active) != 1 || active[0].Rule != "Kept" {
+		t.Errorf("active alarms are %v, want only the kept rule's", active)
+	}
+	for _, alarm := range store.alarms {
+		if alarm.Cleared.Valid != (alarm.Rule != "Kept") {
+			t.Errorf("the stored %s alarm cleared is %t", alarm.Rule, alarm.Cleared.Valid)
+		}
+		if alarm.Cleared.Valid && !alarm.Cleared.Time.Equal(now) {
+			t.Errorf("the stored %s alarm cleared at %s, want %s", alarm.Rule, alarm.Cleared.Time, now)
+		}
+	}
+}
+
+func TestStoreFailureBacksOff(t *testing.T) {
+	store := new(testStore)
+	engine, err := New(store, []Rule{{Name: "Cell voltage low", Type: CellLow, Severity: Critical, Threshold: 1.0, Hysteresis: 0.05}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	engine.AddListener(func(event Event) {
+		actions = append(actions, event.Action)
+	})
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local)
+	evaluate := func(after time.Duration, volts float64) {
+		engine.Evaluate(&Snapshot{Time: start.Add(after), CellVolts: [2][]float64{{volts}}})
+	}
+
+	store.err = errors.New("database down")
+	evaluate(0, 0.9)
+	if store.writes != 1 || len(actions) != 0 {
+		t.Fatalf("with the store down %d writes were tried and %v sent, want 1 write and nothing sent", store.writes, actions)
+	}
+	// The store is left alone until the retry delay has passed
+	evaluate(storeRetryDelay-time.Second, 0.9)
+	if store.writes != 1 || len(actions) != 0 {
+		t.Fatalf("before the retry delay %d writes were tried and %v sent", store.writes, actions)
+	}
+	store.err = nil
+	evaluate(storeRetryDelay, 0.9)
+	if store.writes != 2 || len(actions) != 1 || actions[0] != Raised || len(engine.Active()) != 1 {
+		t.Fatalf("after the retry delay %d writes were tried and %v sent, want the alarm raised", store.writes, actions)
+	}
+
+	// A failed clear leaves the alarm active until it can be recorded
+	store.err = errors.New("database down")
+	evaluate(storeRetryDelay+time.Second, 1.2)
+	if len(actions) != 1 || len(engine.Active()) != 1 {
+		t.Fatalf("with the store down the alarm was cleared - %v", actions)
+	}
+	store.err = nil
+	evaluate((2*storeRetryDelay)+time.Second, 1.2)
+	if len(actions) != 2 || actions[1] != Cleared || len(engine.Active()) != 0 || !store.alarms[0].Cleared.Valid {
+		t.Errorf("after the retry delay got %v and %d active alarms, want the alarm cleared", actions, len(engine.Active()))
+	}
+}
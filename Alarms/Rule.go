@@ -0,0 +1,134 @@
+package Alarms
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Severities
+const (
+	Info     = "info"
+	Warning  = "warning"
+	Critical = "critical"
+)
+
+// Rule types
+const (
+	CellHigh        = "cell_high"        // Any cell above the threshold in volts
+	CellLow         = "cell_low"         // Any cell below the threshold in volts
+	CellSpread      = "cell_spread"      // Highest less lowest cell in a bank above the threshold in volts
+	TemperatureHigh = "temperature_high" // Any temperature sensor above the threshold in C
+	SensorFault     = "sensor_fault"     // The LTC6813 chain reported a voltage or temperature measurement error
+	CommsLoss       = "comms_loss"       // Lost contact with the LTC6813 chain or a fuel gauge controller
+	BanksOff        = "banks_off"        // Both banks are switched off
+	SOCLow          = "soc_low"          // Bank state of charge below the threshold in %
+)
+
+/**
+Rule describes one alarm condition. The alarm is raised when the condition has held for Delay seconds and cleared when
+the value has come back past the threshold by Hysteresis. Fault type rules (sensor_fault, comms_loss and banks_off)
+have a value of 1 while the fault is present so their threshold is ignored.
+*/
+type Rule struct {
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	Severity   string  `json:"severity"`
+	Threshold  float64 `json:"threshold"`
+	Hysteresis float64 `json:"hysteresis"`
+	Delay      int     `json:"delay"`
+	Disabled   bool    `json:"disabled,omitempty"`
+}
+
+/**
+True if the value breaches the rule
+*/
+func (rule *Rule) triggered(value float64) bool {
+	if rule.below() {
+		return value < rule.threshold()
+	}
+	return value > rule.threshold()
+}
+
+/**
+True if the value is far enough back from the threshold for an active alarm to clear
+*/
+func (rule *Rule) cleared(value float64) bool {
+	if rule.below() {
+		return value >= rule.threshold()+rule.Hysteresis
+	}
+	return value <= rule.threshold()-rule.Hysteresis
+}
+
+func (rule *Rule) below() bool {
+	return rule.Type == CellLow || rule.Type == SOCLow
+}
+
+func (rule *Rule) threshold() float64 {
+	switch rule.Type {
+	case SensorFault, CommsLoss, BanksOff:
+		return 0.5
+	}
+	return rule.Threshold
+}
+
+func (rule *Rule) validate() error {
+	if rule.Name == "" {
+		return fmt.Errorf("rule with no name")
+	}
+	switch rule.Type {
+	case CellHigh, CellLow, CellSpread, TemperatureHigh, SensorFault, CommsLoss, BanksOff, SOCLow:
+	default:
+		return fmt.Errorf("rule %s has an unknown type '%s'", rule.Name, rule.Type)
+	}
+	switch rule.Severity {
+	case Info, Warning, Critical:
+	default:
+		return fmt.Errorf("rule %s has an unknown severity '%s'", rule.Name, rule.Severity)
+	}
+	if rule.Hysteresis < 0 || rule.Delay < 0 {
+		return fmt.Errorf("rule %s has a negative hysteresis or delay", rule.Name)
+	}
+	return nil
+}
+
+/**
+The rules used when no rules file is given. Limits suit NiFe cells.
+*/
+func DefaultRules() []Rule {
+	return []Rule{
+		{Name: "Cell voltage high", Type: CellHigh, Severity: Critical, Threshold: 1.75, Hysteresis: 0.05, Delay: 10},
+		{Name: "Cell voltage low", Type: CellLow, Severity: Critical, Threshold: 1.0, Hysteresis: 0.05, Delay: 30},
+		{Name: "Cell voltage spread", Type: CellSpread, Severity: Warning, Threshold: 0.2, Hysteresis: 0.02, Delay: 60},
+		{Name: "Temperature high", Type: TemperatureHigh, Severity: Critical, Threshold: 45.0, Hysteresis: 2.0, Delay: 10},
+		{Name: "Sensor fault", Type: SensorFault, Severity: Warning, Delay: 10},
+		{Name: "Communications lost", Type: CommsLoss, Severity: Critical, Delay: 10},
+		{Name: "Both banks off", Type: BanksOff, Severity: Critical, Delay: 5},
+		{Name: "State of charge low", Type: SOCLow, Severity: Warning, Threshold: 20.0, Hysteresis: 5.0, Delay: 60},
+	}
+}
+
+/**
+Read the rules from a JSON file holding an array of rules. Rule names must be unique.
+*/
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s - %w", path, err)
+	}
+	names := make(map[string]bool)
+	for i := range rules {
+		if err = rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s - %w", path, err)
+		}
+		if names[rules[i].Name] {
+			return nil, fmt.Errorf("%s - rule %s is defined more than once", path, rules[i].Name)
+		}
+		names[rules[i].Name] = true
+	}
+	return rules, nil
+}
@@ -0,0 +1,37 @@
+package Alarms
+
+import "testing"
+
+func TestTriggeredAndCleared(t *testing.T) {
+	high := Rule{Name: "high", Type: CellHigh, Threshold: 1.75, Hysteresis: 0.05}
+	low := Rule{Name: "low", Type: SOCLow, Threshold: 20, Hysteresis: 5}
+	fault := Rule{Name: "fault", Type: CommsLoss, Threshold: 99, Hysteresis: 0}
+	tests := []struct {
+		name      string
+		rule      Rule
+		value     float64
+		triggered bool
+		cleared   bool
+	}{
+		{"above a high threshold", high, 1.76, true, false},
+		{"at a high threshold", high, 1.75, false, false},
+		{"inside the hysteresis below a high threshold", high, 1.71, false, false},
+		{"at the hysteresis below a high threshold", high, 1.70, false, true},
+		{"below a low threshold", low, 19.9, true, false},
+		{"at a low threshold", low, 20, false, false},
+		{"inside the hysteresis above a low threshold", low, 24.9, false, false},
+		{"at the hysteresis above a low threshold", low, 25, false, true},
+		{"fault present ignores the threshold", fault, 1, true, false},
+		{"fault gone", fault, 0, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.rule.triggered(test.value); got != test.triggered {
+				t.Errorf("triggered(%v) = %t, want %t", test.value, got, test.triggered)
+			}
+			if got := test.rule.cleared(test.value); got != test.cleared {
+				t.Errorf("cleared(%v) = %t, want %t", test.value, got, test.cleared)
+			}
+		})
+	}
+}
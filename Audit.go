@@ -0,0 +1,56 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultAuditLimit = 1000
+const maxAuditLimit = 10000
+
+/**
+Return the audit log of commands sent to the relays and controllers, most recent first. Everything is optional. The
+period defaults to the last 7 days.
+/audit?start=2021-06-01 00:00&end=2021-06-02 00:00&source=web&user=alice&action=switch_bank&limit=100
+*/
+func webGetAudit(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	filter := Storage.AuditFilter{
+		End:    time.Now(),
+		Source: r.FormValue("source"),
+		User:   r.FormValue("user"),
+		Action: r.FormValue("action"),
+		Limit:  defaultAuditLimit,
+	}
+	filter.Start = filter.End.AddDate(0, 0, -7)
+	var err error
+	if value := r.FormValue("start"); value != "" {
+		if filter.Start, err = parseWebTime(value); err != nil {
+			ReturnJSONError(w, "Audit", err, http.StatusBadRequest, false)
+			return
+		}
+	}
+	if value := r.FormValue("end"); value != "" {
+		if filter.End, err = parseWebTime(value); err != nil {
+			ReturnJSONError(w, "Audit", err, http.StatusBadRequest, false)
+			return
+		}
+	}
+	if value := r.FormValue("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 || filter.Limit > maxAuditLimit {
+			ReturnJSONErrorString(w, "Audit", "limit must be between 1 and "+strconv.Itoa(maxAuditLimit), http.StatusBadRequest, false)
+			return
+		}
+	}
+	entries, err := store.GetAuditEntries(filter)
+	if err != nil {
+		ReturnJSONError(w, "Audit", err, http.StatusInternalServerError, true)
+		return
+	}
+	if entries == nil {
+		entries = []Storage.AuditEntry{}
+	}
+	returnJSON(w, entries)
+}
@@ -0,0 +1,367 @@
+package Auth
+
+import (
+	"context"
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SessionCookie = "battery_session" // Name of the cookie holding the session after logging in
+const sessionLifetime = 12 * time.Hour // Sessions expire after this long without being used
+const ticketLifetime = 30 * time.Second
+
+/**
+Identity is who made a request and what they may do
+*/
+type Identity struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+type session struct {
+	identity Identity
+	expires  time.Time
+}
+
+type contextKey struct{}
+
+// WriteError sends refusals and failures to the client. Replace it to send errors in the application's own format.
+var WriteError = http.Error
+
+// OpenRole is given to every request when there is no Authenticator. Raise it to Engineer to leave everything open.
+var OpenRole = Viewer
+
+/**
+Authenticator checks the session cookie, API token or websocket ticket on each request against the users file.
+All methods are safe to call on a nil Authenticator, which gives everyone the OpenRole.
+*/
+type Authenticator struct {
+	mu         sync.Mutex
+	path       string
+	modTime    time.Time
+	users      map[string]*User
+	tokens     map[string]*User
+	sessions   map[string]*session
+	tickets    map[string]*session
+	anonymous  Role
+	origins    map[string]bool
+	requireTLS bool
+}
+
+/**
+Load the users file. Requests without credentials get the anonymous role, which may be None. Websocket connections
+are accepted from the same host or any of the allowed origins.
+*/
+func New(path string, anonymous Role, allowedOrigins []string) (*Authenticator, error) {
+	auth := new(Authenticator)
+	auth.path = path
+	auth.anonymous = anonymous
+	auth.sessions = make(map[string]*session)
+	auth.tickets = make(map[string]*session)
+	auth.origins = make(map[string]bool)
+	for _, origin := range allowedOrigins {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			auth.origins[strings.TrimSuffix(origin, "/")] = true
+		}
+	}
+	if err := auth.reload(); err != nil {
+		return nil, err
+	}
+	if len(auth.users) == 0 {
+		log.Println("There are no users in", path, "- add one with -adduser")
+	}
+	return auth, nil
+}
+
+/**
+Read the users file again if it has changed. Called with the lock held.
+*/
+func (auth *Authenticator) reload() error {
+	info, err := os.Stat(auth.path)
+	if err == nil && info.ModTime().Equal(auth.modTime) && auth.users != nil {
+		return nil
+	}
+	users, err := LoadUsers(auth.path)
+	if err != nil {
+		return err
+	}
+	auth.users = make(map[string]*User)
+	auth.tokens = make(map[string]*User)
+	for i := range users {
+		user := &users[i]
+		auth.users[user.Name] = user
+		for _, token := range user.Tokens {
+			auth.tokens[token] = user
+		}
+	}
+	if info != nil {
+		auth.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func (auth *Authenticator) userForToken(token string) (Identity, bool) {
+	if err := auth.reload(); err != nil {
+		log.Println("Failed to read the users file -", err)
+	}
+	if user, found := auth.tokens[HashToken(token)]; found {
+		return Identity{Name: user.Name, Role: user.Role}, true
+	}
+	return Identity{}, false
+}
+
+/**
+Only accept passwords, sessions and tokens over HTTPS so they never cross the network in clear text. Plain HTTP
+requests get the anonymous role.
+*/
+func (auth *Authenticator) RequireTLS() {
+	if auth != nil {
+		auth.mu.Lock()
+		auth.requireTLS = true
+		auth.mu.Unlock()
+	}
+}
+
+/**
+Work out who made the request. Websocket requests may pass a ticket or API token as ?token= because browsers cannot
+set headers on them.
+*/
+func (auth *Authenticator) identify(r *http.Request) (Identity, bool) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	now := time.Now()
+	if auth.requireTLS && r.TLS == nil {
+		return auth.anonymousIdentity()
+	}
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return auth.userForToken(strings.TrimPrefix(header, "Bearer "))
+	}
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		if s, found := auth.sessions[cookie.Value]; found && now.Before(s.expires) {
+			s.expires = now.Add(sessionLifetime)
+			return s.identity, true
+		}
+	}
+	if token := r.URL.Query().Get("token"); token != "" && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		if ticket, found := auth.tickets[token]; found {
+			// Tickets can only be used once
+			delete(auth.tickets, token)
+			if now.Before(ticket.expires) {
+				return ticket.identity, true
+			}
+			return Identity{}, false
+		}
+		return auth.userForToken(token)
+	}
+	return auth.anonymousIdentity()
+}
+
+func (auth *Authenticator) anonymousIdentity() (Identity, bool) {
+	if auth.anonymous > None {
+		return Identity{Name: "anonymous", Role: auth.anonymous}, true
+	}
+	return Identity{}, false
+}
+
+/**
+Wrap the handler so it is only called for users with at least the given role. The identity is added to the request
+context for the handler to use.
+*/
+func (auth *Authenticator) Require(role Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var identity Identity
+		if auth == nil {
+			identity = Identity{Name: r.RemoteAddr, Role: OpenRole}
+			if identity.Role < role {
+				log.Printf("%s was refused %s %s which needs %s and there are no logins", identity.Name, r.Method, r.URL.Path, role)
+				WriteError(w, role.String()+" role required - this needs a users file to log in with", http.StatusForbidden)
+				return
+			}
+		} else {
+			var found bool
+			if identity, found = auth.identify(r); !found {
+				WriteError(w, "login required", http.StatusUnauthorized)
+				return
+			}
+			if identity.Role < role {
+				log.Printf("%s (%s) was refused %s %s which needs %s", identity.Name, identity.Role, r.Method, r.URL.Path, role)
+				WriteError(w, role.String()+" role required", http.StatusForbidden)
+				return
+			}
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, identity)))
+	}
+}
+
+/**
+Return the identity Require added to the request
+*/
+func FromRequest(r *http.Request) Identity {
+	if identity, found := r.Context().Value(contextKey{}).(Identity); found {
+		return identity
+	}
+	return Identity{}
+}
+
+func (auth *Authenticator) newSession(identity Identity, lifetime time.Duration, sessions map[string]*session) (string, error) {
+	id, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	for key, s := range sessions {
+		if now.After(s.expires) {
+			delete(sessions, key)
+		}
+	}
+	sessions[id] = &session{identity: identity, expires: now.Add(lifetime)}
+	return id, nil
+}
+
+func writeIdentity(w http.ResponseWriter, identity Identity) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(identity); err != nil {
+		log.Println(err)
+	}
+}
+
+/**
+Log in with name and password as form values or a JSON body and start a session.
+POST /login
+*/
+func (auth *Authenticator) WebLogin(w http.ResponseWriter, r *http.Request) {
+	if auth == nil {
+		WriteError(w, "authentication is not enabled", http.StatusNotFound)
+		return
+	}
+	auth.mu.Lock()
+	refuse := auth.requireTLS && r.TLS == nil
+	auth.mu.Unlock()
+	if refuse {
+		WriteError(w, "log in over HTTPS", http.StatusForbidden)
+		return
+	}
+	var credentials struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			WriteError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		credentials.Name = r.FormValue("name")
+		credentials.Password = r.FormValue("password")
+	}
+	auth.mu.Lock()
+	if err := auth.reload(); err != nil {
+		log.Println("Failed to read the users file -", err)
+	}
+	user, found := auth.users[credentials.Name]
+	var hash string
+	if found {
+		hash = user.Password
+	}
+	auth.mu.Unlock()
+	if !found || hash == "" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(credentials.Password)) != nil {
+		log.Println("Failed login for", credentials.Name, "from", r.RemoteAddr)
+		// Slow down password guessing
+		time.Sleep(time.Second)
+		WriteError(w, "invalid user name or password", http.StatusUnauthorized)
+		return
+	}
+	identity := Identity{Name: user.Name, Role: user.Role}
+	auth.mu.Lock()
+	id, err := auth.newSession(identity, sessionLifetime, auth.sessions)
+	auth.mu.Unlock()
+	if err != nil {
+		WriteError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	log.Println(identity.Name, "logged in from", r.RemoteAddr)
+	writeIdentity(w, identity)
+}
+
+/**
+End the session
+POST /logout
+*/
+func (auth *Authenticator) WebLogout(w http.ResponseWriter, r *http.Request) {
+	if auth != nil {
+		if cookie, err := r.Cookie(SessionCookie); err == nil {
+			auth.mu.Lock()
+			delete(auth.sessions, cookie.Value)
+			auth.mu.Unlock()
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+Return the user name and role. Must be wrapped by Require.
+GET /whoami
+*/
+func WebWhoAmI(w http.ResponseWriter, r *http.Request) {
+	writeIdentity(w, FromRequest(r))
+}
+
+/**
+Issue a single use ticket, valid for 30 seconds, for opening a websocket as ws://.../ws?token=<ticket>. Must be
+wrapped by Require.
+GET /wsticket
+*/
+func (auth *Authenticator) WebWebSocketTicket(w http.ResponseWriter, r *http.Request) {
+	var ticket string
+	if auth != nil {
+		auth.mu.Lock()
+		var err error
+		ticket, err = auth.newSession(FromRequest(r), ticketLifetime, auth.tickets)
+		auth.mu.Unlock()
+		if err != nil {
+			WriteError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Ticket string `json:"ticket"`
+	}{ticket}); err != nil {
+		log.Println(err)
+	}
+}
+
+/**
+Websocket origin check. Requests without an Origin header come from something other than a browser and are allowed,
+as are pages served by this host and the allowed origins.
+*/
+func (auth *Authenticator) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if auth != nil && auth.origins[strings.TrimSuffix(origin, "/")] {
+		return true
+	}
+	log.Println("Refused websocket connection from origin", origin)
+	return false
+}
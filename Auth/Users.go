@@ -0,0 +1,160 @@
+package Auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+Role decides what a user may do. Each role can do everything the roles below it can.
+*/
+type Role int
+
+const (
+	None     Role = iota
+	Viewer        // Read the data
+	Operator      // Switch banks, the generator, the fan and watering, and acknowledge alarms
+	Engineer      // Write Modbus coils and holding registers
+)
+
+var roleNames = map[Role]string{None: "none", Viewer: "viewer", Operator: "operator", Engineer: "engineer"}
+
+func (role Role) String() string {
+	return roleNames[role]
+}
+
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if strings.EqualFold(name, roleName) {
+			return role, nil
+		}
+	}
+	return None, fmt.Errorf("unknown role '%s' - use viewer, operator or engineer", name)
+}
+
+func (role Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(role.String())
+}
+
+func (role *Role) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	var err error
+	*role, err = ParseRole(name)
+	return err
+}
+
+/**
+User is one entry in the users file. Password is a bcrypt hash and Tokens holds the SHA-256 hashes of the user's API
+tokens.
+*/
+type User struct {
+	Name     string   `json:"name"`
+	Role     Role     `json:"role"`
+	Password string   `json:"password,omitempty"`
+	Tokens   []string `json:"tokens,omitempty"`
+}
+
+/**
+Read the users file. A missing file gives no users.
+*/
+func LoadUsers(path string) ([]User, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err = json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("%s - %w", path, err)
+	}
+	return users, nil
+}
+
+/**
+Write the users file so only the owner can read it
+*/
+func SaveUsers(path string, users []User) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+/**
+Return a random string suitable for a token or session ID
+*/
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+/**
+Add or update a user in the users file, setting the role and password
+*/
+func SetUser(path string, name string, role Role, password string) error {
+	users, err := LoadUsers(path)
+	if err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		if users[i].Name == name {
+			users[i].Role = role
+			users[i].Password = hash
+			return SaveUsers(path, users)
+		}
+	}
+	return SaveUsers(path, append(users, User{Name: name, Role: role, Password: hash}))
+}
+
+/**
+Create a new API token for the user and return it. Only its hash is kept so it cannot be shown again.
+*/
+func AddToken(path string, name string) (string, error) {
+	users, err := LoadUsers(path)
+	if err != nil {
+		return "", err
+	}
+	for i := range users {
+		if users[i].Name == name {
+			token, err := randomToken()
+			if err != nil {
+				return "", err
+			}
+			users[i].Tokens = append(users[i].Tokens, HashToken(token))
+			return token, SaveUsers(path, users)
+		}
+	}
+	return "", fmt.Errorf("no user called %s in %s", name, path)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Auth"
+	websocket "BatteryMonitor6813V4/ModbusBatteryFuelGauge/webSocket"
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var authenticator *Auth.Authenticator // nil when no users file is given, which lets everyone in as a viewer
+
+/**
+Load the users file and protect the web services. With no users file everybody is a viewer, so the controls and the
+engineer commands are refused unless insecure is set to leave everything open as before.
+*/
+func startAuth(usersFile string, anonymousRole string, allowedOrigins string, insecure bool) {
+	Auth.WriteError = func(w http.ResponseWriter, message string, code int) {
+		ReturnJSONErrorString(w, "Authentication", message, code, false)
+	}
+	websocket.SetCheckOrigin(authenticator.CheckOrigin)
+	if usersFile == "" {
+		if insecure {
+			Auth.OpenRole = Auth.Engineer
+			log.Println("No users file given and -insecure is set - the web services are not protected.")
+		} else {
+			log.Println("No users file given - the web services are read only. Use -users to log in or -insecure to allow the controls.")
+		}
+		return
+	}
+	anonymous, err := Auth.ParseRole(anonymousRole)
+	if err != nil {
+		log.Fatalf("Invalid anonymous role - %s - Sorry, I am giving up.", err)
+	}
+	authenticator, err = Auth.New(usersFile, anonymous, strings.Split(allowedOrigins, ","))
+	if err != nil {
+		log.Fatalf("Failed to load the users from %s - %s - Sorry, I am giving up.", usersFile, err)
+	}
+	websocket.SetCheckOrigin(authenticator.CheckOrigin)
+}
+
+/**
+Handle the -adduser and -addtoken command line options. Returns true if one of them was given, in which case the
+program should exit.
+*/
+func runUserCommands(usersFile string, addUser string, addToken string) bool {
+	if addUser == "" && addToken == "" {
+		return false
+	}
+	if usersFile == "" {
+		log.Fatal("Use -users to say which users file to change")
+	}
+	if addUser != "" {
+		fields := strings.SplitN(addUser, ":", 2)
+		if len(fields) != 2 {
+			log.Fatalf("-adduser should be name:role, not %s", addUser)
+		}
+		role, err := Auth.ParseRole(fields[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "Password for %s: ", fields[0])
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if password = strings.TrimRight(password, "\r\n"); password == "" {
+			log.Fatal("The password cannot be blank - ", err)
+		}
+		if err = Auth.SetUser(usersFile, fields[0], role, password); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Saved", fields[0], "as", role, "in", usersFile)
+	}
+	if addToken != "" {
+		token, err := Auth.AddToken(usersFile, addToken)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// This is the only time the token is shown. Only its hash is kept.
+		fmt.Println(token)
+	}
+	return true
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"BatteryMonitor6813V4/Auth"
 	"BatteryMonitor6813V4/FuelGauge"
 	"BatteryMonitor6813V4/FullChargeEvaluator"
 	"BatteryMonitor6813V4/LTC6813/LTC6813"
+	"BatteryMonitor6813V4/Metrics"
+	ModbusController "BatteryMonitor6813V4/ModbusBatteryFuelGauge/modbusController"
+	"BatteryMonitor6813V4/Simulator"
+	"BatteryMonitor6813V4/Storage"
+	"BatteryMonitor6813V4/StoreAndForward"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -23,12 +29,11 @@ import (
 	"periph.io/x/periph/conn/spi/spireg"
 	"periph.io/x/periph/host"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
-import _ "github.com/go-sql-driver/mysql"
-
 const SPIBAUDRATE = physic.MegaHertz * 1
 const SPIBITSPERWORD = 8
 
@@ -89,27 +94,30 @@ type InverterSetpoints struct {
 }
 
 var (
-	ltc                  *LTC6813.LTC6813
-	fuelgauge            *FuelGauge.FuelGauge
-	spiConnection        spi.Conn
-	verbose              *bool
-	spiDevice            *string
-	nErrors              int
-	pDB                  *sql.DB
-	pDatabaseLogin       *string
-	pDatabasePassword    *string
-	pDatabaseServer      *string
-	pDatabasePort        *string
-	pDatabaseName        *string
-	ltcLock              sync.Mutex
-	nDevices             int
-	voltageStatement     *sql.Stmt
-	temperatureStatement *sql.Stmt
-	evaluator            *FullChargeEvaluator.FullChargeEval
-	iValues              InverterValues
-	autoFan              bool
-	signal               *sync.Cond
-	setpoints            InverterSetpoints
+	ltc                *LTC6813.LTC6813
+	fuelgauge          *FuelGauge.FuelGauge
+	spiConnection      spi.Conn
+	verbose            *bool
+	spiDevice          *string
+	nErrors            int
+	store              Storage.Store
+	pDatabaseLogin     *string
+	pDatabasePassword  *string
+	pDatabaseServer    *string
+	pDatabasePort      *string
+	pDatabaseName      *string
+	ltcLock            sync.Mutex
+	nDevices           int
+	dbQueue            *StoreAndForward.Queue
+	voltageColumns     []string
+	temperatureColumns []string
+	evaluator          *FullChargeEvaluator.FullChargeEval
+	iValues            InverterValues
+	autoFan            bool
+	signal             *sync.Cond
+	setpoints          InverterSetpoints
+	simulator          *Simulator.Simulator
+	pWebRoot           *string
 )
 
 var upgrader = websocket.Upgrader{
@@ -117,7 +125,7 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize:   1024,
 	EnableCompression: true,
 	CheckOrigin: func(r *http.Request) bool {
-		return true
+		return authenticator.CheckOrigin(r)
 	},
 }
 
@@ -168,6 +176,7 @@ func setHeaders(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "PATCH, GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 	w.Header().Set("Access-Control-Expose-Headers", "Authorization")
 }
 
@@ -203,6 +212,10 @@ Get the voltage and temperature measurements from the LTC6813 chain
 */
 func performMeasurements() {
 	var err error
+	start := time.Now()
+	defer func() {
+		cycleDuration.Observe(time.Since(start).Seconds())
+	}()
 	if nDevices == 0 {
 		//		nDevices, err = getLTC6813(6)
 		nDevices, err = getLTC6813(3)
@@ -261,7 +274,7 @@ func performMeasurements() {
 Log the LTC6813 data to the database
 */
 func logData() {
-	_, err := voltageStatement.Exec(ltc.GetRawVolts(0, 0), ltc.GetRawVolts(0, 1), ltc.GetRawVolts(0, 2), ltc.GetRawVolts(0, 3), ltc.GetRawVolts(0, 4), ltc.GetRawVolts(0, 5),
+	err := dbQueue.Insert("voltage", voltageColumns, ltc.GetRawVolts(0, 0), ltc.GetRawVolts(0, 1), ltc.GetRawVolts(0, 2), ltc.GetRawVolts(0, 3), ltc.GetRawVolts(0, 4), ltc.GetRawVolts(0, 5),
 		ltc.GetRawVolts(0, 6), ltc.GetRawVolts(0, 7), ltc.GetRawVolts(0, 8), ltc.GetRawVolts(0, 9), ltc.GetRawVolts(0, 10), ltc.GetRawVolts(0, 11),
 		ltc.GetRawVolts(0, 12), ltc.GetRawVolts(0, 13), ltc.GetRawVolts(0, 14), ltc.GetRawVolts(0, 15), ltc.GetRawVolts(0, 16), ltc.GetRawVolts(0, 17),
 		ltc.GetRawVolts(1, 0), ltc.GetRawVolts(1, 1), ltc.GetRawVolts(1, 2), ltc.GetRawVolts(1, 3), ltc.GetRawVolts(1, 4), ltc.GetRawVolts(1, 5),
@@ -283,7 +296,7 @@ func logData() {
 	}
 
 	if time.Now().Second() == 0 {
-		_, err = temperatureStatement.Exec(ltc.GetTemp(0, 0), ltc.GetTemp(0, 1), ltc.GetTemp(0, 2), ltc.GetTemp(0, 3), ltc.GetTemp(0, 4), ltc.GetTemp(0, 5),
+		err = dbQueue.Insert("temperature", temperatureColumns, ltc.GetTemp(0, 0), ltc.GetTemp(0, 1), ltc.GetTemp(0, 2), ltc.GetTemp(0, 3), ltc.GetTemp(0, 4), ltc.GetTemp(0, 5),
 			ltc.GetTemp(0, 6), ltc.GetTemp(0, 7), ltc.GetTemp(0, 8), ltc.GetTemp(0, 9), ltc.GetTemp(0, 10), ltc.GetTemp(0, 11),
 			ltc.GetTemp(0, 12), ltc.GetTemp(0, 13), ltc.GetTemp(0, 14), ltc.GetTemp(0, 15), ltc.GetTemp(0, 16), ltc.GetTemp(0, 17),
 			ltc.GetTemp(1, 0), ltc.GetTemp(1, 1), ltc.GetTemp(1, 2), ltc.GetTemp(1, 3), ltc.GetTemp(1, 4), ltc.GetTemp(1, 5),
@@ -297,6 +310,7 @@ func logData() {
 			ltc.GetTemp(4, 6), ltc.GetTemp(4, 7), ltc.GetTemp(4, 8), ltc.GetTemp(4, 9), ltc.GetTemp(4, 10), ltc.GetTemp(4, 11),
 			ltc.GetTemp(4, 12), ltc.GetTemp(4, 13), ltc.GetTemp(4, 14), ltc.GetTemp(4, 15), ltc.GetTemp(4, 16), ltc.GetTemp(4, 17),
 			ltc.GetTemp(5, 0), ltc.GetTemp(5, 1))
+		logInverterData()
 	}
 	if err != nil {
 		log.Println(err)
@@ -305,6 +319,7 @@ func logData() {
 
 /**
 Start the Web Socket server. This sends out data to all subscribers on a regular schedule so subscribers don't need to poll for updates.
+Every client gets the battery, inverter and fuel gauge data together each cycle. /live lets clients choose what they get.
 */
 func startDataWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -312,35 +327,7 @@ func startDataWebSocket(w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 		return
 	}
-	for {
-		signal.L.Lock()   // Get the signal and lock it.
-		signal.Wait()     // Wait for it to be signalled again. It is unlocked while we wait then locked again before returning
-		signal.L.Unlock() // Unlock it
-		w, err := conn.NextWriter(websocket.TextMessage)
-		if err != nil {
-			log.Println("Failed to get the values websocket writer - ", err)
-			return
-		}
-
-		var sJSON = `{"battery":` + string(ltc.GetValuesAsJSON()) + `,"inverter":`
-		jInverter, err := json.Marshal(&iValues)
-		sJSON += string(jInverter)
-		sJSON += `,"fuelgauge":`
-		sFuelgauge, err := fuelgauge.GetData()
-		if err != nil {
-			sFuelgauge += `{"error":"` + err.Error() + `"}`
-			log.Println("Failed to get the fuelgauge data - ", err)
-		}
-		sJSON += sFuelgauge + "}"
-		_, err = fmt.Fprint(w, sJSON)
-		if err != nil {
-			log.Println("failed to write the values message to the websocket - ", err)
-			return
-		}
-		if err := w.Close(); err != nil {
-			log.Println("Failed to close the values websocket writer - ", err)
-		}
-	}
+	liveHub.ServePlain(conn, topicDashboard)
 }
 
 /**
@@ -443,7 +430,7 @@ func webSwitchOffBank(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid battery bank", http.StatusBadRequest)
 		return
 	}
-	fuelgauge.SwitchOffBank(int(bank))
+	fuelgauge.SwitchOffBank(FuelGauge.WebOrigin(r), int(bank))
 }
 
 func webBatteryFan(w http.ResponseWriter, r *http.Request) {
@@ -478,7 +465,7 @@ func webGetSerialNumbers(w http.ResponseWriter, _ *http.Request) {
 	rowNum := 1
 	setHeaders(w)
 
-	rows, err := pDB.Query(`select cell_number as cell_number, serial_number as serial_number, date_format(install_date, "%D %M %Y") as install_date, date_format(full_charge_detected, "%D %M %Y %H:%i:%s") as full_charge_detected, full_charge as full_charge from serial_numbers`)
+	cells, err := store.GetSerialNumbers()
 	if err != nil {
 		_, err2 := fmt.Fprint(w, `{"error":"`, err, `"}`)
 		log.Println("Error getting serial numbers - ", err)
@@ -490,7 +477,7 @@ func webGetSerialNumbers(w http.ResponseWriter, _ *http.Request) {
 		if eFmt != nil {
 			log.Println(eFmt)
 		}
-		for rows.Next() {
+		for _, cell := range cells {
 			if rowNum > 1 {
 				_, eFmt := fmt.Fprint(w, ",")
 				if eFmt != nil {
@@ -500,18 +487,18 @@ func webGetSerialNumbers(w http.ResponseWriter, _ *http.Request) {
 			if rowNum == 39 {
 				rowNum = 101
 			}
-			err = rows.Scan(&serialNumbers.CellNumber, &serialNumbers.SerialNumber, &serialNumbers.InstallDate, &serialNumbers.FullChargeDetected, &serialNumbers.FullCharge)
+			serialNumbers.CellNumber = cell.CellNumber
+			serialNumbers.SerialNumber = cell.SerialNumber
+			serialNumbers.InstallDate = formatDate(cell.InstallDate, false)
+			serialNumbers.FullChargeDetected = formatDate(cell.FullChargeDetected, true)
+			serialNumbers.FullCharge = cell.FullCharge
+			jsonString, err := json.Marshal(serialNumbers)
 			if err != nil {
-				log.Println("Failed to get the serial numbers - ", err)
+				log.Println("Failed to convert serial numbers to JSON - ", err)
 			} else {
-				jsonString, err := json.Marshal(serialNumbers)
-				if err != nil {
-					log.Println("Failed to convert serial numbers to JSON - ", err)
-				} else {
-					_, eFmt := fmt.Fprint(w, `"`, rowNum, `":`, string(jsonString))
-					if eFmt != nil {
-						log.Println(eFmt)
-					}
+				_, eFmt := fmt.Fprint(w, `"`, rowNum, `":`, string(jsonString))
+				if eFmt != nil {
+					log.Println(eFmt)
 				}
 			}
 			rowNum++
@@ -523,6 +510,31 @@ func webGetSerialNumbers(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+/**
+Format a date the way the web pages expect, e.g. "3rd March 2021" or "3rd March 2021 14:05:00". Null dates are empty.
+*/
+func formatDate(when sql.NullTime, withTime bool) string {
+	if !when.Valid {
+		return ""
+	}
+	suffix := "th"
+	day := when.Time.Day()
+	if day < 11 || day > 13 {
+		switch day % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+	if withTime {
+		return fmt.Sprintf("%d%s %s", day, suffix, when.Time.Format("January 2006 15:04:05"))
+	}
+	return fmt.Sprintf("%d%s %s", day, suffix, when.Time.Format("January 2006"))
+}
+
 func webGetLastFullChargeTimes(w http.ResponseWriter, _ *http.Request) {
 	setHeaders(w)
 	_, eFmt := fmt.Fprint(w, fuelgauge.GetLastFullChargeTimes())
@@ -546,19 +558,59 @@ func returnWebError(w http.ResponseWriter, err error) {
 	}
 }
 
+/**
+Averages over the last few seconds returned by /status/{avg} and /api/v1/status
+*/
+type BatteryStatus struct {
+	Current  float64 `json:"current"`
+	Left     float64 `json:"left"`
+	Right    float64 `json:"right"`
+	SOC      float64 `json:"soc"`
+	SOCLeft  float64 `json:"soc_left"`
+	SOCRight float64 `json:"soc_right"`
+	VBatt    float64 `json:"vbat"`
+	VLeft    float64 `json:"v_left"`
+	VRight   float64 `json:"v_right"`
+}
+
+/**
+Average the current, state of charge and bank voltages over the given number of seconds
+*/
+func getBatteryStatus(seconds uint64) (BatteryStatus, error) {
+	var currentVal BatteryStatus
+
+	// Get the average current and state of charge (SOC) for the past 5 minutes
+	since := time.Now().Add(-time.Duration(seconds) * time.Second)
+
+	// Get the battery specifications for capacity
+	// Ignore the right bank for now.
+	//	total, left, right := fuelgauge.Capacity()
+	_, left, right := fuelgauge.Capacity()
+	average, err := store.GetAverageCurrent(since)
+	if err != nil {
+		return currentVal, err
+	}
+	// Round everything to 1 decimal place and calculate SOC as percentages
+	currentVal.Current = math.Round(average.Current*10) / 10
+	currentVal.Left = math.Round(average.Left*10) / 10
+	currentVal.Right = math.Round(average.Right*10) / 10
+	// Ignore the right bank for now.
+	//		currentVal.SOC = math.Round((average.SOC/float64(total))*1000) / 10
+	currentVal.SOC = math.Round((average.SOCLeft/float64(left))*1000) / 10
+	currentVal.SOCLeft = math.Round((average.SOCLeft/float64(left))*1000) / 10
+	currentVal.SOCRight = math.Round((average.SOCRight/float64(right))*1000) / 10
+
+	currentVal.VLeft, currentVal.VRight, err = store.GetAverageBankVoltage(since)
+	if err != nil {
+		return currentVal, err
+	}
+	currentVal.VLeft = math.Round(currentVal.VLeft*10) / 10
+	currentVal.VRight = math.Round(currentVal.VRight*10) / 10
+	currentVal.VBatt = math.Max(currentVal.VLeft, currentVal.VRight)
+	return currentVal, nil
+}
+
 func webGetStatus(w http.ResponseWriter, r *http.Request) {
-	type current struct {
-		Current  float64 `json:"current"`
-		Left     float64 `json:"left"`
-		Right    float64 `json:"right"`
-		SOC      float64 `json:"soc"`
-		SOCLeft  float64 `json:"soc_left"`
-		SOCRight float64 `json:"soc_right"`
-		VBatt    float64 `json:"vbat"`
-		VLeft    float64 `json:"v_left"`
-		VRight   float64 `json:"v_right"`
-	}
-	var currentVal current
 	setHeaders(w)
 
 	vars := mux.Vars(r)
@@ -569,60 +621,19 @@ func webGetStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the average current and state of charge (SOC) for the past 5 minutes
-	sSQL := `select avg(channel_0 + channel_1) as current
-			, avg(channel_0) as left_
-			, avg(channel_1) as right_
-			, avg(level_of_charge_0 + level_of_charge_1) as soc
-			, avg(level_of_charge_0) as soc_left
-			, avg(level_of_charge_1) as soc_right
-		from current
-		where logged > date_add(now(), interval -` + strconv.FormatUint(seconds, 10) + ` second)`
-
-	// Get the battery specifications for capacity
-	// Ignore the right bank for now.
-	//	total, left, right := fuelgauge.Capacity()
-	_, left, right := fuelgauge.Capacity()
-	row := pDB.QueryRow(sSQL)
-	err = row.Scan(&currentVal.Current, &currentVal.Left, &currentVal.Right, &currentVal.SOC, &currentVal.SOCLeft, &currentVal.SOCRight)
+	currentVal, err := getBatteryStatus(seconds)
 	if err != nil {
-		_, eFmt := fmt.Fprint(w, `{"error":"`, err.Error(), `","sql":"`, sSQL, `"}`)
-		if eFmt != nil {
-			log.Println(eFmt)
-		}
-	} else {
-		// Round everything to 1 decimal place and calculate SOC as percentages
-		currentVal.Current = math.Round(currentVal.Current*10) / 10
-		currentVal.Left = math.Round(currentVal.Left*10) / 10
-		currentVal.Right = math.Round(currentVal.Right*10) / 10
-		// Ignore the right bank for now.
-		//		currentVal.SOC = math.Round((currentVal.SOC/float64(total))*1000) / 10
-		currentVal.SOC = math.Round((currentVal.SOCLeft/float64(left))*1000) / 10
-		currentVal.SOCLeft = math.Round((currentVal.SOCLeft/float64(left))*1000) / 10
-		currentVal.SOCRight = math.Round((currentVal.SOCRight/float64(right))*1000) / 10
-
-		sSQL = `select avg(bank_0) / 10 as vLeft, avg(bank_1) / 10 as vRight from voltage where logged > date_add(now(), interval -` + strconv.FormatUint(seconds, 10) + ` second)`
-
-		row = pDB.QueryRow(sSQL)
-		err = row.Scan(&currentVal.VLeft, &currentVal.VRight)
-		if err != nil {
-			_, eFmt := fmt.Fprint(w, `{"error":"`, err.Error(), `","sql":"`, sSQL, `"}`)
-			if eFmt != nil {
-				log.Println(eFmt)
-			}
-		}
-		currentVal.VLeft = math.Round(currentVal.VLeft*10) / 10
-		currentVal.VRight = math.Round(currentVal.VRight*10) / 10
-		currentVal.VBatt = math.Max(currentVal.VLeft, currentVal.VRight)
-		sJSON, err := json.Marshal(currentVal)
-		if err != nil {
-			returnWebError(w, err)
-			return
-		}
-		_, eFmt := fmt.Fprint(w, string(sJSON))
-		if eFmt != nil {
-			log.Println(eFmt)
-		}
+		returnWebError(w, err)
+		return
+	}
+	sJSON, err := json.Marshal(currentVal)
+	if err != nil {
+		returnWebError(w, err)
+		return
+	}
+	_, eFmt := fmt.Fprint(w, string(sJSON))
+	if eFmt != nil {
+		log.Println(eFmt)
 	}
 }
 
@@ -653,18 +664,23 @@ func webGetCellData(w http.ResponseWriter, r *http.Request) {
 	}
 	var cellVal values
 	var cellData []values = nil
-	sCurrentTerm := ""
+	var minAmps, maxAmps *float64
 
 	vars := mux.Vars(r)
 	setHeaders(w)
 
 	cell, _ := strconv.ParseInt(vars["cell"], 10, 16)
 	if (r.FormValue("minAmps") != "") && (r.FormValue("maxAmps") != "") {
-		sCurrentTerm = fmt.Sprintf(" and i.channel_%d > %s and i.channel_%d < %s", cell/100, r.FormValue("minAmps"), cell/100, r.FormValue("maxAmps"))
+		min, errMin := strconv.ParseFloat(r.FormValue("minAmps"), 64)
+		max, errMax := strconv.ParseFloat(r.FormValue("maxAmps"), 64)
+		if errMin != nil || errMax != nil {
+			http.Error(w, "Invalid current range (minAmps, maxAmps)", http.StatusBadRequest)
+			return
+		}
+		minAmps = &min
+		maxAmps = &max
 	}
-	sVoltageTable := "voltage"
-	sCurrentTable := "current"
-	tm, err := time.Parse("2006-1-2 15:4", r.FormValue("start"))
+	tm, err := parseWebTime(r.FormValue("start"))
 	if err != nil {
 		log.Println("Error reading start time ", r.FormValue("start"), " - ", err)
 		if _, err := fmt.Fprint(w, err.Error()); err != nil {
@@ -672,48 +688,55 @@ func webGetCellData(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-
-	if tm.Before(time.Now().AddDate(0, -1, 0)) {
-		// Select data from the archive tables
-		sVoltageTable = "voltage_archive"
-		sCurrentTable = "current_archive"
+	end, err := parseWebTime(r.FormValue("end"))
+	if err != nil {
+		log.Println("Error reading end time ", r.FormValue("end"), " - ", err)
+		if _, err := fmt.Fprint(w, err.Error()); err != nil {
+			log.Println(err)
+		}
+		return
 	}
 
-	sSQL := fmt.Sprintf(`select min(unix_timestamp(v.logged)) as logged, avg(cell_%03d) / 10000 as volts, avg(i.channel_%d) as amps
-    from `+sVoltageTable+` v join `+sCurrentTable+` i on i.logged = from_unixtime(round(unix_timestamp(v.logged)))
-   where v.logged between '`+r.FormValue("start")+`' and '`+r.FormValue("end")+`'`+sCurrentTerm+`
-   group by unix_timestamp(v.logged) DIV 15`, cell, cell/100)
-	rows, err := pDB.Query(sSQL)
+	if err = Storage.ValidateTimeRange(tm, end, Storage.MaxHistorySpan(15*time.Second)); err != nil {
+		returnHistoryError(w, "Cell Data", err)
+		return
+	}
+	points, err := store.GetCellHistory(int(cell), tm, end, minAmps, maxAmps)
 	if err != nil {
-		_, eFmt := fmt.Fprint(w, `{"error":"`, err.Error(), `","sql":"`, sSQL, `"}`)
-		if eFmt != nil {
-			log.Println(eFmt)
-		}
-	} else {
-		for rows.Next() {
-			err = rows.Scan(&cellVal.Logged, &cellVal.Voltage, &cellVal.Current)
-			if err != nil {
-				returnWebError(w, err)
-				return
-			}
-			cellData = append(cellData, cellVal)
-		}
-		sJSON, err := json.Marshal(cellData)
-		if err != nil {
-			returnWebError(w, err)
-			return
-		}
-		_, eFmt := fmt.Fprint(w, string(sJSON))
-		if eFmt != nil {
-			log.Println(eFmt)
-		}
+		returnHistoryError(w, "Cell Data", err)
+		return
+	}
+	for _, point := range points {
+		cellVal.Logged = point.Logged
+		cellVal.Voltage = point.Volts
+		cellVal.Current = point.Current
+		cellData = append(cellData, cellVal)
 	}
+	sJSON, err := json.Marshal(cellData)
+	if err != nil {
+		returnWebError(w, err)
+		return
+	}
+	_, eFmt := fmt.Fprint(w, string(sJSON))
+	if eFmt != nil {
+		log.Println(eFmt)
+	}
+}
+
+/**
+Open the CAN bus to the inverters. When simulating this is a virtual bus connected to the simulated inverter.
+*/
+func newCANBus() (*can.Bus, error) {
+	if simulator != nil {
+		return simulator.NewCANBus(), nil
+	}
+	return can.NewBusForInterfaceWithName("can0")
 }
 
 func SendSMAHeartBeat() {
 	heartbeat := time.NewTicker(time.Second)
 
-	bus, err := can.NewBusForInterfaceWithName("can0")
+	bus, err := newCANBus()
 	//	var err error
 	loops := 0
 
@@ -731,7 +754,8 @@ func SendSMAHeartBeat() {
 		if err != nil {
 			log.Println("CAN 351 Message error - ", err)
 		}
-		msg355 := SMACanMessages.NewCan355(uint16(fuelgauge.StateOfCharge()), 100.0, fuelgauge.StateOfCharge())
+		soc := stateOfCharge()
+		msg355 := SMACanMessages.NewCan355(uint16(soc), 100.0, soc)
 		//		log.Println("CAN-355 : ", msg355.Frame())
 		err = bus.Publish(msg355.Frame())
 		if err != nil {
@@ -824,7 +848,7 @@ func mainImpl() error {
 			//			if hour > 9 && hour < 19 {
 			if fuelgauge.ReadyToWater(0) && !bank0WateredToday {
 				// Water bank 0
-				err := fuelgauge.WaterBank(0, 10)
+				err := fuelgauge.WaterBank(FuelGauge.RuleOrigin("full charge watering"), 0, 10)
 				if err != nil {
 					log.Println(err)
 				}
@@ -832,7 +856,7 @@ func mainImpl() error {
 			}
 			if fuelgauge.ReadyToWater(1) && !bank1WateredToday {
 				// Water bank 1
-				err := fuelgauge.WaterBank(1, 10)
+				err := fuelgauge.WaterBank(FuelGauge.RuleOrigin("full charge watering"), 1, 10)
 				if err != nil {
 					log.Println(err)
 				}
@@ -841,7 +865,12 @@ func mainImpl() error {
 			// If the evaluator pointer is nil then create a new evaluator
 			//				log.Println("Checking for full charge...")
 			if evaluator == nil {
-				evaluator, _ = FullChargeEvaluator.New(pDB)
+				evaluator, _ = FullChargeEvaluator.New(store)
+				if evaluator != nil {
+					evaluator.OnBankFull(chargeFullCharge)
+					evaluator.OnBankFull(bankFullCharge)
+					evaluator.OnBankFull(socFullCharge)
+				}
 			}
 			// If the pointer is still nil we failed to create the evaluator so skip and try again next time.
 			if evaluator != nil {
@@ -855,6 +884,12 @@ func mainImpl() error {
 				if err != nil {
 					log.Println(err)
 					evaluator = nil
+				} else {
+					for bank, soc := range [2]float32{fuelgauge.StateOfChargeLeft(), fuelgauge.StateOfChargeRight()} {
+						if err := evaluator.ResetWhenDischarged(bank, soc); err != nil {
+							log.Println("Failed to clear the full charge flags of bank", bank, "-", err)
+						}
+					}
 				}
 			} else {
 				log.Println("No full charge evaluator!")
@@ -888,7 +923,7 @@ func mainImpl() error {
 			// While the bank 1 cells are problematic we need to switch to bank 0 at 8:00PM
 			if (hour == 20) && (time.Now().Minute() == 0) {
 				log.Println("Switching off right bank at 8PM")
-				go fuelgauge.SwitchOffBank(FuelGauge.RightBank)
+				go fuelgauge.SwitchOffBank(FuelGauge.RuleOrigin("8PM bank switch"), FuelGauge.RightBank)
 			}
 			// Manage the battery fan based on the maximum temperature. If one or more temperature sensors
 			// show more than 42.0 C then turn on the fan if it is off. If the fan is on and the temperature is below 40.0
@@ -899,11 +934,11 @@ func mainImpl() error {
 			}
 			if (temp > 42.0) && !autoFan {
 				log.Println("Turning on the battery fan because the maximum temperature has risen to ", temp)
-				fuelgauge.TurnOnFan()
+				fuelgauge.TurnOnFan(FuelGauge.RuleOrigin("temperature fan control"))
 				autoFan = true
 			} else if (temp < 41.5) && autoFan {
 				log.Println("Turning off the battery fan because the maximum temperature has dropped to ", temp)
-				fuelgauge.TurnOffFan()
+				fuelgauge.TurnOffFan(FuelGauge.RuleOrigin("temperature fan control"))
 				autoFan = false
 			}
 		}
@@ -916,12 +951,23 @@ func mainImpl() error {
 			signal.Wait()     // Wait for it to be signalled again. It is unlocked while we wait then locked again before returning
 			signal.L.Unlock() // Unlock it
 			logData()
+			exportData()
+			publishLive()
+			publishMQTT()
+			evaluateAlarms()
+			analyseCells()
+			estimateResistance()
+			trackHealth()
+			estimateCharge()
+			meterEnergy()
 		}
 	}()
 
+	startEvents()
+
 	// Start handling incoming 'CAN' messages
 	go func() {
-		bus, err := can.NewBusForInterfaceWithName("can0")
+		bus, err := newCANBus()
 		if err != nil {
 			log.Fatalf("Error starting CAN interface - %s -\nSorry, I am giving up", err)
 		} else {
@@ -941,114 +987,109 @@ func mainImpl() error {
 	log.Println("Starting the WEB server")
 	router := mux.NewRouter().StrictSlash(true)
 	router.PathPrefix("/").Methods("OPTIONS").HandlerFunc(webOptionsHandler)
-	router.HandleFunc("/values", getValues).Methods("GET")
-	router.HandleFunc("/version", getVersion).Methods("GET")
-	router.HandleFunc("/i2cread", getI2Cread).Methods("GET")
-	router.HandleFunc("/i2cwrite", getI2Cwrite).Methods("GET")
-	router.HandleFunc("/i2creadByte", getI2CreadByte).Methods("GET")
-	router.HandleFunc("/i2cVoltage", getI2CVoltage).Methods("GET")
-	router.HandleFunc("/i2cCharge", getI2CCharge).Methods("GET")
-	router.HandleFunc("/i2cCurrent", getI2CCurrent).Methods("GET")
-	router.HandleFunc("/i2cTemp", getI2CTemp).Methods("GET")
-	router.HandleFunc("/ws", startDataWebSocket).Methods("GET")
-	router.HandleFunc("/sockets", socketHome).Methods("GET")
-	router.HandleFunc("/fuelgauge", webGetFuelGaugeValues).Methods("GET")
-	router.HandleFunc("/toggleCoil", webToggleCoil).Methods("PATCH")
-	router.HandleFunc("/setHoldingRegisters", webProcessHoldingRegistersForm).Methods("POST")
-	router.HandleFunc("/waterBank/{bank}/{minutes}", webWaterBank).Methods("PATCH")
-	router.HandleFunc("/batteryFan/{onOff}", webBatteryFan).Methods("PATCH")
-	router.HandleFunc("/batterySwitch/{bank}/{onOff}", webSwitchBattery).Methods("PATCH")
-	router.HandleFunc("/serialNumbers", webGetSerialNumbers).Methods("GET")
-	router.HandleFunc("/lastFullChargeTimes", webGetLastFullChargeTimes).Methods("GET")
-	router.HandleFunc("/batterySettings", webGetBatterySettings).Methods("GET")
-	router.HandleFunc("/batteryCurrent", webGetCurrentData).Methods("GET")
-	router.HandleFunc("/batteryVoltages", webGetVoltageData).Methods("GET")
-	router.HandleFunc("/cellValues/{cell}", webGetCellData).Methods("GET")
-	router.HandleFunc("/status/{avg}", webGetStatus).Methods("GET")
-	router.HandleFunc("/bankOff/{bank}", webSwitchOffBank).Methods("GET")
-	router.HandleFunc("/chargingParameters", webGetChargingParameters).Methods("GET")
-	router.HandleFunc("/generator/{action}", webGeneratorStartStop).Methods("PATCH")
-	spa := spaHandler{staticPath: "/var/www/html", indexPath: "index.html"}
+	registerAPI(router)
+	router.HandleFunc("/login", authenticator.WebLogin).Methods("POST")
+	router.HandleFunc("/logout", authenticator.WebLogout).Methods("POST")
+	router.HandleFunc("/whoami", authenticator.Require(Auth.Viewer, Auth.WebWhoAmI)).Methods("GET")
+	router.HandleFunc("/wsticket", authenticator.Require(Auth.Viewer, authenticator.WebWebSocketTicket)).Methods("GET")
+	router.HandleFunc("/values", authenticator.Require(Auth.Viewer, getValues)).Methods("GET")
+	router.HandleFunc("/version", authenticator.Require(Auth.Viewer, getVersion)).Methods("GET")
+	router.HandleFunc("/i2cread", authenticator.Require(Auth.Viewer, getI2Cread)).Methods("GET")
+	router.HandleFunc("/i2cwrite", authenticator.Require(Auth.Engineer, getI2Cwrite)).Methods("GET")
+	router.HandleFunc("/i2creadByte", authenticator.Require(Auth.Viewer, getI2CreadByte)).Methods("GET")
+	router.HandleFunc("/i2cVoltage", authenticator.Require(Auth.Viewer, getI2CVoltage)).Methods("GET")
+	router.HandleFunc("/i2cCharge", authenticator.Require(Auth.Viewer, getI2CCharge)).Methods("GET")
+	router.HandleFunc("/i2cCurrent", authenticator.Require(Auth.Viewer, getI2CCurrent)).Methods("GET")
+	router.HandleFunc("/i2cTemp", authenticator.Require(Auth.Viewer, getI2CTemp)).Methods("GET")
+	router.HandleFunc("/ws", authenticator.Require(Auth.Viewer, startDataWebSocket)).Methods("GET")
+	router.HandleFunc("/live", authenticator.Require(Auth.Viewer, startLiveWebSocket)).Methods("GET")
+	router.HandleFunc("/events", authenticator.Require(Auth.Viewer, webEvents)).Methods("GET")
+	router.HandleFunc("/sockets", authenticator.Require(Auth.Viewer, socketHome)).Methods("GET")
+	router.HandleFunc("/fuelgauge", authenticator.Require(Auth.Viewer, webGetFuelGaugeValues)).Methods("GET")
+	router.HandleFunc("/toggleCoil", authenticator.Require(Auth.Engineer, webToggleCoil)).Methods("PATCH")
+	router.HandleFunc("/setHoldingRegisters", authenticator.Require(Auth.Engineer, webProcessHoldingRegistersForm)).Methods("POST")
+	router.HandleFunc("/waterBank/{bank}/{minutes}", authenticator.Require(Auth.Operator, webWaterBank)).Methods("PATCH")
+	router.HandleFunc("/batteryFan/{onOff}", authenticator.Require(Auth.Operator, webBatteryFan)).Methods("PATCH")
+	router.HandleFunc("/batterySwitch/{bank}/{onOff}", authenticator.Require(Auth.Operator, webSwitchBattery)).Methods("PATCH")
+	router.HandleFunc("/serialNumbers", authenticator.Require(Auth.Viewer, webGetSerialNumbers)).Methods("GET")
+	router.HandleFunc("/lastFullChargeTimes", authenticator.Require(Auth.Viewer, webGetLastFullChargeTimes)).Methods("GET")
+	router.HandleFunc("/batterySettings", authenticator.Require(Auth.Viewer, webGetBatterySettings)).Methods("GET")
+	router.HandleFunc("/batteryCurrent", authenticator.Require(Auth.Viewer, webGetCurrentData)).Methods("GET")
+	router.HandleFunc("/batteryVoltages", authenticator.Require(Auth.Viewer, webGetVoltageData)).Methods("GET")
+	router.HandleFunc("/cellValues/{cell}", authenticator.Require(Auth.Viewer, webGetCellData)).Methods("GET")
+	router.HandleFunc("/export/{data}", authenticator.Require(Auth.Viewer, webExportData)).Methods("GET")
+	router.HandleFunc("/status/{avg}", authenticator.Require(Auth.Viewer, webGetStatus)).Methods("GET")
+	router.HandleFunc("/bankOff/{bank}", authenticator.Require(Auth.Operator, webSwitchOffBank)).Methods("GET")
+	router.HandleFunc("/chargingParameters", authenticator.Require(Auth.Viewer, webGetChargingParameters)).Methods("GET")
+	router.HandleFunc("/generator/{action}", authenticator.Require(Auth.Operator, webGeneratorStartStop)).Methods("PATCH")
+	router.HandleFunc("/metrics", authenticator.Require(Auth.Viewer, Metrics.Handler(collectMetrics))).Methods("GET")
+	router.HandleFunc("/alarms", authenticator.Require(Auth.Viewer, webGetAlarms)).Methods("GET")
+	router.HandleFunc("/alarms/active", authenticator.Require(Auth.Viewer, webGetActiveAlarms)).Methods("GET")
+	router.HandleFunc("/alarms/rules", authenticator.Require(Auth.Viewer, webGetAlarmRules)).Methods("GET")
+	router.HandleFunc("/alarms/ws", authenticator.Require(Auth.Viewer, startAlarmWebSocket)).Methods("GET")
+	router.HandleFunc("/cells/analytics", authenticator.Require(Auth.Viewer, webGetCellAnalytics)).Methods("GET")
+	router.HandleFunc("/cells/analytics/daily", authenticator.Require(Auth.Viewer, webGetCellAnalyticsDaily)).Methods("GET")
+	router.HandleFunc("/cells/resistance", authenticator.Require(Auth.Viewer, webGetCellResistance)).Methods("GET")
+	router.HandleFunc("/cells/resistance/{cell}", authenticator.Require(Auth.Viewer, webGetCellResistanceHistory)).Methods("GET")
+	router.HandleFunc("/soc", authenticator.Require(Auth.Viewer, webGetStateOfCharge)).Methods("GET")
+	router.HandleFunc("/energy", authenticator.Require(Auth.Viewer, webGetEnergy)).Methods("GET")
+	router.HandleFunc("/drift/{bank}", authenticator.Require(Auth.Viewer, webGetChargeDrift)).Methods("GET")
+	router.HandleFunc("/reports", authenticator.Require(Auth.Viewer, webGetReports)).Methods("GET")
+	router.HandleFunc("/reports/{id}", authenticator.Require(Auth.Viewer, webGetReport)).Methods("GET")
+	router.HandleFunc("/reports/{id}/html", authenticator.Require(Auth.Viewer, webGetReportHTML)).Methods("GET")
+	router.HandleFunc("/retention", authenticator.Require(Auth.Viewer, webGetRetention)).Methods("GET")
+	router.HandleFunc("/capacity", authenticator.Require(Auth.Viewer, webGetCapacity)).Methods("GET")
+	router.HandleFunc("/capacity/{bank}/approve", authenticator.Require(Auth.Operator, webApproveCapacity)).Methods("PATCH", "POST")
+	router.HandleFunc("/audit", authenticator.Require(Auth.Operator, webGetAudit)).Methods("GET")
+	router.HandleFunc("/alarms/{id}/acknowledge", authenticator.Require(Auth.Operator, webAcknowledgeAlarm)).Methods("PATCH", "POST")
+	spa := spaHandler{staticPath: *pWebRoot, indexPath: "index.html"}
 	router.PathPrefix("/").Handler(spa)
 
-	srv := &http.Server{
-		Handler: router,
-		Addr:    ":8000",
-		// Good practice: enforce timeouts for servers you create!
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
-	}
-
 	//err := http.ListenAndServe(":8000", router) // Listen on port 8000
-	err := srv.ListenAndServe()
+	err := serveWeb(router)
 	if err != nil {
 		log.Println("WEB Server Startup error - ", err)
 	}
 	return nil
 }
 
-func connectToDatabase() (*sql.DB, error) {
-	if pDB != nil {
-		_ = pDB.Close()
-		pDB = nil
+/**
+Open the database selected on the command line
+*/
+func connectToDatabase(storeType string, sqlitePath string) (Storage.Store, error) {
+	switch storeType {
+	case "mysql":
+		return Storage.OpenMySQL(*pDatabaseLogin, *pDatabasePassword, *pDatabaseServer, *pDatabasePort, *pDatabaseName)
+	case "sqlite":
+		return Storage.OpenSQLite(sqlitePath)
+	default:
+		return nil, fmt.Errorf("unknown store type '%s' - use mysql or sqlite", storeType)
 	}
-	// Connection string needs the additional parameter of parseTime=true in order to read dat/time values into sql.NullTime variables
-	// var sConnectionString = *pDatabaseLogin + ":" + *pDatabasePassword + "@tcp(" + *pDatabaseServer + ":" + *pDatabasePort + ")/" + *pDatabaseName + "?loc=Local&parseTime=true"
-	var sConnectionString = *pDatabaseLogin + ":" + *pDatabasePassword + "@tcp(" + *pDatabaseServer + ":" + *pDatabasePort + ")/" + *pDatabaseName + "?parseTime=true"
+}
 
-	//	fmt.Println("Connecting to [", sConnectionString, "]")
-	db, err := sql.Open("mysql", sConnectionString)
-	if err != nil {
-		return nil, err
-	}
-	err = db.Ping()
-	if err != nil {
-		_ = db.Close()
-		return nil, err
-	}
-
-	// Prepare the insert statements for voltage and temperature
-	sSQL := `insert into voltage (cell_001,cell_002,cell_003,cell_004,cell_005,cell_006,cell_007,cell_008,cell_009,cell_010
-                                 ,cell_011,cell_012,cell_013,cell_014,cell_015,cell_016,cell_017,cell_018,cell_019,cell_020
-                                 ,cell_021,cell_022,cell_023,cell_024,cell_025,cell_026,cell_027,cell_028,cell_029,cell_030
-                                 ,cell_031,cell_032,cell_033,cell_034,cell_035,cell_036,cell_037,cell_038
-                                 ,cell_101,cell_102,cell_103,cell_104,cell_105,cell_106,cell_107,cell_108,cell_109,cell_110
-                                 ,cell_111,cell_112,cell_113,cell_114,cell_115,cell_116,cell_117,cell_118,cell_119,cell_120
-                                 ,cell_121,cell_122,cell_123,cell_124,cell_125,cell_126,cell_127,cell_128,cell_129,cell_130
-                                 ,cell_131,cell_132,cell_133,cell_134,cell_135,cell_136,cell_137,cell_138
-                                 ,bank_0,bank_1)
-                          values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?
-                                 ,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?
-                                 ,?,?)`
-	voltageStatement, err = db.Prepare(sSQL)
-	if err != nil {
-		errClose := db.Close()
-		if errClose != nil {
-			log.Println(errClose)
+/**
+Build the column lists for the voltage and temperature tables. Cells are 001..038 for bank 0 and 101..138 for bank 1.
+*/
+func buildColumnLists() {
+	for _, base := range []int{0, 100} {
+		for cell := 1; cell <= 38; cell++ {
+			voltageColumns = append(voltageColumns, fmt.Sprintf("cell_%03d", base+cell))
+			temperatureColumns = append(temperatureColumns, fmt.Sprintf("temp_%03d", base+cell))
 		}
-		return nil, err
-	}
-
-	sSQL = `insert into temperature (temp_001,temp_002,temp_003,temp_004,temp_005,temp_006,temp_007,temp_008,temp_009,temp_010
-                                    ,temp_011,temp_012,temp_013,temp_014,temp_015,temp_016,temp_017,temp_018,temp_019,temp_020
-                                    ,temp_021,temp_022,temp_023,temp_024,temp_025,temp_026,temp_027,temp_028,temp_029,temp_030
-                                    ,temp_031,temp_032,temp_033,temp_034,temp_035,temp_036,temp_037,temp_038
-                                    ,temp_101,temp_102,temp_103,temp_104,temp_105,temp_106,temp_107,temp_108,temp_109,temp_110
-                                    ,temp_111,temp_112,temp_113,temp_114,temp_115,temp_116,temp_117,temp_118,temp_119,temp_120
-                                    ,temp_121,temp_122,temp_123,temp_124,temp_125,temp_126,temp_127,temp_128,temp_129,temp_130
-                                    ,temp_131,temp_132,temp_133,temp_134,temp_135,temp_136,temp_137,temp_138)
-                            values (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?
-                                   ,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
-	temperatureStatement, err = db.Prepare(sSQL)
+	}
+	voltageColumns = append(voltageColumns, "bank_0", "bank_1")
+}
+
+/**
+Start the queue that buffers the logged data while the database is unavailable.
+*/
+func startQueue(path string) {
+	var err error
+	dbQueue, err = StoreAndForward.New(timedDatabase{store}, path)
 	if err != nil {
-		errClose := db.Close()
-		if errClose != nil {
-			log.Println(errClose)
-		}
-		return nil, err
-	} else {
-		return db, err
+		log.Fatalf("Failed to open the data buffer %s - %s - Sorry, I am giving up.", path, err)
 	}
+	go dbQueue.Run()
 }
 
 func init() {
@@ -1087,8 +1128,83 @@ func init() {
 	pTimeoutMilliSecs := flag.Int("Timeout", 500, "communication port timeout in milliseconds")
 	pSlave1Address := flag.Int("Slave1", 5, "Modbus slave1 ID")
 	pSlave2Address := flag.Int("Slave2", 1, "Modbus slave2 ID (0 = not present)")
+	pWebRoot = flag.String("webroot", "/var/www/html", "Folder holding the web pages")
+	pStoreType := flag.String("store", "mysql", "Database to log to: mysql or sqlite")
+	pSQLitePath := flag.String("sqlitedb", "/var/lib/BatteryMonitor/battery.db", "SQLite database file used when store=sqlite")
+	pBufferFile := flag.String("buffer", "/var/lib/BatteryMonitor/buffer.wal", "File used to hold logged data while the database is unavailable")
+	pSimulate := flag.Bool("simulate", false, "Run against a simulated battery, fuel gauges and inverter instead of the hardware")
+	pSimDatabase := flag.String("simdb", "simulator.db", "SQLite database file used when simulating")
+	pSimCapacity := flag.Float64("simcapacity", 1000, "Capacity of each simulated bank in Ah")
+	pSimCharge := flag.Float64("simsoc", 80, "Starting state of charge of the simulated banks in %")
+	pSimLoad := flag.String("simload", "30", "Simulated load in amps. Give 24 comma separated values for an hourly profile")
+	pSimSolar := flag.Float64("simsolar", 200, "Simulated solar charging current at midday in amps")
+	pExport := flag.String("export", "", "Export the readings as time series to this URL or file (blank = no export)")
+	pExportFormat := flag.String("exportformat", "influx", "Time series export format: influx (line protocol) or remote (Prometheus remote-write)")
+	pExportToken := flag.String("exporttoken", "", "InfluxDB 2.x API token for the time series export")
+	pExportBatch := flag.Int("exportbatch", 1000, "Number of points sent in each time series export batch")
+	pExportBuffer := flag.Int("exportbuffer", 100000, "Maximum number of points held while the export destination is unavailable")
+	pExportInterval := flag.Int("exportinterval", 10, "Seconds between time series export batches")
+	pMQTTBroker := flag.String("mqtt", "", "MQTT broker to publish to, e.g. tcp://localhost:1883 (blank = no MQTT)")
+	pMQTTClientID := flag.String("mqttclient", "BatteryMonitor", "MQTT client ID")
+	pMQTTUser := flag.String("mqttuser", "", "MQTT user name")
+	pMQTTPassword := flag.String("mqttpassword", "", "MQTT password")
+	pMQTTPrefix := flag.String("mqttprefix", "batterymonitor", "Prefix for the MQTT topics")
+	pMQTTDiscovery := flag.String("mqttdiscovery", "homeassistant", "Home Assistant MQTT discovery prefix (blank = no discovery)")
+	pAlarmRules := flag.String("alarmrules", "", "JSON file of alarm rules (blank = built in rules)")
+	pCellBand := flag.Float64("cellband", 0.05, "Volts a cell may be from its bank's median before it is counted as outside the band")
+	pWeakWindows := flag.String("weakwindows", "1h,24h,168h", "Comma separated windows the weakest cells are ranked over")
+	pDischargeAmps := flag.Float64("dischargeamps", 5, "Amps a bank must be discharging at for its cells to be ranked")
+	pResistanceStep := flag.Float64("resistancestep", 20, "Smallest step in bank current in amps used to estimate the cell resistance")
+	pResistanceRising := flag.Float64("resistancerising", 10, "Percent a month a cell's resistance may rise before it is flagged")
+	pRatedCapacity := flag.Float64("ratedcapacity", 1000, "Rated (nameplate) capacity of each bank in Ah for the state of health")
+	pDeepDischarge := flag.Float64("deepdischarge", 1.0, "Average cell volts under load that ends a capacity test")
+	pRestCurve := flag.String("restcurve", "1.05:0,1.12:5,1.16:10,1.19:20,1.25:50,1.35:100", "Average cell volts:percent state of charge pairs for a resting bank")
+	pRestAmps := flag.Float64("restamps", 2, "Bank current in amps below which the bank is resting")
+	pReportHour := flag.Int("reporthour", 6, "Hour of the morning the daily, weekly (on Monday) and monthly reports are made")
+	pEmailReports := flag.String("emailreports", "weekly", "Comma separated kinds of report (daily, weekly, monthly) sent through the notifier (blank = none)")
+	pArchiveAfter := flag.Int("archiveafter", 0, "Days the readings are kept every second before being moved to the archive tables as one minute rows (0 = retention job off)")
+	pPurgeAfter := flag.Int("purgeafter", 0, "Days the archived readings are kept before being deleted (0 = keep for ever)")
+	pArchiveWindow := flag.String("archivewindow", "1-5", "Off-peak hours the readings are archived and purged in, e.g. 1-5 for 1am to 5am")
+	pArchiveBatch := flag.Int("archivebatch", 60, "Minutes of readings moved to the archive in each batch")
+	pNotify := flag.String("notify", "", "JSON file of notification channels and routes (blank = log only)")
+	pUsers := flag.String("users", "", "JSON file of users and API tokens (blank = no login needed)")
+	pInsecure := flag.Bool("insecure", false, "Without -users, let anyone use the controls and the engineer commands that toggle coils and write registers")
+	pAnonymousRole := flag.String("anonymousrole", "none", "Role given to requests without credentials: none, viewer, operator or engineer")
+	pAllowOrigins := flag.String("alloworigins", "", "Comma separated list of other origins allowed to open websockets, e.g. https://dashboard.local")
+	pAddUser := flag.String("adduser", "", "Add or update a user as name:role, reading the password from stdin, then exit")
+	pAddToken := flag.String("addtoken", "", "Create an API token for the named user, print it, then exit")
+	pTLS := flag.Bool("tls", false, "Serve HTTPS on -httpsaddr. Logins are then only accepted over HTTPS")
+	pTLSCert := flag.String("tlscert", "/var/lib/BatteryMonitor/cert.pem", "HTTPS certificate file. A self-signed one is made if it and the key do not exist")
+	pTLSKey := flag.String("tlskey", "/var/lib/BatteryMonitor/key.pem", "HTTPS private key file")
+	pHTTPSAddress := flag.String("httpsaddr", ":8443", "Address for the HTTPS server")
+	pRedirect := flag.Bool("httpsredirect", true, "Redirect plain HTTP requests to HTTPS when -tls is set")
 
 	flag.Parse()
+	if runUserCommands(*pUsers, *pAddUser, *pAddToken) {
+		os.Exit(0)
+	}
+	startAuth(*pUsers, *pAnonymousRole, *pAllowOrigins, *pInsecure)
+	configureHTTPS(*pTLS, *pTLSCert, *pTLSKey, *pHTTPSAddress, *pRedirect)
+	if *pTLS {
+		authenticator.RequireTLS()
+	}
+	buildColumnLists()
+	startExporter(*pExport, *pExportFormat, *pExportToken, *pExportBatch, *pExportBuffer, time.Duration(*pExportInterval)*time.Second)
+	startNotifier(*pNotify)
+	startAlarms(*pAlarmRules)
+	startCellAnalytics(*pCellBand, *pWeakWindows, *pDischargeAmps)
+	startResistanceEstimator(*pResistanceStep, *pResistanceRising/100)
+	startStateOfHealth(*pRatedCapacity, *pDeepDischarge)
+	startSOCEstimator(*pRestCurve, *pRestAmps)
+	startEnergyMeter()
+	startReports(*pReportHour, *pEmailReports)
+	startRetention(*pArchiveAfter, *pPurgeAfter, *pArchiveWindow, *pArchiveBatch)
+	startMQTT(*pMQTTBroker, *pMQTTClientID, *pMQTTUser, *pMQTTPassword, *pMQTTPrefix, *pMQTTDiscovery)
+	if *pSimulate {
+		startSimulator(*pSimDatabase, *pBufferFile, *pSimCapacity, *pSimCharge, *pSimLoad, *pSimSolar, uint8(*pSlave1Address), uint8(*pSlave2Address))
+		startDatabaseJobs()
+		return
+	}
 	// Initialise the SPI subsystem
 	if _, err := host.Init(); err != nil {
 		log.Fatal(err)
@@ -1104,19 +1220,83 @@ func init() {
 	}
 	nErrors = 0
 
-	// Set up the database connection
-	pDB, err = connectToDatabase()
-	if err != nil {
-		log.Fatalf("Failed to connect to to the database - %s - Sorry, I am giving up.", err)
+	// Set up the database connection. Keep trying until the database server is available.
+	for {
+		store, err = connectToDatabase(*pStoreType, *pSQLitePath)
+		if err == nil {
+			break
+		}
+		log.Println("Failed to connect to to the database - ", err, " - trying again in 10 seconds.")
+		time.Sleep(10 * time.Second)
 	}
+	startQueue(*pBufferFile)
 	// Set up the modbus serial comms to communicate with the current sensors and relays
-	fuelgauge = FuelGauge.New(*pCommsPort, *pBaudRate, *pDataBits, *pStopBits, *pParity, time.Duration(*pTimeoutMilliSecs)*time.Millisecond, pDB, uint8(*pSlave1Address), uint8(*pSlave2Address))
+	fuelgauge = FuelGauge.New(*pCommsPort, *pBaudRate, *pDataBits, *pStopBits, *pParity, time.Duration(*pTimeoutMilliSecs)*time.Millisecond, store, dbQueue, uint8(*pSlave1Address), uint8(*pSlave2Address))
+	fuelgauge.SetNotifier(notifier)
+	fuelgauge.ReadSystemParameters()
+	go fuelgauge.Run()
+	startDatabaseJobs()
+}
+
+/**
+Start the background jobs that work on the database. Called once store is connected and before the web server starts.
+*/
+func startDatabaseJobs() {
+	startHealthTracker()
+	startReportScheduler()
+	startRetentionJob()
+}
+
+/**
+Build the simulated system and connect to it in place of the hardware and the MySQL database.
+*/
+func startSimulator(database string, bufferFile string, capacity float64, startCharge float64, load string, solar float64, slave1Address uint8, slave2Address uint8) {
+	const efficiency = 0.9
+	var loadProfile []float64
+	for _, sAmps := range strings.Split(load, ",") {
+		amps, err := strconv.ParseFloat(strings.TrimSpace(sAmps), 64)
+		if err != nil {
+			log.Fatalf("Invalid simulated load '%s' - %s", sAmps, err)
+		}
+		loadProfile = append(loadProfile, amps)
+	}
+	simulator = Simulator.New(Simulator.Settings{
+		Capacity:     capacity,
+		StartCharge:  startCharge / 100.0,
+		LoadProfile:  loadProfile,
+		SolarPeak:    solar,
+		LeftAddress:  slave1Address,
+		RightAddress: slave2Address,
+		Efficiency:   efficiency,
+	})
+	log.Println("Simulation mode - using", database, "as the database")
+	spiConnection = simulator.SPIConnection()
+	nErrors = 0
+
+	sqliteStore, err := Storage.OpenSQLite(database)
+	if err != nil {
+		log.Fatalf("Failed to open the simulator database - %s - Sorry, I am giving up.", err)
+	}
+	// Match the battery parameters to the simulated banks
+	for bank := 0; bank < 2; bank++ {
+		if err = sqliteStore.SetParameterInt(fmt.Sprintf("capacity_%d", bank), int64(capacity)); err == nil {
+			err = sqliteStore.SetParameterFloat(fmt.Sprintf("charge%d_efficiency", bank), efficiency)
+		}
+		if err != nil {
+			log.Fatalf("Failed to set up the simulator database - %s - Sorry, I am giving up.", err)
+		}
+	}
+	store = sqliteStore
+	startQueue(bufferFile)
+	fuelgauge = FuelGauge.NewWithController(ModbusController.NewSimulated(simulator.ModbusTransporter()), store, dbQueue, slave1Address, slave2Address)
+	fuelgauge.SetNotifier(notifier)
 	fuelgauge.ReadSystemParameters()
+	go simulator.Run()
 	go fuelgauge.Run()
 }
 
 /*
-	WEB Service to return the version information
+WEB Service to return the version information
 */
 func getVersion(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
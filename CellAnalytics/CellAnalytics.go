@@ -0,0 +1,380 @@
+package CellAnalytics
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The longest window the weakest cell ranking can be kept over
+const MaxWindow = 31 * 24 * time.Hour
+
+/**
+Config sets how the cells are judged. Band is how far in volts a cell may be from its bank's median before it counts as
+outside the band. Windows are the periods the weakest cell ranking is kept over, in whole hours. The bank is taken to
+be discharging when its current is below -DischargeAmps.
+*/
+type Config struct {
+	Band          float64
+	Windows       []time.Duration
+	DischargeAmps float64
+}
+
+/**
+CellStat is one cell's place in its bank this cycle. Deviation is from the bank mean in volts.
+*/
+type CellStat struct {
+	Cell      int     `json:"cell"`
+	Volts     float64 `json:"volts"`
+	Deviation float64 `json:"deviation"`
+	ZScore    float64 `json:"z_score"`
+	OutOfBand bool    `json:"out_of_band"`
+}
+
+/**
+BankStats describes the spread of the cell voltages in a bank. Cells reading zero are treated as not fitted and left out.
+*/
+type BankStats struct {
+	Bank        int        `json:"bank"`
+	Cells       int        `json:"cells"`
+	Amps        float64    `json:"amps"`
+	Discharging bool       `json:"discharging"`
+	Min         float64    `json:"min"`
+	MinCell     int        `json:"min_cell"`
+	Max         float64    `json:"max"`
+	MaxCell     int        `json:"max_cell"`
+	Mean        float64    `json:"mean"`
+	Median      float64    `json:"median"`
+	Spread      float64    `json:"spread"`
+	StdDev      float64    `json:"std_dev"`
+	OutOfBand   int        `json:"out_of_band"`
+	CellStats   []CellStat `json:"cell_stats"`
+}
+
+/**
+CellRank is a cell's place in the weakest cell ranking. The weakest cell is the one furthest below the bank mean on
+average while the bank is discharging, i.e. the first to reach low voltage. TimesLowest counts the cycles it was the
+lowest cell in the bank.
+*/
+type CellRank struct {
+	Cell          int     `json:"cell"`
+	Rank          int     `json:"rank"`
+	Samples       int     `json:"samples"`
+	MeanDeviation float64 `json:"mean_deviation"`
+	MeanZScore    float64 `json:"mean_z_score"`
+	TimesLowest   int     `json:"times_lowest"`
+	MinVolts      float64 `json:"min_volts"`
+	MaxVolts      float64 `json:"max_volts"`
+}
+
+/**
+Ranking is the weakest cell ranking of each bank over one window
+*/
+type Ranking struct {
+	Window string        `json:"window"`
+	Banks  [2][]CellRank `json:"banks"`
+}
+
+/**
+Report is everything /cells/analytics returns
+*/
+type Report struct {
+	Time    time.Time    `json:"time"`
+	Band    float64      `json:"band"`
+	Banks   [2]BankStats `json:"banks"`
+	Weakest []Ranking    `json:"weakest"`
+}
+
+// What has been seen of one cell while its bank was discharging
+type cellTally struct {
+	samples   int
+	deviation float64
+	zScore    float64
+	lowest    int
+	minVolts  float64
+	maxVolts  float64
+}
+
+func (tally *cellTally) add(other cellTally) {
+	if other.samples == 0 {
+		return
+	}
+	if tally.samples == 0 || other.minVolts < tally.minVolts {
+		tally.minVolts = other.minVolts
+	}
+	if tally.samples == 0 || other.maxVolts > tally.maxVolts {
+		tally.maxVolts = other.maxVolts
+	}
+	tally.samples += other.samples
+	tally.deviation += other.deviation
+	tally.zScore += other.zScore
+	tally.lowest += other.lowest
+}
+
+// Tallies for every cell over one period, an hour for the windows or a day for the daily record
+type period struct {
+	start time.Time
+	cells [2][]cellTally
+}
+
+func newPeriod(start time.Time, cellsPerBank int) *period {
+	p := &period{start: start}
+	for bank := range p.cells {
+		p.cells[bank] = make([]cellTally, cellsPerBank)
+	}
+	return p
+}
+
+func (p *period) add(stats BankStats) {
+	for _, cell := range stats.CellStats {
+		lowest := 0
+		if cell.Cell == stats.MinCell {
+			lowest = 1
+		}
+		p.cells[stats.Bank][cell.Cell-1].add(cellTally{samples: 1, deviation: cell.Deviation, zScore: cell.ZScore, lowest: lowest,
+			minVolts: cell.Volts, maxVolts: cell.Volts})
+	}
+}
+
+/**
+Analyser works out the bank statistics each cycle and keeps the weakest cell ranking. The ranking is kept in hourly
+tallies for the windows and a tally for the day, which is passed to saveDay when the day ends. The tallies are only in
+memory so a restart starts them again.
+*/
+type Analyser struct {
+	mu           sync.Mutex
+	config       Config
+	cellsPerBank int
+	latest       [2]BankStats
+	updated      time.Time
+	hours        []*period
+	day          *period
+	saveDay      func(day time.Time, banks [2][]CellRank)
+}
+
+/**
+New returns an analyser for banks of cellsPerBank cells. saveDay is called with the day's ranking when each day ends.
+*/
+func New(config Config, cellsPerBank int, saveDay func(day time.Time, banks [2][]CellRank)) *Analyser {
+	sort.Slice(config.Windows, func(i, j int) bool { return config.Windows[i] < config.Windows[j] })
+	return &Analyser{config: config, cellsPerBank: cellsPerBank, saveDay: saveDay}
+}
+
+/**
+ParseWindows reads a comma separated list of windows such as 1h,24h,168h. Windows are whole hours up to MaxWindow.
+*/
+func ParseWindows(value string) ([]time.Duration, error) {
+	var windows []time.Duration
+	for _, sWindow := range strings.Split(value, ",") {
+		window, err := time.ParseDuration(strings.TrimSpace(sWindow))
+		if err != nil {
+			return nil, err
+		}
+		if window < time.Hour || window > MaxWindow || window%time.Hour != 0 {
+			return nil, fmt.Errorf("window %s must be a whole number of hours between 1h and %s", sWindow, MaxWindow)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+/**
+Compute the statistics for one bank. volts holds the cells in order, zero for cells not fitted. The z-scores are zero if
+all the cells read the same.
+*/
+func Compute(bank int, volts []float64, amps float64, config Config) BankStats {
+	stats := BankStats{Bank: bank, Amps: amps, Discharging: amps < -config.DischargeAmps, CellStats: []CellStat{}}
+	var fitted []float64
+	for cell, v := range volts {
+		if v == 0 {
+			continue
+		}
+		fitted = append(fitted, v)
+		stats.CellStats = append(stats.CellStats, CellStat{Cell: cell + 1, Volts: v})
+		if stats.Cells == 0 || v < stats.Min {
+			stats.Min, stats.MinCell = v, cell+1
+		}
+		if stats.Cells == 0 || v > stats.Max {
+			stats.Max, stats.MaxCell = v, cell+1
+		}
+		stats.Cells++
+		stats.Mean += v
+	}
+	if stats.Cells == 0 {
+		return stats
+	}
+	stats.Mean /= float64(stats.Cells)
+	stats.Spread = stats.Max - stats.Min
+	sort.Float64s(fitted)
+	if middle := len(fitted) / 2; len(fitted)%2 == 0 {
+		stats.Median = (fitted[middle-1] + fitted[middle]) / 2
+	} else {
+		stats.Median = fitted[middle]
+	}
+	for _, v := range fitted {
+		stats.StdDev += (v - stats.Mean) * (v - stats.Mean)
+	}
+	stats.StdDev = math.Sqrt(stats.StdDev / float64(stats.Cells))
+	for i := range stats.CellStats {
+		cell := &stats.CellStats[i]
+		cell.Deviation = cell.Volts - stats.Mean
+		if stats.StdDev > 0 {
+			cell.ZScore = cell.Deviation / stats.StdDev
+		}
+		if math.Abs(cell.Volts-stats.Median) > config.Band {
+			cell.OutOfBand = true
+			stats.OutOfBand++
+		}
+	}
+	return stats
+}
+
+/**
+Update the statistics with this cycle's cell voltages and bank currents. Discharging cycles are added to the weakest
+cell tallies. The first update of a new day hands the day before to saveDay.
+*/
+func (analyser *Analyser) Update(now time.Time, volts [2][]float64, amps [2]float64) {
+	analyser.mu.Lock()
+	defer analyser.mu.Unlock()
+	for bank := range volts {
+		analyser.latest[bank] = Compute(bank, volts[bank], amps[bank], analyser.config)
+	}
+	analyser.updated = now
+
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if analyser.day != nil && !analyser.day.start.Equal(dayStart) {
+		if analyser.saveDay != nil {
+			analyser.saveDay(analyser.day.start, analyser.rank(analyser.day.cells))
+		}
+		analyser.day = nil
+	}
+	if analyser.day == nil {
+		analyser.day = newPeriod(dayStart, analyser.cellsPerBank)
+	}
+	hourStart := now.Truncate(time.Hour)
+	if len(analyser.hours) == 0 || !analyser.hours[len(analyser.hours)-1].start.Equal(hourStart) {
+		analyser.hours = append(analyser.hours, newPeriod(hourStart, analyser.cellsPerBank))
+	}
+	// Drop the hours that have left the longest window
+	if len(analyser.config.Windows) > 0 {
+		oldest := hourStart.Add(time.Hour - analyser.config.Windows[len(analyser.config.Windows)-1])
+		for len(analyser.hours) > 0 && analyser.hours[0].start.Before(oldest) {
+			analyser.hours = analyser.hours[1:]
+		}
+	}
+	for _, stats := range analyser.latest {
+		if stats.Discharging && stats.Cells > 0 {
+			analyser.hours[len(analyser.hours)-1].add(stats)
+			analyser.day.add(stats)
+		}
+	}
+}
+
+/**
+Rank the cells of each bank, weakest first. Cells never seen discharging are left out.
+*/
+func (analyser *Analyser) rank(cells [2][]cellTally) [2][]CellRank {
+	var banks [2][]CellRank
+	for bank, tallies := range cells {
+		ranks := []CellRank{}
+		for cell, tally := range tallies {
+			if tally.samples == 0 {
+				continue
+			}
+			ranks = append(ranks, CellRank{
+				Cell:          cell + 1,
+				Samples:       tally.samples,
+				MeanDeviation: tally.deviation / float64(tally.samples),
+				MeanZScore:    tally.zScore / float64(tally.samples),
+				TimesLowest:   tally.lowest,
+				MinVolts:      tally.minVolts,
+				MaxVolts:      tally.maxVolts,
+			})
+		}
+		sort.SliceStable(ranks, func(i, j int) bool {
+			if ranks[i].MeanDeviation != ranks[j].MeanDeviation {
+				return ranks[i].MeanDeviation < ranks[j].MeanDeviation
+			}
+			return ranks[i].TimesLowest > ranks[j].TimesLowest
+		})
+		for i := range ranks {
+			ranks[i].Rank = i + 1
+		}
+		banks[bank] = ranks
+	}
+	return banks
+}
+
+/**
+Return the latest statistics of both banks
+*/
+func (analyser *Analyser) Stats() [2]BankStats {
+	analyser.mu.Lock()
+	defer analyser.mu.Unlock()
+	return analyser.latest
+}
+
+/**
+Return the latest statistics and the weakest cell ranking over each window. The current hour counts as a whole hour.
+*/
+func (analyser *Analyser) Report() Report {
+	analyser.mu.Lock()
+	defer analyser.mu.Unlock()
+	report := Report{Time: analyser.updated, Band: analyser.config.Band, Banks: analyser.latest, Weakest: []Ranking{}}
+	for _, window := range analyser.config.Windows {
+		var cells [2][]cellTally
+		for bank := range cells {
+			cells[bank] = make([]cellTally, analyser.cellsPerBank)
+		}
+		if len(analyser.hours) > 0 {
+			oldest := analyser.hours[len(analyser.hours)-1].start.Add(time.Hour - window)
+			for _, hour := range analyser.hours {
+				if hour.start.Before(oldest) {
+					continue
+				}
+				for bank := range cells {
+					for cell := range cells[bank] {
+						cells[bank][cell].add(hour.cells[bank][cell])
+					}
+				}
+			}
+		}
+		report.Weakest = append(report.Weakest, Ranking{Window: windowName(window), Banks: analyser.rank(cells)})
+	}
+	return report
+}
+
+func windowName(window time.Duration) string {
+	if window%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", window/(24*time.Hour))
+	}
+	return fmt.Sprintf("%dh", window/time.Hour)
+}
+
+/**
+Turn a day's ranking into rows for the cell_analytics table. Cells are numbered as in the database, 1..38 in bank 0
+and 101..138 in bank 1.
+*/
+func DailyRows(day time.Time, banks [2][]CellRank) []Storage.CellAnalyticsDay {
+	var rows []Storage.CellAnalyticsDay
+	for bank, ranks := range banks {
+		for _, rank := range ranks {
+			rows = append(rows, Storage.CellAnalyticsDay{
+				Day:           day,
+				Cell:          bank*100 + rank.Cell,
+				Samples:       rank.Samples,
+				MeanDeviation: rank.MeanDeviation,
+				MeanZScore:    rank.MeanZScore,
+				TimesLowest:   rank.TimesLowest,
+				Rank:          rank.Rank,
+				MinVolts:      rank.MinVolts,
+				MaxVolts:      rank.MaxVolts,
+			})
+		}
+	}
+	return rows
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/CellAnalytics"
+	"BatteryMonitor6813V4/Storage"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Most days /cells/analytics/daily returns in one go
+const maxAnalyticsDays = 366
+
+var cellAnalyser *CellAnalytics.Analyser
+
+/**
+Set up the cell analytics. band is how far in volts a cell may be from the bank median, windows the comma separated
+periods to rank the weakest cells over and dischargeAmps the current a bank must be discharging at to be ranked.
+*/
+func startCellAnalytics(band float64, windows string, dischargeAmps float64) {
+	config := CellAnalytics.Config{Band: band, DischargeAmps: dischargeAmps}
+	var err error
+	if config.Windows, err = CellAnalytics.ParseWindows(windows); err != nil {
+		log.Fatalf("Invalid weakest cell windows - %s - Sorry, I am giving up.", err)
+	}
+	cellAnalyser = CellAnalytics.New(config, cellsPerBank, saveCellAnalytics)
+}
+
+/**
+Write a finished day's weakest cell ranking to the cell_analytics table
+*/
+func saveCellAnalytics(day time.Time, banks [2][]CellAnalytics.CellRank) {
+	for _, row := range CellAnalytics.DailyRows(day, banks) {
+		if err := dbQueue.Insert(Storage.CellAnalyticsTable, Storage.CellAnalyticsColumns, row.Values()...); err != nil {
+			log.Println("Failed to save the cell analytics for", day.Format("2006-01-02"), "-", err)
+			return
+		}
+	}
+}
+
+/**
+Update the cell statistics with this cycle's readings
+*/
+func analyseCells() {
+	if cellAnalyser == nil || ltc == nil || nDevices == 0 || fuelgauge == nil {
+		return
+	}
+	volts := [2][]float64{cellVolts(0), cellVolts(1)}
+	amps := [2]float64{float64(fuelgauge.CurrentLeft()), float64(fuelgauge.CurrentRight())}
+	cellAnalyser.Update(time.Now(), volts, amps)
+}
+
+/**
+Spread, outliers and z-scores of the cells in each bank from the latest readings, with the weakest cell ranking over
+each window.
+/cells/analytics
+*/
+func webGetCellAnalytics(w http.ResponseWriter, _ *http.Request) {
+	setHeaders(w)
+	if cellAnalyser == nil {
+		ReturnJSONErrorString(w, "Cell Analytics", "cell analytics are not running", http.StatusServiceUnavailable, false)
+		return
+	}
+	returnJSON(w, cellAnalyser.Report())
+}
+
+/**
+The daily weakest cell rankings between start and end (yyyy-mm-dd). Defaults to the last 30 days.
+/cells/analytics/daily?start=2022-06-01&end=2022-06-30
+*/
+func webGetCellAnalyticsDaily(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	end := time.Now()
+	start := end.AddDate(0, 0, -30)
+	var err error
+	if value := r.FormValue("start"); value != "" {
+		if start, err = time.ParseInLocation("2006-1-2", value, time.Local); err != nil {
+			ReturnJSONErrorString(w, "Cell Analytics", "start must be yyyy-mm-dd", http.StatusBadRequest, false)
+			return
+		}
+	}
+	if value := r.FormValue("end"); value != "" {
+		if end, err = time.ParseInLocation("2006-1-2", value, time.Local); err != nil {
+			ReturnJSONErrorString(w, "Cell Analytics", "end must be yyyy-mm-dd", http.StatusBadRequest, false)
+			return
+		}
+	}
+	if end.Before(start) || end.Sub(start) > maxAnalyticsDays*24*time.Hour {
+		ReturnJSONErrorString(w, "Cell Analytics", "end must be after start and at most a year later", http.StatusBadRequest, false)
+		return
+	}
+	days, err := store.GetCellAnalytics(start, end)
+	if err != nil {
+		ReturnJSONError(w, "Cell Analytics", err, http.StatusInternalServerError, true)
+		return
+	}
+	if days == nil {
+		days = []Storage.CellAnalyticsDay{}
+	}
+	returnJSON(w, days)
+}
@@ -0,0 +1,322 @@
+package CellResistance
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Readings before a step that must be steady for it to be used
+	steadySamples = 5
+	// How far the current may wander and still be steady
+	steadyAmps = 2.0
+	// Readings further apart than this cannot be used together
+	maxGap = 3 * time.Second
+	// The smallest voltage change the LTC6813 can see
+	voltResolution = 0.0001
+	// Trends need this many estimates over at least minTrendSpan
+	minTrendPoints = 10
+	minTrendSpan   = 7 * 24 * time.Hour
+	month          = 30 * 24 * time.Hour
+)
+
+/**
+Config sets which current steps are used and when a cell is flagged. MinStep is the smallest change in bank current
+in amps that is used and estimates less confident than MinConfidence are dropped. A cell is flagged if its resistance
+is rising by more than RisingPerMonth (0.1 = 10%) a month.
+*/
+type Config struct {
+	MinStep        float64
+	MinConfidence  float64
+	RisingPerMonth float64
+}
+
+/**
+Estimate is one cell's resistance worked out from one current step. Confidence runs from 0 (no better than noise) to
+1, from how big the voltage change was compared with the noise on the readings.
+*/
+type Estimate struct {
+	Time        time.Time `json:"time"`
+	Bank        int       `json:"bank"`
+	Cell        int       `json:"cell"`
+	Milliohms   float64   `json:"milliohms"`
+	Uncertainty float64   `json:"uncertainty"`
+	Confidence  float64   `json:"confidence"`
+	StepAmps    float64   `json:"step_amps"`
+}
+
+/**
+Trend is how a cell's resistance has moved over the trend window. Milliohms is the average over the window and
+SlopePerMonth the change a month as a fraction of the resistance at the start of the window.
+*/
+type Trend struct {
+	Cell          int     `json:"cell"`
+	Estimates     int     `json:"estimates"`
+	Days          float64 `json:"days"`
+	Milliohms     float64 `json:"milliohms"`
+	SlopePerMonth float64 `json:"slope_per_month"`
+	Rising        bool    `json:"rising"`
+}
+
+type sample struct {
+	time  time.Time
+	amps  float64
+	volts []float64
+}
+
+// A step that has been seen and is waiting for the next reading to show the current has stayed there
+type pendingStep struct {
+	before []sample
+	after  sample
+}
+
+/**
+Estimator watches each bank for steps in the current and works out the resistance of each cell from the change in
+its voltage, R = dV/dI. Only steps from a steady current that hold for a second reading are used so the slow change
+of the cell voltage as it charges or discharges does not get counted.
+*/
+type Estimator struct {
+	mu      sync.Mutex
+	config  Config
+	history [2][]sample
+	pending [2]*pendingStep
+	latest  [2][]*Estimate
+	trends  map[int]Trend
+	save    func(estimates []Estimate)
+}
+
+/**
+New returns an estimator for banks of cellsPerBank cells. save is called with the estimates from each step that pass
+MinConfidence.
+*/
+func New(config Config, cellsPerBank int, save func(estimates []Estimate)) *Estimator {
+	estimator := &Estimator{config: config, save: save, trends: make(map[int]Trend)}
+	for bank := range estimator.latest {
+		estimator.latest[bank] = make([]*Estimate, cellsPerBank)
+	}
+	return estimator
+}
+
+/**
+Add this cycle's cell voltages and bank currents
+*/
+func (estimator *Estimator) Update(now time.Time, volts [2][]float64, amps [2]float64) {
+	estimator.mu.Lock()
+	var estimates []Estimate
+	for bank := range volts {
+		estimates = append(estimates, estimator.updateBank(bank, sample{time: now, amps: amps[bank], volts: volts[bank]})...)
+	}
+	estimator.mu.Unlock()
+	if len(estimates) > 0 && estimator.save != nil {
+		estimator.save(estimates)
+	}
+}
+
+func (estimator *Estimator) updateBank(bank int, s sample) []Estimate {
+	history := estimator.history[bank]
+	if len(history) > 0 && s.time.Sub(history[len(history)-1].time) > maxGap {
+		history = nil
+	}
+	if pending := estimator.pending[bank]; pending != nil {
+		estimator.pending[bank] = nil
+		if s.time.Sub(pending.after.time) <= maxGap && math.Abs(s.amps-pending.after.amps) <= steadyAmps {
+			estimator.history[bank] = []sample{pending.after, s}
+			return estimator.estimate(bank, pending.before, []sample{pending.after, s})
+		}
+		estimator.history[bank] = []sample{s}
+		return nil
+	}
+	if len(history) == steadySamples && steady(history) && math.Abs(s.amps-meanAmps(history)) >= estimator.config.MinStep {
+		estimator.pending[bank] = &pendingStep{before: history, after: s}
+		estimator.history[bank] = nil
+		return nil
+	}
+	history = append(history, s)
+	if len(history) > steadySamples {
+		history = history[len(history)-steadySamples:]
+	}
+	estimator.history[bank] = history
+	return nil
+}
+
+func steady(samples []sample) bool {
+	low, high := samples[0].amps, samples[0].amps
+	for _, s := range samples {
+		low = math.Min(low, s.amps)
+		high = math.Max(high, s.amps)
+	}
+	return high-low <= steadyAmps
+}
+
+func meanAmps(samples []sample) float64 {
+	total := 0.0
+	for _, s := range samples {
+		total += s.amps
+	}
+	return total / float64(len(samples))
+}
+
+/**
+Return the mean and standard deviation of one cell's voltage over the samples
+*/
+func cellVolts(samples []sample, cell int) (mean float64, deviation float64) {
+	for _, s := range samples {
+		mean += s.volts[cell]
+	}
+	mean /= float64(len(samples))
+	for _, s := range samples {
+		deviation += (s.volts[cell] - mean) * (s.volts[cell] - mean)
+	}
+	return mean, math.Sqrt(deviation / float64(len(samples)))
+}
+
+/**
+Work out the resistance of each cell across a step. The noise on each cell is taken from its readings before the step,
+but never less than the resolution of the LTC6813.
+*/
+func (estimator *Estimator) estimate(bank int, before []sample, after []sample) []Estimate {
+	stepAmps := meanAmps(after) - meanAmps(before)
+	when := after[len(after)-1].time
+	var estimates []Estimate
+	for cell := range estimator.latest[bank] {
+		if cell >= len(after[0].volts) || before[0].volts[cell] == 0 || after[0].volts[cell] == 0 {
+			continue
+		}
+		voltsBefore, noise := cellVolts(before, cell)
+		voltsAfter, _ := cellVolts(after, cell)
+		noise = math.Max(noise, voltResolution)
+		resistance := (voltsAfter - voltsBefore) / stepAmps
+		uncertainty := noise * math.Sqrt(1/float64(len(before))+1/float64(len(after))) / math.Abs(stepAmps)
+		confidence := 0.0
+		if resistance > 0 {
+			confidence = math.Max(0, 1-(uncertainty/resistance))
+		}
+		estimate := Estimate{Time: when, Bank: bank, Cell: cell + 1, Milliohms: resistance * 1000, Uncertainty: uncertainty * 1000,
+			Confidence: confidence, StepAmps: stepAmps}
+		if confidence >= estimator.config.MinConfidence {
+			estimator.latest[bank][cell] = &estimate
+			estimates = append(estimates, estimate)
+		}
+	}
+	return estimates
+}
+
+/**
+Return the latest estimate for each cell. Cells with no estimate yet are nil.
+*/
+func (estimator *Estimator) Latest() [2][]*Estimate {
+	estimator.mu.Lock()
+	defer estimator.mu.Unlock()
+	var latest [2][]*Estimate
+	for bank := range latest {
+		latest[bank] = append([]*Estimate(nil), estimator.latest[bank]...)
+	}
+	return latest
+}
+
+/**
+Fit the trend of each cell to the stored estimates, each weighted by its confidence. Returns the cells that have started
+rising since the last time.
+*/
+func (estimator *Estimator) UpdateTrends(history []Storage.CellResistance) (newlyRising []Trend) {
+	byCell := make(map[int][]Storage.CellResistance)
+	for _, point := range history {
+		byCell[point.Cell] = append(byCell[point.Cell], point)
+	}
+	trends := make(map[int]Trend)
+	for cell, points := range byCell {
+		trends[cell] = FitTrend(cell, points, estimator.config.RisingPerMonth)
+	}
+	estimator.mu.Lock()
+	defer estimator.mu.Unlock()
+	for cell, trend := range trends {
+		if trend.Rising && !estimator.trends[cell].Rising {
+			newlyRising = append(newlyRising, trend)
+		}
+	}
+	estimator.trends = trends
+	return newlyRising
+}
+
+/**
+Return the latest trend of every cell that has estimates, in cell order
+*/
+func (estimator *Estimator) Trends() []Trend {
+	estimator.mu.Lock()
+	defer estimator.mu.Unlock()
+	trends := []Trend{}
+	for _, trend := range estimator.trends {
+		trends = append(trends, trend)
+	}
+	sort.Slice(trends, func(i, j int) bool { return trends[i].Cell < trends[j].Cell })
+	return trends
+}
+
+/**
+Fit a straight line through one cell's estimates by weighted least squares. The cell is rising if there are enough
+estimates over a long enough time and the resistance is going up by more than risingPerMonth a month.
+*/
+func FitTrend(cell int, points []Storage.CellResistance, risingPerMonth float64) Trend {
+	trend := Trend{Cell: cell, Estimates: len(points)}
+	if len(points) == 0 {
+		return trend
+	}
+	first, last := points[0].Logged, points[0].Logged
+	var sumW, sumX, sumY float64
+	for _, point := range points {
+		if point.Logged.Before(first) {
+			first = point.Logged
+		}
+		if point.Logged.After(last) {
+			last = point.Logged
+		}
+	}
+	for _, point := range points {
+		x := point.Logged.Sub(first).Hours() / month.Hours()
+		sumW += point.Confidence
+		sumX += point.Confidence * x
+		sumY += point.Confidence * point.Milliohms
+	}
+	trend.Days = last.Sub(first).Hours() / 24
+	if sumW == 0 {
+		return trend
+	}
+	meanX, meanY := sumX/sumW, sumY/sumW
+	trend.Milliohms = meanY
+	var sXY, sXX float64
+	for _, point := range points {
+		x := point.Logged.Sub(first).Hours() / month.Hours()
+		sXY += point.Confidence * (x - meanX) * (point.Milliohms - meanY)
+		sXX += point.Confidence * (x - meanX) * (x - meanX)
+	}
+	if sXX == 0 {
+		return trend
+	}
+	slope := sXY / sXX
+	if start := meanY - (slope * meanX); start > 0 {
+		trend.SlopePerMonth = slope / start
+	}
+	trend.Rising = len(points) >= minTrendPoints && last.Sub(first) >= minTrendSpan && trend.SlopePerMonth > risingPerMonth
+	return trend
+}
+
+/**
+Turn estimates into rows for the cell_resistance table with cells numbered as in the database
+*/
+func Rows(estimates []Estimate) []Storage.CellResistance {
+	var rows []Storage.CellResistance
+	for _, estimate := range estimates {
+		rows = append(rows, Storage.CellResistance{
+			Logged:      estimate.Time,
+			Cell:        estimate.Bank*100 + estimate.Cell,
+			Milliohms:   estimate.Milliohms,
+			Uncertainty: estimate.Uncertainty,
+			Confidence:  estimate.Confidence,
+			StepAmps:    estimate.StepAmps,
+		})
+	}
+	return rows
+}
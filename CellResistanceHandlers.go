@@ -0,0 +1,142 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/CellResistance"
+	"BatteryMonitor6813V4/Notifier"
+	"BatteryMonitor6813V4/Storage"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Estimates less certain than this are not kept
+	minResistanceConfidence = 0.5
+	// The trends are fitted to this much history
+	resistanceTrendWindow = 90 * 24 * time.Hour
+	// and refitted this often
+	resistanceTrendInterval = time.Hour
+)
+
+var resistanceEstimator *CellResistance.Estimator
+
+/**
+Start estimating the cell resistances from steps of at least minStep amps. Cells whose resistance is rising by more than
+risingPerMonth (0.1 = 10%) a month are flagged.
+*/
+func startResistanceEstimator(minStep float64, risingPerMonth float64) {
+	if minStep <= 0 {
+		log.Fatalf("Invalid resistance step %f - it must be more than zero - Sorry, I am giving up.", minStep)
+	}
+	resistanceEstimator = CellResistance.New(CellResistance.Config{
+		MinStep:        minStep,
+		MinConfidence:  minResistanceConfidence,
+		RisingPerMonth: risingPerMonth,
+	}, cellsPerBank, saveResistance)
+	go func() {
+		for {
+			time.Sleep(resistanceTrendInterval)
+			updateResistanceTrends()
+		}
+	}()
+}
+
+/**
+Write the estimates from a step to the cell_resistance table
+*/
+func saveResistance(estimates []CellResistance.Estimate) {
+	for _, row := range CellResistance.Rows(estimates) {
+		if err := dbQueue.Insert(Storage.CellResistanceTable, Storage.CellResistanceColumns, row.Values()...); err != nil {
+			log.Println("Failed to save the resistance of cell", row.Cell, "-", err)
+			return
+		}
+	}
+}
+
+/**
+Refit the resistance trends and send a notice for any cell that has started rising
+*/
+func updateResistanceTrends() {
+	if store == nil {
+		return
+	}
+	end := time.Now()
+	history, err := store.GetCellResistance(end.Add(-resistanceTrendWindow), end, 0)
+	if err != nil {
+		log.Println("Failed to read the cell resistance history -", err)
+		return
+	}
+	for _, trend := range resistanceEstimator.UpdateTrends(history) {
+		notifier.Notice(Notifier.Warning, "Cell Resistance", fmt.Sprintf("The resistance of cell %d is rising by %.0f%% a month, averaging %.2f milliohms",
+			trend.Cell, trend.SlopePerMonth*100, trend.Milliohms))
+	}
+}
+
+/**
+Add this cycle's readings to the resistance estimator
+*/
+func estimateResistance() {
+	if resistanceEstimator == nil || ltc == nil || nDevices == 0 || fuelgauge == nil {
+		return
+	}
+	volts := [2][]float64{cellVolts(0), cellVolts(1)}
+	amps := [2]float64{float64(fuelgauge.CurrentLeft()), float64(fuelgauge.CurrentRight())}
+	resistanceEstimator.Update(time.Now(), volts, amps)
+}
+
+/**
+The latest resistance estimate of every cell with the trend of each over the last 90 days. Cells in the trends are
+numbered as in the database, 1..38 and 101..138.
+/cells/resistance
+*/
+func webGetCellResistance(w http.ResponseWriter, _ *http.Request) {
+	setHeaders(w)
+	if resistanceEstimator == nil {
+		ReturnJSONErrorString(w, "Cell Resistance", "the resistance estimator is not running", http.StatusServiceUnavailable, false)
+		return
+	}
+	returnJSON(w, APICellResistance{Latest: resistanceEstimator.Latest(), Trends: resistanceEstimator.Trends()})
+}
+
+/**
+The resistance estimates of one cell (1..38 or 101..138) between start and end. Defaults to the last 30 days.
+/cells/resistance/107?start=2022-06-01 00:00&end=2022-07-01 00:00
+*/
+func webGetCellResistanceHistory(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	cell, err := strconv.Atoi(mux.Vars(r)["cell"])
+	if err != nil || cell == 0 {
+		ReturnJSONErrorString(w, "Cell Resistance", "cell must be 1..38 or 101..138", http.StatusBadRequest, false)
+		return
+	}
+	end := time.Now()
+	start := end.AddDate(0, 0, -30)
+	if value := r.FormValue("start"); value != "" {
+		if start, err = parseWebTime(value); err != nil {
+			ReturnJSONError(w, "Cell Resistance", err, http.StatusBadRequest, false)
+			return
+		}
+	}
+	if value := r.FormValue("end"); value != "" {
+		if end, err = parseWebTime(value); err != nil {
+			ReturnJSONError(w, "Cell Resistance", err, http.StatusBadRequest, false)
+			return
+		}
+	}
+	if err = Storage.ValidateTimeRange(start, end, resistanceTrendWindow*4); err != nil {
+		returnHistoryError(w, "Cell Resistance", err)
+		return
+	}
+	estimates, err := store.GetCellResistance(start, end, cell)
+	if err != nil {
+		returnHistoryError(w, "Cell Resistance", err)
+		return
+	}
+	if estimates == nil {
+		estimates = []Storage.CellResistance{}
+	}
+	returnJSON(w, estimates)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var inverterColumns = []string{"volts", "amps", "soc", "v_setpoint", "frequency", "generator_running"}
+
+/**
+Log the values from the inverters. Nothing is logged until the inverters have reported the battery voltage.
+*/
+func logInverterData() {
+	if iValues.Volts == 0 {
+		return
+	}
+	generator := 0
+	if iValues.GnRun {
+		generator = 1
+	}
+	err := dbQueue.Insert("inverter", inverterColumns, iValues.Volts, iValues.Amps, iValues.Soc, iValues.Vsetpoint, iValues.Frequency, generator)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+/**
+Stream cells, temperatures, current or inverter data between start and end as CSV. cells is an optional comma
+separated list of cells (1..38 and 101..138) and bucket is raw (the default) or 15s, 1m, 1h or 1d for averages.
+The rows are read and sent a window at a time so any length of export can be sent without holding it all in memory.
+*/
+func webExportData(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	query := Storage.ExportQuery{Data: mux.Vars(r)["data"]}
+	var err error
+	if query.Start, err = parseWebTime(r.FormValue("start")); err != nil {
+		ReturnJSONErrorString(w, "Export", "start must be yyyy-mm-dd hh:mm[:ss]", http.StatusBadRequest, false)
+		return
+	}
+	if query.End, err = parseWebTime(r.FormValue("end")); err != nil {
+		ReturnJSONErrorString(w, "Export", "end must be yyyy-mm-dd hh:mm[:ss]", http.StatusBadRequest, false)
+		return
+	}
+	if value := r.FormValue("bucket"); value != "" {
+		if query.Bucket, err = Storage.ParseBucket(value); err != nil {
+			returnHistoryError(w, "Export", err)
+			return
+		}
+	}
+	if value := r.FormValue("cells"); value != "" {
+		for _, sCell := range strings.Split(value, ",") {
+			cell, err := strconv.Atoi(strings.TrimSpace(sCell))
+			if err != nil {
+				ReturnJSONErrorString(w, "Export", "cells must be a comma separated list of cell numbers", http.StatusBadRequest, false)
+				return
+			}
+			query.Cells = append(query.Cells, cell)
+		}
+	}
+	switch r.FormValue("format") {
+	case "", "csv":
+	case "parquet":
+		ReturnJSONErrorString(w, "Export", "Parquet export is not available, use format=csv", http.StatusNotImplemented, false)
+		return
+	default:
+		ReturnJSONErrorString(w, "Export", "format must be csv", http.StatusBadRequest, false)
+		return
+	}
+
+	// Nothing is sent until the first rows have been read so errors still get a proper status
+	var writer *csv.Writer
+	header := func(columns []string) error {
+		clearWriteDeadline(w)
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="battery-%s-%s-%s.csv"`,
+			query.Data, query.Start.Format("20060102T1504"), query.End.Format("20060102T1504")))
+		writer = csv.NewWriter(w)
+		return writer.Write(append([]string{"time"}, columns...))
+	}
+	var record []string
+	rows := 0
+	row := func(logged time.Time, values []sql.NullFloat64) error {
+		record = append(record[:0], logged.Format(Storage.TimeFormat))
+		for _, value := range values {
+			if value.Valid {
+				record = append(record, strconv.FormatFloat(value.Float64, 'f', -1, 64))
+			} else {
+				record = append(record, "")
+			}
+		}
+		rows++
+		if rows%1000 == 0 {
+			writer.Flush()
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+		return writer.Write(record)
+	}
+	err = store.Export(r.Context(), query, header, row)
+	if writer == nil {
+		returnHistoryError(w, "Export", err)
+		return
+	}
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if err != nil {
+		// Too late to tell the client other than by cutting the file short
+		log.Println("Export of", query.Data, "stopped after", rows, "rows -", err)
+	}
+}
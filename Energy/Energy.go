@@ -0,0 +1,242 @@
+package Energy
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// Where a row of energy came from
+	Inverter = "inverter"
+
+	// Readings further apart than this are only counted for this long
+	maxStep = 10 * time.Second
+)
+
+// The sources the banks' energy is saved under
+var bankSources = [2]string{"bank0", "bank1"}
+
+/**
+Totals is the energy and charge that went into and out of a bank, or the battery as the inverter sees it
+*/
+type Totals struct {
+	WhIn  float64 `json:"wh_in"`
+	WhOut float64 `json:"wh_out"`
+	AhIn  float64 `json:"ah_in"`
+	AhOut float64 `json:"ah_out"`
+}
+
+func (totals *Totals) add(volts float64, amps float64, hours float64) {
+	if amps > 0 {
+		totals.WhIn += volts * amps * hours
+		totals.AhIn += amps * hours
+	} else {
+		totals.WhOut -= volts * amps * hours
+		totals.AhOut -= amps * hours
+	}
+}
+
+func (totals *Totals) addTotals(other Totals) {
+	totals.WhIn += other.WhIn
+	totals.WhOut += other.WhOut
+	totals.AhIn += other.AhIn
+	totals.AhOut += other.AhOut
+}
+
+/**
+RoundTrip is the energy out as a fraction of the energy in. It only means much over a period that ends at about the
+state of charge it started at. nil when no energy went in.
+*/
+func (totals Totals) RoundTrip() *float64 {
+	if totals.WhIn <= 0 {
+		return nil
+	}
+	efficiency := math.Round(totals.WhOut*1000/totals.WhIn) / 1000
+	return &efficiency
+}
+
+/**
+Period is the energy of each bank and of the battery as the inverter sees it over a day (yyyy-mm-dd) or a month
+(yyyy-mm). InverterDifference is how far the inverter's energy in and out is from the banks' in % of the banks'.
+*/
+type Period struct {
+	Period              string      `json:"period"`
+	Banks               [2]Totals   `json:"banks"`
+	RoundTripEfficiency [2]*float64 `json:"round_trip_efficiency"`
+	Inverter            Totals      `json:"inverter"`
+	InverterDifference  *float64    `json:"inverter_difference,omitempty"`
+}
+
+func (period *Period) finish() {
+	banks := 0.0
+	for bank := range period.Banks {
+		period.RoundTripEfficiency[bank] = period.Banks[bank].RoundTrip()
+		banks += period.Banks[bank].WhIn + period.Banks[bank].WhOut
+	}
+	if inverter := period.Inverter.WhIn + period.Inverter.WhOut; banks > 0 && inverter > 0 {
+		difference := math.Round((inverter-banks)*1000/banks) / 10
+		period.InverterDifference = &difference
+	}
+}
+
+/**
+Meter adds up the energy of each bank from the bank voltage and the fuel gauge current every second, and of the whole
+battery from the voltage and current the inverter reports. It keeps the current day's totals. The caller saves them
+regularly and restores them after a restart.
+*/
+type Meter struct {
+	mu       sync.Mutex
+	day      time.Time
+	banks    [2]Totals
+	inverter Totals
+	updated  time.Time
+}
+
+/**
+New returns a meter starting from nothing today
+*/
+func New() *Meter {
+	return &Meter{}
+}
+
+func dayOf(when time.Time) time.Time {
+	return time.Date(when.Year(), when.Month(), when.Day(), 0, 0, 0, 0, when.Location())
+}
+
+/**
+Carry on from the totals saved for today, if there are any
+*/
+func (meter *Meter) Restore(rows []Storage.EnergyDay, now time.Time) {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+	today := now.Format("2006-01-02")
+	for _, row := range rows {
+		if row.Day.Format("2006-01-02") != today {
+			continue
+		}
+		meter.day = dayOf(now)
+		totals := Totals{WhIn: row.WhIn, WhOut: row.WhOut, AhIn: row.AhIn, AhOut: row.AhOut}
+		switch row.Source {
+		case bankSources[0]:
+			meter.banks[0] = totals
+		case bankSources[1]:
+			meter.banks[1] = totals
+		case Inverter:
+			meter.inverter = totals
+		}
+	}
+}
+
+/**
+Add one set of readings. volts and amps are the voltage and current of each bank, with the current positive when
+charging. The inverter current has the same sign. Zero volts leaves a reading out. When the day changes the finished
+day's rows are returned so they can be saved.
+*/
+func (meter *Meter) Update(now time.Time, volts [2]float64, amps [2]float64, inverterVolts float64, inverterAmps float64) (finished []Storage.EnergyDay) {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+	if day := dayOf(now); !day.Equal(meter.day) {
+		if !meter.day.IsZero() {
+			finished = meter.rows()
+		}
+		meter.day = day
+		meter.banks = [2]Totals{}
+		meter.inverter = Totals{}
+		meter.updated = time.Time{}
+	}
+	if !meter.updated.IsZero() {
+		step := now.Sub(meter.updated)
+		if step > maxStep {
+			step = maxStep
+		}
+		if step > 0 {
+			for bank := range meter.banks {
+				if volts[bank] > 0 {
+					meter.banks[bank].add(volts[bank], amps[bank], step.Hours())
+				}
+			}
+			if inverterVolts > 0 {
+				meter.inverter.add(inverterVolts, inverterAmps, step.Hours())
+			}
+		}
+	}
+	meter.updated = now
+	return finished
+}
+
+/**
+Called with the meter locked
+*/
+func (meter *Meter) rows() []Storage.EnergyDay {
+	rows := make([]Storage.EnergyDay, 0, 3)
+	for bank, totals := range meter.banks {
+		rows = append(rows, Storage.EnergyDay{Day: meter.day, Source: bankSources[bank], WhIn: totals.WhIn, WhOut: totals.WhOut,
+			AhIn: totals.AhIn, AhOut: totals.AhOut})
+	}
+	return append(rows, Storage.EnergyDay{Day: meter.day, Source: Inverter, WhIn: meter.inverter.WhIn, WhOut: meter.inverter.WhOut,
+		AhIn: meter.inverter.AhIn, AhOut: meter.inverter.AhOut})
+}
+
+/**
+Return today's rows so far, or nothing before the first reading
+*/
+func (meter *Meter) Today() []Storage.EnergyDay {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+	if meter.day.IsZero() {
+		return nil
+	}
+	return meter.rows()
+}
+
+func (period *Period) addRow(row Storage.EnergyDay) {
+	totals := Totals{WhIn: row.WhIn, WhOut: row.WhOut, AhIn: row.AhIn, AhOut: row.AhOut}
+	switch row.Source {
+	case bankSources[0]:
+		period.Banks[0].addTotals(totals)
+	case bankSources[1]:
+		period.Banks[1].addTotals(totals)
+	case Inverter:
+		period.Inverter.addTotals(totals)
+	}
+}
+
+/**
+Periods adds the daily rows up by day, or by month if monthly is set, in time order
+*/
+func Periods(rows []Storage.EnergyDay, monthly bool) []Period {
+	layout := "2006-01-02"
+	if monthly {
+		layout = "2006-01"
+	}
+	periods := []Period{}
+	index := make(map[string]int)
+	for _, row := range rows {
+		name := row.Day.Format(layout)
+		i, ok := index[name]
+		if !ok {
+			i = len(periods)
+			index[name] = i
+			periods = append(periods, Period{Period: name})
+		}
+		periods[i].addRow(row)
+	}
+	for i := range periods {
+		periods[i].finish()
+	}
+	return periods
+}
+
+/**
+Total adds up all the rows into one period named total
+*/
+func Total(rows []Storage.EnergyDay) Period {
+	total := Period{Period: "total"}
+	for _, row := range rows {
+		total.addRow(row)
+	}
+	total.finish()
+	return total
+}
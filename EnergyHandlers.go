@@ -0,0 +1,147 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Energy"
+	"BatteryMonitor6813V4/Storage"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// Today's energy is saved this often so little is lost on a restart
+	energySaveInterval = 10 * time.Minute
+	// How often to try again to read today's saved energy if the database could not be read
+	energyRestoreRetry = time.Minute
+	// Most days /energy returns by day, and by month
+	maxEnergyDays   = 366
+	maxEnergyMonths = 120
+)
+
+var (
+	energyMeter    *Energy.Meter
+	energyRestored bool
+	energyLastTry  time.Time
+	energyLastSave time.Time
+)
+
+func startEnergyMeter() {
+	energyMeter = Energy.New()
+}
+
+/**
+Return the voltage of each bank as the sum of its cells. A bank with no readings is zero.
+*/
+func bankVolts() (volts [2]float64) {
+	for bank := 0; bank < 2; bank++ {
+		for _, cell := range cellVolts(bank) {
+			volts[bank] += cell
+		}
+	}
+	return volts
+}
+
+func saveEnergy(rows []Storage.EnergyDay) {
+	if len(rows) == 0 {
+		return
+	}
+	if err := store.SaveEnergyDay(rows[0].Day, rows); err != nil {
+		log.Println("Failed to save the energy for", rows[0].Day.Format("2006-01-02"), "-", err)
+	}
+}
+
+/**
+Add this cycle's readings to the energy meter, saving today's totals every 10 minutes and each day as it ends. Nothing
+is metered or saved until today's saved totals have been read, otherwise they would be saved over.
+*/
+func meterEnergy() {
+	if energyMeter == nil || store == nil || ltc == nil || nDevices == 0 || fuelgauge == nil {
+		return
+	}
+	now := time.Now()
+	if !energyRestored {
+		if now.Sub(energyLastTry) < energyRestoreRetry {
+			return
+		}
+		energyLastTry = now
+		today, err := store.GetEnergy(now, now)
+		if err != nil {
+			log.Println("Failed to read today's energy -", err)
+			return
+		}
+		energyMeter.Restore(today, now)
+		energyRestored = true
+	}
+	amps := [2]float64{float64(fuelgauge.CurrentLeft()), float64(fuelgauge.CurrentRight())}
+	saveEnergy(energyMeter.Update(now, bankVolts(), amps, float64(iValues.Volts), float64(iValues.Amps)))
+	if now.Sub(energyLastSave) >= energySaveInterval {
+		energyLastSave = now
+		saveEnergy(energyMeter.Today())
+	}
+}
+
+/**
+Energy in and out of each bank with the round trip efficiency, and the inverter's figures to check them against, by
+day or month between start and end (yyyy-mm-dd). Defaults to the last 30 days by day or the last 12 months by month.
+/energy?period=month&start=2022-01-01&end=2022-12-31
+*/
+func webGetEnergy(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	if energyMeter == nil {
+		ReturnJSONErrorString(w, "Energy", "the energy meter is not running", http.StatusServiceUnavailable, false)
+		return
+	}
+	monthly := false
+	switch r.FormValue("period") {
+	case "", "day":
+	case "month":
+		monthly = true
+	default:
+		ReturnJSONErrorString(w, "Energy", "period must be day or month", http.StatusBadRequest, false)
+		return
+	}
+	end := time.Now()
+	start := end.AddDate(0, 0, -30)
+	maxDays := maxEnergyDays
+	if monthly {
+		start = time.Date(end.Year(), end.Month()-11, 1, 0, 0, 0, 0, end.Location())
+		maxDays = maxEnergyMonths * 31
+	}
+	var err error
+	if value := r.FormValue("start"); value != "" {
+		if start, err = time.ParseInLocation("2006-1-2", value, time.Local); err != nil {
+			ReturnJSONErrorString(w, "Energy", "start must be yyyy-mm-dd", http.StatusBadRequest, false)
+			return
+		}
+	}
+	if value := r.FormValue("end"); value != "" {
+		if end, err = time.ParseInLocation("2006-1-2", value, time.Local); err != nil {
+			ReturnJSONErrorString(w, "Energy", "end must be yyyy-mm-dd", http.StatusBadRequest, false)
+			return
+		}
+	}
+	if end.Before(start) || end.Sub(start) > time.Duration(maxDays)*24*time.Hour {
+		ReturnJSONErrorString(w, "Energy", "end must be after start and not too far from it", http.StatusBadRequest, false)
+		return
+	}
+	days, err := store.GetEnergy(start, end)
+	if err != nil {
+		ReturnJSONError(w, "Energy", err, http.StatusInternalServerError, true)
+		return
+	}
+	// Today's totals in the database can be up to 10 minutes old
+	if today := energyMeter.Today(); len(today) > 0 {
+		day := today[0].Day.Format("2006-01-02")
+		if day >= start.Format("2006-01-02") && day <= end.Format("2006-01-02") {
+			saved := days
+			days = nil
+			for _, row := range saved {
+				if row.Day.Format("2006-01-02") != day {
+					days = append(days, row)
+				}
+			}
+			days = append(days, today...)
+		}
+	}
+	returnJSON(w, APIEnergy{Periods: Energy.Periods(days, monthly), Total: Energy.Total(days)})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events kept for clients resuming with Last-Event-ID. A measurement is added every second so this is a few minutes.
+const eventBufferSize = 300
+const eventKeepAlive = 15 * time.Second
+
+// The server sent event types
+const (
+	eventMeasurement = "measurement"
+	eventAlarm       = "alarm"
+	eventControl     = "control"
+)
+
+type serverEvent struct {
+	seq  uint64
+	name string
+	data []byte
+}
+
+/**
+eventBroker keeps the recent events in a ring buffer and wakes the /events streams when a new one arrives. Event IDs
+are <start>-<seq> where start is when the program started, so an ID from before a restart is recognised.
+*/
+type eventBroker struct {
+	mu      sync.Mutex
+	start   int64
+	events  []serverEvent
+	nextSeq uint64
+	waiting map[chan struct{}]bool
+}
+
+var broker = &eventBroker{start: time.Now().Unix(), nextSeq: 1, waiting: make(map[chan struct{}]bool)}
+var startEventsOnce sync.Once
+
+/**
+Feed the event stream with the measurements every time performMeasurements signals new data, and with the alarm
+and control events as they happen.
+*/
+func startEvents() {
+	startEventsOnce.Do(func() {
+		go func() {
+			for {
+				signal.L.Lock()
+				signal.Wait()
+				signal.L.Unlock()
+				battery, inverter, fuelGauge := liveValues()
+				broker.publishJSON(eventMeasurement, dashboardJSON(battery, inverter, fuelGauge))
+			}
+		}()
+		fuelgauge.AddAuditListener(func(entry Storage.AuditEntry) {
+			broker.publish(eventControl, entry)
+		})
+	})
+}
+
+func (broker *eventBroker) publish(name string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Println("Failed to serialise the", name, "event -", err)
+		return
+	}
+	broker.publishJSON(name, data)
+}
+
+func (broker *eventBroker) publishJSON(name string, data []byte) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.events = append(broker.events, serverEvent{seq: broker.nextSeq, name: name, data: data})
+	broker.nextSeq++
+	if len(broker.events) > eventBufferSize {
+		broker.events = broker.events[len(broker.events)-eventBufferSize:]
+	}
+	for wake := range broker.waiting {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (broker *eventBroker) subscribe() chan struct{} {
+	wake := make(chan struct{}, 1)
+	broker.mu.Lock()
+	broker.waiting[wake] = true
+	broker.mu.Unlock()
+	return wake
+}
+
+func (broker *eventBroker) unsubscribe(wake chan struct{}) {
+	broker.mu.Lock()
+	delete(broker.waiting, wake)
+	broker.mu.Unlock()
+}
+
+/**
+Return the sequence number to start after for a Last-Event-ID. A blank ID starts with the next event. An ID from
+before a restart, or one that cannot be read, starts with the oldest event still buffered.
+*/
+func (broker *eventBroker) resumeAfter(lastEventID string) uint64 {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if lastEventID == "" {
+		return broker.nextSeq - 1
+	}
+	parts := strings.SplitN(lastEventID, "-", 2)
+	if len(parts) == 2 && parts[0] == strconv.FormatInt(broker.start, 10) {
+		if seq, err := strconv.ParseUint(parts[1], 10, 64); err == nil && seq < broker.nextSeq {
+			return seq
+		}
+	}
+	return 0
+}
+
+/**
+Return the buffered events after seq. If the client has fallen so far behind that events have left the buffer it
+just carries on from the oldest one still there.
+*/
+func (broker *eventBroker) after(seq uint64) []serverEvent {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	i := len(broker.events)
+	for i > 0 && broker.events[i-1].seq > seq {
+		i--
+	}
+	return append([]serverEvent(nil), broker.events[i:]...)
+}
+
+/**
+Server-Sent Events stream of measurement (the same data as /ws every cycle), alarm and control events for clients
+that cannot use a websocket. ?events=alarm,control limits the event types. A client reconnecting with a
+Last-Event-ID header (or ?lastEventId=) gets the events it missed if they are still buffered.
+*/
+func webEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ReturnJSONErrorString(w, "Events", "streaming is not supported", http.StatusInternalServerError, true)
+		return
+	}
+	wanted := map[string]bool{eventMeasurement: true, eventAlarm: true, eventControl: true}
+	if value := r.FormValue("events"); value != "" {
+		wanted = make(map[string]bool)
+		for _, name := range strings.Split(value, ",") {
+			switch name {
+			case eventMeasurement, eventAlarm, eventControl:
+				wanted[name] = true
+			default:
+				ReturnJSONErrorString(w, "Events", "events must be measurement, alarm or control", http.StatusBadRequest, false)
+				return
+			}
+		}
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.FormValue("lastEventId")
+	}
+
+	clearWriteDeadline(w)
+	setHeaders(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	wake := broker.subscribe()
+	defer broker.unsubscribe(wake)
+	seq := broker.resumeAfter(lastEventID)
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	if _, err := fmt.Fprint(w, "retry: 5000\n\n"); err != nil {
+		return
+	}
+	for {
+		for _, event := range broker.after(seq) {
+			seq = event.seq
+			if !wanted[event.name] {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d-%d\nevent: %s\ndata: %s\n\n", broker.start, event.seq, event.name, event.data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wake:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep alive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
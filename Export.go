@@ -0,0 +1,124 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"BatteryMonitor6813V4/TimeSeries"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cellsPerBank = Storage.CellsPerBank
+const cellsPerDevice = 18
+
+/**
+Return the LTC6813 device and sensor channel a cell (0..37) of a bank is read from
+*/
+func cellIndex(bank int, cell int) (device int, sensor int) {
+	return (bank * 3) + (cell / cellsPerDevice), cell % cellsPerDevice
+}
+
+/**
+Return the voltage of each cell in the bank
+*/
+func cellVolts(bank int) []float64 {
+	volts := make([]float64, cellsPerBank)
+	for cell := range volts {
+		volts[cell] = float64(ltc.GetVolts(cellIndex(bank, cell)))
+	}
+	return volts
+}
+
+var exporter *TimeSeries.Exporter
+
+/**
+Set up the time series exporter. The destination is an http(s) URL or a file path. Format is influx for line
+protocol or remote for Prometheus remote-write, which has to go to a URL.
+*/
+func startExporter(destination string, format string, token string, batchSize int, maxBuffered int, interval time.Duration) {
+	if destination == "" {
+		return
+	}
+	isURL := strings.HasPrefix(destination, "http://") || strings.HasPrefix(destination, "https://")
+	var writer TimeSeries.Writer
+	switch {
+	case format == "influx" && isURL:
+		writer = TimeSeries.NewInfluxHTTP(destination, token)
+	case format == "influx":
+		writer = TimeSeries.NewFile(destination)
+	case format == "remote" && isURL:
+		writer = TimeSeries.NewRemoteWrite(destination, "battery")
+	default:
+		log.Fatalf("Cannot export %s format to %s - Sorry, I am giving up.", format, destination)
+	}
+	exporter = TimeSeries.New(writer, batchSize, maxBuffered, interval)
+	go exporter.Run()
+	log.Println("Exporting time series data to", destination)
+}
+
+/**
+Queue one measurement cycle for export. Each cell is tagged with its bank, its cell number in the bank and the LTC6813
+device and sensor channel it is read from.
+*/
+func exportData() {
+	if exporter == nil {
+		return
+	}
+	now := time.Now()
+	points := make([]TimeSeries.Point, 0, (2*cellsPerBank)+3)
+	for bank := 0; bank < 2; bank++ {
+		sBank := strconv.Itoa(bank)
+		for cell := 0; cell < cellsPerBank; cell++ {
+			device, sensor := cellIndex(bank, cell)
+			fields := map[string]float64{"volts": float64(ltc.GetVolts(device, sensor))}
+			if temperature, err := ltc.GetTemperature(device, sensor); err == nil {
+				fields["temperature"] = float64(temperature)
+			}
+			points = append(points, TimeSeries.Point{
+				Measurement: "cell",
+				Tags: map[string]string{
+					"bank":   sBank,
+					"cell":   strconv.Itoa(cell + 1),
+					"device": strconv.Itoa(device),
+					"sensor": strconv.Itoa(sensor),
+				},
+				Fields: fields,
+				Time:   now,
+			})
+		}
+		fields := map[string]float64{
+			"volts": float64(ltc.GetSumOfCellsVolts(bank*3) + ltc.GetSumOfCellsVolts((bank*3)+1) + ltc.GetVolts((bank*3)+2, 0) + ltc.GetVolts((bank*3)+2, 1)),
+		}
+		if fuelgauge != nil {
+			if bank == 0 {
+				fields["current"] = float64(fuelgauge.CurrentLeft())
+				fields["soc"] = float64(fuelgauge.StateOfChargeLeft())
+				fields["charge"] = float64(fuelgauge.FgLeft.Coulombs)
+			} else {
+				fields["current"] = float64(fuelgauge.CurrentRight())
+				fields["soc"] = float64(fuelgauge.StateOfChargeRight())
+				fields["charge"] = float64(fuelgauge.FgRight.Coulombs)
+			}
+		}
+		points = append(points, TimeSeries.Point{
+			Measurement: "bank",
+			Tags:        map[string]string{"bank": sBank},
+			Fields:      fields,
+			Time:        now,
+		})
+	}
+	points = append(points, TimeSeries.Point{
+		Measurement: "inverter",
+		Tags:        map[string]string{},
+		Fields: map[string]float64{
+			"volts":     float64(iValues.Volts),
+			"amps":      float64(iValues.Amps),
+			"soc":       float64(iValues.Soc),
+			"vsetpoint": float64(iValues.Vsetpoint),
+			"frequency": iValues.Frequency,
+		},
+		Time: now,
+	})
+	exporter.Add(points...)
+}
@@ -0,0 +1,109 @@
+package FuelGauge
+
+import (
+	"BatteryMonitor6813V4/Auth"
+	"BatteryMonitor6813V4/Storage"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Where a command came from
+const SourceWeb = "web"
+const SourceMQTT = "mqtt"
+const SourceRule = "rule" // One of the automatic rules in the monitor itself
+
+/**
+Origin says who or what asked for a command so it can be recorded in the audit log. For automatic rules the user is
+the name of the rule.
+*/
+type Origin struct {
+	Source string
+	User   string
+}
+
+/**
+The origin of a command sent to the web service by the logged in user
+*/
+func WebOrigin(r *http.Request) Origin {
+	return Origin{Source: SourceWeb, User: Auth.FromRequest(r).Name}
+}
+
+/**
+The origin of one of the automatic rules
+*/
+func RuleOrigin(rule string) Origin {
+	return Origin{Source: SourceRule, User: rule}
+}
+
+/**
+Return ok, refused (the command was not allowed) or failed (the controller did not do it)
+*/
+func commandResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case CommandStatus(err) == http.StatusBadRequest:
+		return "refused"
+	default:
+		return "failed"
+	}
+}
+
+/**
+Record a command in the audit table. The parameters are stored as JSON.
+*/
+func (fuelgauge *FuelGauge) audit(origin Origin, action string, parameters map[string]interface{}, previousState string, err error) {
+	result := commandResult(err)
+	sError := ""
+	if err != nil {
+		sError = err.Error()
+	}
+	sParameters, jsonErr := json.Marshal(parameters)
+	if jsonErr != nil {
+		sParameters = []byte(fmt.Sprint(parameters))
+	}
+	log.Printf("Audit: %s %s by %s %s - was %s - %s %s", action, sParameters, origin.Source, origin.User, previousState, result, sError)
+	fuelgauge.notifyAudit(Storage.AuditEntry{Logged: time.Now(), Source: origin.Source, User: origin.User, Action: action,
+		Parameters: string(sParameters), PreviousState: previousState, Result: result, Error: sError})
+	if fuelgauge.queue == nil {
+		return
+	}
+	if err := fuelgauge.queue.Insert(Storage.AuditTable, Storage.AuditColumns, origin.Source, origin.User, action,
+		string(sParameters), previousState, result, sError); err != nil {
+		log.Println("Failed to write the audit log -", err)
+	}
+}
+
+/**
+Call the function for every command recorded in the audit log, as it happens
+*/
+func (fuelgauge *FuelGauge) AddAuditListener(listener func(Storage.AuditEntry)) {
+	fuelgauge.listenerMu.Lock()
+	defer fuelgauge.listenerMu.Unlock()
+	fuelgauge.listeners = append(fuelgauge.listeners, listener)
+}
+
+func (fuelgauge *FuelGauge) notifyAudit(entry Storage.AuditEntry) {
+	fuelgauge.listenerMu.Lock()
+	defer fuelgauge.listenerMu.Unlock()
+	for _, listener := range fuelgauge.listeners {
+		listener(entry)
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+/**
+Describe which banks are on for the audit log
+*/
+func (fuelgauge *FuelGauge) bankStates() string {
+	return fmt.Sprintf("left %s, right %s", onOff(fuelgauge.BankOn(LeftBank)), onOff(fuelgauge.BankOn(RightBank)))
+}
@@ -0,0 +1,119 @@
+package FuelGauge
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// The charging efficiency is learned from this many of the latest cycles between full charges
+	efficiencyCycles = 5
+	// and needs at least this many of them
+	minEfficiencyCycles = 2
+	// A cycle must take this fraction of the capacity out of the bank to count
+	minCycleFraction = 0.1
+	// Learned efficiencies outside this range are taken to be bad data
+	minEfficiency = 0.5
+	maxEfficiency = 1.0
+)
+
+/**
+Reset the bank's charge register to its capacity because the full charge evaluator has found every cell in the bank
+full. The drift of the counter from the capacity is recorded in the charge_drift table along with the charge in and out
+since the previous reset. Between two full charges the charge out must equal the charge in times the charging
+efficiency so the efficiency is learned from the latest cycles and saved in charge0_efficiency or charge1_efficiency.
+*/
+func (fuelgauge *FuelGauge) ResetChargeAtFull(origin Origin, bank int, when time.Time) (drift Storage.ChargeDrift, err error) {
+	var channel *fuelGaugeChannel
+	switch bank {
+	case LeftBank:
+		channel = &fuelgauge.FgLeft
+	case RightBank:
+		channel = &fuelgauge.FgRight
+	default:
+		return drift, ErrInvalidBank
+	}
+	previousState := fmt.Sprintf("%.1f", channel.Coulombs)
+	drift = Storage.ChargeDrift{
+		Logged:     when,
+		Bank:       bank,
+		CounterAh:  float64(channel.Coulombs),
+		CapacityAh: float64(channel.Capacity),
+		DriftAh:    float64(channel.Capacity) - float64(channel.Coulombs),
+		Efficiency: channel.Efficiency,
+	}
+	err = fuelgauge.mbus.WriteHoldingRegister(ChargeRegister, uint16(float32(channel.Capacity)*10.0), channel.SlaveAddress)
+	if err == nil {
+		channel.Coulombs = float32(channel.Capacity)
+		fuelgauge.setFullCharge(bank)
+	}
+	fuelgauge.audit(origin, "reset_charge", map[string]interface{}{"bank": bank, "value": channel.Capacity, "drift": math.Round(drift.DriftAh*10) / 10}, previousState, err)
+	if err != nil {
+		return drift, err
+	}
+
+	if history, err := fuelgauge.store.GetChargeDrift(bank, efficiencyCycles-1); err != nil {
+		log.Println("Failed to get the charge drift history for bank", bank, "-", err)
+	} else {
+		if len(history) > 0 {
+			fuelgauge.measureCycle(&drift, history[0].Logged, when)
+		}
+		fuelgauge.learnEfficiency(channel, &drift, history)
+	}
+	if err := fuelgauge.queue.Insert(Storage.ChargeDriftTable, Storage.ChargeDriftColumns, drift.Values()...); err != nil {
+		log.Println("Failed to save the charge drift for bank", bank, "-", err)
+	}
+	return drift, nil
+}
+
+/**
+Fill in the charge in and out of the bank since the previous full charge from the logged current
+*/
+func (fuelgauge *FuelGauge) measureCycle(drift *Storage.ChargeDrift, previous time.Time, when time.Time) {
+	discharged, charged, err := fuelgauge.store.GetChargeBetween(drift.Bank, previous, when)
+	if err != nil {
+		log.Println("Failed to get the charge since the last full charge of bank", drift.Bank, "-", err)
+		return
+	}
+	drift.DischargedAh = discharged
+	drift.ChargedAh = charged
+	if charged > 0 && discharged >= drift.CapacityAh*minCycleFraction {
+		efficiency := discharged / charged
+		drift.CycleEfficiency = &efficiency
+	}
+}
+
+/**
+Work out the charging efficiency over this cycle and the ones in the history and use it if it is believable
+*/
+func (fuelgauge *FuelGauge) learnEfficiency(channel *fuelGaugeChannel, drift *Storage.ChargeDrift, history []Storage.ChargeDrift) {
+	cycles := 0
+	discharged := 0.0
+	charged := 0.0
+	for _, cycle := range append([]Storage.ChargeDrift{*drift}, history...) {
+		if cycle.CycleEfficiency != nil {
+			cycles++
+			discharged += cycle.DischargedAh
+			charged += cycle.ChargedAh
+		}
+	}
+	if cycles < minEfficiencyCycles {
+		return
+	}
+	efficiency := discharged / charged
+	if efficiency < minEfficiency || efficiency > maxEfficiency {
+		log.Printf("Ignoring a charging efficiency of %.3f for bank %d learned from %d cycles", efficiency, drift.Bank, cycles)
+		return
+	}
+	efficiency = math.Round(efficiency*1000) / 1000
+	if err := fuelgauge.store.SetParameterFloat(fmt.Sprintf("charge%d_efficiency", drift.Bank), efficiency); err != nil {
+		log.Println("Failed to save the charging efficiency for bank", drift.Bank, "-", err)
+		return
+	}
+	log.Printf("Charging efficiency for bank %d changed from %.3f to %.3f over %d cycles", drift.Bank, channel.Efficiency, efficiency, cycles)
+	channel.Efficiency = efficiency
+	drift.Efficiency = efficiency
+}
@@ -3,16 +3,20 @@ package FuelGauge
 import (
 	"BatteryMonitor6813V4/ModbusBatteryFuelGauge/Data"
 	ModbusController "BatteryMonitor6813V4/ModbusBatteryFuelGauge/modbusController"
+	"BatteryMonitor6813V4/Notifier"
+	"BatteryMonitor6813V4/Storage"
+	"BatteryMonitor6813V4/StoreAndForward"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"log"
+	"math"
 	"net/http"
-	"net/smtp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -34,16 +38,17 @@ type fuelGaugeChannel struct {
 //}
 
 type FuelGauge struct {
-	mbus                 *ModbusController.ModbusController
-	FgLeft               fuelGaugeChannel
-	FgRight              fuelGaugeChannel
-	currentStatement     *sql.Stmt
-	systemParamStatement *sql.Stmt
-	fullChargeStatement  *sql.Stmt
-	pDB                  *sql.DB
-	baudRate             int
-	commsPort            string
-	reportTicker         *time.Ticker
+	mbus         *ModbusController.ModbusController
+	FgLeft       fuelGaugeChannel
+	FgRight      fuelGaugeChannel
+	queue        *StoreAndForward.Queue
+	store        Storage.Store
+	baudRate     int
+	commsPort    string
+	reportTicker *time.Ticker
+	notifier     *Notifier.Notifier
+	listenerMu   sync.Mutex
+	listeners    []func(Storage.AuditEntry)
 }
 
 /*
@@ -78,7 +83,30 @@ type RegisterRequest struct {
 	Value int16  `json:"value"`
 }
 
+// Errors returned when a command is refused. Anything else is a failure talking to the controllers.
+var ErrInvalidBank = errors.New("Invalid battery bank")
+var ErrInvalidWateringTime = errors.New("Invalid minutes for watering time")
+var ErrBothBanksOff = errors.New("Cannot turn both batteries off.")
+var ErrInvalidCapacity = errors.New("Invalid bank capacity")
+var ErrInvalidCoil = errors.New("Invalid coil")
+var ErrInvalidRegister = errors.New("Invalid holding register")
+
+/**
+Return the HTTP status for an error from one of the command functions
+*/
+func CommandStatus(err error) int {
+	switch err {
+	case ErrInvalidBank, ErrInvalidWateringTime, ErrBothBanksOff, ErrInvalidCapacity, ErrInvalidCoil, ErrInvalidRegister:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+var currentColumns = []string{"channel_0", "channel_1", "level_of_charge_0", "level_of_charge_1"}
+
 const WATERCHARGETHRESHOLD = 98.0 // The state of charge point reached at which the watering system is turned on.
+const MaxWateringMinutes = 15     // The longest the watering system can be turned on for by a command
 const LeftBank = 0
 const RightBank = 1
 
@@ -276,19 +304,85 @@ func (fuelgauge *FuelGauge) WebToggleCoil(w http.ResponseWriter, r *http.Request
 	}
 	// coil
 	n, _ := strconv.ParseUint(address, 10, 16)
+	if _, err := fuelgauge.toggleCoil(WebOrigin(r), dataPointer, uint16(n)); err == ErrInvalidCoil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	_, err := fmt.Fprint(w, "Coil ", n, " on slave ", dataPointer.SlaveAddress, " toggled.")
+	if err != nil {
+		log.Println(err)
+	}
+	//	getValues(true, dataPointer, fuelgauge.mbus)
+}
+
+/**
+Return the latest values read from the bank's controller, 0 = left and 1 = right
+*/
+func (fuelgauge *FuelGauge) controllerData(bank int) (*Data.Data, error) {
+	switch bank {
+	case 0:
+		return fuelgauge.FgLeft.ModbusData, nil
+	case 1:
+		return fuelgauge.FgRight.ModbusData, nil
+	}
+	return nil, ErrInvalidBank
+}
 
-	nIndex := uint16(n)
-	nIndex = nIndex - dataPointer.CoilStart() // nIndex is now 0 based
-	err := fuelgauge.mbus.WriteCoil(nIndex+dataPointer.CoilStart(), !dataPointer.Coil[nIndex], dataPointer.SlaveAddress)
+/**
+Toggle one of the coils on the bank's controller, returning its new state
+*/
+func (fuelgauge *FuelGauge) ToggleCoil(origin Origin, bank int, coil uint16) (on bool, err error) {
+	dataPointer, err := fuelgauge.controllerData(bank)
+	if err != nil {
+		return false, err
+	}
+	return fuelgauge.toggleCoil(origin, dataPointer, coil)
+}
+
+func (fuelgauge *FuelGauge) toggleCoil(origin Origin, dataPointer *Data.Data, coil uint16) (on bool, err error) {
+	if coil < dataPointer.CoilStart() || int(coil-dataPointer.CoilStart()) >= len(dataPointer.Coil) {
+		return false, ErrInvalidCoil
+	}
+	previous := dataPointer.Coil[coil-dataPointer.CoilStart()]
+	err = fuelgauge.mbus.WriteCoil(coil, !previous, dataPointer.SlaveAddress)
 	if err != nil {
 		dataPointer.LastError = err.Error()
 	}
-	w.Header().Set("Cache-Control", "no-store")
-	_, err = fmt.Fprint(w, "Coil ", nIndex+dataPointer.CoilStart(), " on slave ", dataPointer.SlaveAddress, " toggled.")
+	fuelgauge.audit(origin, "toggle_coil", map[string]interface{}{"slave": dataPointer.SlaveAddress, "coil": coil, "value": onOff(!previous)},
+		onOff(previous), err)
+	return !previous, err
+}
+
+/**
+Write one of the holding registers, given by its Modbus address, on the bank's controller
+*/
+func (fuelgauge *FuelGauge) SetHoldingRegister(origin Origin, bank int, address uint16, value uint16) error {
+	dataPointer, err := fuelgauge.controllerData(bank)
+	if err != nil {
+		return err
+	}
+	for _, ep := range EndPointsLeft {
+		if ep.address == address && ep.dataType == HoldingRegister {
+			return fuelgauge.setHoldingRegister(origin, dataPointer, ep, value)
+		}
+	}
+	return ErrInvalidRegister
+}
+
+func (fuelgauge *FuelGauge) setHoldingRegister(origin Origin, dataPointer *Data.Data, ep ModbusEndPoint, value uint16) error {
+	previous := ""
+	if index := int(ep.address) - int(dataPointer.HoldingStart()); index >= 0 && index < len(dataPointer.Holding) {
+		previous = strconv.Itoa(int(dataPointer.Holding[index]))
+	}
+	err := fuelgauge.mbus.WriteHoldingRegister(ep.address, value, dataPointer.SlaveAddress)
+	fuelgauge.audit(origin, "set_holding_register", map[string]interface{}{"slave": dataPointer.SlaveAddress, "register": ep.id,
+		"address": ep.address, "value": value}, previous, err)
 	if err != nil {
 		log.Println(err)
+		dataPointer.LastError = err.Error()
 	}
-	//	getValues(true, dataPointer, fuelgauge.mbus)
+	return err
 }
 
 /**
@@ -318,11 +412,7 @@ func (fuelgauge *FuelGauge) WebProcessHoldingRegistersForm(w http.ResponseWriter
 		for _, ep := range EndPointsLeft {
 			if (ep.id == sKey) && (ep.dataType == HoldingRegister) {
 				//				log.Println("Holding ", ep.id, " set to ", nValue)
-				err = fuelgauge.mbus.WriteHoldingRegister(ep.address, uint16(nValue), dataPointer.SlaveAddress)
-				if err != nil {
-					log.Println(err)
-					dataPointer.LastError = err.Error()
-				}
+				err = fuelgauge.setHoldingRegister(WebOrigin(r), dataPointer, ep, uint16(nValue))
 			}
 		}
 		if err != nil {
@@ -425,7 +515,7 @@ func (fuelgauge *FuelGauge) logValues(current0 uint16, current1 uint16, charge0
 		c1 = 0.1
 	}
 
-	_, err := fuelgauge.currentStatement.Exec(float32(i0)/100.0, float32(i1)/100.0, c0, c1)
+	err := fuelgauge.queue.Insert("current", currentColumns, float32(i0)/100.0, float32(i1)/100.0, c0, c1)
 	if err != nil {
 		log.Println(err)
 	}
@@ -438,12 +528,12 @@ func (fuelgauge *FuelGauge) logValues(current0 uint16, current1 uint16, charge0
 		delta = delta + 65536
 	}
 	if delta > 0 {
-		_, err = fuelgauge.systemParamStatement.Exec(float64(delta)*fuelgauge.FgLeft.Efficiency, "charge_in_counter_0")
+		err = fuelgauge.store.AddToParameter("charge_in_counter_0", float64(delta)*fuelgauge.FgLeft.Efficiency)
 		if err != nil {
 			log.Println("Adding charge to bank 0 - ", err)
 		}
 	} else if delta < 0 {
-		_, err = fuelgauge.systemParamStatement.Exec(0-delta, "charge_out_counter_0")
+		err = fuelgauge.store.AddToParameter("charge_out_counter_0", float64(0-delta))
 		if err != nil {
 			log.Println("Reducing charge to bank 0 - ", err)
 		}
@@ -462,12 +552,12 @@ func (fuelgauge *FuelGauge) logValues(current0 uint16, current1 uint16, charge0
 	fuelgauge.FgLeft.Coulombs = charge0
 	delta = int(charge1) - int(fuelgauge.FgRight.Coulombs)
 	if delta > 0 {
-		_, err = fuelgauge.systemParamStatement.Exec(float64(delta)*fuelgauge.FgRight.Efficiency, "charge_in_counter_1")
+		err = fuelgauge.store.AddToParameter("charge_in_counter_1", float64(delta)*fuelgauge.FgRight.Efficiency)
 		if err != nil {
 			log.Println("Adding charge to bank 1 - ", err)
 		}
 	} else if delta < 0 {
-		_, err = fuelgauge.systemParamStatement.Exec(0-delta, "charge_out_counter_1")
+		err = fuelgauge.store.AddToParameter("charge_out_counter_1", float64(0-delta))
 		if err != nil {
 			log.Println("Reducing charge to bank 1 - ", err)
 		}
@@ -492,18 +582,11 @@ Check that at least one battery is connected
 func (fuelgauge *FuelGauge) CheckBatteryConnectionState() {
 	if fuelgauge.FgLeft.ModbusData.Discrete[LeftBankSense] && fuelgauge.FgLeft.ModbusData.Discrete[RightBankSense] {
 		// Both batteries appear to be switched off so we need to switch the left bank on.
-		fuelgauge.PulseRelay(LeftBankOnRelay, fuelgauge.FgLeft.SlaveAddress, 2)
+		err := fuelgauge.PulseRelay(LeftBankOnRelay, fuelgauge.FgLeft.SlaveAddress, 2)
+		fuelgauge.audit(RuleOrigin("both banks off"), "switch_bank", map[string]interface{}{"bank": LeftBank, "value": "on"}, fuelgauge.bankStates(), err)
 		log.Println("Turning on the left bank because both banks reported OFF")
-		// This should neve have happened so we should send an email warning that we had to do it.
-		err := smtp.SendMail("mail.cedartechnology.com:587",
-			smtp.PlainAuth("", "pi@cedartechnology.com", "7444561", "mail.cedartechnology.com"),
-			"pi@cedartechnology.com", []string{"ian.abercrombie@cedartechnology.com"}, []byte(`From: Battery
-To: Ian.Abercrombie@CedarTechnology.com
-Subject: Battery Correction
-Turned on the left bank because both banks were reporting OFF`))
-		if err != nil {
-			log.Println("Failed to send email about having to turn on the left bank because both banks were off. - ", err)
-		}
+		// This should never have happened so we should send a warning that we had to do it.
+		fuelgauge.notifier.Notice(Notifier.Warning, "Battery Correction", "Turned on the left bank because both banks were reporting OFF")
 	}
 }
 
@@ -540,36 +623,31 @@ func (fuelgauge *FuelGauge) Run() {
 Read the capacity and last full charge datetime vaules from the database
 */
 func (fuelgauge *FuelGauge) ReadSystemParameters() {
-	row := fuelgauge.pDB.QueryRow(`select date_value from system_parameters where name = 'bank0_full'`)
-	err := row.Scan(&fuelgauge.FgLeft.LastFullCharge)
+	var err error
+	fuelgauge.FgLeft.LastFullCharge, err = fuelgauge.store.GetParameterTime("bank0_full")
 	if err != nil {
 		log.Println("Error getting last full charge left from system parameters - ", err)
 	}
-	row = fuelgauge.pDB.QueryRow(`select date_value from system_parameters where name = 'bank1_full'`)
-	err = row.Scan(&fuelgauge.FgRight.LastFullCharge)
+	fuelgauge.FgRight.LastFullCharge, err = fuelgauge.store.GetParameterTime("bank1_full")
 	if err != nil {
 		log.Println("Error getting last full charge right from system parameters - ", err)
 	}
-	row = fuelgauge.pDB.QueryRow(`select integer_value from system_parameters where name = 'capacity_0'`)
-	err = row.Scan(&fuelgauge.FgLeft.Capacity)
+	capacity, err := fuelgauge.store.GetParameterInt("capacity_0")
 	if err != nil {
 		log.Println("Error getting left bank capacity from system parameters - ", err)
+	} else {
+		fuelgauge.FgLeft.Capacity = int16(capacity)
 	}
-	row = fuelgauge.pDB.QueryRow(`select integer_value from system_parameters where name = 'capacity_1'`)
-	err = row.Scan(&fuelgauge.FgRight.Capacity)
+	capacity, err = fuelgauge.store.GetParameterInt("capacity_1")
 	if err != nil {
 		log.Println("Error getting right bank capacity from system parameters - ", err)
+	} else {
+		fuelgauge.FgRight.Capacity = int16(capacity)
 	}
 }
 
 func (fuelgauge *FuelGauge) setFullCharge(bank int) {
-	var sSQL string
-	if bank == 0 {
-		sSQL = `update system_parameters set integer_value = 1, date_value = now() where name = 'bank0_full' and integer_value = 0`
-	} else {
-		sSQL = `update system_parameters set integer_value = 1, date_value = now() where name = 'bank1_full' and integer_value = 0`
-	}
-	_, err := fuelgauge.pDB.Exec(sSQL)
+	err := fuelgauge.store.SetFlagParameter(fmt.Sprintf("bank%d_full", bank))
 	if err != nil {
 		log.Println("Error trying to set the full charge flag for bank ", bank, " - ", err)
 	}
@@ -636,14 +714,41 @@ func (fuelgauge *FuelGauge) Capacity() (total int16, left int16, right int16) {
 }
 
 /**
-Pulse the selected relay on the given slave for the given time duration
+Change the capacity in Ah the state of charge of a bank is worked out from, saving it in the system parameters
 */
-func (fuelgauge *FuelGauge) PulseRelay(relay uint16, slave uint8, seconds uint8) {
+func (fuelgauge *FuelGauge) SetCapacity(origin Origin, bank int, capacity int) (err error) {
+	var channel *fuelGaugeChannel
+	switch bank {
+	case LeftBank:
+		channel = &fuelgauge.FgLeft
+	case RightBank:
+		channel = &fuelgauge.FgRight
+	default:
+		err = ErrInvalidBank
+	}
+	previousState := ""
+	if err == nil {
+		previousState = strconv.Itoa(int(channel.Capacity))
+		if capacity < 1 || capacity > math.MaxInt16 {
+			err = ErrInvalidCapacity
+		} else if err = fuelgauge.store.SetParameterInt(fmt.Sprintf("capacity_%d", bank), int64(capacity)); err == nil {
+			channel.Capacity = int16(capacity)
+		}
+	}
+	fuelgauge.audit(origin, "set_capacity", map[string]interface{}{"bank": bank, "value": capacity}, previousState, err)
+	return err
+}
+
+/**
+Pulse the selected relay on the given slave for the given time duration. Returns the error turning it on.
+*/
+func (fuelgauge *FuelGauge) PulseRelay(relay uint16, slave uint8, seconds uint8) error {
 	// Turn the relay on
 	log.Println("Pulse - turning relay ", relay, " on.")
 	err := fuelgauge.mbus.WriteCoil(relay, true, slave)
 	if err != nil {
 		log.Println("Failed to turn on relay ", relay, " - ", err)
+		return err
 	}
 	// Turn it off again after the delay period
 	time.AfterFunc(time.Duration(seconds)*time.Second, func() {
@@ -653,6 +758,7 @@ func (fuelgauge *FuelGauge) PulseRelay(relay uint16, slave uint8, seconds uint8)
 			log.Println("Failed to turn off relay ", relay, " - ", err)
 		}
 	})
+	return nil
 }
 
 /**
@@ -661,13 +767,18 @@ This is called when one bank reaches full charge to switch to the other bank.
 It should also be called at 7PM to switch to the left bank in case we are still on the right.
 This is done while the right bank cells are causing issues.
 */
-func (fuelgauge *FuelGauge) SwitchOffBank(bank int) {
+func (fuelgauge *FuelGauge) SwitchOffBank(origin Origin, bank int) {
 	var (
 		onRelay           uint16
 		offRelay          uint16
 		thisBatterySense  uint16
 		otherBatterySense uint16
+		err               error
 	)
+	previousState := fuelgauge.bankStates()
+	defer func() {
+		fuelgauge.audit(origin, "switch_off_bank", map[string]interface{}{"bank": bank}, previousState, err)
+	}()
 
 	//	log.Println("Switching off bank ", bank)
 
@@ -690,28 +801,23 @@ func (fuelgauge *FuelGauge) SwitchOffBank(bank int) {
 
 	if fuelgauge.FgLeft.ModbusData.Discrete[otherBatterySense] {
 		// Activate the relay to switch on the other battery if it is switched off so there is always one active bank
-		fuelgauge.PulseRelay(onRelay, fuelgauge.FgLeft.SlaveAddress, 2)
+		if err = fuelgauge.PulseRelay(onRelay, fuelgauge.FgLeft.SlaveAddress, 2); err != nil {
+			return
+		}
 		log.Println("OtherBatterySense (", otherBatterySense, ") shows TRUE so attempting to turn on bank by pulsing relay ", onRelay)
 		time.Sleep(time.Second * 15)
 		// Now switch the selected battery off giving 15 seconds for the switching capacitor to discharge properly
 
 		if !fuelgauge.FgLeft.ModbusData.Discrete[otherBatterySense] {
-			fuelgauge.PulseRelay(offRelay, fuelgauge.FgLeft.SlaveAddress, 2)
+			err = fuelgauge.PulseRelay(offRelay, fuelgauge.FgLeft.SlaveAddress, 2)
 		} else {
 			log.Println("Attempt to turn on the other bank Failed. Cannot turn off bank ", bank)
-			err := smtp.SendMail("mail.cedartechnology.com:587",
-				smtp.PlainAuth("", "pi@cedartechnology.com", "7444561", "mail.cedartechnology.com"),
-				"pi@cedartechnology.com", []string{"ian.abercrombie@cedartechnology.com"}, []byte(`From: Battery
-To: Ian.Abercrombie@CedarTechnology.com
-Subject: Battery Correction
-Attempted to turn on a bank so the other bank can be turned off but the turn on command failed.`))
-			if err != nil {
-				log.Println("Failed to send email about having to turn on the left bank because both banks were off. - ", err)
-			}
+			fuelgauge.notifier.Notice(Notifier.Critical, "Battery Correction", "Attempted to turn on a bank so the other bank can be turned off but the turn on command failed.")
+			err = errors.New("the other bank did not turn on")
 		}
 	} else {
 		// The other battery is already on so just turn ours off Activate the relay to switch off the selected battery
-		fuelgauge.PulseRelay(offRelay, fuelgauge.FgLeft.SlaveAddress, 2)
+		err = fuelgauge.PulseRelay(offRelay, fuelgauge.FgLeft.SlaveAddress, 2)
 	}
 }
 
@@ -1029,22 +1135,18 @@ func (fuelgauge *FuelGauge) WebGetValues(w http.ResponseWriter, _ *http.Request)
 /**
 Perform the bank watering function. Turn on the relevant valve for the requested time in minutes.
 */
-func (fuelgauge *FuelGauge) WaterBank(bank uint8, timer uint8) error {
-	var relay uint16
-	// Solenoids are on coils 6 & 8 of the right bank controller.
-	if bank == LeftBank {
-		relay = LeftWaterRelay
-	} else {
-		relay = RightWaterRelay
-	}
+func (fuelgauge *FuelGauge) WaterBank(origin Origin, bank uint8, timer uint8) error {
+	return fuelgauge.Water(origin, uint64(bank), uint64(timer))
+}
+
+func (fuelgauge *FuelGauge) startWatering(bank uint8, timer uint8) error {
+	// Solenoids are on coils 7 & 8 of the right bank controller.
+	relay := waterRelay(bank)
 	err := fuelgauge.mbus.WriteCoil(relay, true, fuelgauge.FgRight.SlaveAddress)
 	if err == nil {
 		time.AfterFunc(time.Duration(timer)*time.Minute, func() {
 			err := fuelgauge.mbus.WriteCoil(relay, false, fuelgauge.FgRight.SlaveAddress)
-			if err != nil {
-				log.Println(err)
-				return
-			}
+			fuelgauge.audit(RuleOrigin("watering timer"), "water_bank", map[string]interface{}{"bank": bank, "minutes": 0}, "on", err)
 		})
 	} else {
 		return err
@@ -1059,28 +1161,57 @@ Send PATCH to URL: /waterBank/{bank}/{minutes}
 func (fuelgauge *FuelGauge) WebWaterBank(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bank, err := strconv.ParseUint(vars["bank"], 10, 8)
-	if (err != nil) || (bank > 1) {
-		http.Error(w, "Invalid battery bank", http.StatusBadRequest)
+	if err != nil {
+		http.Error(w, ErrInvalidBank.Error(), http.StatusBadRequest)
 		return
 	}
 	timer, err := strconv.ParseUint(vars["minutes"], 10, 8)
-	if (err != nil) || (timer > 15) {
-		http.Error(w, "Invalid minutes for watering time", http.StatusBadRequest)
+	if err != nil {
+		http.Error(w, ErrInvalidWateringTime.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = fuelgauge.WaterBank(uint8(bank), uint8(timer))
+	err = fuelgauge.Water(WebOrigin(r), bank, timer)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), CommandStatus(err))
+	}
+}
+
+/**
+Check the bank and time then turn on the watering system. Zero minutes turns it off. Used by the web and MQTT commands.
+*/
+func (fuelgauge *FuelGauge) Water(origin Origin, bank uint64, minutes uint64) (err error) {
+	previousState := ""
+	defer func() {
+		fuelgauge.audit(origin, "water_bank", map[string]interface{}{"bank": bank, "minutes": minutes}, previousState, err)
+	}()
+	if bank > 1 {
+		return ErrInvalidBank
+	}
+	previousState = onOff(fuelgauge.Watering(int(bank)))
+	if minutes > MaxWateringMinutes {
+		return ErrInvalidWateringTime
+	}
+	if minutes == 0 {
+		return fuelgauge.mbus.WriteCoil(waterRelay(uint8(bank)), false, fuelgauge.FgRight.SlaveAddress)
+	}
+	return fuelgauge.startWatering(uint8(bank), uint8(minutes))
+}
+
+func waterRelay(bank uint8) uint16 {
+	if bank == LeftBank {
+		return LeftWaterRelay
 	}
+	return RightWaterRelay
 }
 
 /**
 Turn on the fan if it is off
 */
-func (fuelgauge *FuelGauge) TurnOnFan() {
+func (fuelgauge *FuelGauge) TurnOnFan(origin Origin) {
 	if !fuelgauge.FgLeft.ModbusData.Coil[BatteryFanRelay-1] {
 		err := fuelgauge.mbus.WriteCoil(BatteryFanRelay, true, fuelgauge.FgLeft.SlaveAddress)
+		fuelgauge.audit(origin, "battery_fan", map[string]interface{}{"value": "on"}, "off", err)
 		if err != nil {
 			log.Println("Failed to turn the battery fan on", err)
 		}
@@ -1090,9 +1221,10 @@ func (fuelgauge *FuelGauge) TurnOnFan() {
 /**
 Turn off the fan if it is on
 */
-func (fuelgauge *FuelGauge) TurnOffFan() {
+func (fuelgauge *FuelGauge) TurnOffFan(origin Origin) {
 	if fuelgauge.FgLeft.ModbusData.Coil[BatteryFanRelay-1] {
 		err := fuelgauge.mbus.WriteCoil(BatteryFanRelay, false, fuelgauge.FgLeft.SlaveAddress)
+		fuelgauge.audit(origin, "battery_fan", map[string]interface{}{"value": "off"}, "on", err)
 		if err != nil {
 			log.Println("Failed to turn the battery fan off", err)
 		}
@@ -1115,13 +1247,30 @@ func (fuelgauge *FuelGauge) WebGeneratorStartStop(w http.ResponseWriter, r *http
 		http.Error(w, "Start or Stop expected", http.StatusBadRequest)
 		return
 	}
-	// Fan relay is on coil 8 of the left bank controller
-	err := fuelgauge.mbus.WriteCoil(GeneratorRelay, OnOff, fuelgauge.FgLeft.SlaveAddress)
+	err := fuelgauge.SetGenerator(WebOrigin(r), OnOff)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+/**
+Start or stop the generator
+*/
+func (fuelgauge *FuelGauge) SetGenerator(origin Origin, run bool) error {
+	previousState := "stopped"
+	if fuelgauge.GeneratorRunning() {
+		previousState = "running"
+	}
+	// Generator relay is on coil 5 of the left bank controller
+	err := fuelgauge.mbus.WriteCoil(GeneratorRelay, run, fuelgauge.FgLeft.SlaveAddress)
+	action := "stop"
+	if run {
+		action = "start"
+	}
+	fuelgauge.audit(origin, "generator", map[string]interface{}{"value": action}, previousState, err)
+	return err
+}
+
 /**
 Turn on or off the battery house ventilation fan for the minutes.
 Send PATCH to URL: /batteryFan/{onOff}
@@ -1138,13 +1287,23 @@ func (fuelgauge *FuelGauge) WebBatteryFan(w http.ResponseWriter, r *http.Request
 		http.Error(w, "On or Off expected", http.StatusBadRequest)
 		return
 	}
-	// Fan relay is on coil 8 of the left bank controller
-	err := fuelgauge.mbus.WriteCoil(BatteryFanRelay, OnOff, fuelgauge.FgLeft.SlaveAddress)
+	err := fuelgauge.SetBatteryFan(WebOrigin(r), OnOff)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+/**
+Turn the battery house ventilation fan on or off
+*/
+func (fuelgauge *FuelGauge) SetBatteryFan(origin Origin, on bool) error {
+	previousState := onOff(fuelgauge.BatteryFanOn())
+	// Fan relay is on coil 8 of the left bank controller
+	err := fuelgauge.mbus.WriteCoil(BatteryFanRelay, on, fuelgauge.FgLeft.SlaveAddress)
+	fuelgauge.audit(origin, "battery_fan", map[string]interface{}{"value": onOff(on)}, previousState, err)
+	return err
+}
+
 /**
 Switch one of the battery banks on or off.
 /batterySwitch/{bank}/{onOff}
@@ -1168,83 +1327,84 @@ func (fuelgauge *FuelGauge) WebSwitchBattery(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	var relay uint16
+	var bank int
 	switch vars["bank"] {
 	case "0":
-		if OnOff {
+		bank = LeftBank
+	case "1":
+		bank = RightBank
+	default:
+		http.Error(w, "bank 0(left) or 1(right) expected", http.StatusBadRequest)
+		return
+	}
+
+	err := fuelgauge.SwitchBattery(WebOrigin(r), bank, OnOff)
+	if err != nil {
+		http.Error(w, err.Error(), CommandStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+/**
+Switch one of the battery banks on or off by pulsing its relay. Refuses to turn a bank off if the other bank is
+already off.
+*/
+func (fuelgauge *FuelGauge) SwitchBattery(origin Origin, bank int, on bool) (err error) {
+	previousState := fuelgauge.bankStates()
+	defer func() {
+		fuelgauge.audit(origin, "switch_bank", map[string]interface{}{"bank": bank, "value": onOff(on)}, previousState, err)
+	}()
+	var relay uint16
+	switch bank {
+	case LeftBank:
+		if on {
 			relay = LeftBankOnRelay
 		} else {
 			// If the right battery is off (discrete input 8 = 1) DO NOT turn the left bank off
 			if fuelgauge.FgLeft.ModbusData.Discrete[RightBankSense] {
-				http.Error(w, "Cannot turn both batteries off.", http.StatusBadRequest)
-				return
+				return ErrBothBanksOff
 			}
 			relay = LeftBankOffRelay
 		}
-	case "1":
-		if OnOff {
+	case RightBank:
+		if on {
 			relay = RightBankOnRelay
 		} else {
 			// If the left battery is off (discrete input 8 = 1) DO NOT turn the left bank off
 			if fuelgauge.FgLeft.ModbusData.Discrete[LeftBankSense] {
-				http.Error(w, "Cannot turn both batteries off.", http.StatusBadRequest)
-				return
+				return ErrBothBanksOff
 			}
 			relay = RightBankOffRelay
 		}
 	default:
-		http.Error(w, "bank 0(left) or 1(right) expected", http.StatusBadRequest)
-		return
+		return ErrInvalidBank
 	}
 
 	// Activate the relay to switch the battery
-	err := fuelgauge.mbus.WriteCoil(relay, true, fuelgauge.FgLeft.SlaveAddress)
+	err = fuelgauge.mbus.WriteCoil(relay, true, fuelgauge.FgLeft.SlaveAddress)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 	time.Sleep(time.Second * 2)
-	err = fuelgauge.mbus.WriteCoil(relay, false, fuelgauge.FgLeft.SlaveAddress)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-	w.WriteHeader(http.StatusOK)
+	return fuelgauge.mbus.WriteCoil(relay, false, fuelgauge.FgLeft.SlaveAddress)
 }
 
 /**
 Get the charging efficiences from the system parameters
 */
-func (fuelgauge *FuelGauge) getChargingEfficiencies(db *sql.DB) error {
-	rows, err := db.Query("select name, double_value from system_parameters where name like 'charge__efficiency' order by name")
+func (fuelgauge *FuelGauge) getChargingEfficiencies() error {
+	efficiencies, err := fuelgauge.store.GetChargingEfficiencies()
 	if err != nil {
-		closeErr := db.Close()
-		if closeErr != nil {
-			log.Println(closeErr)
-		}
 		return err
-	} else {
-		for rows.Next() {
-			var name string
-			var efficiency float64
-			err = rows.Scan(&name, &efficiency)
-			if err != nil {
-				closeErr := db.Close()
-				if closeErr != nil {
-					log.Println(closeErr)
-				}
-				return err
-			}
-			if name == "charge0_efficiency" {
-				fuelgauge.FgLeft.Efficiency = efficiency
-			} else if name == "charge1_efficiency" {
-				fuelgauge.FgRight.Efficiency = efficiency
-			} else {
-				closeErr := db.Close()
-				if closeErr != nil {
-					log.Println(closeErr)
-				}
-				return errors.New("unknown entry in system parameters found matching query 'charge__efficiency'")
-			}
+	}
+	for name, efficiency := range efficiencies {
+		if name == "charge0_efficiency" {
+			fuelgauge.FgLeft.Efficiency = efficiency
+		} else if name == "charge1_efficiency" {
+			fuelgauge.FgRight.Efficiency = efficiency
+		} else {
+			return errors.New("unknown entry in system parameters found matching query 'charge__efficiency'")
 		}
 	}
 	return nil
@@ -1253,69 +1413,49 @@ func (fuelgauge *FuelGauge) getChargingEfficiencies(db *sql.DB) error {
 /**
 Initialise a new FuelGauge object and connect to the two fuel gauge controllers using the given parameters
 */
-func New(commsPort string, baudRate int, dataBits int, stopBits int, parity string, timeout time.Duration, pDataBase *sql.DB, slave1Address uint8, slave2Address uint8) *FuelGauge {
-	var err error
-	this := new(FuelGauge)
+func New(commsPort string, baudRate int, dataBits int, stopBits int, parity string, timeout time.Duration, store Storage.Store, queue *StoreAndForward.Queue, slave1Address uint8, slave2Address uint8) *FuelGauge {
+	this := NewWithController(ModbusController.New(commsPort, baudRate, dataBits, stopBits, parity, timeout), store, queue, slave1Address, slave2Address)
 	this.commsPort = commsPort
 	this.baudRate = baudRate
+	return this
+}
+
+/**
+Initialise a new FuelGauge object using an already configured modbus controller. Used by the simulator.
+*/
+func NewWithController(mbus *ModbusController.ModbusController, store Storage.Store, queue *StoreAndForward.Queue, slave1Address uint8, slave2Address uint8) *FuelGauge {
+	var err error
+	this := new(FuelGauge)
 	this.FgLeft.SlaveAddress = slave1Address
 	this.FgRight.SlaveAddress = slave2Address
 	this.FgLeft.ModbusData = Data.New(16, 1, 9, 1, 11, 1, 8, 1, this.FgLeft.SlaveAddress)
 	this.FgRight.ModbusData = Data.New(16, 1, 9, 1, 11, 1, 8, 1, this.FgRight.SlaveAddress)
 
 	// Set up the database connection
-	this.pDB = pDataBase
-	this.mbus = ModbusController.New(commsPort, baudRate, dataBits, stopBits, parity, timeout)
+	this.store = store
+	this.queue = queue
+	this.mbus = mbus
 	if this.mbus != nil {
 		defer this.mbus.Close()
 
 		err = this.mbus.Connect()
 		if err != nil {
-			log.Println("Port = ", commsPort, " baudrate = ", baudRate)
+			log.Println("Failed to connect to the fuel gauge controllers - ", err)
 			panic(err)
 		}
 	}
-	this.currentStatement, err = pDataBase.Prepare(`insert into current (logged, channel_0, channel_1, level_of_charge_0, level_of_charge_1) values (now(),?,?,?,?)`)
-	if err != nil {
-		log.Println("Error preparing insert current statement - ", err)
-		panic(err)
-	}
 
-	this.systemParamStatement, err = pDataBase.Prepare(`update system_parameters set double_value = double_value + ? where name = ?`)
+	when, count0, count1, err := store.GetLastCharge()
 	if err != nil {
-		log.Println("Error preparing system parameter update statement - ", err)
+		log.Println("Failed to get the last coulomb counts - ", err)
 		panic(err)
 	}
+	this.FgLeft.Coulombs = count0
+	this.FgLeft.LastUpdate = when.Time
+	this.FgRight.Coulombs = count1
+	this.FgRight.LastUpdate = when.Time
 
-	this.fullChargeStatement, err = pDataBase.Prepare(`select count(*) from serial_numbers where full_charge = 1 and cell_number between ? and ?`)
-	if err != nil {
-		log.Println("Error preparing full cell count statement - ", err)
-		panic(err)
-	}
-
-	rows, err := pDataBase.Query("select logged, level_of_charge_0, level_of_charge_1 from current order by logged desc limit 1")
-	if err != nil {
-		log.Println("Error getting last current values - ", err)
-		panic(err)
-	} else {
-		this.FgLeft.Coulombs = 0
-		this.FgRight.Coulombs = 0
-		for rows.Next() {
-			var count0 float32
-			var count1 float32
-			var when sql.NullTime
-			err = rows.Scan(&when, &count0, &count1)
-			if err != nil {
-				log.Println("Failed to get the last coulomb counts - ", err)
-				panic(err)
-			}
-			this.FgLeft.Coulombs = count0
-			this.FgLeft.LastUpdate = when.Time
-			this.FgRight.Coulombs = count1
-			this.FgRight.LastUpdate = when.Time
-		}
-	}
-	err = this.getChargingEfficiencies(pDataBase)
+	err = this.getChargingEfficiencies()
 	if err != nil {
 		log.Println("Failed to get the charging efficiencies - ", err)
 		panic(err)
@@ -1341,3 +1481,64 @@ func (fuelgauge *FuelGauge) Current() float32 {
 	//	return float32(int16(fuelgauge.FgLeft.ModbusData.Input[AvgCurrent-1])+int16(fuelgauge.FgRight.ModbusData.Input[AvgCurrent-1])) / 100.0
 	return float32(int16(fuelgauge.FgLeft.ModbusData.Input[AvgCurrent-1])) / 100.0
 }
+
+func (fuelgauge *FuelGauge) CurrentLeft() float32 {
+	return float32(int16(fuelgauge.FgLeft.ModbusData.Input[AvgCurrent-1])) / 100.0
+}
+
+func (fuelgauge *FuelGauge) CurrentRight() float32 {
+	return float32(int16(fuelgauge.FgRight.ModbusData.Input[AvgCurrent-1])) / 100.0
+}
+
+/**
+True if the coil on the fuel gauge controller is on. False if it has not been read yet.
+*/
+func coilState(data *Data.Data, coil uint16) bool {
+	return int(coil) <= len(data.Coil) && data.Coil[coil-1]
+}
+
+/**
+True if the battery house ventilation fan is on
+*/
+func (fuelgauge *FuelGauge) BatteryFanOn() bool {
+	return coilState(fuelgauge.FgLeft.ModbusData, BatteryFanRelay)
+}
+
+/**
+True if the generator is running
+*/
+func (fuelgauge *FuelGauge) GeneratorRunning() bool {
+	return coilState(fuelgauge.FgLeft.ModbusData, GeneratorRelay)
+}
+
+/**
+True if the watering system is on for the bank
+*/
+func (fuelgauge *FuelGauge) Watering(bank int) bool {
+	return coilState(fuelgauge.FgRight.ModbusData, waterRelay(uint8(bank)))
+}
+
+/**
+True if the bank is switched on. The sense input is set when the bank is off.
+*/
+func (fuelgauge *FuelGauge) BankOn(bank int) bool {
+	sense := LeftBankSense
+	if bank == RightBank {
+		sense = RightBankSense
+	}
+	return sense < len(fuelgauge.FgLeft.ModbusData.Discrete) && !fuelgauge.FgLeft.ModbusData.Discrete[sense]
+}
+
+/**
+Send warnings, such as having to switch a bank back on, through the notifier. Without one they are only logged.
+*/
+func (fuelgauge *FuelGauge) SetNotifier(notifier *Notifier.Notifier) {
+	fuelgauge.notifier = notifier
+}
+
+/**
+Return the number of failed Modbus transactions with the given slave since startup
+*/
+func (fuelgauge *FuelGauge) ModbusErrors(slave uint8) uint64 {
+	return fuelgauge.mbus.Errors(slave)
+}
@@ -1,90 +1,72 @@
 package FullChargeEvaluator
 
 import (
-	"database/sql"
+	"BatteryMonitor6813V4/Storage"
 	"log"
 	"time"
 )
 
+// A bank's full charge flags are cleared once it has been discharged below this state of charge
+const resetStateOfCharge = 90
+
 type FullChargeEval struct {
-	pDB              *sql.DB
-	loadDataSQL      *sql.Stmt
-	getSlopeSQL      *sql.Stmt
-	setFullChargeSQL *sql.Stmt
-	checkFullSQL     *sql.Stmt
-	systemParamsSQL  *sql.Stmt
-	fullFlags        [2][38]bool
-	span             int
-	threshold        float64
-	minRows          int64
+	store     Storage.Store
+	fullFlags [2][38]bool
+	span      int
+	threshold float64
+	minRows   int64
+	bankFull  []func(bank int, when time.Time)
 }
 
-func New(pDB *sql.DB) (*FullChargeEval, error) {
+func New(store Storage.Store) (*FullChargeEval, error) {
 	fce := new(FullChargeEval)
-	fce.pDB = pDB
-	var err error
-	fce.loadDataSQL, err = pDB.Prepare("call ChargingDataLoad(?,?,?)")
-	if err != nil {
-		log.Println("Failed to prepare the ChargingDataLoad statement -", err)
-		return nil, err
-	}
-	fce.getSlopeSQL, err = pDB.Prepare("select Slope(?)")
-	if err != nil {
-		log.Println("Failed to prepare the select Slope statement-", err)
-		return nil, err
-	}
-	fce.setFullChargeSQL, err = pDB.Prepare("update serial_numbers set full_charge=?, full_charge_detected=? where cell_number=?")
-	if err != nil {
-		log.Println("Failed to prepare the update serial_numbers statement -", err)
-		return nil, err
-	}
-	fce.checkFullSQL, err = pDB.Prepare("select cell_number, full_charge from serial_numbers")
-	if err != nil {
-		log.Println("Failed to prepare the select cell_number, full_charge from serial_numbers -", err)
-		return nil, err
-	}
-	fce.systemParamsSQL, err = pDB.Prepare("select ifnull(date_value ,ifnull(double_value, integer_value)) as value from system_parameters where name = ?")
-	if err != nil {
-		log.Println("Failed to prepare the select from system_parameters statement -", err)
-		return nil, err
-	}
+	fce.store = store
 	return fce, nil
 }
 
+/**
+Call the function whenever the last cell of a bank reaches full charge. Functions are called in the order they were added.
+*/
+func (fullChargeEvaluator *FullChargeEval) OnBankFull(bankFull func(bank int, when time.Time)) {
+	fullChargeEvaluator.bankFull = append(fullChargeEvaluator.bankFull, bankFull)
+}
+
+func (fullChargeEvaluator *FullChargeEval) bankIsFull(bank int) bool {
+	for _, full := range fullChargeEvaluator.fullFlags[bank] {
+		if !full {
+			return false
+		}
+	}
+	return true
+}
+
 func (fullChargeEvaluator *FullChargeEval) loadFullFlags() error {
-	row := fullChargeEvaluator.systemParamsSQL.QueryRow("full_charge_min_rows")
-	err := row.Scan(&fullChargeEvaluator.minRows)
+	var err error
+	fullChargeEvaluator.minRows, err = fullChargeEvaluator.store.GetParameterInt("full_charge_min_rows")
 	if err != nil {
 		log.Println("Failed to get full_charge_min_rows from system_parameters.", err)
 		return err
 	}
 
-	row = fullChargeEvaluator.systemParamsSQL.QueryRow("full_charge_scan_mins")
-	err = row.Scan(&fullChargeEvaluator.span)
+	span, err := fullChargeEvaluator.store.GetParameterInt("full_charge_scan_mins")
 	if err != nil {
 		log.Println("Failed to get full_charge_scan_mins from system_parameters.", err)
 		return err
 	}
+	fullChargeEvaluator.span = int(span)
 
-	row = fullChargeEvaluator.systemParamsSQL.QueryRow("full_charge_threshold")
-	err = row.Scan(&fullChargeEvaluator.threshold)
+	fullChargeEvaluator.threshold, err = fullChargeEvaluator.store.GetParameterFloat("full_charge_threshold")
 	if err != nil {
 		log.Println("Failed to get full_charge_threshold from system_parameters.", err)
 		return err
 	}
 
-	rows, err := fullChargeEvaluator.checkFullSQL.Query()
+	flags, err := fullChargeEvaluator.store.GetFullChargeFlags()
 	if err != nil {
 		log.Println("Failed to get the current full cell status.", err)
 		return err
 	}
-	var cellNumber uint8
-	var fullCharge bool
-	for rows.Next() {
-		if err = rows.Scan(&cellNumber, &fullCharge); err != nil {
-			log.Println("Error getting full charge rows. ", err)
-			return err
-		}
+	for cellNumber, fullCharge := range flags {
 		if cellNumber < 100 {
 			fullChargeEvaluator.fullFlags[0][cellNumber-1] = fullCharge
 		} else {
@@ -94,32 +76,31 @@ func (fullChargeEvaluator *FullChargeEval) loadFullFlags() error {
 	return nil
 }
 
-func (fullChargeEvaluator *FullChargeEval) loadTemporaryTable(when time.Time, span int, bank uint8) (rows int64, err error) {
-	rows = 0
-	row := fullChargeEvaluator.loadDataSQL.QueryRow(when, span, bank)
-	err = row.Scan(&rows)
-	if err != nil {
-		log.Println("Error getting row count for temporary table -", err)
-	}
-	return
+func (fullChargeEvaluator *FullChargeEval) setFullChargeState(state bool, when time.Time, cell int) (err error) {
+	return fullChargeEvaluator.store.SetCellFullCharge(cell, state, when)
 }
 
-func (fullChargeEvaluator *FullChargeEval) getFullChargeState(cell int, threshold float64) (bool, error) {
-	var slope sql.NullFloat64
-
-	res := fullChargeEvaluator.getSlopeSQL.QueryRow(cell)
-	err := res.Scan(&slope)
-	//	log.Println("Cell ", cell, " slope = ", slope, " threshold = ", threshold)
-	if slope.Valid {
-		return slope.Float64 < threshold, err
-	} else {
-		return false, err
+/**
+Clear the full charge flags of a bank that has been discharged below 90% so its next full charge is detected and the
+bank full functions are called again. Uses the flags read by the last ProcessFullCharge.
+*/
+func (fullChargeEvaluator *FullChargeEval) ResetWhenDischarged(bank int, stateOfCharge float32) error {
+	if stateOfCharge >= resetStateOfCharge {
+		return nil
 	}
-}
-
-func (fullChargeEvaluator *FullChargeEval) setFullChargeState(state bool, when time.Time, cell int) (err error) {
-	_, err = fullChargeEvaluator.setFullChargeSQL.Exec(state, when, cell)
-	return
+	anyFull := false
+	for _, full := range fullChargeEvaluator.fullFlags[bank] {
+		anyFull = anyFull || full
+	}
+	if !anyFull {
+		return nil
+	}
+	if err := fullChargeEvaluator.store.ClearFullCharge(bank); err != nil {
+		return err
+	}
+	log.Printf("Bank %d discharged to %.0f%% - full charge flags cleared", bank, stateOfCharge)
+	fullChargeEvaluator.fullFlags[bank] = [38]bool{}
+	return nil
 }
 
 func (fullChargeEvaluator *FullChargeEval) ProcessFullCharge(when time.Time) error {
@@ -129,20 +110,18 @@ func (fullChargeEvaluator *FullChargeEval) ProcessFullCharge(when time.Time) err
 		return err
 	}
 	for bank := range fullChargeEvaluator.fullFlags {
-		rows, err := fullChargeEvaluator.loadTemporaryTable(when, fullChargeEvaluator.span, uint8(bank))
+		rows, slopes, err := fullChargeEvaluator.store.CellVoltageSlopes(bank, when, fullChargeEvaluator.span)
 		if err != nil {
 			log.Println("Error getting the data to process -", err)
 			return err
 		}
 		if rows >= fullChargeEvaluator.minRows {
+			wasFull := fullChargeEvaluator.bankIsFull(bank)
 			//			fmt.Println(rows, "rows read for bank", bank)
 			for cell, flag := range fullChargeEvaluator.fullFlags[bank] {
 				if !flag {
-					full, err := fullChargeEvaluator.getFullChargeState(cell+1, fullChargeEvaluator.threshold)
-					if err != nil {
-						log.Println("Failed to get the cell state for cell ", cell+1, " - ", err)
-						return err
-					}
+					//	log.Println("Cell ", cell+1, " slope = ", slopes[cell], " threshold = ", fullChargeEvaluator.threshold)
+					full := slopes[cell].Valid && (slopes[cell].Float64 < fullChargeEvaluator.threshold)
 					fullChargeEvaluator.fullFlags[bank][cell] = full
 					if full {
 						err := fullChargeEvaluator.setFullChargeState(true, when, cell+1)
@@ -153,6 +132,11 @@ func (fullChargeEvaluator *FullChargeEval) ProcessFullCharge(when time.Time) err
 					}
 				}
 			}
+			if !wasFull && fullChargeEvaluator.bankIsFull(bank) {
+				for _, bankFull := range fullChargeEvaluator.bankFull {
+					bankFull(bank, when)
+				}
+			}
 			//		} else {
 			//			log.Println("Only", rows, "rows were found for time", when)
 		}
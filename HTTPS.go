@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const httpAddress = ":8000"
+const certificateLifetime = 10 * 365 * 24 * time.Hour
+
+// How the web server is to be run. Set up by configureHTTPS.
+var webServer struct {
+	tls          bool
+	certFile     string
+	keyFile      string
+	httpsAddress string
+	redirect     bool
+}
+
+/**
+Check the certificate and key for HTTPS, making a self-signed pair if neither file exists yet.
+*/
+func configureHTTPS(enable bool, certFile string, keyFile string, httpsAddress string, redirect bool) {
+	webServer.tls = enable
+	webServer.certFile = certFile
+	webServer.keyFile = keyFile
+	webServer.httpsAddress = httpsAddress
+	webServer.redirect = redirect
+	if !enable {
+		return
+	}
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		log.Println("Creating a self-signed certificate in", certFile)
+		if err := generateCertificate(certFile, keyFile); err != nil {
+			log.Fatalf("Failed to create the self-signed certificate - %s - Sorry, I am giving up.", err)
+		}
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		log.Fatalf("Failed to load the HTTPS certificate %s and key %s - %s - Sorry, I am giving up.", certFile, keyFile, err)
+	}
+}
+
+/**
+Write a self-signed certificate for this host's name and addresses and its private key
+*/
+func generateCertificate(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"Cedar Technology Battery Manager"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certificateLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname, "localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if addresses, err := net.InterfaceAddrs(); err == nil {
+		for _, address := range addresses {
+			if ipNet, ok := address.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = writePEM(keyFile, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(path string, blockType string, der []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err = pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/**
+Send plain HTTP requests to the same path on the HTTPS server. 308 keeps the method so PATCH and POST still work.
+*/
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	_, port, _ := net.SplitHostPort(webServer.httpsAddress)
+	if port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+func newServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler: handler,
+		Addr:    address,
+		// Good practice: enforce timeouts for servers you create!
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+}
+
+/**
+Remove the write timeout from a response that streams for longer than the server normally allows. Only this response
+is affected, over HTTP/1.1 or HTTP/2.
+*/
+func clearWriteDeadline(w http.ResponseWriter) {
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Println("Failed to clear the write deadline -", err)
+	}
+}
+
+/**
+Run the web server on :8000, or on the HTTPS address with :8000 either redirecting to it or serving plain HTTP as well.
+Only returns if a server fails.
+*/
+func serveWeb(handler http.Handler) error {
+	if !webServer.tls {
+		return newServer(httpAddress, handler).ListenAndServe()
+	}
+	plain := handler
+	if webServer.redirect {
+		plain = http.HandlerFunc(redirectToHTTPS)
+	}
+	go func() {
+		if err := newServer(httpAddress, plain).ListenAndServe(); err != nil {
+			log.Println("HTTP server error - ", err)
+		}
+	}()
+	log.Println("Serving HTTPS on", webServer.httpsAddress)
+	return newServer(webServer.httpsAddress, handler).ListenAndServeTLS(webServer.certFile, webServer.keyFile)
+}
@@ -8,6 +8,7 @@ import (
 	"math"
 	"periph.io/x/periph/conn/spi"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -47,6 +48,9 @@ type LTC6813 struct {
 	lastTempError     string
 }
 
+// PEC errors seen since startup. Kept outside the device so it survives the chain being re-initialised.
+var pecErrors uint64
+
 // Configuration Register A codes
 const ADC_OPTION_0 = 0x00
 
@@ -277,6 +281,13 @@ func (this *LTC6813) clearPacket() {
 	}
 }
 
+/**
+Return the number of PEC errors seen since startup
+*/
+func PECErrors() uint64 {
+	return atomic.LoadUint64(&pecErrors)
+}
+
 /**
 Calculate the PEC for the given data block
 */
@@ -402,12 +413,13 @@ Checks the PEC for the command and each banks data block
 func (this *LTC6813) checkPEC(sError string, bCheckCmd bool) error {
 	if bCheckCmd {
 		if this.getCmdPEC() != this.calculateCmdPEC() {
+			atomic.AddUint64(&pecErrors, 1)
 			return fmt.Errorf("PEC error in Command")
 		}
 	}
 	for i := 0; i < this.chainLength; i++ {
 		if this.getDataPEC(i) != this.calculateDataPEC(i) {
-
+			atomic.AddUint64(&pecErrors, 1)
 			return fmt.Errorf("PEC error in data block %d %x [%x] %s", i, this.getData(0), this.getData(i), sError)
 		}
 	}
@@ -1078,6 +1090,20 @@ func (this *LTC6813) GetValuesAsJSON() []byte {
 	return j
 }
 
+/**
+Return the error from the last voltage measurement or an empty string if it succeeded
+*/
+func (this *LTC6813) VoltageError() string {
+	return this.lastVoltageError
+}
+
+/**
+Return the error from the last temperature measurement or an empty string if it succeeded
+*/
+func (this *LTC6813) TemperatureError() string {
+	return this.lastTempError
+}
+
 func (this *LTC6813) GetMaxTemperature() (tMax float32) {
 	tMax = 0.0
 	for _, reading := range this.readings {
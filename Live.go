@@ -0,0 +1,116 @@
+package main
+
+import (
+	websocket "BatteryMonitor6813V4/ModbusBatteryFuelGauge/webSocket"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The live data topics. Single cells are bank/{bank}/cell/{cell} with cells numbered from 1 as in MQTT.
+const (
+	topicBattery   = "battery"
+	topicInverter  = "inverter"
+	topicFuelGauge = "fuelgauge"
+	topicAlarms    = "alarms"
+	// Everything together in the format /ws has always sent
+	topicDashboard = "dashboard"
+)
+
+var liveHub = websocket.NewHub(validLiveTopic)
+
+func validLiveTopic(topic string) bool {
+	switch topic {
+	case topicBattery, topicInverter, topicFuelGauge, topicAlarms, topicDashboard:
+		return true
+	}
+	var bank, cell int
+	if n, err := fmt.Sscanf(topic, "bank/%d/cell/%d", &bank, &cell); err != nil || n != 2 {
+		return false
+	}
+	return cellTopic(bank, cell) == topic && bank >= 0 && bank <= 1 && cell >= 1 && cell <= cellsPerBank
+}
+
+func cellTopic(bank int, cell int) string {
+	return "bank/" + strconv.Itoa(bank) + "/cell/" + strconv.Itoa(cell)
+}
+
+/**
+Return the battery, inverter and fuel gauge values as JSON
+*/
+func liveValues() (battery json.RawMessage, inverter json.RawMessage, fuelGauge json.RawMessage) {
+	battery = ltc.GetValuesAsJSON()
+	sFuelGauge, err := fuelgauge.GetData()
+	if err != nil {
+		log.Println("Failed to get the fuelgauge data - ", err)
+		sFuelGauge = `{"error":` + strconv.Quote(err.Error()) + `}`
+	}
+	inverter, err = json.Marshal(&iValues)
+	if err != nil {
+		log.Println("Failed to get the inverter data - ", err)
+		inverter = json.RawMessage(`{}`)
+	}
+	return battery, inverter, json.RawMessage(sFuelGauge)
+}
+
+/**
+Put the values together the way /ws has always sent them
+*/
+func dashboardJSON(battery json.RawMessage, inverter json.RawMessage, fuelGauge json.RawMessage) json.RawMessage {
+	return json.RawMessage(`{"battery":` + string(battery) + `,"inverter":` + string(inverter) + `,"fuelgauge":` + string(fuelGauge) + `}`)
+}
+
+/**
+Send this cycle's values to the live data websocket clients. Only the topics somebody has subscribed to are serialised.
+*/
+func publishLive() {
+	if liveHub.Clients() == 0 {
+		return
+	}
+	battery, inverter, fuelGauge := liveValues()
+	topics := map[string]interface{}{
+		topicBattery:   battery,
+		topicInverter:  inverter,
+		topicFuelGauge: fuelGauge,
+		topicDashboard: dashboardJSON(battery, inverter, fuelGauge),
+	}
+	if alarmEngine != nil {
+		topics[topicAlarms] = map[string]interface{}{"active": alarmEngine.Active()}
+	}
+	type liveCell struct {
+		Volts       float32  `json:"volts"`
+		Temperature *float32 `json:"temperature"`
+	}
+	for bank := 0; bank < 2; bank++ {
+		for cell := 0; cell < cellsPerBank; cell++ {
+			device, sensor := cellIndex(bank, cell)
+			value := liveCell{Volts: ltc.GetVolts(device, sensor)}
+			if temperature, err := ltc.GetTemperature(device, sensor); err == nil {
+				value.Temperature = &temperature
+			}
+			topics[cellTopic(bank, cell+1)] = value
+		}
+	}
+	liveHub.Publish(topics)
+}
+
+/**
+Live data websocket with subscriptions. Topics are battery, inverter, fuelgauge, alarms, dashboard and
+bank/{bank}/cell/{cell}. The first topics can be given as ?topics=battery,inverter and changed by sending
+{"subscribe":[...]} or {"unsubscribe":[...]}. Each topic starts with a snapshot followed by just the changes each cycle.
+*/
+func startLiveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var topics []string
+	if value := r.FormValue("topics"); value != "" {
+		topics = strings.Split(value, ",")
+	}
+	liveHub.Serve(conn, topics)
+}
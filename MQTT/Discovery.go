@@ -0,0 +1,111 @@
+package MQTT
+
+import (
+	"encoding/json"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"regexp"
+)
+
+/**
+Device groups the entities in Home Assistant
+*/
+type Device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+/**
+Entity is one Home Assistant sensor, binary_sensor or switch. StateTopic and CommandTopic are relative to the prefix
+and are filled out along with the device and availability when the configuration is published.
+*/
+type Entity struct {
+	Component           string  `json:"-"`
+	ObjectID            string  `json:"-"`
+	Name                string  `json:"name"`
+	UniqueID            string  `json:"unique_id"`
+	StateTopic          string  `json:"state_topic,omitempty"`
+	CommandTopic        string  `json:"command_topic,omitempty"`
+	DeviceClass         string  `json:"device_class,omitempty"`
+	StateClass          string  `json:"state_class,omitempty"`
+	UnitOfMeasurement   string  `json:"unit_of_measurement,omitempty"`
+	Icon                string  `json:"icon,omitempty"`
+	PayloadOn           string  `json:"payload_on,omitempty"`
+	PayloadOff          string  `json:"payload_off,omitempty"`
+	StateOn             string  `json:"state_on,omitempty"`
+	StateOff            string  `json:"state_off,omitempty"`
+	AvailabilityTopic   string  `json:"availability_topic"`
+	PayloadAvailable    string  `json:"payload_available"`
+	PayloadNotAvailable string  `json:"payload_not_available"`
+	Device              *Device `json:"device"`
+}
+
+type discovery struct {
+	prefix   string
+	nodeID   string
+	device   Device
+	entities []Entity
+}
+
+var invalidID = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+/**
+Publish Home Assistant discovery configurations for the entities under discoveryPrefix (normally homeassistant).
+They are sent every time the client connects and again whenever Home Assistant announces it has restarted on
+<discoveryPrefix>/status. Call before Connect.
+*/
+func (client *Client) Discover(discoveryPrefix string, device Device, entities []Entity) {
+	d := new(discovery)
+	d.prefix = discoveryPrefix
+	d.nodeID = invalidID.ReplaceAllString(client.prefix, "_")
+	d.device = device
+	for _, entity := range entities {
+		entity.UniqueID = d.nodeID + "_" + entity.ObjectID
+		if entity.StateTopic != "" {
+			entity.StateTopic = client.Topic(entity.StateTopic)
+		}
+		if entity.CommandTopic != "" {
+			entity.CommandTopic = client.Topic(entity.CommandTopic)
+		}
+		entity.AvailabilityTopic = client.Topic(StatusTopic)
+		entity.PayloadAvailable = Online
+		entity.PayloadNotAvailable = Offline
+		entity.Device = &d.device
+		d.entities = append(d.entities, entity)
+	}
+	client.mu.Lock()
+	client.discovery = d
+	client.mu.Unlock()
+}
+
+func (client *Client) publishDiscovery() {
+	d := client.discovery
+	for _, entity := range d.entities {
+		config, err := json.Marshal(entity)
+		if err != nil {
+			log.Println("Failed to build the Home Assistant configuration for", entity.ObjectID, "-", err)
+			continue
+		}
+		client.client.Publish(d.prefix+"/"+entity.Component+"/"+d.nodeID+"/"+entity.ObjectID+"/config", 1, true, config)
+	}
+}
+
+func (client *Client) subscribeDiscovery() {
+	token := client.client.Subscribe(client.discovery.prefix+"/status", 1, func(_ mqtt.Client, message mqtt.Message) {
+		if string(message.Payload()) == Online {
+			log.Println("Home Assistant has started, sending the discovery configuration")
+			client.publishDiscovery()
+			client.mu.Lock()
+			// Send the current values again as well
+			client.published = make(map[string]string)
+			client.mu.Unlock()
+		}
+	})
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Println("Failed to subscribe to the Home Assistant status -", token.Error())
+		}
+	}()
+}
@@ -0,0 +1,211 @@
+package MQTT
+
+import (
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Unchanged values are only published again after this long so new subscribers and the broker stay current
+const refreshInterval = time.Minute
+
+// Availability of the battery monitor is published here, relative to the prefix
+const StatusTopic = "status"
+const Online = "online"
+const Offline = "offline"
+
+/**
+CommandHandler carries out a command received on <prefix>/command/<name>/... The topic levels after the command name
+are passed in args.
+*/
+type CommandHandler func(args []string, payload string) error
+
+/**
+Client publishes the live data to an MQTT broker as retained topics and carries out the commands it receives.
+*/
+type Client struct {
+	client      mqtt.Client
+	prefix      string
+	mu          sync.Mutex
+	commands    map[string]CommandHandler
+	published   map[string]string
+	lastRefresh time.Time
+	discovery   *discovery
+}
+
+/**
+Create a client for the broker, e.g. tcp://localhost:1883. Topics are published under prefix. Register the commands
+before calling Connect. <prefix>/status is set to online when connected and the broker sets it to offline when the
+connection is lost or the process stops.
+*/
+func New(broker string, clientID string, username string, password string, prefix string) *Client {
+	client := new(Client)
+	client.prefix = strings.TrimSuffix(prefix, "/")
+	client.commands = make(map[string]CommandHandler)
+	client.published = make(map[string]string)
+
+	options := mqtt.NewClientOptions()
+	options.AddBroker(broker)
+	options.SetClientID(clientID)
+	options.SetUsername(username)
+	options.SetPassword(password)
+	options.SetAutoReconnect(true)
+	options.SetConnectRetry(true)
+	options.SetConnectRetryInterval(10 * time.Second)
+	options.SetWill(client.Topic(StatusTopic), Offline, 1, true)
+	options.SetOnConnectHandler(client.onConnect)
+	options.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Println("Lost the connection to the MQTT broker -", err)
+	})
+	client.client = mqtt.NewClient(options)
+	return client
+}
+
+/**
+The topic for the given levels under the prefix
+*/
+func (client *Client) Topic(levels ...string) string {
+	return client.prefix + "/" + strings.Join(levels, "/")
+}
+
+/**
+Add a command. It is subscribed to as <prefix>/command/<name>/#
+*/
+func (client *Client) HandleCommand(name string, handler CommandHandler) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.commands[name] = handler
+}
+
+/**
+Start connecting to the broker. Returns straight away and keeps retrying in the background if the broker is not there.
+*/
+func (client *Client) Connect() {
+	client.client.Connect()
+}
+
+func (client *Client) onConnect(c mqtt.Client) {
+	log.Println("Connected to the MQTT broker")
+	client.mu.Lock()
+	// Send everything again after a reconnect
+	client.published = make(map[string]string)
+	client.mu.Unlock()
+	c.Publish(client.Topic(StatusTopic), 1, true, Online)
+	token := c.Subscribe(client.Topic("command", "#"), 1, client.onCommand)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Println("Failed to subscribe to the MQTT commands -", token.Error())
+		}
+	}()
+	if client.discovery != nil {
+		client.publishDiscovery()
+		client.subscribeDiscovery()
+	}
+}
+
+/**
+Result of a command, published to <prefix>/command/result
+*/
+type commandResult struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (client *Client) onCommand(c mqtt.Client, message mqtt.Message) {
+	levels := strings.Split(strings.TrimPrefix(message.Topic(), client.Topic("command")+"/"), "/")
+	if levels[0] == "result" {
+		return
+	}
+	client.mu.Lock()
+	handler, found := client.commands[levels[0]]
+	client.mu.Unlock()
+	// Commands can take a while (switching a bank takes a few seconds) so do not hold up the MQTT client
+	go func() {
+		result := commandResult{Topic: message.Topic(), Payload: string(message.Payload())}
+		var err error
+		if found {
+			log.Println("MQTT command", message.Topic(), string(message.Payload()))
+			err = handler(levels[1:], strings.TrimSpace(string(message.Payload())))
+		} else {
+			err = fmt.Errorf("unknown command %s", levels[0])
+		}
+		if err != nil {
+			log.Println("MQTT command", message.Topic(), "failed -", err)
+			result.Error = err.Error()
+		} else {
+			result.Success = true
+		}
+		if payload, err := json.Marshal(result); err == nil {
+			c.Publish(client.Topic("command", "result"), 1, false, payload)
+		}
+	}()
+}
+
+/**
+Publish the values as retained messages. Keys are topics relative to the prefix. Values that have not changed since
+they were last sent are skipped unless it is time for a refresh.
+*/
+func (client *Client) Publish(values map[string]string) {
+	if !client.client.IsConnectionOpen() {
+		return
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	refresh := time.Since(client.lastRefresh) > refreshInterval
+	if refresh {
+		client.lastRefresh = time.Now()
+	}
+	for topic, value := range values {
+		if last, found := client.published[topic]; found && last == value && !refresh {
+			continue
+		}
+		client.published[topic] = value
+		client.client.Publish(client.prefix+"/"+topic, 0, true, value)
+	}
+}
+
+/**
+Add the JSON value to the topics, one topic per value. Objects become levels named by their keys and arrays become
+levels numbered from 1.
+*/
+func Flatten(topic string, value interface{}, topics map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			Flatten(topic+"/"+key, item, topics)
+		}
+	case []interface{}:
+		for i, item := range v {
+			Flatten(topic+"/"+strconv.Itoa(i+1), item, topics)
+		}
+	case nil:
+		topics[topic] = ""
+	case string:
+		topics[topic] = v
+	case float64:
+		topics[topic] = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		topics[topic] = strconv.FormatBool(v)
+	default:
+		topics[topic] = fmt.Sprint(v)
+	}
+}
+
+/**
+Add a JSON document to the topics
+*/
+func FlattenJSON(topic string, document []byte, topics map[string]string) error {
+	var value interface{}
+	if err := json.Unmarshal(document, &value); err != nil {
+		return err
+	}
+	Flatten(topic, value, topics)
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/FuelGauge"
+	"BatteryMonitor6813V4/MQTT"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var mqttClient *MQTT.Client
+
+// MQTT does not say who sent a command so they are audited without a user
+var mqttOrigin = FuelGauge.Origin{Source: FuelGauge.SourceMQTT}
+
+/**
+Connect to the MQTT broker and set up the commands. Does nothing if no broker was given.
+*/
+func startMQTT(broker string, clientID string, username string, password string, prefix string, discoveryPrefix string) {
+	if broker == "" {
+		return
+	}
+	mqttClient = MQTT.New(broker, clientID, username, password, prefix)
+	mqttClient.HandleCommand("fan", mqttBatteryFan)
+	mqttClient.HandleCommand("generator", mqttGenerator)
+	mqttClient.HandleCommand("water", mqttWaterBank)
+	mqttClient.HandleCommand("bank", mqttSwitchBattery)
+	if discoveryPrefix != "" {
+		mqttClient.Discover(discoveryPrefix, MQTT.Device{
+			Identifiers:  []string{clientID},
+			Name:         "Battery Monitor",
+			Manufacturer: "Cedar Technology",
+			Model:        "BatteryMonitor6813V4",
+		}, homeAssistantEntities())
+	}
+	mqttClient.Connect()
+	log.Println("Publishing to MQTT broker", broker, "under", prefix)
+}
+
+// Minutes the watering system runs for when it is switched on from Home Assistant
+const homeAssistantWateringMinutes = 5
+
+var bankNames = [2]string{"Left", "Right"}
+var fuelgaugeBanks = [2]string{"left", "right"}
+
+/**
+The sensors and switches announced to Home Assistant. State topics are published by publishMQTT and the command
+topics are the MQTT commands.
+*/
+func homeAssistantEntities() []MQTT.Entity {
+	var entities []MQTT.Entity
+	for bank, name := range bankNames {
+		sBank := strconv.Itoa(bank)
+		entities = append(entities,
+			MQTT.Entity{Component: "sensor", ObjectID: "bank" + sBank + "_volts", Name: name + " Bank Voltage",
+				StateTopic: "battery/bank/" + sBank + "/volts", DeviceClass: "voltage", StateClass: "measurement", UnitOfMeasurement: "V"},
+			MQTT.Entity{Component: "sensor", ObjectID: "bank" + sBank + "_soc", Name: name + " Bank State of Charge",
+				StateTopic: "fuelgauge/" + fuelgaugeBanks[bank] + "/soc", DeviceClass: "battery", StateClass: "measurement", UnitOfMeasurement: "%"},
+			MQTT.Entity{Component: "sensor", ObjectID: "bank" + sBank + "_current", Name: name + " Bank Current",
+				StateTopic: "fuelgauge/" + fuelgaugeBanks[bank] + "/current", DeviceClass: "current", StateClass: "measurement", UnitOfMeasurement: "A"},
+			MQTT.Entity{Component: "sensor", ObjectID: "bank" + sBank + "_max_temperature", Name: name + " Bank Max Temperature",
+				StateTopic: "battery/bank/" + sBank + "/max_temperature", DeviceClass: "temperature", StateClass: "measurement", UnitOfMeasurement: "°C"},
+			MQTT.Entity{Component: "switch", ObjectID: "bank" + sBank + "_water", Name: name + " Bank Watering", Icon: "mdi:water",
+				StateTopic: "state/water/" + sBank, CommandTopic: "command/water/" + sBank,
+				PayloadOn: strconv.Itoa(homeAssistantWateringMinutes), PayloadOff: "0", StateOn: "ON", StateOff: "OFF"},
+			MQTT.Entity{Component: "switch", ObjectID: "bank" + sBank + "_switch", Name: name + " Bank", Icon: "mdi:battery",
+				StateTopic: "state/bank/" + sBank, CommandTopic: "command/bank/" + sBank,
+				PayloadOn: "on", PayloadOff: "off", StateOn: "ON", StateOff: "OFF"},
+		)
+	}
+	return append(entities,
+		MQTT.Entity{Component: "switch", ObjectID: "fan", Name: "Battery Fan", Icon: "mdi:fan",
+			StateTopic: "state/fan", CommandTopic: "command/fan",
+			PayloadOn: "on", PayloadOff: "off", StateOn: "ON", StateOff: "OFF"},
+		MQTT.Entity{Component: "switch", ObjectID: "generator", Name: "Generator", Icon: "mdi:engine",
+			StateTopic: "state/generator", CommandTopic: "command/generator",
+			PayloadOn: "start", PayloadOff: "stop", StateOn: "ON", StateOff: "OFF"},
+	)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "ON"
+	}
+	return "OFF"
+}
+
+/**
+Parse an on/off (or start/stop) command payload
+*/
+func parseOnOff(payload string, on string, off string) (bool, error) {
+	switch {
+	case strings.EqualFold(payload, on):
+		return true, nil
+	case strings.EqualFold(payload, off):
+		return false, nil
+	}
+	return false, fmt.Errorf("%s or %s expected", on, off)
+}
+
+/**
+Parse the bank number from the topic
+*/
+func parseBank(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, errors.New("bank 0(left) or 1(right) expected in the topic")
+	}
+	bank, err := strconv.ParseUint(args[0], 10, 8)
+	if err != nil || bank > 1 {
+		return 0, FuelGauge.ErrInvalidBank
+	}
+	return int(bank), nil
+}
+
+/**
+<prefix>/command/fan  on|off
+*/
+func mqttBatteryFan(_ []string, payload string) error {
+	on, err := parseOnOff(payload, "on", "off")
+	if err != nil {
+		return err
+	}
+	return fuelgauge.SetBatteryFan(mqttOrigin, on)
+}
+
+/**
+<prefix>/command/generator  start|stop
+*/
+func mqttGenerator(_ []string, payload string) error {
+	run, err := parseOnOff(payload, "start", "stop")
+	if err != nil {
+		return err
+	}
+	return fuelgauge.SetGenerator(mqttOrigin, run)
+}
+
+/**
+<prefix>/command/water/{bank}  minutes, 0 turns it off
+*/
+func mqttWaterBank(args []string, payload string) error {
+	bank, err := parseBank(args)
+	if err != nil {
+		return err
+	}
+	minutes, err := strconv.ParseUint(payload, 10, 8)
+	if err != nil {
+		return FuelGauge.ErrInvalidWateringTime
+	}
+	return fuelgauge.Water(mqttOrigin, uint64(bank), minutes)
+}
+
+/**
+<prefix>/command/bank/{bank}  on|off
+*/
+func mqttSwitchBattery(args []string, payload string) error {
+	bank, err := parseBank(args)
+	if err != nil {
+		return err
+	}
+	on, err := parseOnOff(payload, "on", "off")
+	if err != nil {
+		return err
+	}
+	return fuelgauge.SwitchBattery(mqttOrigin, bank, on)
+}
+
+/**
+Publish the battery, inverter and fuel gauge data sent to the /ws websocket clients. Cells are published per bank as
+battery/bank/{bank}/cell/{cell}/volts and .../temperature with cells numbered from 1.
+*/
+func publishMQTT() {
+	if mqttClient == nil {
+		return
+	}
+	topics := make(map[string]string)
+	if ltc != nil {
+		var battery struct {
+			VoltageError     string       `json:"voltage_error"`
+			TemperatureError string       `json:"temperature_error"`
+			Voltages         [2][]uint16  `json:"voltages"`
+			Totals           [2]float32   `json:"totals"`
+			Temperatures     [2][]float32 `json:"temperatures"`
+		}
+		if err := json.Unmarshal(ltc.GetValuesAsJSON(), &battery); err != nil {
+			log.Println("Failed to read the battery values for MQTT -", err)
+		} else {
+			topics["battery/voltage_error"] = battery.VoltageError
+			topics["battery/temperature_error"] = battery.TemperatureError
+			for bank := range battery.Voltages {
+				sBank := "battery/bank/" + strconv.Itoa(bank)
+				topics[sBank+"/volts"] = strconv.FormatFloat(float64(battery.Totals[bank]), 'f', 2, 32)
+				for cell, volts := range battery.Voltages[bank] {
+					topics[sBank+"/cell/"+strconv.Itoa(cell+1)+"/volts"] = strconv.FormatFloat(float64(volts)/10000.0, 'f', 4, 64)
+				}
+				maxTemperature := float32(math.Inf(-1))
+				for cell, temperature := range battery.Temperatures[bank] {
+					topics[sBank+"/cell/"+strconv.Itoa(cell+1)+"/temperature"] = strconv.FormatFloat(float64(temperature), 'f', 1, 32)
+					if temperature > maxTemperature {
+						maxTemperature = temperature
+					}
+				}
+				if len(battery.Temperatures[bank]) > 0 {
+					topics[sBank+"/max_temperature"] = strconv.FormatFloat(float64(maxTemperature), 'f', 1, 32)
+				}
+			}
+		}
+	}
+	if jInverter, err := json.Marshal(&iValues); err != nil {
+		log.Println("Failed to read the inverter values for MQTT -", err)
+	} else if err = MQTT.FlattenJSON("inverter", jInverter, topics); err != nil {
+		log.Println("Failed to read the inverter values for MQTT -", err)
+	}
+	if fuelgauge != nil {
+		if sFuelgauge, err := fuelgauge.GetData(); err != nil {
+			log.Println("Failed to get the fuelgauge data for MQTT -", err)
+		} else if err = MQTT.FlattenJSON("fuelgauge", []byte(sFuelgauge), topics); err != nil {
+			log.Println("Failed to read the fuelgauge data for MQTT -", err)
+		}
+		topics["fuelgauge/left/current"] = strconv.FormatFloat(float64(fuelgauge.CurrentLeft()), 'f', 2, 32)
+		topics["fuelgauge/right/current"] = strconv.FormatFloat(float64(fuelgauge.CurrentRight()), 'f', 2, 32)
+		topics["fuelgauge/left/soc"] = strconv.FormatFloat(float64(fuelgauge.StateOfChargeLeft()), 'f', 1, 32)
+		topics["fuelgauge/right/soc"] = strconv.FormatFloat(float64(fuelgauge.StateOfChargeRight()), 'f', 1, 32)
+		topics["state/fan"] = onOff(fuelgauge.BatteryFanOn())
+		topics["state/generator"] = onOff(fuelgauge.GeneratorRunning())
+		for bank := range bankNames {
+			topics["state/water/"+strconv.Itoa(bank)] = onOff(fuelgauge.Watering(bank))
+			topics["state/bank/"+strconv.Itoa(bank)] = onOff(fuelgauge.BankOn(bank))
+		}
+	}
+	mqttClient.Publish(topics)
+}
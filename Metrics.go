@@ -0,0 +1,148 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/LTC6813/LTC6813"
+	"BatteryMonitor6813V4/Metrics"
+	"BatteryMonitor6813V4/ModbusBatteryFuelGauge/Data"
+	"BatteryMonitor6813V4/Storage"
+	"strconv"
+	"time"
+)
+
+var cycleDuration = Metrics.NewHistogram(0.05, 0.1, 0.25, 0.5, 0.75, 1, 2.5, 5)
+var insertLatency = Metrics.NewHistogram(0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 5)
+
+/**
+Wraps the store given to the logging queue so the time taken by each insert is recorded
+*/
+type timedDatabase struct {
+	Storage.Store
+}
+
+func (db timedDatabase) Insert(table string, logged string, columns []string, values []interface{}) error {
+	start := time.Now()
+	err := db.Store.Insert(table, logged, columns, values)
+	insertLatency.Observe(time.Since(start).Seconds())
+	return err
+}
+
+/**
+Write the coil or discrete input states of the fuel gauge slaves
+*/
+func collectSlaveStates(w *Metrics.Writer, name string, label string, slaves []*Data.Data, discrete bool) {
+	for _, data := range slaves {
+		if data == nil || data.SlaveAddress == 0 {
+			continue
+		}
+		states, start := data.Coil, data.CoilStart()
+		if discrete {
+			states, start = data.Discrete, data.DiscreteStart()
+		}
+		for i, on := range states {
+			w.Sample(name, Metrics.Bool(on), "slave", strconv.Itoa(int(data.SlaveAddress)), label, strconv.Itoa(int(start)+i))
+		}
+	}
+}
+
+/**
+Everything served at /metrics
+*/
+func collectMetrics(w *Metrics.Writer) {
+	if ltc != nil {
+		w.Family("battery_cell_volts", "Cell voltage", "gauge")
+		for bank := 0; bank < 2; bank++ {
+			for cell := 0; cell < cellsPerBank; cell++ {
+				w.Sample("battery_cell_volts", float64(ltc.GetVolts(cellIndex(bank, cell))),
+					"bank", strconv.Itoa(bank), "cell", strconv.Itoa(cell+1))
+			}
+		}
+		w.Family("battery_cell_temperature_celsius", "Cell temperature. Sensors reading out of range are left out", "gauge")
+		for bank := 0; bank < 2; bank++ {
+			for cell := 0; cell < cellsPerBank; cell++ {
+				if temperature, err := ltc.GetTemperature(cellIndex(bank, cell)); err == nil {
+					w.Sample("battery_cell_temperature_celsius", float64(temperature), "bank", strconv.Itoa(bank), "cell", strconv.Itoa(cell+1))
+				}
+			}
+		}
+		w.Family("battery_bank_volts", "Sum of the cell voltages in the bank", "gauge")
+		for bank := 0; bank < 2; bank++ {
+			device := bank * 3
+			w.Sample("battery_bank_volts", float64(ltc.GetSumOfCellsVolts(device)+ltc.GetSumOfCellsVolts(device+1)+ltc.GetVolts(device+2, 0)+ltc.GetVolts(device+2, 1)),
+				"bank", strconv.Itoa(bank))
+		}
+	}
+
+	if fuelgauge != nil {
+		w.Family("battery_bank_current_amps", "Average bank current from the fuel gauge. Positive is charging", "gauge")
+		w.Sample("battery_bank_current_amps", float64(fuelgauge.CurrentLeft()), "bank", "0")
+		w.Sample("battery_bank_current_amps", float64(fuelgauge.CurrentRight()), "bank", "1")
+		w.Family("battery_bank_soc_percent", "Bank state of charge from the fuel gauge", "gauge")
+		w.Sample("battery_bank_soc_percent", float64(fuelgauge.StateOfChargeLeft()), "bank", "0")
+		w.Sample("battery_bank_soc_percent", float64(fuelgauge.StateOfChargeRight()), "bank", "1")
+		w.Family("battery_bank_charge_ampere_hours", "Charge held in the bank", "gauge")
+		w.Sample("battery_bank_charge_ampere_hours", float64(fuelgauge.FgLeft.Coulombs), "bank", "0")
+		w.Sample("battery_bank_charge_ampere_hours", float64(fuelgauge.FgRight.Coulombs), "bank", "1")
+		w.Family("battery_bank_capacity_ampere_hours", "Bank capacity", "gauge")
+		w.Sample("battery_bank_capacity_ampere_hours", float64(fuelgauge.FgLeft.Capacity), "bank", "0")
+		w.Sample("battery_bank_capacity_ampere_hours", float64(fuelgauge.FgRight.Capacity), "bank", "1")
+
+		slaves := []*Data.Data{fuelgauge.FgLeft.ModbusData, fuelgauge.FgRight.ModbusData}
+		w.Family("battery_fuelgauge_coil", "Fuel gauge relay coil state (1 = on)", "gauge")
+		collectSlaveStates(w, "battery_fuelgauge_coil", "coil", slaves, false)
+		w.Family("battery_fuelgauge_discrete_input", "Fuel gauge discrete input state (1 = set)", "gauge")
+		collectSlaveStates(w, "battery_fuelgauge_discrete_input", "input", slaves, true)
+
+		w.Family("battery_modbus_errors_total", "Failed Modbus transactions with each fuel gauge slave", "counter")
+		for _, slave := range []uint8{fuelgauge.FgLeft.SlaveAddress, fuelgauge.FgRight.SlaveAddress} {
+			if slave != 0 {
+				w.Sample("battery_modbus_errors_total", float64(fuelgauge.ModbusErrors(slave)), "slave", strconv.Itoa(int(slave)))
+			}
+		}
+	}
+
+	w.Gauge("battery_inverter_volts", "Battery voltage reported by the inverter", float64(iValues.Volts))
+	w.Gauge("battery_inverter_amps", "Battery current reported by the inverter", float64(iValues.Amps))
+	w.Gauge("battery_inverter_soc_percent", "Battery state of charge reported by the inverter", float64(iValues.Soc))
+	w.Gauge("battery_inverter_charge_setpoint_volts", "Charge voltage set point reported by the inverter", float64(iValues.Vsetpoint))
+	w.Gauge("battery_inverter_frequency_hertz", "AC frequency reported by the inverter", iValues.Frequency)
+	w.Family("battery_inverter_state", "Inverter relay and status flags (1 = set)", "gauge")
+	for _, state := range []struct {
+		name  string
+		value bool
+	}{
+		{"relay1", iValues.OnRelay1}, {"relay2", iValues.OnRelay2},
+		{"relay1slave1", iValues.OnRelay1Slave1}, {"relay2slave1", iValues.OnRelay2Slave1},
+		{"relay1slave2", iValues.OnRelay1Slave2}, {"relay2slave2", iValues.OnRelay2Slave2},
+		{"gnrun", iValues.GnRun}, {"gnrunslave1", iValues.GnRunSlave1}, {"gnrunslave2", iValues.GnRunSlave2},
+		{"autogn", iValues.AutoGn}, {"autolodext", iValues.AutoLodExt}, {"autolodsoc", iValues.AutoLodSoc},
+		{"tm1", iValues.Tm1}, {"tm2", iValues.Tm2}, {"extpwrder", iValues.ExtPwrDer}, {"extvfok", iValues.ExtVfOk},
+		{"gdon", iValues.GdOn}, {"error", iValues.Errror}, {"run", iValues.Run}, {"batfan", iValues.BatFan},
+		{"acdcir", iValues.AcdCir}, {"mccbatfan", iValues.MccBatFan}, {"mccautoload", iValues.MccAutoLod},
+		{"chp", iValues.Chp}, {"chpadd", iValues.ChpAdd}, {"sicomremote", iValues.SiComRemote},
+		{"overload", iValues.OverLoad}, {"extsrcconn", iValues.ExtSrcConn}, {"silent", iValues.Silent},
+		{"current", iValues.Current}, {"feedselfc", iValues.FeedSelfC}, {"esave", iValues.Esave},
+	} {
+		w.Sample("battery_inverter_state", Metrics.Bool(state.value), "state", state.name)
+	}
+
+	w.Family("battery_setpoint_volts", "Voltage set points sent to the inverter", "gauge")
+	w.Sample("battery_setpoint_volts", float64(setpoints.VSetpoint), "setpoint", "current")
+	w.Sample("battery_setpoint_volts", float64(setpoints.VTargetSetpoint), "setpoint", "target")
+	w.Sample("battery_setpoint_volts", float64(setpoints.VDischarge), "setpoint", "discharge")
+	w.Sample("battery_setpoint_volts", float64(setpoints.VChargingSetpoint), "setpoint", "charging")
+	w.Sample("battery_setpoint_volts", float64(setpoints.VChargedSetpoint), "setpoint", "charged")
+	w.Family("battery_setpoint_amps", "Current set points sent to the inverter", "gauge")
+	w.Sample("battery_setpoint_amps", float64(setpoints.ISetpoint), "setpoint", "current")
+	w.Sample("battery_setpoint_amps", float64(setpoints.ITargetSetpoint), "setpoint", "target")
+	w.Sample("battery_setpoint_amps", float64(setpoints.IDischarge), "setpoint", "discharge")
+	w.Sample("battery_setpoint_amps", float64(setpoints.IChargingSetpoint), "setpoint", "charging")
+	w.Sample("battery_setpoint_amps", float64(setpoints.IChargedSetpoint), "setpoint", "charged")
+
+	w.Counter("battery_ltc6813_pec_errors_total", "PEC errors reading the LTC6813 chain", float64(LTC6813.PECErrors()))
+	w.Counter("battery_measurement_errors_total", "Failed LTC6813 measurement cycles", float64(nErrors))
+	cycleDuration.Write(w, "battery_measurement_cycle_seconds", "Time taken to measure the cell voltages and temperatures")
+	insertLatency.Write(w, "battery_database_insert_seconds", "Time taken to insert a logged row into the database")
+	if dbQueue != nil {
+		w.Gauge("battery_database_buffered_rows", "Logged rows waiting in the buffer file for the database", float64(dbQueue.Pending()))
+	}
+}
@@ -0,0 +1,150 @@
+package Metrics
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/**
+Writer writes metrics in the Prometheus text exposition format (version 0.0.4). Each family is started with Family and
+followed by its samples.
+*/
+type Writer struct {
+	out *bufio.Writer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+/**
+Start a new metric family. Type is gauge, counter or histogram.
+*/
+func (w *Writer) Family(name string, help string, metricType string) {
+	_, _ = fmt.Fprintf(w.out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+/**
+Write one sample. Labels are given as name, value pairs.
+*/
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	_, _ = w.out.WriteString(name)
+	if len(labels) > 1 {
+		_ = w.out.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				_ = w.out.WriteByte(',')
+			}
+			_, _ = fmt.Fprintf(w.out, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		_ = w.out.WriteByte('}')
+	}
+	_ = w.out.WriteByte(' ')
+	_, _ = w.out.WriteString(formatValue(value))
+	_ = w.out.WriteByte('\n')
+}
+
+/**
+Write a gauge that has a single unlabelled sample
+*/
+func (w *Writer) Gauge(name string, help string, value float64) {
+	w.Family(name, help, "gauge")
+	w.Sample(name, value)
+}
+
+/**
+Write a counter that has a single unlabelled sample
+*/
+func (w *Writer) Counter(name string, help string, value float64) {
+	w.Family(name, help, "counter")
+	w.Sample(name, value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+/**
+Bool returns 1 for true and 0 for false for relay and flag states
+*/
+func Bool(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+/**
+Return a handler that serves the metrics written by collect
+*/
+func Handler(collect func(w *Writer)) http.HandlerFunc {
+	return func(response http.ResponseWriter, _ *http.Request) {
+		response.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := &Writer{out: bufio.NewWriter(response)}
+		collect(w)
+		if err := w.out.Flush(); err != nil {
+			log.Println("Failed to write the metrics -", err)
+		}
+	}
+}
+
+/**
+Histogram counts observations into cumulative buckets, e.g. durations in seconds.
+*/
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+/**
+Create a histogram with the given upper bounds, which must be in increasing order. The +Inf bucket is added
+automatically.
+*/
+func NewHistogram(buckets ...float64) *Histogram {
+	histogram := new(Histogram)
+	histogram.buckets = buckets
+	histogram.counts = make([]uint64, len(buckets))
+	return histogram
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+/**
+Write the histogram as a complete family
+*/
+func (histogram *Histogram) Write(w *Writer, name string, help string) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	w.Family(name, help, "histogram")
+	for i, bound := range histogram.buckets {
+		w.Sample(name+"_bucket", float64(histogram.counts[i]), "le", formatValue(bound))
+	}
+	w.Sample(name+"_bucket", float64(histogram.count), "le", "+Inf")
+	w.Sample(name+"_sum", histogram.sum)
+	w.Sample(name+"_count", float64(histogram.count))
+}
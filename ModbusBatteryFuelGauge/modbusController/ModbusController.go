@@ -6,12 +6,15 @@ import (
 	"github.com/goburrow/modbus"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ModbusController struct {
+	errorCount   [256]uint64 // Failed transactions for each slave ID. First so it is 64 bit aligned for atomic on ARM
 	rtuClient    *modbus.RTUClientHandler
 	modbusClient modbus.Client
+	transporter  modbus.Transporter // Replaces the serial port when set, used by the simulator
 	mu           sync.Mutex
 }
 
@@ -31,6 +34,18 @@ func New(rtuAddress string, baudRate int, dataBits int, stopBits int, parity str
 	return this
 }
 
+/**
+*  Set up a new ModBus that sends its RTU frames to the given transporter instead of a serial port.
+ */
+func NewSimulated(transporter modbus.Transporter) *ModbusController {
+	this := new(ModbusController)
+	this.rtuClient = modbus.NewRTUClientHandler("simulated")
+	this.rtuClient.SlaveId = 1
+	this.transporter = transporter
+
+	return this
+}
+
 func (this *ModbusController) Close() {
 	this.mu.Lock()
 	defer this.mu.Unlock()
@@ -44,6 +59,10 @@ func (this *ModbusController) Close() {
 func (this *ModbusController) Connect() error {
 	this.mu.Lock()
 	defer this.mu.Unlock()
+	if this.transporter != nil {
+		this.modbusClient = modbus.NewClient2(this.rtuClient, this.transporter)
+		return nil
+	}
 	err := this.rtuClient.Connect()
 	if err != nil {
 		return err
@@ -52,6 +71,23 @@ func (this *ModbusController) Connect() error {
 	return nil
 }
 
+/**
+*  Count a failed transaction for the slave. The counters are read without taking the bus lock so the metrics do not
+*  wait for a slow slave.
+ */
+func (this *ModbusController) countError(err error, slaveId uint8) {
+	if err != nil {
+		atomic.AddUint64(&this.errorCount[slaveId], 1)
+	}
+}
+
+/**
+*  Return the number of failed transactions with the given slave since startup.
+ */
+func (this *ModbusController) Errors(slaveId uint8) uint64 {
+	return atomic.LoadUint64(&this.errorCount[slaveId])
+}
+
 func (this *ModbusController) readCoil(coil uint16) (bool, error) {
 	data, err := this.modbusClient.ReadCoils(coil, 1)
 	if err != nil {
@@ -69,7 +105,9 @@ func (this *ModbusController) ReadCoil(coil uint16, slaveId uint8) (bool, error)
 	this.mu.Lock()
 	defer this.mu.Unlock()
 	this.rtuClient.SlaveId = slaveId
-	return this.readCoil(coil)
+	value, err := this.readCoil(coil)
+	this.countError(err, slaveId)
+	return value, err
 }
 
 func (this *ModbusController) WriteCoil(coil uint16, value bool, slaveId uint8) error {
@@ -82,6 +120,7 @@ func (this *ModbusController) WriteCoil(coil uint16, value bool, slaveId uint8)
 	} else {
 		_, err = this.modbusClient.WriteSingleCoil(coil, 0x0000)
 	}
+	this.countError(err, slaveId)
 	return err
 }
 
@@ -102,7 +141,9 @@ func (this *ModbusController) ReadHoldingRegister(holdingRegister uint16, slaveI
 	this.mu.Lock()
 	defer this.mu.Unlock()
 	this.rtuClient.SlaveId = slaveId
-	return this.readHoldingRegister(holdingRegister)
+	value, err := this.readHoldingRegister(holdingRegister)
+	this.countError(err, slaveId)
+	return value, err
 }
 
 func (this *ModbusController) readHoldingRegisterDiv10(register uint16) (float32, error) {
@@ -123,6 +164,7 @@ func (this *ModbusController) WriteHoldingRegister(register uint16, value uint16
 	defer this.mu.Unlock()
 	this.rtuClient.SlaveId = slaveId
 	_, err := this.modbusClient.WriteSingleRegister(register, value)
+	this.countError(err, slaveId)
 	return err
 }
 
@@ -149,7 +191,9 @@ func (this *ModbusController) ReadInputRegister(holdingRegister uint16, slaveId
 	this.mu.Lock()
 	defer this.mu.Unlock()
 	this.rtuClient.SlaveId = slaveId
-	return this.readInputRegister(holdingRegister)
+	value, err := this.readInputRegister(holdingRegister)
+	this.countError(err, slaveId)
+	return value, err
 }
 
 func (this *ModbusController) readDiscreteInput(input uint16) (bool, error) {
@@ -184,6 +228,7 @@ func (this *ModbusController) ReadMultipleDiscreteRegisters(start uint16, count
 	defer this.mu.Unlock()
 	this.rtuClient.SlaveId = slaveId
 	mbData, err := this.modbusClient.ReadDiscreteInputs(start, count)
+	this.countError(err, slaveId)
 	if err != nil {
 		return make([]bool, count), err
 	} else {
@@ -196,6 +241,7 @@ func (this *ModbusController) ReadMultipleCoils(start uint16, count uint16, slav
 	defer this.mu.Unlock()
 	this.rtuClient.SlaveId = slaveId
 	mbData, err := this.modbusClient.ReadCoils(start, count)
+	this.countError(err, slaveId)
 	if err != nil {
 		return make([]bool, count), err
 	} else {
@@ -216,6 +262,7 @@ func (this *ModbusController) ReadMultipleInputRegisters(start uint16, count uin
 	defer this.mu.Unlock()
 	this.rtuClient.SlaveId = slaveId
 	mbData, err := this.modbusClient.ReadInputRegisters(start, count)
+	this.countError(err, slaveId)
 	return convertBytesToWords(mbData), err
 }
 
@@ -224,6 +271,7 @@ func (this *ModbusController) ReadMultipleHoldingRegisters(start uint16, count u
 	defer this.mu.Unlock()
 	this.rtuClient.SlaveId = slaveId
 	mbData, err := this.modbusClient.ReadHoldingRegisters(start, count)
+	this.countError(err, slaveId)
 	return convertBytesToWords(mbData), err
 }
 
@@ -231,5 +279,7 @@ func (this *ModbusController) ReadDiscreteInput(input uint16, slaveId uint8) (bo
 	this.mu.Lock()
 	defer this.mu.Unlock()
 	this.rtuClient.SlaveId = slaveId
-	return this.readCoil(input)
+	value, err := this.readCoil(input)
+	this.countError(err, slaveId)
+	return value, err
 }
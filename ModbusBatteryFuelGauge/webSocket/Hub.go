@@ -0,0 +1,388 @@
+package websocket
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = 30 * time.Second
+	// Messages queued for a client before it is treated as too slow
+	sendQueue = 32
+	// Cycles in a row a client may have messages dropped before it is disconnected
+	maxDroppedCycles = 30
+	maxClientMessage = 4096
+)
+
+/**
+HubMessage is what a subscribing client receives. A snapshot has the whole value of the topic in Data and is sent
+first and after any messages had to be dropped. After that only the changed values are sent in Changes, keyed by their
+path in the snapshot with array indexes as numbers, e.g. "voltages.1.7". Values that have gone are null. Events, such
+as alarms being raised, are sent as they happen with the event in Data.
+*/
+type HubMessage struct {
+	Topic   string                     `json:"topic"`
+	Type    string                     `json:"type"`
+	Data    json.RawMessage            `json:"data,omitempty"`
+	Changes map[string]json.RawMessage `json:"changes,omitempty"`
+	Error   string                     `json:"error,omitempty"`
+}
+
+// What a client sends to change its subscriptions
+type hubRequest struct {
+	Subscribe   []string `json:"subscribe"`
+	Unsubscribe []string `json:"unsubscribe"`
+}
+
+/**
+Hub sends the live data to websocket clients once per measurement cycle. Each topic is serialised once per cycle no
+matter how many clients there are, and clients only get the topics they subscribe to. A client that cannot keep up
+has messages dropped rather than holding up the others, then gets fresh snapshots once it catches up.
+*/
+type Hub struct {
+	mu         sync.Mutex
+	clients    map[*HubClient]bool
+	values     map[string]map[string]json.RawMessage
+	validTopic func(topic string) bool
+}
+
+type HubClient struct {
+	hub  *Hub
+	conn *websocket.Conn
+	send chan []byte
+	// Subscribed topics and whether the client has had a snapshot of each
+	topics map[string]bool
+	// Plain clients get the whole value of one topic each cycle without the HubMessage wrapper
+	plain   string
+	dropped int
+}
+
+/**
+NewHub returns a hub accepting subscriptions to the topics validTopic allows.
+*/
+func NewHub(validTopic func(topic string) bool) *Hub {
+	return &Hub{
+		clients:    make(map[*HubClient]bool),
+		values:     make(map[string]map[string]json.RawMessage),
+		validTopic: validTopic,
+	}
+}
+
+/**
+Serve a websocket client that subscribes to topics. It starts with the given topics and can send
+{"subscribe":["topic",...]} and {"unsubscribe":["topic",...]} to change them. Returns when the client goes away.
+*/
+func (hub *Hub) Serve(conn *websocket.Conn, topics []string) {
+	client := hub.newClient(conn, "")
+	client.subscribe(topics)
+	client.run()
+}
+
+/**
+Serve a websocket client that gets the whole value of one topic every cycle, for clients that do not subscribe.
+*/
+func (hub *Hub) ServePlain(conn *websocket.Conn, topic string) {
+	client := hub.newClient(conn, topic)
+	client.run()
+}
+
+func (hub *Hub) newClient(conn *websocket.Conn, plain string) *HubClient {
+	client := &HubClient{hub: hub, conn: conn, send: make(chan []byte, sendQueue), topics: make(map[string]bool), plain: plain}
+	hub.mu.Lock()
+	hub.clients[client] = true
+	hub.mu.Unlock()
+	return client
+}
+
+/**
+Return the number of connected clients
+*/
+func (hub *Hub) Clients() int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return len(hub.clients)
+}
+
+/**
+Publish the value of every topic for this cycle. Topics nobody is subscribed to are skipped and forgotten so a new
+subscriber always starts with a fresh snapshot. json.RawMessage values are used as they are.
+*/
+func (hub *Hub) Publish(topics map[string]interface{}) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	wanted := make(map[string]bool)
+	for client := range hub.clients {
+		for topic := range client.topics {
+			wanted[topic] = true
+		}
+		if client.plain != "" {
+			wanted[client.plain] = true
+		}
+	}
+	type topicMessages struct {
+		data     json.RawMessage
+		snapshot []byte
+		delta    []byte
+	}
+	messages := make(map[string]*topicMessages)
+	for topic, value := range topics {
+		if !wanted[topic] {
+			delete(hub.values, topic)
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			log.Println("Failed to serialise the", topic, "topic -", err)
+			continue
+		}
+		m := &topicMessages{data: data}
+		m.snapshot, _ = json.Marshal(HubMessage{Topic: topic, Type: "snapshot", Data: data})
+		current := flatten(data)
+		if previous, found := hub.values[topic]; found {
+			if changes := changedValues(previous, current); len(changes) > 0 {
+				m.delta, _ = json.Marshal(HubMessage{Topic: topic, Type: "delta", Changes: changes})
+			}
+		}
+		hub.values[topic] = current
+		messages[topic] = m
+	}
+
+	for client := range hub.clients {
+		sent := true
+		if client.plain != "" {
+			if m, found := messages[client.plain]; found {
+				sent = client.queue(m.data)
+			}
+		}
+		for topic, hasSnapshot := range client.topics {
+			m, found := messages[topic]
+			if !found {
+				continue
+			}
+			switch {
+			case !hasSnapshot:
+				if client.queue(m.snapshot) {
+					client.topics[topic] = true
+				} else {
+					sent = false
+				}
+			case m.delta != nil:
+				sent = client.queue(m.delta) && sent
+			}
+		}
+		client.checkDropped(sent)
+	}
+}
+
+/**
+Send an event to everyone subscribed to the topic straight away
+*/
+func (hub *Hub) PublishEvent(topic string, event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Failed to serialise the", topic, "event -", err)
+		return
+	}
+	message, _ := json.Marshal(HubMessage{Topic: topic, Type: "event", Data: data})
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for client := range hub.clients {
+		if _, subscribed := client.topics[topic]; subscribed {
+			client.queue(message)
+		}
+	}
+}
+
+/**
+Queue a message for the client without waiting. Returns false if the client's queue is full or it has gone. Called
+with the hub locked.
+*/
+func (client *HubClient) queue(message []byte) bool {
+	if !client.hub.clients[client] {
+		return false
+	}
+	select {
+	case client.send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+After dropping messages the client needs fresh snapshots as it has missed changes. A client that has not kept up for
+too long is disconnected. Called with the hub locked.
+*/
+func (client *HubClient) checkDropped(sent bool) {
+	if sent {
+		client.dropped = 0
+		return
+	}
+	for topic := range client.topics {
+		client.topics[topic] = false
+	}
+	client.dropped++
+	if client.dropped == maxDroppedCycles {
+		log.Println("Websocket client", client.conn.RemoteAddr(), "is too slow - disconnecting")
+		delete(client.hub.clients, client)
+		close(client.send)
+	}
+}
+
+func (client *HubClient) subscribe(topics []string) {
+	var unknown []string
+	client.hub.mu.Lock()
+	for _, topic := range topics {
+		if client.hub.validTopic(topic) {
+			if _, found := client.topics[topic]; !found {
+				client.topics[topic] = false
+			}
+		} else {
+			unknown = append(unknown, topic)
+		}
+	}
+	for _, topic := range unknown {
+		message, _ := json.Marshal(HubMessage{Topic: topic, Type: "error", Error: "unknown topic"})
+		client.queue(message)
+	}
+	client.hub.mu.Unlock()
+}
+
+func (client *HubClient) unsubscribe(topics []string) {
+	client.hub.mu.Lock()
+	for _, topic := range topics {
+		delete(client.topics, topic)
+	}
+	client.hub.mu.Unlock()
+}
+
+/**
+Run the client's reader and writer until the connection fails, then remove it from the hub
+*/
+func (client *HubClient) run() {
+	go client.writer()
+	client.reader()
+	client.hub.mu.Lock()
+	if client.hub.clients[client] {
+		delete(client.hub.clients, client)
+		close(client.send)
+	}
+	client.hub.mu.Unlock()
+}
+
+/**
+Read subscription changes from the client. A pong or any message keeps the connection alive.
+*/
+func (client *HubClient) reader() {
+	client.conn.SetReadLimit(maxClientMessage)
+	_ = client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		var request hubRequest
+		if err := client.conn.ReadJSON(&request); err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+			default:
+				return
+			}
+			message, _ := json.Marshal(HubMessage{Type: "error", Error: "requests must be JSON - " + err.Error()})
+			client.hub.mu.Lock()
+			client.queue(message)
+			client.hub.mu.Unlock()
+			continue
+		}
+		_ = client.conn.SetReadDeadline(time.Now().Add(pongWait))
+		client.subscribe(request.Subscribe)
+		client.unsubscribe(request.Unsubscribe)
+	}
+}
+
+/**
+Write the queued messages and ping the client so dead connections are found
+*/
+func (client *HubClient) writer() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = client.conn.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-client.send:
+			_ = client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				_ = client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+/**
+Flatten a JSON value into the JSON of each of its leaves keyed by path
+*/
+func flatten(data json.RawMessage) map[string]json.RawMessage {
+	var value interface{}
+	values := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &value); err != nil {
+		return values
+	}
+	var walk func(path string, value interface{})
+	walk = func(path string, value interface{}) {
+		join := func(key string) string {
+			if path == "" {
+				return key
+			}
+			return path + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, child := range v {
+				walk(join(key), child)
+			}
+		case []interface{}:
+			for i, child := range v {
+				walk(join(strconv.Itoa(i)), child)
+			}
+		default:
+			values[path], _ = json.Marshal(v)
+		}
+	}
+	walk("", value)
+	return values
+}
+
+/**
+Return the values that are new or different in current, and null for any that are no longer there
+*/
+func changedValues(previous map[string]json.RawMessage, current map[string]json.RawMessage) map[string]json.RawMessage {
+	changes := make(map[string]json.RawMessage)
+	for path, value := range current {
+		if old, found := previous[path]; !found || string(old) != string(value) {
+			changes[path] = value
+		}
+	}
+	for path := range previous {
+		if _, found := current[path]; !found {
+			changes[path] = json.RawMessage("null")
+		}
+	}
+	return changes
+}
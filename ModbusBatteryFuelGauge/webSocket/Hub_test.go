@@ -0,0 +1,134 @@
+package websocket
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+/**
+Add a client subscribed to the topics with room for queue messages. It has no connection so must not be disconnected.
+*/
+func testClient(hub *Hub, queue int, topics ...string) *HubClient {
+	client := &HubClient{hub: hub, send: make(chan []byte, queue), topics: make(map[string]bool)}
+	for _, topic := range topics {
+		client.topics[topic] = false
+	}
+	hub.clients[client] = true
+	return client
+}
+
+/**
+Return the messages waiting for the client
+*/
+func received(t *testing.T, client *HubClient) []HubMessage {
+	t.Helper()
+	var messages []HubMessage
+	for {
+		select {
+		case data := <-client.send:
+			var message HubMessage
+			if err := json.Unmarshal(data, &message); err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, message)
+		default:
+			return messages
+		}
+	}
+}
+
+func changes(values map[string]string) map[string]json.RawMessage {
+	raw := make(map[string]json.RawMessage)
+	for path, value := range values {
+		raw[path] = json.RawMessage(value)
+	}
+	return raw
+}
+
+func TestFlatten(t *testing.T) {
+	got := flatten(json.RawMessage(`{"soc":50.5,"name":"left","on":true,"none":null,"volts":[1.2,[3,4]],"bank":{"cell":{"v":1}}}`))
+	want := changes(map[string]string{"soc": "50.5", "name": `"left"`, "on": "true", "none": "null", "volts.0": "1.2", "volts.1.0": "3",
+		"volts.1.1": "4", "bank.cell.v": "1"})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+	if got := flatten(json.RawMessage(`7`)); !reflect.DeepEqual(got, changes(map[string]string{"": "7"})) {
+		t.Errorf("a plain value flattened to %s", got)
+	}
+}
+
+func TestChangedValues(t *testing.T) {
+	previous := changes(map[string]string{"same": "1", "changed": "2", "gone": "3"})
+	current := changes(map[string]string{"same": "1", "changed": "4", "new": `"x"`})
+	want := changes(map[string]string{"changed": "4", "new": `"x"`, "gone": "null"})
+	if got := changedValues(previous, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+	if got := changedValues(current, current); len(got) != 0 {
+		t.Errorf("no change gave %s", got)
+	}
+}
+
+func TestPublishSnapshotThenDeltas(t *testing.T) {
+	hub := NewHub(func(string) bool { return true })
+	client := testClient(hub, sendQueue, "battery")
+	other := testClient(hub, sendQueue, "inverter")
+
+	hub.Publish(map[string]interface{}{"battery": map[string]interface{}{"soc": 50, "volts": []float64{1.2, 1.3}}, "unwanted": 1})
+	messages := received(t, client)
+	if len(messages) != 1 || messages[0].Type != "snapshot" || messages[0].Topic != "battery" ||
+		string(messages[0].Data) != `{"soc":50,"volts":[1.2,1.3]}` {
+		t.Fatalf("first publish sent %+v, want the snapshot", messages)
+	}
+	if messages := received(t, other); len(messages) != 0 {
+		t.Errorf("a client not subscribed to the topic was sent %+v", messages)
+	}
+	if _, found := hub.values["unwanted"]; found {
+		t.Error("a topic nobody subscribes to was kept")
+	}
+
+	// Nothing has changed so nothing is sent
+	hub.Publish(map[string]interface{}{"battery": map[string]interface{}{"soc": 50, "volts": []float64{1.2, 1.3}}})
+	if messages := received(t, client); len(messages) != 0 {
+		t.Errorf("an unchanged topic sent %+v", messages)
+	}
+
+	// Only the changes are sent, with removed values as null
+	hub.Publish(map[string]interface{}{"battery": map[string]interface{}{"volts": []float64{1.2, 1.31, 1.4}}})
+	messages = received(t, client)
+	want := changes(map[string]string{"soc": "null", "volts.1": "1.31", "volts.2": "1.4"})
+	if len(messages) != 1 || messages[0].Type != "delta" || messages[0].Data != nil || !reflect.DeepEqual(messages[0].Changes, want) {
+		t.Errorf("the change sent %+v, want a delta of %s", messages, want)
+	}
+}
+
+func TestPublishResnapshotAfterDrop(t *testing.T) {
+	hub := NewHub(func(string) bool { return true })
+	// Room for one message so the second cycle is dropped if the first has not been sent
+	client := testClient(hub, 1, "battery")
+
+	hub.Publish(map[string]interface{}{"battery": []int{1}})
+	hub.Publish(map[string]interface{}{"battery": []int{2}})
+	if client.dropped != 1 || client.topics["battery"] {
+		t.Fatalf("after dropping a message the client has dropped %d and snapshot %t", client.dropped, client.topics["battery"])
+	}
+	if messages := received(t, client); len(messages) != 1 || messages[0].Type != "snapshot" || string(messages[0].Data) != "[1]" {
+		t.Fatalf("the queue held %+v, want the first snapshot", messages)
+	}
+
+	// The delta for the dropped cycle is lost so the client is sent the whole value again
+	hub.Publish(map[string]interface{}{"battery": []int{3}})
+	if messages := received(t, client); len(messages) != 1 || messages[0].Type != "snapshot" || string(messages[0].Data) != "[3]" {
+		t.Fatalf("after catching up the client was sent %+v, want a fresh snapshot", messages)
+	}
+	if client.dropped != 0 || !client.topics["battery"] {
+		t.Errorf("after catching up the client has dropped %d and snapshot %t", client.dropped, client.topics["battery"])
+	}
+
+	hub.Publish(map[string]interface{}{"battery": []int{4}})
+	if messages := received(t, client); len(messages) != 1 || messages[0].Type != "delta" ||
+		!reflect.DeepEqual(messages[0].Changes, changes(map[string]string{"0": "4"})) {
+		t.Errorf("the next change sent %+v, want a delta", messages)
+	}
+}
@@ -13,6 +13,11 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
+// SetCheckOrigin replaces the function that decides which origins may open a websocket
+func SetCheckOrigin(checkOrigin func(r *http.Request) bool) {
+	upgrader.CheckOrigin = checkOrigin
+}
+
 func Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
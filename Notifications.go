@@ -0,0 +1,43 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Alarms"
+	"BatteryMonitor6813V4/Notifier"
+	"log"
+)
+
+var notifier *Notifier.Notifier
+
+/**
+Load the notification channels and routes and start sending. Without a configuration file notifications are only
+logged.
+*/
+func startNotifier(configFile string) {
+	if configFile == "" {
+		return
+	}
+	config, err := Notifier.LoadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load the notification settings - %s - Sorry, I am giving up.", err)
+	}
+	notifier, err = Notifier.New(config)
+	if err != nil {
+		log.Fatalf("Failed to set up the notifications from %s - %s - Sorry, I am giving up.", configFile, err)
+	}
+	go notifier.Run()
+	log.Println("Sending notifications through", len(config.Channels), "channels")
+}
+
+/**
+Alarm engine listener sending each alarm event through the notifier
+*/
+func notifyAlarm(event Alarms.Event) {
+	notifier.Notify(Notifier.Message{
+		Event:    event.Action,
+		Severity: event.Alarm.Severity,
+		Rule:     event.Alarm.Rule,
+		Source:   event.Alarm.Source,
+		Text:     event.Alarm.Message,
+		AlarmID:  event.Alarm.ID,
+	})
+}
@@ -0,0 +1,294 @@
+package Notifier
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+/**
+channel delivers one message
+*/
+type channel interface {
+	send(subject string, body string, message *Message) error
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+func newChannel(config ChannelConfig) (channel, error) {
+	switch config.Type {
+	case "smtp":
+		if config.Server == "" || config.From == "" || len(config.To) == 0 {
+			return nil, fmt.Errorf("smtp channel %s needs a server, from and to", config.Name)
+		}
+		if _, _, err := net.SplitHostPort(config.Server); err != nil {
+			return nil, fmt.Errorf("smtp channel %s - %w", config.Name, err)
+		}
+		switch config.TLS {
+		case "", "starttls", "tls", "none":
+		default:
+			return nil, fmt.Errorf("smtp channel %s - tls must be starttls, tls or none", config.Name)
+		}
+		channel := &smtpChannel{config: config}
+		from, err := mail.ParseAddress(config.From)
+		if err != nil {
+			return nil, fmt.Errorf("smtp channel %s - from %q - %w", config.Name, config.From, err)
+		}
+		channel.from = from.Address
+		for _, to := range config.To {
+			address, err := mail.ParseAddress(to)
+			if err != nil {
+				return nil, fmt.Errorf("smtp channel %s - to %q - %w", config.Name, to, err)
+			}
+			channel.to = append(channel.to, address.Address)
+		}
+		return channel, nil
+	case "webhook":
+		if config.URL == "" {
+			return nil, fmt.Errorf("webhook channel %s needs a url", config.Name)
+		}
+		return &webhookChannel{config}, nil
+	case "ntfy":
+		if config.URL == "" {
+			return nil, fmt.Errorf("ntfy channel %s needs the topic url", config.Name)
+		}
+		return &ntfyChannel{config}, nil
+	case "gotify":
+		if config.URL == "" || config.Token == "" {
+			return nil, fmt.Errorf("gotify channel %s needs a url and token", config.Name)
+		}
+		return &gotifyChannel{config}, nil
+	}
+	return nil, fmt.Errorf("channel %s has unknown type '%s' - use smtp, webhook, ntfy or gotify", config.Name, config.Type)
+}
+
+/**
+Post to the URL and check for a 2xx response
+*/
+func post(request *http.Request) error {
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		text, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s returned %s %s", request.URL.Host, response.Status, strings.TrimSpace(string(text)))
+	}
+	return nil
+}
+
+/**
+smtpChannel sends mail. The From and To headers are written as configured, which may include display names, while
+from and to are the bare addresses the server is given.
+*/
+type smtpChannel struct {
+	config ChannelConfig
+	from   string
+	to     []string
+}
+
+func (channel *smtpChannel) send(subject string, body string, message *Message) error {
+	config := &channel.config
+	host, _, _ := net.SplitHostPort(config.Server)
+	var buffer bytes.Buffer
+	buffer.WriteString("From: " + config.From + "\r\n")
+	buffer.WriteString("To: " + strings.Join(config.To, ", ") + "\r\n")
+	buffer.WriteString("Subject: " + encodeSubject(subject) + "\r\n")
+	buffer.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+	if message.HTML == "" {
+		buffer.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&buffer, body); err != nil {
+			return err
+		}
+	} else if err := writeAlternative(&buffer, body, message.HTML); err != nil {
+		return err
+	}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if config.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", config.Server, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", config.Server)
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	if config.TLS == "" || config.TLS == "starttls" {
+		if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if config.User != "" {
+		if err = client.Auth(smtp.PlainAuth("", config.User, config.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(channel.from); err != nil {
+		return err
+	}
+	for _, to := range channel.to {
+		if err = client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+/**
+Write the text and HTML as a multipart/alternative body so mail readers that cannot show HTML show the text
+*/
+func writeAlternative(buffer *bytes.Buffer, text string, html string) error {
+	parts := multipart.NewWriter(buffer)
+	buffer.WriteString("Content-Type: multipart/alternative; boundary=" + parts.Boundary() + "\r\n\r\n")
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{{"text/plain; charset=utf-8", text}, {"text/html; charset=utf-8", html}} {
+		writer, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}, "Content-Transfer-Encoding": {"quoted-printable"}})
+		if err != nil {
+			return err
+		}
+		if err = writeQuotedPrintable(writer, part.content); err != nil {
+			return err
+		}
+	}
+	return parts.Close()
+}
+
+/**
+Write the text with CRLF line endings as quoted-printable so long lines and non-ASCII characters get through any server
+*/
+func writeQuotedPrintable(writer io.Writer, text string) error {
+	encoder := quotedprintable.NewWriter(writer)
+	if _, err := encoder.Write([]byte(strings.ReplaceAll(text, "\n", "\r\n"))); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+/**
+Make the subject safe for the header. Line breaks from the template are turned into spaces so they cannot start a new
+header, and anything other than plain ASCII is RFC 2047 encoded.
+*/
+func encodeSubject(subject string) string {
+	subject = strings.Join(strings.FieldsFunc(subject, func(r rune) bool {
+		return r == '\r' || r == '\n'
+	}), " ")
+	return mime.QEncoding.Encode("utf-8", subject)
+}
+
+/**
+webhookChannel posts the message as JSON with the rendered subject and body added
+*/
+type webhookChannel struct {
+	config ChannelConfig
+}
+
+func (channel *webhookChannel) send(subject string, body string, message *Message) error {
+	payload, err := json.Marshal(struct {
+		*Message
+		Subject string `json:"subject"`
+		Body    string `json:"body"`
+	}{message, subject, body})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, channel.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range channel.config.Headers {
+		request.Header.Set(name, value)
+	}
+	return post(request)
+}
+
+// ntfy and Gotify priorities for each severity
+var ntfyPriorities = map[string]string{Info: "default", Warning: "high", Critical: "urgent"}
+var gotifyPriorities = map[string]int{Info: 2, Warning: 5, Critical: 8}
+
+/**
+ntfyChannel publishes to an ntfy topic URL, e.g. https://ntfy.sh/battery
+*/
+type ntfyChannel struct {
+	config ChannelConfig
+}
+
+func (channel *ntfyChannel) send(subject string, body string, message *Message) error {
+	request, err := http.NewRequest(http.MethodPost, channel.config.URL, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Title", subject)
+	if priority, found := ntfyPriorities[message.Severity]; found {
+		request.Header.Set("Priority", priority)
+	}
+	request.Header.Set("Tags", "battery,"+message.Event)
+	if channel.config.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+channel.config.Token)
+	}
+	return post(request)
+}
+
+/**
+gotifyChannel posts to a Gotify server using an application token
+*/
+type gotifyChannel struct {
+	config ChannelConfig
+}
+
+func (channel *gotifyChannel) send(subject string, body string, message *Message) error {
+	payload, err := json.Marshal(struct {
+		Title    string `json:"title"`
+		Message  string `json:"message"`
+		Priority int    `json:"priority"`
+	}{subject, body, gotifyPriorities[message.Severity]})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(channel.config.URL, "/")+"/message", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Gotify-Key", channel.config.Token)
+	return post(request)
+}
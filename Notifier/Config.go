@@ -0,0 +1,104 @@
+package Notifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+/**
+Config is read from the JSON file given by -notify. Passwords, tokens, user names and URLs may refer to environment
+variables as ${NAME} so secrets do not have to be kept in the file.
+*/
+type Config struct {
+	Channels    []ChannelConfig `json:"channels"`
+	Routes      []Route         `json:"routes"`
+	Subject     string          `json:"subject"`      // Template for the subject/title
+	Body        string          `json:"body"`         // Template for the message body
+	MinInterval *int            `json:"min_interval"` // Seconds before the same message is sent again on a channel, 0 = no limit
+	MaxPerHour  *int            `json:"max_per_hour"` // Most messages sent on one channel in an hour, 0 = no limit
+	MaxAttempts int             `json:"max_attempts"` // Attempts to deliver a message before giving up
+}
+
+/**
+ChannelConfig describes one way of sending messages. Type is smtp, webhook, ntfy or gotify. Subject and Body override
+the templates in Config for this channel.
+*/
+type ChannelConfig struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	Subject  string            `json:"subject,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Server   string            `json:"server,omitempty"`   // smtp host:port
+	TLS      string            `json:"tls,omitempty"`      // smtp starttls (default), tls or none
+	From     string            `json:"from,omitempty"`     // smtp sender
+	To       []string          `json:"to,omitempty"`       // smtp recipients
+	User     string            `json:"user,omitempty"`     // smtp user
+	Password string            `json:"password,omitempty"` // smtp password
+	URL      string            `json:"url,omitempty"`      // webhook URL, ntfy topic URL or gotify server
+	Token    string            `json:"token,omitempty"`    // ntfy access token or gotify application token
+	Headers  map[string]string `json:"headers,omitempty"`  // webhook headers
+}
+
+/**
+Route sends the messages matching all of its lists to its channels. An empty list matches everything. If there are no
+routes every message goes to every channel.
+*/
+type Route struct {
+	Severities []string `json:"severities,omitempty"`
+	Rules      []string `json:"rules,omitempty"`
+	Events     []string `json:"events,omitempty"`
+	Channels   []string `json:"channels"`
+}
+
+const defaultSubject = `Battery {{.Severity}} - {{.Rule}} {{.Event}}`
+const defaultBody = `{{.Text}}
+{{.Time.Format "2006-01-02 15:04:05"}}`
+
+/**
+Read the configuration file and fill in the defaults
+*/
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := new(Config)
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("%s - %w", path, err)
+	}
+	if config.Subject == "" {
+		config.Subject = defaultSubject
+	}
+	if config.Body == "" {
+		config.Body = defaultBody
+	}
+	// The rate limits are only defaulted when they are left out so they can be turned off with 0
+	if config.MinInterval == nil {
+		config.MinInterval = intPointer(300)
+	}
+	if config.MaxPerHour == nil {
+		config.MaxPerHour = intPointer(30)
+	}
+	if *config.MinInterval < 0 || *config.MaxPerHour < 0 {
+		return nil, fmt.Errorf("%s - min_interval and max_per_hour cannot be negative", path)
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = 10
+	}
+	for i := range config.Channels {
+		channel := &config.Channels[i]
+		channel.User = os.ExpandEnv(channel.User)
+		channel.Password = os.ExpandEnv(channel.Password)
+		channel.Token = os.ExpandEnv(channel.Token)
+		channel.URL = os.ExpandEnv(channel.URL)
+		for name, value := range channel.Headers {
+			channel.Headers[name] = os.ExpandEnv(value)
+		}
+	}
+	return config, nil
+}
+
+func intPointer(value int) *int {
+	return &value
+}
@@ -0,0 +1,291 @@
+package Notifier
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Severities, the same as the alarm severities
+const (
+	Info     = "info"
+	Warning  = "warning"
+	Critical = "critical"
+)
+
+// Events for messages that are not about an alarm
+const (
+	Notice = "notice"
+	Report = "report"
+)
+
+// Most messages waiting to be sent. The oldest are dropped beyond this.
+const maxQueued = 1000
+
+// Delay before the first retry of a failed message. It doubles with each attempt up to maxRetryDelay.
+const firstRetryDelay = 30 * time.Second
+const maxRetryDelay = 30 * time.Minute
+
+/**
+Message is what gets sent. Event is raised, cleared or acknowledged for alarms, report for the summary reports or notice
+for anything else. HTML is only sent by email, as an alternative to the text.
+*/
+type Message struct {
+	Event    string    `json:"event"`
+	Severity string    `json:"severity"`
+	Rule     string    `json:"rule"`
+	Source   string    `json:"source"`
+	Text     string    `json:"text"`
+	Time     time.Time `json:"time"`
+	AlarmID  int64     `json:"alarm_id,omitempty"`
+	HTML     string    `json:"-"`
+}
+
+type namedChannel struct {
+	name     string
+	channel  channel
+	subject  *template.Template
+	body     *template.Template
+	lastSent map[string]time.Time // When each message was last sent, for the minimum interval
+	sent     []time.Time          // When messages were sent in the last hour
+}
+
+type delivery struct {
+	channel  *namedChannel
+	subject  string
+	body     string
+	message  Message
+	attempts int
+	due      time.Time
+}
+
+/**
+Notifier routes messages to the configured channels, limits how often they are sent and retries failed deliveries.
+All methods are safe to call on a nil Notifier, in which case messages are only logged.
+*/
+type Notifier struct {
+	mu       sync.Mutex
+	config   *Config
+	channels map[string]*namedChannel
+	queue    []*delivery
+	wake     chan struct{}
+}
+
+/**
+Set up the channels and templates from the configuration. Call Run to start sending.
+*/
+func New(config *Config) (*Notifier, error) {
+	notifier := new(Notifier)
+	notifier.config = config
+	notifier.channels = make(map[string]*namedChannel)
+	notifier.wake = make(chan struct{}, 1)
+	for _, channelConfig := range config.Channels {
+		if _, found := notifier.channels[channelConfig.Name]; found || channelConfig.Name == "" {
+			return nil, fmt.Errorf("channel names must be unique and not blank - '%s'", channelConfig.Name)
+		}
+		c, err := newChannel(channelConfig)
+		if err != nil {
+			return nil, err
+		}
+		named := &namedChannel{name: channelConfig.Name, channel: c, lastSent: make(map[string]time.Time)}
+		subject, body := config.Subject, config.Body
+		if channelConfig.Subject != "" {
+			subject = channelConfig.Subject
+		}
+		if channelConfig.Body != "" {
+			body = channelConfig.Body
+		}
+		if named.subject, err = template.New("subject").Parse(subject); err != nil {
+			return nil, fmt.Errorf("channel %s subject - %w", channelConfig.Name, err)
+		}
+		if named.body, err = template.New("body").Parse(body); err != nil {
+			return nil, fmt.Errorf("channel %s body - %w", channelConfig.Name, err)
+		}
+		notifier.channels[channelConfig.Name] = named
+	}
+	for _, route := range config.Routes {
+		for _, name := range route.Channels {
+			if _, found := notifier.channels[name]; !found {
+				return nil, fmt.Errorf("route refers to unknown channel '%s'", name)
+			}
+		}
+	}
+	return notifier, nil
+}
+
+func matches(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+The channels the message is routed to
+*/
+func (notifier *Notifier) route(message *Message) []*namedChannel {
+	var channels []*namedChannel
+	if len(notifier.config.Routes) == 0 {
+		for _, config := range notifier.config.Channels {
+			channels = append(channels, notifier.channels[config.Name])
+		}
+		return channels
+	}
+	added := make(map[string]bool)
+	for _, route := range notifier.config.Routes {
+		if matches(route.Severities, message.Severity) && matches(route.Rules, message.Rule) && matches(route.Events, message.Event) {
+			for _, name := range route.Channels {
+				if !added[name] {
+					added[name] = true
+					channels = append(channels, notifier.channels[name])
+				}
+			}
+		}
+	}
+	return channels
+}
+
+/**
+True if the channel is allowed to send the message now. Records the send if it is. A zero MinInterval or MaxPerHour
+does not limit the messages.
+*/
+func (notifier *Notifier) allow(channel *namedChannel, message *Message, now time.Time) bool {
+	key := message.Event + "|" + message.Rule + "|" + message.Source
+	if last, found := channel.lastSent[key]; found && now.Sub(last) < time.Duration(*notifier.config.MinInterval)*time.Second {
+		return false
+	}
+	recent := channel.sent[:0]
+	for _, sent := range channel.sent {
+		if now.Sub(sent) < time.Hour {
+			recent = append(recent, sent)
+		}
+	}
+	channel.sent = recent
+	if *notifier.config.MaxPerHour > 0 && len(channel.sent) >= *notifier.config.MaxPerHour {
+		return false
+	}
+	channel.lastSent[key] = now
+	channel.sent = append(channel.sent, now)
+	return true
+}
+
+func render(t *template.Template, message *Message) string {
+	var buffer bytes.Buffer
+	if err := t.Execute(&buffer, message); err != nil {
+		log.Println("Failed to build the", t.Name(), "of a notification -", err)
+		return message.Text
+	}
+	return buffer.String()
+}
+
+/**
+Queue the message for each channel it is routed to. Never blocks.
+*/
+func (notifier *Notifier) Notify(message Message) {
+	if message.Time.IsZero() {
+		message.Time = time.Now()
+	}
+	if notifier == nil {
+		log.Println("Notification (no channels configured) -", message.Rule, message.Event, "-", message.Text)
+		return
+	}
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	for _, channel := range notifier.route(&message) {
+		if !notifier.allow(channel, &message, message.Time) {
+			log.Println("Rate limited the", channel.name, "notification -", message.Text)
+			continue
+		}
+		if len(notifier.queue) >= maxQueued {
+			log.Println("Notification queue is full, dropping", notifier.queue[0].channel.name, "message -", notifier.queue[0].message.Text)
+			notifier.queue = notifier.queue[1:]
+		}
+		d := &delivery{channel: channel, message: message, due: message.Time}
+		// Reports carry their own subject and body
+		if message.Event == Report {
+			d.subject, d.body = message.Rule, message.Text
+		} else {
+			d.subject, d.body = render(channel.subject, &message), render(channel.body, &message)
+		}
+		notifier.queue = append(notifier.queue, d)
+	}
+	select {
+	case notifier.wake <- struct{}{}:
+	default:
+	}
+}
+
+/**
+Send a notice that is not about an alarm
+*/
+func (notifier *Notifier) Notice(severity string, subject string, text string) {
+	notifier.Notify(Message{Event: Notice, Severity: severity, Rule: subject, Text: text})
+}
+
+/**
+Send a summary report with the text for most channels and the HTML for email
+*/
+func (notifier *Notifier) Report(subject string, text string, html string) {
+	notifier.Notify(Message{Event: Report, Severity: Info, Rule: subject, Text: text, HTML: html})
+}
+
+/**
+Take the deliveries that are due off the queue
+*/
+func (notifier *Notifier) due(now time.Time) []*delivery {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	var due []*delivery
+	waiting := notifier.queue[:0]
+	for _, d := range notifier.queue {
+		if !d.due.After(now) {
+			due = append(due, d)
+		} else {
+			waiting = append(waiting, d)
+		}
+	}
+	notifier.queue = waiting
+	return due
+}
+
+/**
+Send the queued messages, retrying failures with a growing delay. Never returns.
+*/
+func (notifier *Notifier) Run() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-notifier.wake:
+		}
+		for _, d := range notifier.due(time.Now()) {
+			err := d.channel.channel.send(d.subject, d.body, &d.message)
+			if err == nil {
+				continue
+			}
+			d.attempts++
+			if d.attempts >= notifier.config.MaxAttempts {
+				log.Println("Giving up sending", d.channel.name, "notification after", d.attempts, "attempts -", err)
+				continue
+			}
+			delay := firstRetryDelay << uint(d.attempts-1)
+			if delay > maxRetryDelay || delay <= 0 {
+				delay = maxRetryDelay
+			}
+			log.Println("Failed to send", d.channel.name, "notification, retrying in", delay, "-", err)
+			d.due = time.Now().Add(delay)
+			notifier.mu.Lock()
+			notifier.queue = append(notifier.queue, d)
+			notifier.mu.Unlock()
+		}
+	}
+}
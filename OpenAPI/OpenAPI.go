@@ -0,0 +1,170 @@
+package OpenAPI
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/**
+Parameter is a path or query parameter of an operation
+*/
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+}
+
+/**
+Path and query parameters. Path parameters are always required.
+*/
+func PathParameter(name string, typeName string, description string) Parameter {
+	return Parameter{Name: name, In: "path", Description: description, Required: true, Schema: &Schema{Type: typeName}}
+}
+
+func QueryParameter(name string, typeName string, description string) Parameter {
+	return Parameter{Name: name, In: "query", Description: description, Schema: &Schema{Type: typeName}}
+}
+
+/**
+Operation describes one endpoint. Request and Response are values of the body types, for example Status{} or
+[]Alarm(nil), which are described by reflection. Leave them nil if there is no body.
+*/
+type Operation struct {
+	Method      string
+	Path        string
+	Summary     string
+	Description string
+	Tag         string
+	Parameters  []Parameter
+	Request     interface{}
+	Response    interface{}
+	Errors      []int // HTTP status codes returned with an error body
+}
+
+type mediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type body struct {
+	Description string               `json:"description"`
+	Required    bool                 `json:"required,omitempty"`
+	Content     map[string]mediaType `json:"content,omitempty"`
+}
+
+type operation struct {
+	Summary     string           `json:"summary,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Tags        []string         `json:"tags,omitempty"`
+	Parameters  []Parameter      `json:"parameters,omitempty"`
+	RequestBody *body            `json:"requestBody,omitempty"`
+	Responses   map[string]*body `json:"responses"`
+}
+
+type info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type server struct {
+	URL string `json:"url"`
+}
+
+type components struct {
+	Schemas         map[string]*Schema     `json:"schemas"`
+	SecuritySchemes map[string]interface{} `json:"securitySchemes,omitempty"`
+}
+
+/**
+Document is an OpenAPI 3 description of an API built up one operation at a time
+*/
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       info                             `json:"info"`
+	Servers    []server                         `json:"servers"`
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components components                       `json:"components"`
+	Security   []map[string][]string            `json:"security,omitempty"`
+
+	errorType reflect.Type
+}
+
+/**
+Start a document for the API served under basePath. Errors are described with the type of errorBody.
+*/
+func New(title string, version string, description string, basePath string, errorBody interface{}) *Document {
+	doc := &Document{
+		OpenAPI: "3.0.3",
+		Info:    info{Title: title, Version: version, Description: description},
+		Servers: []server{{URL: basePath}},
+		Paths:   make(map[string]map[string]*operation),
+	}
+	doc.Components.Schemas = make(map[string]*Schema)
+	if errorBody != nil {
+		doc.errorType = reflect.TypeOf(errorBody)
+	}
+	return doc
+}
+
+/**
+Describe the session cookie and bearer token accepted by the API. Either may be used.
+*/
+func (doc *Document) AddSecurity(cookieName string) {
+	doc.Components.SecuritySchemes = map[string]interface{}{
+		"bearer":  map[string]string{"type": "http", "scheme": "bearer"},
+		"session": map[string]string{"type": "apiKey", "in": "cookie", "name": cookieName},
+	}
+	doc.Security = []map[string][]string{{"bearer": {}}, {"session": {}}}
+}
+
+func (doc *Document) content(value interface{}) map[string]mediaType {
+	return map[string]mediaType{"application/json": {Schema: doc.schemaFor(reflect.TypeOf(value))}}
+}
+
+/**
+Add an operation. Paths use the {name} form for parameters, as gorilla/mux does.
+*/
+func (doc *Document) Add(op Operation) {
+	o := &operation{Summary: op.Summary, Description: op.Description, Parameters: op.Parameters, Responses: make(map[string]*body)}
+	if op.Tag != "" {
+		o.Tags = []string{op.Tag}
+	}
+	if op.Request != nil {
+		o.RequestBody = &body{Description: "Request", Required: true, Content: doc.content(op.Request)}
+	}
+	success := &body{Description: "OK"}
+	if op.Response != nil {
+		success.Content = doc.content(op.Response)
+	}
+	o.Responses["200"] = success
+	for _, code := range op.Errors {
+		errorBody := &body{Description: http.StatusText(code)}
+		if doc.errorType != nil {
+			errorBody.Content = map[string]mediaType{"application/json": {Schema: doc.schemaFor(doc.errorType)}}
+		}
+		o.Responses[strconv.Itoa(code)] = errorBody
+	}
+	if doc.Paths[op.Path] == nil {
+		doc.Paths[op.Path] = make(map[string]*operation)
+	}
+	doc.Paths[op.Path][strings.ToLower(op.Method)] = o
+}
+
+/**
+Serve the document as JSON
+*/
+func (doc *Document) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,121 @@
+package OpenAPI
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+/**
+Schema is an OpenAPI 3 schema object. Only the parts needed to describe Go types are included.
+*/
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+var jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+var textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+/**
+Return the schema for the type. Named structs are added to the components and referred to by name so each is only
+described once.
+*/
+func (doc *Document) schemaFor(t reflect.Type) *Schema {
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Ptr:
+		schema := *doc.schemaFor(t.Elem())
+		if schema.Ref != "" {
+			// $ref cannot have siblings in OpenAPI 3.0
+			return &schema
+		}
+		schema.Nullable = true
+		return &schema
+	case t.Implements(jsonMarshaler) || t.Implements(textMarshaler):
+		// Types with their own encoding, such as enumerations, are sent as strings
+		return &Schema{Type: "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: doc.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: doc.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return doc.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, found := doc.Components.Schemas[name]; !found {
+			// Reserve the name first in case the type refers to itself
+			doc.Components.Schemas[name] = &Schema{}
+			doc.Components.Schemas[name] = doc.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	default:
+		return &Schema{}
+	}
+}
+
+func (doc *Document) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue // unexported
+		}
+		name := field.Name
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+			name = tagName
+		}
+		if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+			embedded := doc.structSchema(field.Type)
+			for key, value := range embedded.Properties {
+				schema.Properties[key] = value
+			}
+			continue
+		}
+		schema.Properties[name] = doc.schemaFor(field.Type)
+	}
+	return schema
+}
+
+/**
+Name a struct by package and type so types with the same name in different packages do not collide
+*/
+func schemaName(t reflect.Type) string {
+	pkg := t.PkgPath()
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		pkg = pkg[i+1:]
+	}
+	if pkg == "" || pkg == "main" {
+		return t.Name()
+	}
+	return pkg + "." + t.Name()
+}
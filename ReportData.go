@@ -1,7 +1,9 @@
 package main
 
 import (
+	"BatteryMonitor6813V4/Storage"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -59,55 +61,33 @@ func webGetCurrentData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var sSQL string
+	bucket := historyBucket(start, end, 0)
+	if err = Storage.ValidateTimeRange(start, end, Storage.MaxHistorySpan(bucket)); err != nil {
+		returnHistoryError(w, "Current Data", err)
+		return
+	}
 
-	if start.After(end) {
-		ReturnJSONErrorString(w, "Current Data", "Start must be before end", http.StatusBadRequest, false)
+	points, err := store.GetCurrentHistory(start, end, bucket)
+	if err != nil {
+		returnHistoryError(w, "Current Data", err)
 		return
 	}
-	if end.Sub(start) > time.Hour {
-		sSQL = `select min(unix_timestamp(logged)) as logged,
-		avg(channel_0) as left_,
-		avg(channel_1) as right_,
-		avg(level_of_charge_0) as soc_left,
-		avg(level_of_charge_1) as soc_right
-		from current
-		where logged between ? and ?
-		group by unix_timestamp(logged) DIV 15`
-	} else {
-		sSQL = `select unix_timestamp(logged) as logged,
-		channel_0 as left_,
-		channel_1 as right_,
-		level_of_charge_0 as soc_left,
-		level_of_charge_1 as soc_right
-		from current
-		where logged between ? and ?`
+	for _, point := range points {
+		currentVal.Logged = point.Logged
+		currentVal.Left = point.Left
+		currentVal.Right = point.Right
+		currentVal.SOCLeft = point.SOCLeft
+		currentVal.SOCRight = point.SOCRight
+		currentData = append(currentData, currentVal)
 	}
-
-	rows, err := pDB.Query(sSQL, start, end)
+	sJSON, err := json.Marshal(currentData)
 	if err != nil {
-		_, eFmt := fmt.Fprint(w, `{"error":"`, err.Error(), `","sql":"`, sSQL, `"}`)
-		if eFmt != nil {
-			log.Println(eFmt)
-		}
-	} else {
-		for rows.Next() {
-			err = rows.Scan(&currentVal.Logged, &currentVal.Left, &currentVal.Right, &currentVal.SOCLeft, &currentVal.SOCRight)
-			if err != nil {
-				returnWebError(w, err)
-				return
-			}
-			currentData = append(currentData, currentVal)
-		}
-		sJSON, err := json.Marshal(currentData)
-		if err != nil {
-			returnWebError(w, err)
-			return
-		}
-		_, eFmt := fmt.Fprint(w, string(sJSON))
-		if eFmt != nil {
-			log.Println(eFmt)
-		}
+		returnWebError(w, err)
+		return
+	}
+	_, eFmt := fmt.Fprint(w, string(sJSON))
+	if eFmt != nil {
+		log.Println(eFmt)
 	}
 }
 
@@ -122,33 +102,82 @@ func webGetVoltageData(w http.ResponseWriter, r *http.Request) {
 
 	setHeaders(w)
 
-	sSQL := `select min(unix_timestamp(logged)) as logged, avg(bank_0) / 10 as left_, avg(bank_1) / 10 as right_
-  from voltage
- where logged between '` + r.FormValue("start") + `' and '` + r.FormValue("end") + `'
-		group by unix_timestamp(logged) DIV 15`
-	rows, err := pDB.Query(sSQL)
+	start, err := parseWebTime(r.FormValue("start"))
 	if err != nil {
-		_, eFmt := fmt.Fprint(w, `{"error":"`, err.Error(), `","sql":"`, sSQL, `"}`)
-		if eFmt != nil {
-			log.Println(eFmt)
-		}
-	} else {
-		for rows.Next() {
-			err = rows.Scan(&voltageVal.Logged, &voltageVal.Left, &voltageVal.Right)
-			if err != nil {
-				returnWebError(w, err)
-				return
-			}
-			voltageData = append(voltageData, voltageVal)
-		}
-		sJSON, err := json.Marshal(voltageData)
-		if err != nil {
-			returnWebError(w, err)
-			return
-		}
-		_, eFmt := fmt.Fprint(w, string(sJSON))
-		if eFmt != nil {
-			log.Println(eFmt)
+		ReturnJSONError(w, "Voltage Data", err, http.StatusBadRequest, false)
+		return
+	}
+	end, err := parseWebTime(r.FormValue("end"))
+	if err != nil {
+		ReturnJSONError(w, "Voltage Data", err, http.StatusBadRequest, false)
+		return
+	}
+
+	bucket := historyBucket(start, end, 15*time.Second)
+	if err = Storage.ValidateTimeRange(start, end, Storage.MaxHistorySpan(bucket)); err != nil {
+		returnHistoryError(w, "Voltage Data", err)
+		return
+	}
+	points, err := store.GetBankVoltageHistory(start, end, bucket)
+	if err != nil {
+		returnHistoryError(w, "Voltage Data", err)
+		return
+	}
+	for _, point := range points {
+		voltageVal.Logged = point.Logged
+		voltageVal.Left = point.Left
+		voltageVal.Right = point.Right
+		voltageData = append(voltageData, voltageVal)
+	}
+	sJSON, err := json.Marshal(voltageData)
+	if err != nil {
+		returnWebError(w, err)
+		return
+	}
+	_, eFmt := fmt.Fprint(w, string(sJSON))
+	if eFmt != nil {
+		log.Println(eFmt)
+	}
+}
+
+/**
+Parse a date/time from the web pages. Seconds are optional.
+*/
+/**
+Choose the bucket for a history request. Up to an hour is returned raw, or in buckets of at least minimum, and longer
+ranges get the smallest bucket that keeps the number of points within the default limit.
+*/
+func historyBucket(start time.Time, end time.Time, minimum time.Duration) time.Duration {
+	span := end.Sub(start)
+	if span <= time.Hour && minimum == 0 {
+		return 0
+	}
+	for _, bucket := range []time.Duration{15 * time.Second, time.Minute, time.Hour} {
+		if bucket >= minimum && span/bucket <= Storage.DefaultHistoryLimit {
+			return bucket
 		}
 	}
+	return 24 * time.Hour
+}
+
+/**
+Return a history query error as a bad request, a timeout as service unavailable and anything else as a server error.
+*/
+func returnHistoryError(w http.ResponseWriter, device string, err error) {
+	switch {
+	case errors.Is(err, Storage.ErrInvalidQuery):
+		ReturnJSONError(w, device, err, http.StatusBadRequest, false)
+	case errors.Is(err, Storage.ErrQueryTimeout):
+		ReturnJSONError(w, device, err, http.StatusServiceUnavailable, true)
+	default:
+		ReturnJSONError(w, device, err, http.StatusInternalServerError, true)
+	}
+}
+
+func parseWebTime(value string) (time.Time, error) {
+	when, err := time.Parse("2006-1-2 15:4:5", value)
+	if err != nil {
+		return time.Parse("2006-1-2 15:4", value)
+	}
+	return when, nil
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Reports"
+	"BatteryMonitor6813V4/Storage"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the scheduler looks for a report that is due
+	reportCheckInterval = 10 * time.Minute
+	// Most reports /reports lists
+	maxReportsListed = 500
+)
+
+var (
+	reportHour     int
+	emailedReports = make(map[string]bool)
+	// Stops the scheduler and an on demand request making the same report at once
+	reportLock sync.Mutex
+)
+
+/**
+Set up the reports to be made at hour each morning, emailing the kinds in the comma separated list through the notifier.
+*/
+func startReports(hour int, email string) {
+	if hour < 0 || hour > 23 {
+		log.Fatalf("Invalid report hour %d - it must be 0 to 23 - Sorry, I am giving up.", hour)
+	}
+	reportHour = hour
+	for _, kind := range strings.Split(email, ",") {
+		if kind = strings.TrimSpace(kind); kind == "" {
+			continue
+		}
+		if _, _, err := Reports.LastPeriod(kind, time.Now()); err != nil {
+			log.Fatalf("Invalid -emailreports - %s - Sorry, I am giving up.", err)
+		}
+		emailedReports[kind] = true
+	}
+}
+
+/**
+Start making the reports. Called once the database is connected.
+*/
+func startReportScheduler() {
+	go runReports()
+}
+
+/**
+Make each kind of report once its period has ended and it is past the report hour. A report missed while the monitor
+was stopped is made when it starts again, as long as its period is still the latest.
+*/
+func runReports() {
+	ticker := time.NewTicker(reportCheckInterval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		now := time.Now()
+		if now.Hour() < reportHour {
+			continue
+		}
+		for _, kind := range Reports.Kinds {
+			start, end, _ := Reports.LastPeriod(kind, now)
+			if have, err := store.HaveReport(kind, start); err != nil {
+				log.Println("Failed to look for the", kind, "report -", err)
+				continue
+			} else if have {
+				continue
+			}
+			if _, err := makeReport(kind, start, end, emailedReports[kind]); err != nil {
+				log.Println("Failed to make the", kind, "report -", err)
+			}
+		}
+	}
+}
+
+/**
+Generate the report, save it and send it by email if asked to
+*/
+func makeReport(kind string, start time.Time, end time.Time, email bool) (Storage.SavedReport, error) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	report := Reports.Generate(store, kind, start, end)
+	for _, problem := range report.Errors {
+		log.Println("The", kind, "report is missing", problem)
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		return Storage.SavedReport{}, err
+	}
+	saved := Storage.SavedReport{Kind: kind, Start: start, End: end, Generated: report.Generated, Body: string(body)}
+	if saved.ID, err = store.SaveReport(saved); err != nil {
+		return saved, err
+	}
+	log.Println("Made the", kind, "report for", start.Format("2006-01-02"), "to", end.Format("2006-01-02"))
+	if email {
+		html, err := report.HTML()
+		if err != nil {
+			log.Println("Failed to build the", kind, "report page -", err)
+		}
+		notifier.Report(report.Title(), report.Text(), string(html))
+	}
+	return saved, nil
+}
+
+/**
+The saved reports, newest first, without their contents. Filter by kind (daily, weekly or monthly).
+/reports?kind=weekly&limit=10
+*/
+func webGetReports(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	if store == nil {
+		ReturnJSONErrorString(w, "Reports", "the database is not connected", http.StatusServiceUnavailable, false)
+		return
+	}
+	kind := r.FormValue("kind")
+	if _, _, err := Reports.LastPeriod(kind, time.Now()); kind != "" && err != nil {
+		ReturnJSONError(w, "Reports", err, http.StatusBadRequest, false)
+		return
+	}
+	limit := 50
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxReportsListed {
+			ReturnJSONErrorString(w, "Reports", "limit must be 1 to "+strconv.Itoa(maxReportsListed), http.StatusBadRequest, false)
+			return
+		}
+	}
+	reports, err := store.GetReports(kind, limit)
+	if err != nil {
+		ReturnJSONError(w, "Reports", err, http.StatusInternalServerError, true)
+		return
+	}
+	if reports == nil {
+		reports = []Storage.SavedReport{}
+	}
+	returnJSON(w, reports)
+}
+
+/**
+Find the report named by the id in the path, returning false after sending the error if it is not there
+*/
+func getReportVar(w http.ResponseWriter, r *http.Request) (Storage.SavedReport, bool) {
+	if store == nil {
+		ReturnJSONErrorString(w, "Reports", "the database is not connected", http.StatusServiceUnavailable, false)
+		return Storage.SavedReport{}, false
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		ReturnJSONErrorString(w, "Reports", "invalid report id", http.StatusBadRequest, false)
+		return Storage.SavedReport{}, false
+	}
+	report, err := store.GetReport(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		ReturnJSONErrorString(w, "Reports", "there is no such report", http.StatusNotFound, false)
+		return report, false
+	} else if err != nil {
+		ReturnJSONError(w, "Reports", err, http.StatusInternalServerError, true)
+		return report, false
+	}
+	return report, true
+}
+
+/**
+The report as JSON
+/reports/12
+*/
+func webGetReport(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	if saved, ok := getReportVar(w, r); ok {
+		returnJSON(w, json.RawMessage(saved.Body))
+	}
+}
+
+/**
+The report as a web page that can be saved or printed on its own
+/reports/12/html
+*/
+func webGetReportHTML(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	saved, ok := getReportVar(w, r)
+	if !ok {
+		return
+	}
+	var report Reports.Report
+	if err := json.Unmarshal([]byte(saved.Body), &report); err != nil {
+		ReturnJSONError(w, "Reports", err, http.StatusInternalServerError, true)
+		return
+	}
+	html, err := report.HTML()
+	if err != nil {
+		ReturnJSONError(w, "Reports", err, http.StatusInternalServerError, true)
+		return
+	}
+	if _, err = w.Write(html); err != nil {
+		log.Println(err)
+	}
+}
+
+/**
+Make the report for the latest complete period now, replacing any already saved for it
+*/
+func apiMakeReport(w http.ResponseWriter, r *http.Request) {
+	if store == nil {
+		ReturnJSONErrorString(w, "Reports", "the database is not connected", http.StatusServiceUnavailable, false)
+		return
+	}
+	var request APIReportRequest
+	if !decodeRequest(w, r, "Reports", &request) {
+		return
+	}
+	start, end, err := Reports.LastPeriod(request.Kind, time.Now())
+	if err != nil {
+		ReturnJSONError(w, "Reports", err, http.StatusBadRequest, false)
+		return
+	}
+	saved, err := makeReport(request.Kind, start, end, request.Email)
+	if err != nil {
+		ReturnJSONError(w, "Reports", err, http.StatusInternalServerError, true)
+		return
+	}
+	returnJSON(w, saved)
+}
@@ -0,0 +1,76 @@
+package Reports
+
+import (
+	"bytes"
+	"html/template"
+)
+
+// The page carries its own styles so it can be saved or sent by email on its own
+var page = template.Must(template.New("report").Funcs(template.FuncMap{
+	"optional": optional,
+	"kwh": func(wh float64) float64 {
+		return wh / 1000
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; color: #222; margin: 2em; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: right; }
+th { background: #eee; }
+td.text, th.text { text-align: left; }
+.critical { color: #b00; }
+.warning { color: #b60; }
+.missing { color: #888; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Start.Format "2006-01-02 15:04"}} to {{.End.Format "2006-01-02 15:04"}}</p>
+<h2>Banks</h2>
+<table>
+<tr><th class="text"></th>{{range .Banks}}<th>Bank {{.Bank}}</th>{{end}}</tr>
+<tr><td class="text">Lowest state of charge</td>{{range .Banks}}<td>{{optional .MinSOC "%.0f%%"}}</td>{{end}}</tr>
+<tr><td class="text">Highest state of charge</td>{{range .Banks}}<td>{{optional .MaxSOC "%.0f%%"}}</td>{{end}}</tr>
+<tr><td class="text">Hours at full charge</td>{{range .Banks}}<td>{{printf "%.1f" .HoursAtFull}}</td>{{end}}</tr>
+<tr><td class="text">Charge in</td>{{range .Banks}}<td>{{printf "%.0f" .AhIn}}Ah</td>{{end}}</tr>
+<tr><td class="text">Charge out</td>{{range .Banks}}<td>{{printf "%.0f" .AhOut}}Ah</td>{{end}}</tr>
+<tr><td class="text">Energy in</td>{{range .Banks}}<td>{{printf "%.1f" (kwh .WhIn)}}kWh</td>{{end}}</tr>
+<tr><td class="text">Energy out</td>{{range .Banks}}<td>{{printf "%.1f" (kwh .WhOut)}}kWh</td>{{end}}</tr>
+<tr><td class="text">Round trip efficiency</td>{{range .Banks}}<td>{{optional .RoundTripEfficiency "%.2f"}}</td>{{end}}</tr>
+<tr><td class="text">Widest cell spread</td>{{range .Banks}}<td>{{optional .MaxCellSpread "%.3fV"}}</td>{{end}}</tr>
+</table>
+<h2>Site</h2>
+<table>
+<tr><td class="text">Highest temperature</td><td>{{optional .MaxTemperature "%.1f°C"}}</td></tr>
+<tr><td class="text">Generator run time</td><td>{{printf "%.1f" .GeneratorHours}} hours</td></tr>
+<tr><td class="text">Watering</td><td>{{.WateringEvents}}</td></tr>
+<tr><td class="text">Alarms raised</td><td>{{len .Alarms}}</td></tr>
+</table>
+{{if .Alarms}}<h2>Alarms</h2>
+<table>
+<tr><th class="text">Raised</th><th class="text">Severity</th><th class="text">Alarm</th><th class="text">Cleared</th></tr>
+{{range .Alarms}}<tr><td class="text">{{.Raised.Format "2006-01-02 15:04"}}</td><td class="text {{.Severity}}">{{.Severity}}</td><td class="text">{{.Message}}</td><td class="text">{{if .Cleared}}{{.Cleared.Format "2006-01-02 15:04"}}{{end}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Errors}}<h2>Missing from this report</h2>
+<ul class="missing">{{range .Errors}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<p class="missing">Generated {{.Generated.Format "2006-01-02 15:04"}}</p>
+</body>
+</html>
+`))
+
+/**
+HTML is the report as a self-contained web page
+*/
+func (report Report) HTML() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := page.Execute(&buffer, report); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,249 @@
+package Reports
+
+import (
+	"BatteryMonitor6813V4/Energy"
+	"BatteryMonitor6813V4/Storage"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The kinds of report
+const (
+	Daily   = "daily"
+	Weekly  = "weekly"
+	Monthly = "monthly"
+)
+
+// Kinds lists the kinds of report in order of length
+var Kinds = []string{Daily, Weekly, Monthly}
+
+// A bank estimated at or above this state of charge counts as full
+const fullSOC = 99.0
+
+/**
+BankSummary is what one bank did over the period. The state of charge is the estimate from the state of charge
+estimator and MaxCellSpread the widest difference in volts between the hourly average voltages of its cells.
+*/
+type BankSummary struct {
+	Bank                int      `json:"bank"`
+	MinSOC              *float64 `json:"min_soc"`
+	MaxSOC              *float64 `json:"max_soc"`
+	HoursAtFull         float64  `json:"hours_at_full"`
+	AhIn                float64  `json:"ah_in"`
+	AhOut               float64  `json:"ah_out"`
+	WhIn                float64  `json:"wh_in"`
+	WhOut               float64  `json:"wh_out"`
+	RoundTripEfficiency *float64 `json:"round_trip_efficiency"`
+	MaxCellSpread       *float64 `json:"max_cell_spread"`
+}
+
+type AlarmSummary struct {
+	Rule     string     `json:"rule"`
+	Severity string     `json:"severity"`
+	Source   string     `json:"source"`
+	Message  string     `json:"message"`
+	Raised   time.Time  `json:"raised"`
+	Cleared  *time.Time `json:"cleared,omitempty"`
+}
+
+/**
+Report summarises the battery over a day, week or month. Anything that could not be worked out is left out and the
+reason added to Errors so the rest of the report still gets through.
+*/
+type Report struct {
+	Kind           string         `json:"kind"`
+	Start          time.Time      `json:"start"`
+	End            time.Time      `json:"end"`
+	Generated      time.Time      `json:"generated"`
+	Banks          [2]BankSummary `json:"banks"`
+	MaxTemperature *float64       `json:"max_temperature"`
+	Alarms         []AlarmSummary `json:"alarms"`
+	WateringEvents int            `json:"watering_events"`
+	GeneratorHours float64        `json:"generator_hours"`
+	Errors         []string       `json:"errors,omitempty"`
+}
+
+/**
+LastPeriod returns the most recent complete period of the kind before now. Weeks start on Monday.
+*/
+func LastPeriod(kind string, now time.Time) (start time.Time, end time.Time, err error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch kind {
+	case Daily:
+		return today.AddDate(0, 0, -1), today, nil
+	case Weekly:
+		end = today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+		return end.AddDate(0, 0, -7), end, nil
+	case Monthly:
+		end = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		return end.AddDate(0, -1, 0), end, nil
+	}
+	return start, end, fmt.Errorf("%q is not a kind of report - use daily, weekly or monthly", kind)
+}
+
+func (report *Report) failed(what string, err error) {
+	report.Errors = append(report.Errors, fmt.Sprintf("%s - %s", what, err))
+}
+
+/**
+Generate works out the report for the period from start to end from the data in the store
+*/
+func Generate(store Storage.Store, kind string, start time.Time, end time.Time) Report {
+	report := Report{Kind: kind, Start: start, End: end, Generated: time.Now(), Alarms: []AlarmSummary{}}
+	for bank := range report.Banks {
+		report.Banks[bank].Bank = bank
+		min, max, atFull, err := store.GetSOCSummary(bank, start, end, fullSOC)
+		if err != nil {
+			report.failed(fmt.Sprintf("state of charge of bank %d", bank), err)
+			continue
+		}
+		if min.Valid {
+			report.Banks[bank].MinSOC = &min.Float64
+			report.Banks[bank].MaxSOC = &max.Float64
+		}
+		report.Banks[bank].HoursAtFull = float64(atFull) / 60
+	}
+
+	// The energy table has a row for each day so the last day is the one before end
+	if days, err := store.GetEnergy(start, end.AddDate(0, 0, -1)); err != nil {
+		report.failed("energy", err)
+	} else {
+		total := Energy.Total(days)
+		for bank, totals := range total.Banks {
+			report.Banks[bank].AhIn = totals.AhIn
+			report.Banks[bank].AhOut = totals.AhOut
+			report.Banks[bank].WhIn = totals.WhIn
+			report.Banks[bank].WhOut = totals.WhOut
+			report.Banks[bank].RoundTripEfficiency = total.RoundTripEfficiency[bank]
+		}
+	}
+
+	report.cellSpread(store)
+	report.maxTemperature(store)
+
+	if alarms, err := store.GetAlarms(start, end); err != nil {
+		report.failed("alarms", err)
+	} else {
+		for _, alarm := range alarms {
+			summary := AlarmSummary{Rule: alarm.Rule, Severity: alarm.Severity, Source: alarm.Source, Message: alarm.Message, Raised: alarm.Raised}
+			if alarm.Cleared.Valid {
+				summary.Cleared = &alarm.Cleared.Time
+			}
+			report.Alarms = append(report.Alarms, summary)
+		}
+	}
+
+	if entries, err := store.GetAuditEntries(Storage.AuditFilter{Start: start, End: end, Action: "water_bank"}); err != nil {
+		report.failed("watering", err)
+	} else {
+		for _, entry := range entries {
+			// Turning the water off is recorded as zero minutes
+			var parameters struct {
+				Minutes int `json:"minutes"`
+			}
+			if entry.Result == "ok" && json.Unmarshal([]byte(entry.Parameters), &parameters) == nil && parameters.Minutes > 0 {
+				report.WateringEvents++
+			}
+		}
+	}
+
+	if minutes, err := store.GetGeneratorMinutes(start, end); err != nil {
+		report.failed("generator run time", err)
+	} else {
+		report.GeneratorHours = float64(minutes) / 60
+	}
+	return report
+}
+
+func (report *Report) cellSpread(store Storage.Store) {
+	history, err := store.QueryHistory(Storage.HistoryQuery{Series: Storage.SeriesCellVolts, Start: report.Start, End: report.End,
+		Bucket: time.Hour, Limit: Storage.MaxHistoryLimit})
+	if err != nil {
+		report.failed("cell spread", err)
+		return
+	}
+	cellsPerBank := len(history.Columns) / 2
+	for _, point := range history.Points {
+		for bank := range report.Banks {
+			low, high := 0.0, 0.0
+			for _, volts := range point.Avg[bank*cellsPerBank : (bank+1)*cellsPerBank] {
+				// Cells reading zero are not connected
+				if volts == nil || *volts <= 0 {
+					continue
+				}
+				if low == 0 || *volts < low {
+					low = *volts
+				}
+				if *volts > high {
+					high = *volts
+				}
+			}
+			if spread := high - low; low > 0 && (report.Banks[bank].MaxCellSpread == nil || spread > *report.Banks[bank].MaxCellSpread) {
+				report.Banks[bank].MaxCellSpread = &spread
+			}
+		}
+	}
+}
+
+func (report *Report) maxTemperature(store Storage.Store) {
+	history, err := store.QueryHistory(Storage.HistoryQuery{Series: Storage.SeriesTemperature, Start: report.Start, End: report.End,
+		Bucket: time.Hour, Limit: Storage.MaxHistoryLimit})
+	if err != nil {
+		report.failed("temperature", err)
+		return
+	}
+	for _, point := range history.Points {
+		for _, temperature := range point.Max {
+			if temperature != nil && (report.MaxTemperature == nil || *temperature > *report.MaxTemperature) {
+				value := *temperature
+				report.MaxTemperature = &value
+			}
+		}
+	}
+}
+
+/**
+Title is the subject line of the report
+*/
+func (report Report) Title() string {
+	switch report.Kind {
+	case Weekly:
+		return "Battery weekly report - week starting " + report.Start.Format("Monday 2 January 2006")
+	case Monthly:
+		return "Battery monthly report - " + report.Start.Format("January 2006")
+	}
+	return "Battery daily report - " + report.Start.Format("Monday 2 January 2006")
+}
+
+func optional(value *float64, format string) string {
+	if value == nil {
+		return "-"
+	}
+	return fmt.Sprintf(format, *value)
+}
+
+/**
+Text is the report as plain text for notifications that cannot show HTML
+*/
+func (report Report) Text() string {
+	var text strings.Builder
+	text.WriteString(report.Title() + "\n\n")
+	for _, bank := range report.Banks {
+		fmt.Fprintf(&text, "Bank %d: state of charge %s to %s, %.1f hours full, %.0fAh / %.1fkWh in, %.0fAh / %.1fkWh out, round trip %s, widest cell spread %s\n",
+			bank.Bank, optional(bank.MinSOC, "%.0f%%"), optional(bank.MaxSOC, "%.0f%%"), bank.HoursAtFull, bank.AhIn, bank.WhIn/1000,
+			bank.AhOut, bank.WhOut/1000, optional(bank.RoundTripEfficiency, "%.2f"), optional(bank.MaxCellSpread, "%.3fV"))
+	}
+	fmt.Fprintf(&text, "Highest temperature %s\n", optional(report.MaxTemperature, "%.1fC"))
+	fmt.Fprintf(&text, "Generator ran for %.1f hours\n", report.GeneratorHours)
+	fmt.Fprintf(&text, "Watered %d times\n", report.WateringEvents)
+	fmt.Fprintf(&text, "%d alarms raised\n", len(report.Alarms))
+	for _, alarm := range report.Alarms {
+		fmt.Fprintf(&text, "  %s %s - %s\n", alarm.Raised.Format("2006-01-02 15:04"), alarm.Severity, alarm.Message)
+	}
+	for _, problem := range report.Errors {
+		fmt.Fprintf(&text, "Missing %s\n", problem)
+	}
+	return text.String()
+}
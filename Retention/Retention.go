@@ -0,0 +1,302 @@
+package Retention
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the job looks to see if it is in the off-peak window
+const windowCheckInterval = time.Minute
+
+// Log the progress on a table every this many batches
+const progressBatches = 50
+
+/**
+Config says what is kept where. Live rows older than ArchiveAfter are moved to the archive tables as one minute rows
+and archive rows older than PurgeAfter are deleted. A zero PurgeAfter keeps them for ever. The job only runs in the
+off-peak hours from StartHour up to EndHour, which may wrap past midnight, moving Batch of live data at a time with a
+Pause between batches so the logging is not held up.
+*/
+type Config struct {
+	ArchiveAfter time.Duration
+	PurgeAfter   time.Duration
+	StartHour    int
+	EndHour      int
+	Batch        time.Duration
+	Pause        time.Duration
+}
+
+/**
+ParseWindow reads an off-peak window given as start-end hours, e.g. 1-5 or 23-4
+*/
+func ParseWindow(window string) (start int, end int, err error) {
+	hours := strings.Split(window, "-")
+	if len(hours) == 2 {
+		start, err = strconv.Atoi(strings.TrimSpace(hours[0]))
+		if err == nil {
+			end, err = strconv.Atoi(strings.TrimSpace(hours[1]))
+		}
+		if err == nil && start >= 0 && start <= 23 && end >= 0 && end <= 23 && start != end {
+			return start, end, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("%q is not a window of hours such as 1-5", window)
+}
+
+/**
+TableProgress is how far the job has got with one table. ArchivedTo and PurgedTo are the end of the last batch, so
+nothing older is left in the live table or archive table respectively. The counts are for the current or last run.
+*/
+type TableProgress struct {
+	Table      string     `json:"table"`
+	ArchivedTo *time.Time `json:"archived_to"`
+	PurgedTo   *time.Time `json:"purged_to"`
+	Batches    int        `json:"batches"`
+	Moved      int64      `json:"moved"`   // Rows moved out of the live table
+	Written    int64      `json:"written"` // One minute rows written to the archive table
+	Purged     int64      `json:"purged"`  // Rows deleted from the archive table
+	Done       bool       `json:"done"`    // Nothing is left that is older than the cutoffs
+	Error      string     `json:"error,omitempty"`
+}
+
+type Status struct {
+	Running       bool            `json:"running"`
+	Started       *time.Time      `json:"started"`
+	Finished      *time.Time      `json:"finished"`
+	ArchiveBefore *time.Time      `json:"archive_before"`
+	PurgeBefore   *time.Time      `json:"purge_before"`
+	Window        string          `json:"window"`
+	Tables        []TableProgress `json:"tables"`
+	Error         string          `json:"error,omitempty"` // Set if the archive tables could not be prepared
+}
+
+/**
+Job moves, downsamples and purges the logged data in the background
+*/
+type Job struct {
+	store  Storage.Store
+	config Config
+	mu     sync.Mutex
+	status Status
+	force  bool
+	wake   chan struct{}
+}
+
+// ErrRunning is returned by Start when a run is already going
+var ErrRunning = errors.New("the retention job is already running")
+
+func New(store Storage.Store, config Config) *Job {
+	job := &Job{store: store, config: config, wake: make(chan struct{}, 1)}
+	job.status.Window = fmt.Sprintf("%02d:00-%02d:00", config.StartHour, config.EndHour)
+	for _, table := range Storage.ArchiveTables {
+		job.status.Tables = append(job.status.Tables, TableProgress{Table: table})
+	}
+	return job
+}
+
+/**
+True if the hour is in the off-peak window
+*/
+func (job *Job) offPeak(now time.Time) bool {
+	hour := now.Hour()
+	if job.config.StartHour < job.config.EndHour {
+		return hour >= job.config.StartHour && hour < job.config.EndHour
+	}
+	return hour >= job.config.StartHour || hour < job.config.EndHour
+}
+
+/**
+True if the run should go on with another batch
+*/
+func (job *Job) carryOn() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.force || job.offPeak(time.Now())
+}
+
+/**
+Start a run now, outside the off-peak window if need be
+*/
+func (job *Job) Start() error {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.status.Running {
+		return ErrRunning
+	}
+	job.force = true
+	select {
+	case job.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+/**
+Status returns a copy of the progress so far
+*/
+func (job *Job) Status() Status {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	status := job.status
+	status.Tables = append([]TableProgress(nil), job.status.Tables...)
+	return status
+}
+
+func (job *Job) update(table int, change func(progress *TableProgress)) {
+	job.mu.Lock()
+	change(&job.status.Tables[table])
+	job.mu.Unlock()
+}
+
+/**
+Run once a night in the off-peak window, or when started. A run that reaches the end of the window stops and carries
+on from where it got to the next night. The archive tables are given their minimum and maximum columns first. Only
+returns if that fails.
+*/
+func (job *Job) Run() {
+	if err := job.store.PrepareArchive(); err != nil {
+		log.Println("Retention job cannot run -", err)
+		job.mu.Lock()
+		job.status.Error = err.Error()
+		job.mu.Unlock()
+		return
+	}
+	ranToday := ""
+	ticker := time.NewTicker(windowCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-job.wake:
+		}
+		now := time.Now()
+		job.mu.Lock()
+		force := job.force
+		job.mu.Unlock()
+		// The window can span midnight so a night's run is known by the date the window started
+		night := now.Format("2006-01-02")
+		if job.config.StartHour > job.config.EndHour && now.Hour() < job.config.EndHour {
+			night = now.AddDate(0, 0, -1).Format("2006-01-02")
+		}
+		if force || (job.offPeak(now) && ranToday != night) {
+			ranToday = night
+			job.run(now)
+		}
+	}
+}
+
+func (job *Job) run(now time.Time) {
+	archiveBefore := now.Add(-job.config.ArchiveAfter)
+	job.mu.Lock()
+	job.status.Running = true
+	job.status.Started = &now
+	job.status.Finished = nil
+	job.status.ArchiveBefore = &archiveBefore
+	job.status.PurgeBefore = nil
+	var purgeBefore time.Time
+	if job.config.PurgeAfter > 0 {
+		purgeBefore = now.Add(-job.config.PurgeAfter)
+		job.status.PurgeBefore = &purgeBefore
+	}
+	for i := range job.status.Tables {
+		job.status.Tables[i] = TableProgress{Table: job.status.Tables[i].Table, ArchivedTo: job.status.Tables[i].ArchivedTo,
+			PurgedTo: job.status.Tables[i].PurgedTo}
+	}
+	job.mu.Unlock()
+	log.Println("Starting the retention job - archiving rows before", archiveBefore.Format(Storage.TimeFormat))
+
+	for i, table := range Storage.ArchiveTables {
+		done := job.archive(i, table, archiveBefore)
+		if done && job.config.PurgeAfter > 0 {
+			done = job.purge(i, table, purgeBefore)
+		}
+		job.update(i, func(progress *TableProgress) {
+			progress.Done = done
+		})
+		progress := job.Status().Tables[i]
+		log.Printf("Retention job %s - moved %d rows into %d one minute rows and purged %d rows in %d batches - done: %t",
+			table, progress.Moved, progress.Written, progress.Purged, progress.Batches, progress.Done)
+		if !job.carryOn() {
+			break
+		}
+	}
+
+	finished := time.Now()
+	job.mu.Lock()
+	job.status.Running = false
+	job.status.Finished = &finished
+	job.force = false
+	job.mu.Unlock()
+	log.Println("Finished the retention job after", finished.Sub(now).Round(time.Second))
+}
+
+/**
+Move the table's old rows to the archive in batches. Returns true if there are none left.
+*/
+func (job *Job) archive(i int, table string, before time.Time) bool {
+	for job.carryOn() {
+		batch, err := job.store.ArchiveBatch(table, before, job.config.Batch)
+		if err != nil {
+			log.Println("Retention job failed to archive", table, "-", err)
+			job.update(i, func(progress *TableProgress) {
+				progress.Error = err.Error()
+			})
+			return false
+		}
+		// A batch with no end found nothing to do
+		if batch.End.IsZero() {
+			return true
+		}
+		job.update(i, func(progress *TableProgress) {
+			progress.ArchivedTo = &batch.End
+			progress.Batches++
+			progress.Moved += batch.Removed
+			progress.Written += batch.Written
+			if progress.Batches%progressBatches == 0 {
+				log.Println("Retention job", table, "- archived up to", batch.End.Format(Storage.TimeFormat), "-", progress.Moved, "rows moved so far")
+			}
+		})
+		if !batch.More {
+			return true
+		}
+		time.Sleep(job.config.Pause)
+	}
+	return false
+}
+
+/**
+Delete the archive table's rows that are past the retention in batches. Returns true if there are none left.
+*/
+func (job *Job) purge(i int, table string, before time.Time) bool {
+	// Archive rows are a minute apart so a batch covers sixty times as long for the same number of rows
+	span := job.config.Batch * 60
+	for job.carryOn() {
+		batch, err := job.store.PurgeBatch(table, before, span)
+		if err != nil {
+			log.Println("Retention job failed to purge", table+"_archive", "-", err)
+			job.update(i, func(progress *TableProgress) {
+				progress.Error = err.Error()
+			})
+			return false
+		}
+		if batch.End.IsZero() {
+			return true
+		}
+		job.update(i, func(progress *TableProgress) {
+			progress.PurgedTo = &batch.End
+			progress.Batches++
+			progress.Purged += batch.Removed
+		})
+		if !batch.More {
+			return true
+		}
+		time.Sleep(job.config.Pause)
+	}
+	return false
+}
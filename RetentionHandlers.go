@@ -0,0 +1,88 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Retention"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Time between retention batches so the logging can get to the database
+const retentionPause = time.Second
+
+var (
+	retentionConfig *Retention.Config
+	retentionJob    *Retention.Job
+)
+
+/**
+Check the retention settings. Ages are in days and the batch in minutes. An archiveAfter of zero turns the job off as
+it replaces the second by second readings with one minute rows, which cannot be undone.
+*/
+func startRetention(archiveAfter int, purgeAfter int, window string, batchMinutes int) {
+	if archiveAfter == 0 {
+		if purgeAfter != 0 {
+			log.Fatalf("Invalid -purgeafter %d - the archive is only purged when -archiveafter is set - Sorry, I am giving up.", purgeAfter)
+		}
+		return
+	}
+	startHour, endHour, err := Retention.ParseWindow(window)
+	if err != nil {
+		log.Fatalf("Invalid -archivewindow - %s - Sorry, I am giving up.", err)
+	}
+	if archiveAfter < 0 || purgeAfter < 0 || (purgeAfter > 0 && purgeAfter <= archiveAfter) {
+		log.Fatalf("Invalid -archiveafter %d or -purgeafter %d days - rows must be archived after at least a day and purged after they are archived - Sorry, I am giving up.",
+			archiveAfter, purgeAfter)
+	}
+	if batchMinutes < 1 || batchMinutes > 24*60 {
+		log.Fatalf("Invalid -archivebatch %d - it must be 1 to 1440 minutes - Sorry, I am giving up.", batchMinutes)
+	}
+	retentionConfig = &Retention.Config{
+		ArchiveAfter: time.Duration(archiveAfter) * 24 * time.Hour,
+		PurgeAfter:   time.Duration(purgeAfter) * 24 * time.Hour,
+		StartHour:    startHour,
+		EndHour:      endHour,
+		Batch:        time.Duration(batchMinutes) * time.Minute,
+		Pause:        retentionPause,
+	}
+}
+
+/**
+Start the retention job if it is turned on. Called once the database is connected.
+*/
+func startRetentionJob() {
+	if retentionConfig == nil {
+		log.Println("The retention job is off - set -archiveafter to move old readings to the archive tables")
+		return
+	}
+	retentionJob = Retention.New(store, *retentionConfig)
+	go retentionJob.Run()
+}
+
+/**
+How far the retention job has got archiving and purging each table
+*/
+func webGetRetention(w http.ResponseWriter, _ *http.Request) {
+	setHeaders(w)
+	if retentionJob == nil {
+		ReturnJSONErrorString(w, "Retention", "the retention job is off - set -archiveafter to turn it on", http.StatusServiceUnavailable, false)
+		return
+	}
+	returnJSON(w, retentionJob.Status())
+}
+
+/**
+Start the retention job now rather than waiting for the off-peak window
+*/
+func apiStartRetention(w http.ResponseWriter, _ *http.Request) {
+	if retentionJob == nil {
+		ReturnJSONErrorString(w, "Retention", "the retention job is off - set -archiveafter to turn it on", http.StatusServiceUnavailable, false)
+		return
+	}
+	if err := retentionJob.Start(); errors.Is(err, Retention.ErrRunning) {
+		ReturnJSONError(w, "Retention", err, http.StatusConflict, false)
+		return
+	}
+	returnJSON(w, APIResult{Success: true})
+}
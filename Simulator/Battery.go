@@ -0,0 +1,317 @@
+package Simulator
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const CellsPerBank = 38
+const LeftBank = 0
+const RightBank = 1
+
+const cellResistance = 0.0008 // Nominal internal resistance of one cell in ohms
+const ambientTemperature = 25.0
+const generatorAmps = 150.0 // Charging current available when the generator is running
+
+/**
+One simulated NiFe cell. Each cell is given a small random variation so the web pages show realistic spreads.
+*/
+type simCell struct {
+	capacityFactor float64 // Fraction of the nominal bank capacity this cell actually holds
+	resistance     float64 // Internal resistance in ohms
+	offset         float64 // Fixed offset of the open circuit voltage
+	temperature    float64 // Cell temperature in degrees C
+	volts          float64 // Terminal voltage at the last step
+}
+
+type simBank struct {
+	cells     [CellsPerBank]simCell
+	capacity  float64 // Nominal capacity in Ah
+	charge    float64 // True charge in Ah
+	current   float64 // Bank current in A, positive when charging
+	connected bool
+}
+
+/**
+Battery holds the state of the two simulated banks plus the site load and solar input that drive them.
+*/
+type Battery struct {
+	mu           sync.Mutex
+	banks        [2]simBank
+	loadProfile  []float64 // Load in amps for each hour of the day. A single entry is a constant load.
+	solarPeak    float64   // Solar charging current in amps at midday
+	sunrise      float64   // Hour of the day the solar output starts
+	sunset       float64   // Hour of the day the solar output stops
+	generatorOn  bool
+	fanOn        bool
+	chargeVolts  float64 // Charge voltage limit from the inverter
+	chargeAmps   float64 // Charge current limit from the inverter
+	dischargeAmp float64 // Discharge current limit from the inverter
+	minVolts     float64 // Discharge voltage limit from the inverter
+}
+
+/**
+Create a new battery model with two banks of the given capacity, starting at the given state of charge (0..1).
+*/
+func NewBattery(capacity float64, startCharge float64, loadProfile []float64, solarPeak float64) *Battery {
+	battery := new(Battery)
+	battery.loadProfile = loadProfile
+	if len(battery.loadProfile) == 0 {
+		battery.loadProfile = []float64{0}
+	}
+	battery.solarPeak = solarPeak
+	battery.sunrise = 6.0
+	battery.sunset = 19.0
+	battery.chargeVolts = 65.0
+	battery.chargeAmps = 1200.0
+	battery.dischargeAmp = 1200.0
+	battery.minVolts = 36.0
+	for b := range battery.banks {
+		bank := &battery.banks[b]
+		bank.capacity = capacity
+		bank.charge = capacity * startCharge
+		bank.connected = b == LeftBank
+		for c := range bank.cells {
+			bank.cells[c].capacityFactor = 1.0 - (rand.Float64() * 0.08)
+			bank.cells[c].resistance = cellResistance * (0.9 + (rand.Float64() * 0.3))
+			bank.cells[c].offset = (rand.Float64() - 0.5) * 0.02
+			bank.cells[c].temperature = ambientTemperature
+		}
+	}
+	battery.updateVoltages()
+	return battery
+}
+
+/**
+Open circuit voltage of a NiFe cell at the given state of charge (0..1)
+*/
+func openCircuitVolts(soc float64) float64 {
+	soc = math.Max(0.0, math.Min(1.0, soc))
+	return 1.15 + (0.2 * soc) - (0.1 * math.Exp(-soc*20))
+}
+
+/**
+Terminal voltage of one cell given the bank charge and the bank current.
+NiFe cells climb steeply towards the end of charge so we add a gassing term above 90%.
+*/
+func (cell *simCell) terminalVolts(bank *simBank, current float64) float64 {
+	soc := bank.charge / (bank.capacity * cell.capacityFactor)
+	v := openCircuitVolts(soc) + cell.offset + (current * cell.resistance)
+	if current > 0 && soc > 0.9 {
+		v += 0.25 * math.Min(1.0, (soc-0.9)/0.1)
+	}
+	return v
+}
+
+func (bank *simBank) volts(current float64) float64 {
+	total := 0.0
+	for c := range bank.cells {
+		total += bank.cells[c].terminalVolts(bank, current)
+	}
+	return total
+}
+
+func (bank *simBank) resistance() float64 {
+	total := 0.0
+	for c := range bank.cells {
+		total += bank.cells[c].resistance
+	}
+	return total
+}
+
+/**
+The load in amps for the given time of day
+*/
+func (battery *Battery) load(now time.Time) float64 {
+	if len(battery.loadProfile) == 1 {
+		return battery.loadProfile[0]
+	}
+	return battery.loadProfile[now.Hour()%len(battery.loadProfile)]
+}
+
+/**
+The solar charging current in amps for the given time of day. A simple half sine between sunrise and sunset.
+*/
+func (battery *Battery) solar(now time.Time) float64 {
+	hour := float64(now.Hour()) + (float64(now.Minute()) / 60.0)
+	if hour <= battery.sunrise || hour >= battery.sunset {
+		return 0.0
+	}
+	return battery.solarPeak * math.Sin(math.Pi*(hour-battery.sunrise)/(battery.sunset-battery.sunrise))
+}
+
+/**
+Advance the model by the given time step.
+*/
+func (battery *Battery) Step(now time.Time, dt time.Duration) {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+
+	net := battery.solar(now) - battery.load(now)
+	if battery.generatorOn {
+		net += generatorAmps
+	}
+
+	var connected []*simBank
+	for b := range battery.banks {
+		battery.banks[b].current = 0
+		if battery.banks[b].connected {
+			connected = append(connected, &battery.banks[b])
+		}
+	}
+	if len(connected) > 0 {
+		current := net / float64(len(connected))
+		for _, bank := range connected {
+			bank.current = battery.limitCurrent(bank, current)
+		}
+	}
+
+	hours := dt.Hours()
+	for b := range battery.banks {
+		bank := &battery.banks[b]
+		bank.charge += bank.current * hours
+		bank.charge = math.Max(0.0, math.Min(bank.capacity*1.05, bank.charge))
+		for c := range bank.cells {
+			cell := &bank.cells[c]
+			// Heating from I squared R less cooling towards ambient. The fan doubles the cooling rate.
+			cooling := 0.002
+			if battery.fanOn {
+				cooling = 0.004
+			}
+			heat := bank.current * bank.current * cell.resistance * 0.0005
+			cell.temperature += (heat - (cooling * (cell.temperature - ambientTemperature))) * dt.Seconds()
+		}
+	}
+	battery.updateVoltages()
+}
+
+/**
+Apply the inverter limits to the current requested from one bank. When charging, the inverter holds the bank at the
+charge voltage by reducing the current (constant voltage phase). When discharging it cuts off at the discharge voltage.
+*/
+func (battery *Battery) limitCurrent(bank *simBank, current float64) float64 {
+	if current > 0 {
+		current = math.Min(current, battery.chargeAmps)
+		if bank.volts(current) > battery.chargeVolts {
+			restVolts := bank.volts(0.0001)
+			current = math.Max(0.0, (battery.chargeVolts-restVolts)/bank.resistance())
+		}
+	} else {
+		current = math.Max(current, -battery.dischargeAmp)
+		if bank.volts(current) < battery.minVolts {
+			current = 0
+		}
+	}
+	return current
+}
+
+func (battery *Battery) updateVoltages() {
+	for b := range battery.banks {
+		bank := &battery.banks[b]
+		for c := range bank.cells {
+			bank.cells[c].volts = bank.cells[c].terminalVolts(bank, bank.current)
+		}
+	}
+}
+
+/**
+Set the charge and discharge limits as received from the SMA 0x351 message.
+*/
+func (battery *Battery) SetLimits(chargeVolts float64, chargeAmps float64, dischargeAmps float64, dischargeVolts float64) {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	battery.chargeVolts = chargeVolts
+	battery.chargeAmps = chargeAmps
+	battery.dischargeAmp = dischargeAmps
+	battery.minVolts = dischargeVolts
+}
+
+/**
+Switch a bank in or out of circuit
+*/
+func (battery *Battery) Connect(bank int, connected bool) {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	battery.banks[bank].connected = connected
+}
+
+func (battery *Battery) Connected(bank int) bool {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	return battery.banks[bank].connected
+}
+
+func (battery *Battery) SetGenerator(on bool) {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	battery.generatorOn = on
+}
+
+func (battery *Battery) Generator() bool {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	return battery.generatorOn
+}
+
+func (battery *Battery) SetFan(on bool) {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	battery.fanOn = on
+}
+
+/**
+Return the voltage of one cell. Cell is 0 based within the bank.
+*/
+func (battery *Battery) CellVolts(bank int, cell int) float64 {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	return battery.banks[bank].cells[cell].volts
+}
+
+/**
+Return the temperature of one cell. Cell is 0 based within the bank.
+*/
+func (battery *Battery) CellTemperature(bank int, cell int) float64 {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	return battery.banks[bank].cells[cell].temperature
+}
+
+func (battery *Battery) BankVolts(bank int) float64 {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	total := 0.0
+	for _, cell := range battery.banks[bank].cells {
+		total += cell.volts
+	}
+	return total
+}
+
+func (battery *Battery) BankCurrent(bank int) float64 {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	return battery.banks[bank].current
+}
+
+/**
+Return the true state of charge of the bank as a percentage
+*/
+func (battery *Battery) StateOfCharge(bank int) float64 {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	return (battery.banks[bank].charge * 100.0) / battery.banks[bank].capacity
+}
+
+func (battery *Battery) MaxTemperature() float64 {
+	battery.mu.Lock()
+	defer battery.mu.Unlock()
+	tMax := -273.15
+	for _, bank := range battery.banks {
+		for _, cell := range bank.cells {
+			tMax = math.Max(tMax, cell.temperature)
+		}
+	}
+	return tMax
+}
@@ -0,0 +1,251 @@
+package Simulator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// Modbus function codes
+const (
+	fnReadCoils              = 0x01
+	fnReadDiscreteInputs     = 0x02
+	fnReadHoldingRegisters   = 0x03
+	fnReadInputRegisters     = 0x04
+	fnWriteSingleCoil        = 0x05
+	fnWriteSingleRegister    = 0x06
+	exceptionIllegalFunction = 0x01
+	exceptionIllegalAddress  = 0x02
+)
+
+// Register map of the fuel gauge controllers. Addresses are 1 based as used by the FuelGauge package.
+const (
+	leftBankSense      = 1
+	rightBankSense     = 2
+	leftBankOnRelay    = 1
+	leftBankOffRelay   = 2
+	rightBankOnRelay   = 3
+	rightBankOffRelay  = 4
+	generatorRelay     = 5
+	batteryFanRelay    = 8
+	currentRegister    = 1
+	avgCurrentRegister = 8
+	chargeRegister     = 6
+	efficiencyRegister = 8
+)
+
+/**
+One simulated fuel gauge controller. Addresses 0..16 are held so the 1 based addresses can be used directly.
+*/
+type simSlave struct {
+	address  uint8
+	bank     int
+	coils    [17]bool
+	discrete [10]bool
+	input    [12]uint16
+	holding  [9]uint16
+	charge   float64 // Coulomb counter in Ah as counted by the controller
+}
+
+/**
+FuelGaugeSlaves simulates the pair of Modbus fuel gauge controllers on the RS485 bus. It implements the goburrow
+modbus Transporter interface so it receives complete RTU frames exactly as they would be sent down the serial line.
+The left controller measures the left bank current and drives the bank switching, generator and fan relays.
+The right controller measures the right bank and drives the watering solenoids.
+*/
+type FuelGaugeSlaves struct {
+	mu      sync.Mutex
+	battery *Battery
+	slaves  []*simSlave
+}
+
+func NewFuelGaugeSlaves(battery *Battery, leftAddress uint8, rightAddress uint8, efficiency float64) *FuelGaugeSlaves {
+	fg := new(FuelGaugeSlaves)
+	fg.battery = battery
+	for bank, address := range []uint8{leftAddress, rightAddress} {
+		slave := &simSlave{address: address, bank: bank}
+		slave.charge = battery.StateOfCharge(bank) * battery.banks[bank].capacity / 100.0
+		slave.holding[chargeRegister] = uint16(int16(slave.charge * 10))
+		slave.holding[efficiencyRegister] = uint16(efficiency * 200)
+		fg.slaves = append(fg.slaves, slave)
+	}
+	fg.slaves[0].discrete[leftBankSense] = !battery.Connected(LeftBank)
+	fg.slaves[0].discrete[rightBankSense] = !battery.Connected(RightBank)
+	return fg
+}
+
+/**
+Update the controller registers from the battery model. Called once per simulation step.
+*/
+func (fg *FuelGaugeSlaves) Update(seconds float64) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	for _, slave := range fg.slaves {
+		current := fg.battery.BankCurrent(slave.bank)
+		slave.input[currentRegister] = uint16(int16(current * 100))
+		slave.input[avgCurrentRegister] = uint16(int16(current * 100))
+		// The controller counts charge using its own efficiency setting, so it drifts from the true charge just like the real one.
+		delta := current * seconds / 3600.0
+		if delta > 0 {
+			delta = delta * float64(slave.holding[efficiencyRegister]) / 200.0
+		}
+		slave.charge += delta
+		slave.holding[chargeRegister] = uint16(int16(slave.charge * 10))
+	}
+	left := fg.slaves[0]
+	left.discrete[leftBankSense] = !fg.battery.Connected(LeftBank)
+	left.discrete[rightBankSense] = !fg.battery.Connected(RightBank)
+}
+
+func (fg *FuelGaugeSlaves) slave(address uint8) *simSlave {
+	for _, slave := range fg.slaves {
+		if slave.address == address {
+			return slave
+		}
+	}
+	return nil
+}
+
+/**
+Modbus RTU CRC16
+*/
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for bit := 0; bit < 8; bit++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+func rtuFrame(address uint8, pdu []byte) []byte {
+	adu := append([]byte{address}, pdu...)
+	crc := crc16(adu)
+	return append(adu, byte(crc), byte(crc>>8))
+}
+
+func packBits(bits []bool) []byte {
+	packed := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			packed[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return packed
+}
+
+/**
+Send implements modbus.Transporter. It decodes the request ADU and returns the slave's response ADU.
+*/
+func (fg *FuelGaugeSlaves) Send(aduRequest []byte) ([]byte, error) {
+	if len(aduRequest) < 8 {
+		return nil, fmt.Errorf("modbus request too short (%d bytes)", len(aduRequest))
+	}
+	if crc16(aduRequest[:len(aduRequest)-2]) != binary.LittleEndian.Uint16(aduRequest[len(aduRequest)-2:]) {
+		return nil, fmt.Errorf("modbus request CRC error")
+	}
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+
+	slave := fg.slave(aduRequest[0])
+	if slave == nil {
+		return nil, fmt.Errorf("simulated slave %d is not responding", aduRequest[0])
+	}
+	function := aduRequest[1]
+	address := binary.BigEndian.Uint16(aduRequest[2:4])
+	value := binary.BigEndian.Uint16(aduRequest[4:6])
+	exception := func(code byte) ([]byte, error) {
+		return rtuFrame(slave.address, []byte{function | 0x80, code}), nil
+	}
+
+	switch function {
+	case fnReadCoils, fnReadDiscreteInputs:
+		var bits []bool
+		if function == fnReadCoils {
+			bits = slave.coils[:]
+		} else {
+			bits = slave.discrete[:]
+		}
+		if int(address)+int(value) > len(bits) {
+			return exception(exceptionIllegalAddress)
+		}
+		packed := packBits(bits[address : address+value])
+		return rtuFrame(slave.address, append([]byte{function, byte(len(packed))}, packed...)), nil
+
+	case fnReadHoldingRegisters, fnReadInputRegisters:
+		var registers []uint16
+		if function == fnReadHoldingRegisters {
+			registers = slave.holding[:]
+		} else {
+			registers = slave.input[:]
+		}
+		if int(address)+int(value) > len(registers) {
+			return exception(exceptionIllegalAddress)
+		}
+		pdu := []byte{function, byte(value * 2)}
+		for _, register := range registers[address : address+value] {
+			pdu = append(pdu, byte(register>>8), byte(register))
+		}
+		return rtuFrame(slave.address, pdu), nil
+
+	case fnWriteSingleCoil:
+		if int(address) >= len(slave.coils) {
+			return exception(exceptionIllegalAddress)
+		}
+		fg.setCoil(slave, address, value == 0xFF00)
+		return rtuFrame(slave.address, aduRequest[1:6]), nil
+
+	case fnWriteSingleRegister:
+		if int(address) >= len(slave.holding) {
+			return exception(exceptionIllegalAddress)
+		}
+		slave.holding[address] = value
+		if address == chargeRegister {
+			slave.charge = float64(int16(value)) / 10.0
+		}
+		return rtuFrame(slave.address, aduRequest[1:6]), nil
+	}
+	return exception(exceptionIllegalFunction)
+}
+
+/**
+Set a coil and apply its effect to the battery model. The bank switches are latching contactors operated by
+pulsing the on or off relay, so only the rising edge matters.
+*/
+func (fg *FuelGaugeSlaves) setCoil(slave *simSlave, coil uint16, on bool) {
+	rising := on && !slave.coils[coil]
+	slave.coils[coil] = on
+	if slave != fg.slaves[0] {
+		return
+	}
+	switch coil {
+	case leftBankOnRelay:
+		if rising {
+			fg.battery.Connect(LeftBank, true)
+		}
+	case leftBankOffRelay:
+		if rising {
+			fg.battery.Connect(LeftBank, false)
+		}
+	case rightBankOnRelay:
+		if rising {
+			fg.battery.Connect(RightBank, true)
+		}
+	case rightBankOffRelay:
+		if rising {
+			fg.battery.Connect(RightBank, false)
+		}
+	case generatorRelay:
+		fg.battery.SetGenerator(on)
+	case batteryFanRelay:
+		fg.battery.SetFan(on)
+	}
+	slave.discrete[leftBankSense] = !fg.battery.Connected(LeftBank)
+	slave.discrete[rightBankSense] = !fg.battery.Connected(RightBank)
+}
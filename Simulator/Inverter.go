@@ -0,0 +1,192 @@
+package Simulator
+
+import (
+	"encoding/binary"
+	"github.com/brutella/can"
+	"io"
+	"log"
+	"math"
+	"sync"
+)
+
+/**
+CANHub is a virtual CAN bus. Every frame written by one endpoint is delivered to all the other endpoints, the same
+way a frame put on the wire is seen by every other node. Endpoints carry the raw frames produced by the can package
+so they can be wrapped with can.NewReadWriteCloser and used by a can.Bus exactly like a SocketCAN interface.
+*/
+type CANHub struct {
+	mu        sync.Mutex
+	endpoints []*canEndpoint
+}
+
+type canEndpoint struct {
+	hub       *CANHub
+	rx        chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewCANHub() *CANHub {
+	return new(CANHub)
+}
+
+/**
+Attach a new node to the virtual bus and return a can.Bus connected to it.
+*/
+func (hub *CANHub) NewBus() *can.Bus {
+	endpoint := &canEndpoint{hub: hub, rx: make(chan []byte, 100), closed: make(chan struct{})}
+	hub.mu.Lock()
+	hub.endpoints = append(hub.endpoints, endpoint)
+	hub.mu.Unlock()
+	return can.NewBus(can.NewReadWriteCloser(endpoint))
+}
+
+func (hub *CANHub) deliver(from *canEndpoint, frame []byte) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for _, endpoint := range hub.endpoints {
+		if endpoint == from {
+			continue
+		}
+		data := make([]byte, len(frame))
+		copy(data, frame)
+		select {
+		case endpoint.rx <- data:
+		default:
+			// A node that is not reading loses frames just like a real CAN controller with a full receive buffer
+		}
+	}
+}
+
+func (endpoint *canEndpoint) Read(p []byte) (int, error) {
+	select {
+	case frame := <-endpoint.rx:
+		return copy(p, frame), nil
+	case <-endpoint.closed:
+		return 0, io.EOF
+	}
+}
+
+func (endpoint *canEndpoint) Write(p []byte) (int, error) {
+	select {
+	case <-endpoint.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	endpoint.hub.deliver(endpoint, p)
+	return len(p), nil
+}
+
+func (endpoint *canEndpoint) Close() error {
+	endpoint.closeOnce.Do(func() {
+		close(endpoint.closed)
+		endpoint.hub.mu.Lock()
+		defer endpoint.hub.mu.Unlock()
+		for i, e := range endpoint.hub.endpoints {
+			if e == endpoint {
+				endpoint.hub.endpoints = append(endpoint.hub.endpoints[:i], endpoint.hub.endpoints[i+1:]...)
+				break
+			}
+		}
+	})
+	return nil
+}
+
+/**
+Inverter simulates the Sunny Island inverters on the CAN bus. It takes the charge and discharge limits from the
+0x351 messages sent by the battery monitor and applies them to the battery model, and reports the battery state
+back once a second the way the real inverters do.
+
+All values are little endian as in the SMA protocol:
+
+	0x351 charge voltage 0.1V, charge current 0.1A, discharge current 0.1A, discharge voltage 0.1V
+	0x305 battery voltage 0.1V, battery current 0.1A (signed), battery temperature 0.1C, state of charge %
+	0x306 state of health %, charge procedure, operating state, reserved, active error (16 bits), charge set point 0.1V
+	0x010 frequency 0.01Hz
+	0x307 relay and status bits
+*/
+type Inverter struct {
+	battery   *Battery
+	bus       *can.Bus
+	frequency float64
+	mu        sync.Mutex
+	vSetpoint float64
+}
+
+func NewInverter(battery *Battery, hub *CANHub) *Inverter {
+	inverter := new(Inverter)
+	inverter.battery = battery
+	inverter.bus = hub.NewBus()
+	inverter.frequency = 60.0
+	inverter.bus.SubscribeFunc(inverter.handleFrame)
+	return inverter
+}
+
+func (inverter *Inverter) handleFrame(frm can.Frame) {
+	if frm.ID != 0x351 || frm.Length < 8 {
+		return
+	}
+	chargeVolts := float64(binary.LittleEndian.Uint16(frm.Data[0:])) / 10.0
+	chargeAmps := float64(int16(binary.LittleEndian.Uint16(frm.Data[2:]))) / 10.0
+	dischargeAmps := float64(int16(binary.LittleEndian.Uint16(frm.Data[4:]))) / 10.0
+	dischargeVolts := float64(binary.LittleEndian.Uint16(frm.Data[6:])) / 10.0
+	inverter.battery.SetLimits(chargeVolts, chargeAmps, dischargeAmps, dischargeVolts)
+	inverter.mu.Lock()
+	inverter.vSetpoint = chargeVolts
+	inverter.mu.Unlock()
+}
+
+func newFrame(id uint32, data []byte) can.Frame {
+	frm := can.Frame{ID: id, Length: uint8(len(data))}
+	copy(frm.Data[:], data)
+	return frm
+}
+
+/**
+Send the inverter status frames. Called once a second by the simulator.
+*/
+func (inverter *Inverter) publish() {
+	volts := (inverter.battery.BankVolts(LeftBank) + inverter.battery.BankVolts(RightBank)) / 2.0
+	current := inverter.battery.BankCurrent(LeftBank) + inverter.battery.BankCurrent(RightBank)
+	soc := (inverter.battery.StateOfCharge(LeftBank) + inverter.battery.StateOfCharge(RightBank)) / 2.0
+
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint16(data[0:], uint16(math.Round(volts*10)))
+	binary.LittleEndian.PutUint16(data[2:], uint16(int16(math.Round(current*10))))
+	binary.LittleEndian.PutUint16(data[4:], uint16(int16(math.Round(inverter.battery.MaxTemperature()*10))))
+	binary.LittleEndian.PutUint16(data[6:], uint16(math.Round(soc)))
+	frames := []can.Frame{newFrame(0x305, data)}
+
+	inverter.mu.Lock()
+	vSetpoint := inverter.vSetpoint
+	inverter.mu.Unlock()
+	data = make([]byte, 8)
+	data[0] = 100
+	binary.LittleEndian.PutUint16(data[6:], uint16(math.Round(vSetpoint*10)))
+	frames = append(frames, newFrame(0x306, data))
+
+	data = make([]byte, 2)
+	binary.LittleEndian.PutUint16(data, uint16(math.Round(inverter.frequency*100)))
+	frames = append(frames, newFrame(0x010, data))
+
+	data = make([]byte, 8)
+	if inverter.battery.Generator() {
+		data[0] |= 0x01 // Generator run request
+	}
+	frames = append(frames, newFrame(0x307, data))
+
+	for _, frm := range frames {
+		if err := inverter.bus.Publish(frm); err != nil {
+			log.Println("Simulated inverter CAN error - ", err)
+		}
+	}
+}
+
+/**
+Listen for frames from the battery monitor. Blocks until the bus is disconnected.
+*/
+func (inverter *Inverter) Run() {
+	if err := inverter.bus.ConnectAndPublish(); err != nil {
+		log.Println("Simulated inverter CAN bus stopped - ", err)
+	}
+}
@@ -0,0 +1,255 @@
+package Simulator
+
+import (
+	"encoding/binary"
+	"math"
+	"periph.io/x/periph/conn"
+	"periph.io/x/periph/conn/spi"
+	"sync"
+)
+
+// LTC6813 commands the simulated chain responds to
+const (
+	cmdWRCFGA  = 0x01
+	cmdRDCFGA  = 0x02
+	cmdRDCVA   = 0x04
+	cmdRDCVB   = 0x06
+	cmdRDCVC   = 0x08
+	cmdRDCVD   = 0x0A
+	cmdRDCVE   = 0x09
+	cmdRDCVF   = 0x0B
+	cmdRDAUXA  = 0x0C
+	cmdRDAUXB  = 0x0E
+	cmdRDAUXC  = 0x0D
+	cmdRDAUXD  = 0x0F
+	cmdRDSTATA = 0x10
+	cmdWRCFGB  = 0x24
+	cmdADCV    = 0x260
+	cmdADAX    = 0x460
+	cmdADCVSC  = 0x467
+	cmdADCVAX  = 0x46F
+	cmdRDCOMM  = 0x722
+)
+
+const adcModeMask = 0x190 // ADC mode and discharge permitted bits that can be added to the conversion commands
+const cellsPerDevice = 18
+const devicesPerBank = 3
+const bCoefficient = 6000.0
+const vRef2 = 30000 // GPIO reading with the thermistor open circuit
+
+/**
+Register contents of one simulated LTC6813
+*/
+type simDevice struct {
+	cellVolts  [18]uint16
+	gpioVolts  [9]uint16
+	refVolts   uint16
+	sumOfCells uint16
+	configA    [6]byte
+	configB    [6]byte
+}
+
+/**
+LTC6813Chain simulates a daisy chain of LTC6813 devices on the end of an SPI connection. It decodes the commands sent
+by the LTC6813 driver and answers read commands with values taken from the battery model, complete with valid PECs.
+*/
+type LTC6813Chain struct {
+	mu      sync.Mutex
+	battery *Battery
+	devices []simDevice
+}
+
+var pecTable [256]uint16
+
+func init() {
+	// Build the CRC15 table used by the LTC6813 packet error code, polynomial 0x4599
+	for i := range pecTable {
+		remainder := uint16(i) << 7
+		for bit := 0; bit < 8; bit++ {
+			if remainder&0x4000 != 0 {
+				remainder = (remainder << 1) ^ 0x4599
+			} else {
+				remainder <<= 1
+			}
+		}
+		pecTable[i] = remainder
+	}
+}
+
+func calculatePEC(data []byte) uint16 {
+	var remainder uint16 = 16
+	for _, b := range data {
+		addr := byte(remainder>>7) ^ b
+		remainder = (remainder << 8) ^ pecTable[addr]
+	}
+	return remainder * 2
+}
+
+func NewLTC6813Chain(battery *Battery) *LTC6813Chain {
+	chain := new(LTC6813Chain)
+	chain.battery = battery
+	return chain
+}
+
+func (chain *LTC6813Chain) String() string {
+	return "Simulated LTC6813 chain"
+}
+
+func (chain *LTC6813Chain) Duplex() conn.Duplex {
+	return conn.Full
+}
+
+func (chain *LTC6813Chain) TxPackets(p []spi.Packet) error {
+	for _, packet := range p {
+		if err := chain.Tx(packet.W, packet.R); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+Process one SPI transaction. The LTC6813 driver always passes the same buffer for write and read.
+*/
+func (chain *LTC6813Chain) Tx(w, r []byte) error {
+	// Single byte transfers are only used to wake up the isoSPI link.
+	if len(w) < 4 {
+		return nil
+	}
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	length := (len(w) - 4) / 8
+	for len(chain.devices) < length {
+		chain.devices = append(chain.devices, simDevice{})
+	}
+	cmd := binary.BigEndian.Uint16(w[0:2])
+	if len(r) != len(w) {
+		copy(r, w)
+	}
+
+	switch cmd {
+	case cmdWRCFGA:
+		for d := 0; d < length; d++ {
+			copy(chain.devices[d].configA[:], w[(d*8)+4:(d*8)+10])
+		}
+		return nil
+	case cmdWRCFGB:
+		for d := 0; d < length; d++ {
+			copy(chain.devices[d].configB[:], w[(d*8)+4:(d*8)+10])
+		}
+		return nil
+	}
+
+	switch cmd &^ adcModeMask {
+	case cmdADCV, cmdADCVSC, cmdADCVAX:
+		chain.convertCells(length)
+		return nil
+	case cmdADAX:
+		chain.convertGPIO(length)
+		return nil
+	}
+
+	for d := 0; d < length; d++ {
+		data := r[(d*8)+4 : (d*8)+10]
+		device := &chain.devices[d]
+		switch cmd {
+		case cmdRDCFGA:
+			copy(data, device.configA[:])
+		case cmdRDCVA:
+			putWords(data, device.cellVolts[0], device.cellVolts[1], device.cellVolts[2])
+		case cmdRDCVB:
+			putWords(data, device.cellVolts[3], device.cellVolts[4], device.cellVolts[5])
+		case cmdRDCVC:
+			putWords(data, device.cellVolts[6], device.cellVolts[7], device.cellVolts[8])
+		case cmdRDCVD:
+			putWords(data, device.cellVolts[9], device.cellVolts[10], device.cellVolts[11])
+		case cmdRDCVE:
+			putWords(data, device.cellVolts[12], device.cellVolts[13], device.cellVolts[14])
+		case cmdRDCVF:
+			putWords(data, device.cellVolts[15], device.cellVolts[16], device.cellVolts[17])
+		case cmdRDAUXA:
+			putWords(data, device.gpioVolts[0], device.gpioVolts[1], device.gpioVolts[2])
+		case cmdRDAUXB:
+			putWords(data, device.gpioVolts[3], device.gpioVolts[4], device.refVolts)
+		case cmdRDAUXC:
+			putWords(data, device.gpioVolts[5], device.gpioVolts[6], device.gpioVolts[7])
+		case cmdRDAUXD:
+			putWords(data, device.gpioVolts[8], 0, 0)
+		case cmdRDSTATA:
+			putWords(data, device.sumOfCells, 0, 0)
+		case cmdRDCOMM:
+			putWords(data, 0, 0, 0)
+		default:
+			// Write and start commands we do not model (I2C etc.) are accepted and ignored
+			return nil
+		}
+		binary.BigEndian.PutUint16(r[(d*8)+10:], calculatePEC(data))
+	}
+	return nil
+}
+
+func putWords(data []byte, w0 uint16, w1 uint16, w2 uint16) {
+	binary.LittleEndian.PutUint16(data[0:], w0)
+	binary.LittleEndian.PutUint16(data[2:], w1)
+	binary.LittleEndian.PutUint16(data[4:], w2)
+}
+
+/**
+Map a device and channel to the bank and cell in the battery model.
+Returns false if the channel is not connected to a cell.
+*/
+func cellForChannel(device int, channel int) (bank int, cell int, ok bool) {
+	bank = device / devicesPerBank
+	cell = ((device % devicesPerBank) * cellsPerDevice) + channel
+	ok = bank < 2 && cell < CellsPerBank
+	return
+}
+
+/**
+Take a snapshot of the cell voltages from the battery model. Voltages are in units of 100uV.
+*/
+func (chain *LTC6813Chain) convertCells(length int) {
+	for d := 0; d < length; d++ {
+		var sum uint32
+		for c := range chain.devices[d].cellVolts {
+			var raw uint16
+			if bank, cell, ok := cellForChannel(d, c); ok {
+				raw = uint16(math.Round(chain.battery.CellVolts(bank, cell) * 10000.0))
+			}
+			chain.devices[d].cellVolts[c] = raw
+			sum += uint32(raw)
+		}
+		// The sum of cells register has a resolution of 30 times the cell voltage resolution
+		chain.devices[d].sumOfCells = uint16(sum / 30)
+		chain.devices[d].refVolts = 30000
+	}
+}
+
+/**
+Convert a temperature into the GPIO voltage the thermistor divider would produce
+*/
+func thermistorVolts(t float64) uint16 {
+	x := (1.0 / (t + 273.15)) - 0.003354
+	return uint16(math.Round(vRef2 / (1.0 + math.Exp(-x*bCoefficient))))
+}
+
+/**
+Take a snapshot of the temperature sensors selected by the multiplexer. The mux address is written to configuration
+register B as (sensor * 2) + 1. GPIO1 reads sensors 0..7, GPIO2 sensors 8..15 and GPIO3 & GPIO6 read sensors 16 & 17.
+*/
+func (chain *LTC6813Chain) convertGPIO(length int) {
+	sensorTemp := func(device int, sensor int) uint16 {
+		if bank, cell, ok := cellForChannel(device, sensor); ok {
+			return thermistorVolts(chain.battery.CellTemperature(bank, cell))
+		}
+		return 0
+	}
+	for d := 0; d < length; d++ {
+		mux := int(chain.devices[d].configB[0]>>1) & 0x07
+		chain.devices[d].gpioVolts[0] = sensorTemp(d, mux)
+		chain.devices[d].gpioVolts[1] = sensorTemp(d, mux+8)
+		chain.devices[d].gpioVolts[2] = sensorTemp(d, 16)
+		chain.devices[d].gpioVolts[5] = sensorTemp(d, 17)
+	}
+}
@@ -0,0 +1,85 @@
+package Simulator
+
+import (
+	"github.com/brutella/can"
+	"github.com/goburrow/modbus"
+	"log"
+	"periph.io/x/periph/conn/spi"
+	"time"
+)
+
+/**
+Settings used to build the simulated system
+*/
+type Settings struct {
+	Capacity     float64   // Capacity of each bank in Ah
+	StartCharge  float64   // Starting state of charge (0..1)
+	LoadProfile  []float64 // Site load in amps for each hour of the day
+	SolarPeak    float64   // Solar charging current at midday in amps
+	LeftAddress  uint8     // Modbus address of the left bank fuel gauge
+	RightAddress uint8     // Modbus address of the right bank fuel gauge
+	Efficiency   float64   // Charge efficiency used by the simulated fuel gauges (0..1)
+}
+
+/**
+Simulator ties together the battery model and the simulated hardware. The battery monitor talks to the hardware
+through the same interfaces it uses for the real devices so everything above the drivers runs unchanged.
+*/
+type Simulator struct {
+	Battery  *Battery
+	chain    *LTC6813Chain
+	slaves   *FuelGaugeSlaves
+	hub      *CANHub
+	inverter *Inverter
+	lastStep time.Time
+}
+
+func New(settings Settings) *Simulator {
+	sim := new(Simulator)
+	sim.Battery = NewBattery(settings.Capacity, settings.StartCharge, settings.LoadProfile, settings.SolarPeak)
+	sim.chain = NewLTC6813Chain(sim.Battery)
+	sim.slaves = NewFuelGaugeSlaves(sim.Battery, settings.LeftAddress, settings.RightAddress, settings.Efficiency)
+	sim.hub = NewCANHub()
+	sim.inverter = NewInverter(sim.Battery, sim.hub)
+	return sim
+}
+
+/**
+The SPI connection to the simulated LTC6813 chain
+*/
+func (sim *Simulator) SPIConnection() spi.Conn {
+	return sim.chain
+}
+
+/**
+The transporter carrying Modbus RTU frames to the simulated fuel gauges
+*/
+func (sim *Simulator) ModbusTransporter() modbus.Transporter {
+	return sim.slaves
+}
+
+/**
+Return a new CAN bus connected to the simulated inverter
+*/
+func (sim *Simulator) NewCANBus() *can.Bus {
+	return sim.hub.NewBus()
+}
+
+/**
+Run the simulation in real time. Never returns.
+*/
+func (sim *Simulator) Run() {
+	log.Println("Starting the simulator.")
+	go sim.inverter.Run()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	sim.lastStep = time.Now()
+	for {
+		now := <-ticker.C
+		dt := now.Sub(sim.lastStep)
+		sim.lastStep = now
+		sim.Battery.Step(now, dt)
+		sim.slaves.Update(dt.Seconds())
+		sim.inverter.publish()
+	}
+}
@@ -0,0 +1,279 @@
+package StateOfCharge
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Where the estimate came from last
+	Counting   = "counting"
+	Rest       = "rest"
+	FullCharge = "full charge"
+	Restored   = "restored"
+
+	// Readings further apart than this are only counted for this long. The fuel gauge counter covers longer gaps.
+	maxStep = 10 * time.Second
+	// The standard deviation is never allowed to grow past this fraction of the capacity
+	maxUncertainty = 0.5
+)
+
+/**
+OCVPoint is one point on the rest voltage curve, the average cell voltage of a bank that has been resting at the given
+state of charge.
+*/
+type OCVPoint struct {
+	Volts   float64
+	Percent float64
+}
+
+/**
+Config sets how far the estimate is trusted. Uncertainties are one standard deviation as a fraction of the capacity.
+
+ThroughputError is the fraction of each Ah counted that may be wrong and IdleDrift the uncertainty added each hour
+whatever the current, for self discharge. A bank is resting once its current has stayed below RestAmps for RestTime,
+when its average cell voltage is read against RestCurve with an uncertainty of RestUncertainty. FullUncertainty is how
+far from 100% a bank may be when the full charge evaluator finds every cell full.
+*/
+type Config struct {
+	ThroughputError    float64
+	IdleDrift          float64
+	InitialUncertainty float64
+	RestAmps           float64
+	RestTime           time.Duration
+	RestCurve          []OCVPoint
+	RestUncertainty    float64
+	FullUncertainty    float64
+}
+
+/**
+Estimate is the state of charge of a bank with its uncertainty, both in %. Counter is the state of charge from the fuel
+gauge's own coulomb counter for comparison.
+*/
+type Estimate struct {
+	Bank        int        `json:"bank"`
+	SOC         float64    `json:"soc"`
+	Uncertainty float64    `json:"uncertainty"`
+	Counter     float64    `json:"counter"`
+	Source      string     `json:"source"`
+	LastAnchor  *time.Time `json:"last_anchor,omitempty"`
+	Updated     time.Time  `json:"updated"`
+}
+
+type bankState struct {
+	running    bool
+	soc        float64 // 0..1
+	sigma      float64 // 0..1
+	counter    float64 // %
+	source     string
+	lastAnchor time.Time
+	updated    time.Time
+	restStart  time.Time
+	restUsed   bool
+}
+
+/**
+Estimator combines the current from the fuel gauges with rest voltages and full charges using a one state Kalman
+filter for each bank. Between anchors the charge is counted, allowing for the charging efficiency, and the uncertainty
+grows. Counting errors are mostly offsets in the current sensor so the standard deviation rather than the variance
+grows with the charge counted. Each anchor is a measurement that pulls the estimate towards it by how much more it is
+trusted than the estimate.
+*/
+type Estimator struct {
+	mu     sync.Mutex
+	config Config
+	banks  [2]bankState
+}
+
+/**
+New returns an estimator that starts each bank from the fuel gauge counter or a restored estimate
+*/
+func New(config Config) *Estimator {
+	sort.Slice(config.RestCurve, func(i, j int) bool { return config.RestCurve[i].Volts < config.RestCurve[j].Volts })
+	return &Estimator{config: config}
+}
+
+/**
+ParseCurve reads a rest voltage curve given as volts:percent pairs, for example "1.05:0,1.25:50,1.35:100"
+*/
+func ParseCurve(curve string) ([]OCVPoint, error) {
+	var points []OCVPoint
+	for _, pair := range strings.Split(curve, ",") {
+		fields := strings.Split(strings.TrimSpace(pair), ":")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%q is not volts:percent", pair)
+		}
+		volts, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || volts <= 0 {
+			return nil, fmt.Errorf("%q is not a valid voltage", fields[0])
+		}
+		percent, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("%q is not a valid percentage", fields[1])
+		}
+		points = append(points, OCVPoint{Volts: volts, Percent: percent})
+	}
+	if len(points) < 2 {
+		return nil, fmt.Errorf("the rest voltage curve needs at least two points")
+	}
+	return points, nil
+}
+
+/**
+Read the state of charge (0..1) from the rest voltage curve, interpolating between points
+*/
+func (estimator *Estimator) restSOC(volts float64) float64 {
+	curve := estimator.config.RestCurve
+	if volts <= curve[0].Volts {
+		return curve[0].Percent / 100
+	}
+	for i := 1; i < len(curve); i++ {
+		if volts <= curve[i].Volts {
+			fraction := (volts - curve[i-1].Volts) / (curve[i].Volts - curve[i-1].Volts)
+			return (curve[i-1].Percent + (fraction * (curve[i].Percent - curve[i-1].Percent))) / 100
+		}
+	}
+	return curve[len(curve)-1].Percent / 100
+}
+
+/**
+Kalman measurement update. Called with the estimator locked.
+*/
+func (bank *bankState) correct(measured float64, uncertainty float64, source string, when time.Time) {
+	p := bank.sigma * bank.sigma
+	gain := p / (p + (uncertainty * uncertainty))
+	bank.soc = math.Max(0, math.Min(1, bank.soc+(gain*(measured-bank.soc))))
+	bank.sigma = math.Sqrt((1 - gain) * p)
+	bank.source = source
+	bank.lastAnchor = when
+}
+
+/**
+Restore a bank from a saved estimate. The fuel gauge counter carried on while we were not running so the change in it
+since the estimate was saved is added along with the uncertainty that brings.
+*/
+func (estimator *Estimator) Restore(saved Estimate, counter float64, now time.Time) {
+	if saved.Bank < 0 || saved.Bank > 1 {
+		return
+	}
+	estimator.mu.Lock()
+	defer estimator.mu.Unlock()
+	change := (counter - saved.Counter) / 100
+	hours := now.Sub(saved.Updated).Hours()
+	bank := &estimator.banks[saved.Bank]
+	bank.soc = math.Max(0, math.Min(1, (saved.SOC/100)+change))
+	bank.sigma = math.Min(maxUncertainty, (saved.Uncertainty/100)+(estimator.config.ThroughputError*math.Abs(change))+(estimator.config.IdleDrift*math.Max(0, hours)))
+	bank.counter = counter
+	bank.source = Restored
+	if saved.LastAnchor != nil {
+		bank.lastAnchor = *saved.LastAnchor
+	}
+	bank.updated = now
+	bank.running = true
+}
+
+/**
+Add one set of readings. amps is the bank current, positive when charging, capacity the bank capacity in Ah and
+efficiency the charging efficiency. meanVolts is the average cell voltage of each bank, zero if not known, and counter
+the fuel gauge state of charge in %.
+*/
+func (estimator *Estimator) Update(now time.Time, amps [2]float64, capacity [2]float64, efficiency [2]float64, meanVolts [2]float64, counter [2]float64) {
+	estimator.mu.Lock()
+	defer estimator.mu.Unlock()
+	for b := range estimator.banks {
+		bank := &estimator.banks[b]
+		if capacity[b] <= 0 {
+			continue
+		}
+		bank.counter = counter[b]
+		if !bank.running {
+			bank.soc = math.Max(0, math.Min(1, counter[b]/100))
+			bank.sigma = estimator.config.InitialUncertainty
+			bank.source = Counting
+			bank.updated = now
+			bank.running = true
+			continue
+		}
+		step := now.Sub(bank.updated)
+		if step <= 0 {
+			continue
+		}
+		if step > maxStep {
+			step = maxStep
+		}
+		bank.updated = now
+
+		// Predict
+		ah := amps[b] * step.Hours()
+		if ah > 0 {
+			ah *= efficiency[b]
+		}
+		bank.soc = math.Max(0, math.Min(1, bank.soc+(ah/capacity[b])))
+		bank.sigma += (estimator.config.ThroughputError * math.Abs(ah) / capacity[b]) + (estimator.config.IdleDrift * step.Hours())
+		bank.sigma = math.Min(maxUncertainty, bank.sigma)
+		if bank.source == Restored {
+			bank.source = Counting
+		}
+
+		// Correct from the rest voltage once each time the bank rests
+		if math.Abs(amps[b]) >= estimator.config.RestAmps {
+			bank.restStart = time.Time{}
+			bank.restUsed = false
+			continue
+		}
+		if bank.restStart.IsZero() {
+			bank.restStart = now
+		}
+		if !bank.restUsed && meanVolts[b] > 0 && len(estimator.config.RestCurve) > 1 && now.Sub(bank.restStart) >= estimator.config.RestTime {
+			bank.correct(estimator.restSOC(meanVolts[b]), estimator.config.RestUncertainty, Rest, now)
+			bank.restUsed = true
+		}
+	}
+}
+
+/**
+The full charge evaluator found every cell in the bank full
+*/
+func (estimator *Estimator) FullCharge(bank int, when time.Time) {
+	if bank < 0 || bank > 1 {
+		return
+	}
+	estimator.mu.Lock()
+	defer estimator.mu.Unlock()
+	if estimator.banks[bank].running {
+		estimator.banks[bank].correct(1, estimator.config.FullUncertainty, FullCharge, when)
+	}
+}
+
+/**
+Return the estimate for the bank. ok is false until the first readings have been added.
+*/
+func (estimator *Estimator) Estimate(bank int) (estimate Estimate, ok bool) {
+	if bank < 0 || bank > 1 {
+		return Estimate{}, false
+	}
+	estimator.mu.Lock()
+	defer estimator.mu.Unlock()
+	state := estimator.banks[bank]
+	if !state.running {
+		return Estimate{Bank: bank}, false
+	}
+	estimate = Estimate{
+		Bank:        bank,
+		SOC:         state.soc * 100,
+		Uncertainty: state.sigma * 100,
+		Counter:     state.counter,
+		Source:      state.source,
+		Updated:     state.updated,
+	}
+	if !state.lastAnchor.IsZero() {
+		anchor := state.lastAnchor
+		estimate.LastAnchor = &anchor
+	}
+	return estimate, true
+}
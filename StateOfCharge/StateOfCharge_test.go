@@ -0,0 +1,186 @@
+package StateOfCharge
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+const testCapacity = 100.0
+
+/**
+Feed bank 0 readings every 10 seconds for the duration after from. Bank 1 has no capacity so is left out.
+*/
+func feed(estimator *Estimator, from time.Duration, duration time.Duration, amps float64, efficiency float64, meanVolts float64) time.Duration {
+	for at := from + 10*time.Second; at <= from+duration; at += 10 * time.Second {
+		estimator.Update(testStart.Add(at), [2]float64{amps}, [2]float64{testCapacity}, [2]float64{efficiency}, [2]float64{meanVolts}, [2]float64{50})
+	}
+	return from + duration
+}
+
+/**
+Start bank 0 at the counter's 50% with the configured initial uncertainty
+*/
+func started(config Config) *Estimator {
+	estimator := New(config)
+	estimator.Update(testStart, [2]float64{}, [2]float64{testCapacity}, [2]float64{1}, [2]float64{}, [2]float64{50})
+	return estimator
+}
+
+func checkEstimate(t *testing.T, estimator *Estimator, soc float64, uncertainty float64, source string) Estimate {
+	t.Helper()
+	estimate, ok := estimator.Estimate(0)
+	if !ok {
+		t.Fatal("bank 0 has no estimate")
+	}
+	if math.Abs(estimate.SOC-soc) > 1e-6 || math.Abs(estimate.Uncertainty-uncertainty) > 1e-6 || estimate.Source != source {
+		t.Errorf("got %.6f%% ± %.6f%% from %s, want %.6f%% ± %.6f%% from %s", estimate.SOC, estimate.Uncertainty, estimate.Source,
+			soc, uncertainty, source)
+	}
+	return estimate
+}
+
+func TestCounting(t *testing.T) {
+	tests := []struct {
+		name       string
+		amps       float64
+		efficiency float64
+		duration   time.Duration
+		soc        float64
+	}{
+		// 36A for 100 seconds is 1Ah, 1% of the bank
+		{"charging is reduced by the efficiency", 36, 0.8, 100 * time.Second, 50.8},
+		{"discharging is not", -36, 0.8, 100 * time.Second, 49},
+		{"resting", 0, 0.8, 100 * time.Second, 50},
+		{"full", 360, 1, 2 * time.Hour, 100},
+		{"empty", -360, 1, 2 * time.Hour, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			estimator := started(Config{InitialUncertainty: 0.05})
+			feed(estimator, 0, test.duration, test.amps, test.efficiency, 0)
+			checkEstimate(t, estimator, test.soc, 5, Counting)
+		})
+	}
+}
+
+func TestCountingGap(t *testing.T) {
+	// A reading a minute after the last is only counted for 10 seconds
+	estimator := started(Config{})
+	estimator.Update(testStart.Add(time.Minute), [2]float64{360}, [2]float64{testCapacity}, [2]float64{1}, [2]float64{}, [2]float64{50})
+	checkEstimate(t, estimator, 51, 0, Counting)
+}
+
+func TestUncertaintyGrows(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      Config
+		amps        float64
+		efficiency  float64
+		duration    time.Duration
+		uncertainty float64
+	}{
+		// 1Ah of a 100Ah bank with a 1% error is 0.01%
+		{"with the charge counted", Config{InitialUncertainty: 0.05, ThroughputError: 0.01}, -36, 1, 100 * time.Second, 5.01},
+		{"with the charge stored", Config{InitialUncertainty: 0.05, ThroughputError: 0.01}, 36, 0.5, 100 * time.Second, 5.005},
+		{"with time", Config{InitialUncertainty: 0.05, IdleDrift: 0.01}, 0, 1, time.Hour, 6},
+		{"up to the limit", Config{InitialUncertainty: 0.45, IdleDrift: 1}, 0, 1, time.Hour, 50},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			estimator := started(test.config)
+			feed(estimator, 0, test.duration, test.amps, test.efficiency, 0)
+			estimate, _ := estimator.Estimate(0)
+			if math.Abs(estimate.Uncertainty-test.uncertainty) > 1e-6 {
+				t.Errorf("uncertainty %.6f%%, want %.6f%%", estimate.Uncertainty, test.uncertainty)
+			}
+		})
+	}
+}
+
+func TestRestAnchorOncePerRest(t *testing.T) {
+	config := Config{
+		InitialUncertainty: 0.1,
+		RestAmps:           1,
+		RestTime:           time.Minute,
+		RestCurve:          []OCVPoint{{1.4, 100}, {1.0, 0}},
+		RestUncertainty:    0.1,
+	}
+	estimator := started(config)
+	// The rest starts with the first reading after the start so is a minute old at 70 seconds
+	at := feed(estimator, 0, 60*time.Second, 0, 1, 1.2)
+	checkEstimate(t, estimator, 50, 10, Counting)
+
+	// 1.2V is 50% on the curve. The estimate and the rest voltage are trusted equally so it moves half way.
+	estimator.banks[0].soc = 0.8
+	at = feed(estimator, at, 10*time.Second, 0, 1, 1.2)
+	estimate := checkEstimate(t, estimator, 65, math.Sqrt(0.005)*100, Rest)
+	if estimate.LastAnchor == nil || !estimate.LastAnchor.Equal(testStart.Add(at)) {
+		t.Errorf("last anchor %v, want %s", estimate.LastAnchor, testStart.Add(at))
+	}
+
+	// Still the same rest so the voltage is not used again
+	at = feed(estimator, at, 10*time.Minute, 0, 1, 1.2)
+	checkEstimate(t, estimator, 65, math.Sqrt(0.005)*100, Rest)
+
+	// A current ends the rest and the next rest is used once it has lasted the rest time
+	at = feed(estimator, at, 10*time.Second, 3.6, 1, 1.2)
+	checkEstimate(t, estimator, 65.01, math.Sqrt(0.005)*100, Rest)
+	at = feed(estimator, at, 60*time.Second, 0, 1, 1.2)
+	checkEstimate(t, estimator, 65.01, math.Sqrt(0.005)*100, Rest)
+	feed(estimator, at, 10*time.Second, 0, 1, 1.2)
+	// The estimate is now trusted more than the rest voltage so it moves a third of the way
+	p := 0.005
+	gain := p / (p + 0.01)
+	checkEstimate(t, estimator, (0.6501+gain*(0.5-0.6501))*100, math.Sqrt((1-gain)*p)*100, Rest)
+}
+
+func TestRestNeedsVoltage(t *testing.T) {
+	estimator := started(Config{InitialUncertainty: 0.1, RestAmps: 1, RestTime: time.Minute, RestCurve: []OCVPoint{{1.0, 0}, {1.4, 100}},
+		RestUncertainty: 0.1})
+	// Without the cell voltages the rest is not used
+	feed(estimator, 0, 10*time.Minute, 0, 1, 0)
+	checkEstimate(t, estimator, 50, 10, Counting)
+}
+
+func TestFullChargeAnchor(t *testing.T) {
+	estimator := New(Config{InitialUncertainty: 0.1, FullUncertainty: 0.01})
+	// Nothing to correct until the bank is running
+	estimator.FullCharge(0, testStart)
+	if _, ok := estimator.Estimate(0); ok {
+		t.Fatal("a full charge started the estimator")
+	}
+	estimator.Update(testStart, [2]float64{}, [2]float64{testCapacity}, [2]float64{1}, [2]float64{}, [2]float64{80})
+	when := testStart.Add(time.Hour)
+	estimator.FullCharge(0, when)
+	estimator.FullCharge(2, when)
+	p := 0.01
+	gain := p / (p + 0.0001)
+	estimate := checkEstimate(t, estimator, (0.8+gain*0.2)*100, math.Sqrt((1-gain)*p)*100, FullCharge)
+	if estimate.LastAnchor == nil || !estimate.LastAnchor.Equal(when) {
+		t.Errorf("last anchor %v, want %s", estimate.LastAnchor, when)
+	}
+	if _, ok := estimator.Estimate(1); ok {
+		t.Error("bank 1 has an estimate without any readings")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	estimator := New(Config{ThroughputError: 0.01, IdleDrift: 0.005})
+	anchor := testStart.Add(-24 * time.Hour)
+	saved := Estimate{Bank: 0, SOC: 60, Uncertainty: 2, Counter: 55, Source: Rest, LastAnchor: &anchor, Updated: testStart.Add(-2 * time.Hour)}
+	// The counter went up 10% while we were stopped
+	estimator.Restore(saved, 65, testStart)
+	estimate := checkEstimate(t, estimator, 70, 2+(0.01*10)+(0.5*2), Restored)
+	if estimate.LastAnchor == nil || !estimate.LastAnchor.Equal(anchor) {
+		t.Errorf("last anchor %v, want %s", estimate.LastAnchor, anchor)
+	}
+	// Counting carries on from the restored estimate
+	estimator.Update(testStart.Add(10*time.Second), [2]float64{}, [2]float64{testCapacity}, [2]float64{1}, [2]float64{}, [2]float64{65})
+	estimate, _ = estimator.Estimate(0)
+	if math.Abs(estimate.SOC-70) > 1e-6 || estimate.Source != Counting {
+		t.Errorf("after restoring got %.6f%% from %s, want 70%% from %s", estimate.SOC, estimate.Source, Counting)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/FuelGauge"
+	"BatteryMonitor6813V4/StateOfCharge"
+	"BatteryMonitor6813V4/Storage"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// Estimates are saved this often so they carry on across restarts
+	socSaveInterval = time.Minute
+	// How often to try again to read the saved estimates if the database could not be read
+	socRestoreRetry = time.Minute
+	// A bank must have been below the rest current this long before its voltage is used
+	socRestTime = 30 * time.Minute
+	// Charge resets returned by /drift
+	chargeDriftReturned = 50
+)
+
+var (
+	socEstimator *StateOfCharge.Estimator
+	socRestored  bool
+	socLastTry   time.Time
+	socLastSave  time.Time
+)
+
+/**
+Start estimating the state of charge of each bank. restCurve is the rest voltage curve as volts:percent pairs and
+restAmps the current below which a bank is resting.
+*/
+func startSOCEstimator(restCurve string, restAmps float64) {
+	curve, err := StateOfCharge.ParseCurve(restCurve)
+	if err != nil {
+		log.Fatalf("Invalid rest voltage curve %q - %s - Sorry, I am giving up.", restCurve, err)
+	}
+	if restAmps <= 0 {
+		log.Fatalf("Invalid rest current %f - it must be more than zero - Sorry, I am giving up.", restAmps)
+	}
+	socEstimator = StateOfCharge.New(StateOfCharge.Config{
+		ThroughputError:    0.02,
+		IdleDrift:          0.0005,
+		InitialUncertainty: 0.1,
+		RestAmps:           restAmps,
+		RestTime:           socRestTime,
+		RestCurve:          curve,
+		RestUncertainty:    0.1,
+		FullUncertainty:    0.02,
+	})
+}
+
+/**
+Carry on from the estimates saved before we were last stopped. Returns false if they could not be read.
+*/
+func restoreSOC() bool {
+	counter := [2]float64{float64(fuelgauge.StateOfChargeLeft()), float64(fuelgauge.StateOfChargeRight())}
+	for bank := 0; bank < 2; bank++ {
+		saved, err := store.GetLatestSOCEstimate(bank)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			log.Println("Failed to read the saved state of charge of bank", bank, "-", err)
+			return false
+		}
+		estimate := StateOfCharge.Estimate{Bank: bank, SOC: saved.SOC, Uncertainty: saved.Uncertainty, Counter: saved.Counter, Updated: saved.Logged}
+		if saved.LastAnchor.Valid {
+			estimate.LastAnchor = &saved.LastAnchor.Time
+		}
+		socEstimator.Restore(estimate, counter[bank], time.Now())
+	}
+	return true
+}
+
+/**
+Add this cycle's readings to the state of charge estimator and save the estimates every minute. Nothing is estimated
+or saved until the saved estimates have been read, otherwise they would be saved over.
+*/
+func estimateCharge() {
+	if socEstimator == nil || store == nil || fuelgauge == nil {
+		return
+	}
+	now := time.Now()
+	if !socRestored {
+		if now.Sub(socLastTry) < socRestoreRetry {
+			return
+		}
+		socLastTry = now
+		if !restoreSOC() {
+			return
+		}
+		socRestored = true
+	}
+	amps := [2]float64{float64(fuelgauge.CurrentLeft()), float64(fuelgauge.CurrentRight())}
+	capacity := [2]float64{float64(fuelgauge.FgLeft.Capacity), float64(fuelgauge.FgRight.Capacity)}
+	efficiency := [2]float64{fuelgauge.FgLeft.Efficiency, fuelgauge.FgRight.Efficiency}
+	counter := [2]float64{float64(fuelgauge.StateOfChargeLeft()), float64(fuelgauge.StateOfChargeRight())}
+	var meanVolts [2]float64
+	if ltc != nil && nDevices > 0 {
+		meanVolts = meanCellVolts()
+	}
+	socEstimator.Update(now, amps, capacity, efficiency, meanVolts, counter)
+	if now.Sub(socLastSave) < socSaveInterval {
+		return
+	}
+	socLastSave = now
+	for bank := 0; bank < 2; bank++ {
+		if estimate, ok := socEstimator.Estimate(bank); ok {
+			saveSOC(estimate)
+		}
+	}
+}
+
+func saveSOC(estimate StateOfCharge.Estimate) {
+	row := Storage.SOCEstimate{Bank: estimate.Bank, SOC: estimate.SOC, Uncertainty: estimate.Uncertainty, Counter: estimate.Counter, Source: estimate.Source}
+	if estimate.LastAnchor != nil {
+		row.LastAnchor = sql.NullTime{Time: *estimate.LastAnchor, Valid: true}
+	}
+	if err := dbQueue.Insert(Storage.SOCEstimateTable, Storage.SOCEstimateColumns, row.Values()...); err != nil {
+		log.Println("Failed to save the state of charge of bank", estimate.Bank, "-", err)
+	}
+}
+
+/**
+Full charge evaluator listener resetting the fuel gauge charge to the bank capacity
+*/
+func chargeFullCharge(bank int, when time.Time) {
+	drift, err := fuelgauge.ResetChargeAtFull(FuelGauge.RuleOrigin("full charge evaluator"), bank, when)
+	if err != nil {
+		log.Println("Failed to reset the charge of bank", bank, "at full charge -", err)
+		return
+	}
+	log.Printf("Bank %d charge reset to %.0fAh at full charge - the counter had drifted %.1fAh", bank, drift.CapacityAh, drift.DriftAh)
+}
+
+/**
+Full charge evaluator listener anchoring the state of charge at 100%
+*/
+func socFullCharge(bank int, when time.Time) {
+	if socEstimator == nil {
+		return
+	}
+	socEstimator.FullCharge(bank, when)
+	if estimate, ok := socEstimator.Estimate(bank); ok {
+		log.Printf("Bank %d state of charge set to %.1f%% +/- %.1f%% at full charge", bank, estimate.SOC, estimate.Uncertainty)
+		saveSOC(estimate)
+	}
+}
+
+/**
+The state of charge sent to the inverter. Like fuelgauge.StateOfCharge the right bank is left out while its current
+sensor is not working. Falls back to the fuel gauge counter until the estimator has started.
+*/
+func stateOfCharge() float32 {
+	if socEstimator != nil {
+		if estimate, ok := socEstimator.Estimate(0); ok {
+			return float32(estimate.SOC)
+		}
+	}
+	return fuelgauge.StateOfCharge()
+}
+
+/**
+Estimated state of charge of each bank with its uncertainty and the fuel gauge counter's figure
+/soc
+*/
+func webGetStateOfCharge(w http.ResponseWriter, _ *http.Request) {
+	setHeaders(w)
+	if socEstimator == nil {
+		ReturnJSONErrorString(w, "State of Charge", "the state of charge estimator is not running", http.StatusServiceUnavailable, false)
+		return
+	}
+	estimates := []StateOfCharge.Estimate{}
+	for bank := 0; bank < 2; bank++ {
+		if estimate, ok := socEstimator.Estimate(bank); ok {
+			estimates = append(estimates, estimate)
+		}
+	}
+	returnJSON(w, estimates)
+}
+
+/**
+The latest fuel gauge charge resets of the bank at full charge with the drift and charging efficiency from each
+/drift/{bank}
+*/
+func webGetChargeDrift(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	bank, ok := parseBankVar(w, r, "Charge Drift")
+	if !ok {
+		return
+	}
+	drifts, err := store.GetChargeDrift(bank, chargeDriftReturned)
+	if err != nil {
+		ReturnJSONError(w, "Charge Drift", err, http.StatusInternalServerError, true)
+		return
+	}
+	if drifts == nil {
+		drifts = []Storage.ChargeDrift{}
+	}
+	returnJSON(w, drifts)
+}
@@ -0,0 +1,197 @@
+package StateOfHealth
+
+import (
+	"BatteryMonitor6813V4/Storage"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// The usable capacity is the average of this many of the latest tests
+	testsAveraged = 3
+	// Tests returned with the health of a bank
+	testsReturned = 10
+	// A deep discharge this soon after the full charge is not a test
+	minTestDuration = time.Hour
+	// The bank must be discharging at least this hard for its voltage to count as a deep discharge
+	minDischargeAmps = 1.0
+)
+
+/**
+Config holds the rated (nameplate) capacity of each bank in Ah and the average cell voltage under load that counts as
+a deep discharge.
+*/
+type Config struct {
+	RatedCapacity      float64
+	DeepDischargeVolts float64
+}
+
+/**
+BankHealth is what is known about the health of one bank. ConfiguredAh is the capacity the state of charge is
+currently worked out from. EstimatedAh is the average of the latest tests and StateOfHealth is that as a percentage
+of the rated capacity. Both are missing until a test has completed. EquivalentFullCycles is all the charge ever taken
+out of the bank divided by its rated capacity.
+*/
+type BankHealth struct {
+	Bank                 int                    `json:"bank"`
+	RatedAh              float64                `json:"rated_ah"`
+	ConfiguredAh         float64                `json:"configured_ah"`
+	EstimatedAh          *float64               `json:"estimated_ah,omitempty"`
+	StateOfHealth        *float64               `json:"state_of_health,omitempty"`
+	EquivalentFullCycles float64                `json:"equivalent_full_cycles"`
+	OpenTest             *Storage.CapacityTest  `json:"open_test,omitempty"`
+	Tests                []Storage.CapacityTest `json:"tests"`
+}
+
+/**
+Tracker measures the capacity of each bank. A test starts when a bank reaches full charge and ends when the average
+cell voltage falls to the deep discharge voltage while discharging. The charge delivered in between, from the logged
+current, is the usable capacity of the bank. Tests are kept in the database so they carry on across restarts.
+*/
+type Tracker struct {
+	mu     sync.Mutex
+	store  Storage.Store
+	config Config
+	open   [2]*Storage.CapacityTest
+	loaded bool
+}
+
+/**
+New returns a tracker keeping its tests in the store
+*/
+func New(store Storage.Store, config Config) *Tracker {
+	return &Tracker{store: store, config: config}
+}
+
+/**
+Read the open tests the first time they are needed. Called with the tracker locked.
+*/
+func (tracker *Tracker) load() error {
+	if tracker.loaded {
+		return nil
+	}
+	for bank := range tracker.open {
+		test, err := tracker.store.GetOpenCapacityTest(bank)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		tracker.open[bank] = &test
+	}
+	tracker.loaded = true
+	return nil
+}
+
+/**
+Start a test for the bank from a full charge. A test already running starts again from here.
+*/
+func (tracker *Tracker) FullCharge(bank int, when time.Time) error {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if err := tracker.load(); err != nil {
+		return err
+	}
+	if err := tracker.store.StartCapacityTest(bank, when); err != nil {
+		return err
+	}
+	test, err := tracker.store.GetOpenCapacityTest(bank)
+	if err != nil {
+		return err
+	}
+	tracker.open[bank] = &test
+	return nil
+}
+
+/**
+Check each bank with an open test for a deep discharge. meanVolts is the average cell voltage of each bank, amps the
+bank current and efficiency the charging efficiency used to allow for charge put back in during the test. Returns the
+tests that completed.
+*/
+func (tracker *Tracker) Update(now time.Time, meanVolts [2]float64, amps [2]float64, efficiency [2]float64) ([]Storage.CapacityTest, error) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if err := tracker.load(); err != nil {
+		return nil, err
+	}
+	var completed []Storage.CapacityTest
+	for bank, test := range tracker.open {
+		if test == nil || meanVolts[bank] == 0 || meanVolts[bank] > tracker.config.DeepDischargeVolts || amps[bank] > -minDischargeAmps {
+			continue
+		}
+		if now.Sub(test.FullCharge) < minTestDuration {
+			continue
+		}
+		discharged, charged, err := tracker.store.GetChargeBetween(bank, test.FullCharge, now)
+		if err != nil {
+			return completed, err
+		}
+		deepDischarge := now
+		test.DeepDischarge = &deepDischarge
+		test.DischargedAh = discharged
+		test.ChargedAh = charged
+		test.DeliveredAh = discharged - (charged * efficiency[bank])
+		test.RatedAh = tracker.config.RatedCapacity
+		if err = tracker.store.CompleteCapacityTest(*test); err != nil {
+			return completed, err
+		}
+		completed = append(completed, *test)
+		tracker.open[bank] = nil
+	}
+	return completed, nil
+}
+
+/**
+Return the health of the bank. configuredAh is the capacity the fuel gauge is using.
+*/
+func (tracker *Tracker) Health(bank int, configuredAh float64) (BankHealth, error) {
+	if bank < 0 || bank > 1 {
+		return BankHealth{}, fmt.Errorf("bank %d is not 0 or 1", bank)
+	}
+	health := BankHealth{Bank: bank, RatedAh: tracker.config.RatedCapacity, ConfiguredAh: configuredAh, Tests: []Storage.CapacityTest{}}
+	tracker.mu.Lock()
+	if err := tracker.load(); err != nil {
+		tracker.mu.Unlock()
+		return health, err
+	}
+	if test := tracker.open[bank]; test != nil {
+		open := *test
+		health.OpenTest = &open
+	}
+	tracker.mu.Unlock()
+
+	tests, err := tracker.store.GetCapacityTests(bank, testsReturned)
+	if err != nil {
+		return health, err
+	}
+	if tests != nil {
+		health.Tests = tests
+	}
+	if len(tests) > 0 {
+		n := len(tests)
+		if n > testsAveraged {
+			n = testsAveraged
+		}
+		estimated := 0.0
+		for _, test := range tests[:n] {
+			estimated += test.DeliveredAh
+		}
+		estimated /= float64(n)
+		health.EstimatedAh = &estimated
+		if tracker.config.RatedCapacity > 0 {
+			soh := estimated * 100 / tracker.config.RatedCapacity
+			health.StateOfHealth = &soh
+		}
+	}
+	chargeOut, err := tracker.store.GetParameterFloat(fmt.Sprintf("charge_out_counter_%d", bank))
+	if err != nil {
+		return health, err
+	}
+	if tracker.config.RatedCapacity > 0 {
+		health.EquivalentFullCycles = chargeOut / tracker.config.RatedCapacity
+	}
+	return health, nil
+}
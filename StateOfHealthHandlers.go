@@ -0,0 +1,187 @@
+package main
+
+import (
+	"BatteryMonitor6813V4/Auth"
+	"BatteryMonitor6813V4/FuelGauge"
+	"BatteryMonitor6813V4/Notifier"
+	"BatteryMonitor6813V4/StateOfHealth"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	healthConfig  StateOfHealth.Config
+	healthTracker *StateOfHealth.Tracker
+)
+
+/**
+Set up the state of health tracking. The tracker itself is created once the database is there.
+*/
+func startStateOfHealth(ratedCapacity float64, deepDischargeVolts float64) {
+	if ratedCapacity <= 0 || deepDischargeVolts <= 0 {
+		log.Fatalf("Invalid rated capacity %f or deep discharge voltage %f - both must be more than zero - Sorry, I am giving up.",
+			ratedCapacity, deepDischargeVolts)
+	}
+	healthConfig = StateOfHealth.Config{RatedCapacity: ratedCapacity, DeepDischargeVolts: deepDischargeVolts}
+}
+
+/**
+Create the tracker. Called once the database is connected and before anything reads healthTracker.
+*/
+func startHealthTracker() {
+	if healthConfig.RatedCapacity > 0 {
+		healthTracker = StateOfHealth.New(store, healthConfig)
+	}
+}
+
+/**
+Full charge evaluator listener starting a capacity test when every cell in a bank is full
+*/
+func bankFullCharge(bank int, when time.Time) {
+	log.Println("Bank", bank, "has reached full charge - starting a capacity test")
+	if healthTracker != nil {
+		if err := healthTracker.FullCharge(bank, when); err != nil {
+			log.Println("Failed to start the capacity test for bank", bank, "-", err)
+		}
+	}
+}
+
+/**
+Return the average cell voltage of each bank, leaving out cells reading zero. A bank with no readings is zero.
+*/
+func meanCellVolts() (meanVolts [2]float64) {
+	for bank := 0; bank < 2; bank++ {
+		fitted := 0
+		for _, volts := range cellVolts(bank) {
+			if volts != 0 {
+				meanVolts[bank] += volts
+				fitted++
+			}
+		}
+		if fitted > 0 {
+			meanVolts[bank] /= float64(fitted)
+		}
+	}
+	return meanVolts
+}
+
+/**
+Look for the end of a capacity test in this cycle's readings
+*/
+func trackHealth() {
+	if healthTracker == nil || ltc == nil || nDevices == 0 || fuelgauge == nil {
+		return
+	}
+	meanVolts := meanCellVolts()
+	amps := [2]float64{float64(fuelgauge.CurrentLeft()), float64(fuelgauge.CurrentRight())}
+	efficiency := [2]float64{fuelgauge.FgLeft.Efficiency, fuelgauge.FgRight.Efficiency}
+	completed, err := healthTracker.Update(time.Now(), meanVolts, amps, efficiency)
+	if err != nil {
+		log.Println("Failed to check the capacity tests -", err)
+	}
+	for _, test := range completed {
+		notifier.Notice(Notifier.Info, "Capacity Test", fmt.Sprintf("Bank %d delivered %.0fAh from full charge at %s to deep discharge, %.0f%% of its rated %.0fAh",
+			test.Bank, test.DeliveredAh, test.FullCharge.Format("2006-01-02 15:04"), test.DeliveredAh*100/test.RatedAh, test.RatedAh))
+	}
+}
+
+func bankHealth() ([]StateOfHealth.BankHealth, error) {
+	if healthTracker == nil {
+		return nil, fmt.Errorf("the state of health tracker is not running")
+	}
+	_, left, right := fuelgauge.Capacity()
+	var banks []StateOfHealth.BankHealth
+	for bank, capacity := range []int16{left, right} {
+		health, err := healthTracker.Health(bank, float64(capacity))
+		if err != nil {
+			return nil, err
+		}
+		banks = append(banks, health)
+	}
+	return banks, nil
+}
+
+/**
+Measured capacity, state of health and equivalent full cycles of each bank with the latest capacity tests
+/capacity
+*/
+func webGetCapacity(w http.ResponseWriter, _ *http.Request) {
+	setHeaders(w)
+	banks, err := bankHealth()
+	if err != nil {
+		ReturnJSONError(w, "Capacity", err, http.StatusServiceUnavailable, true)
+		return
+	}
+	returnJSON(w, banks)
+}
+
+/**
+Set the capacity of the bank from the capacity tests, or to capacity if it is given
+/capacity/{bank}/approve?capacity=850
+*/
+func webApproveCapacity(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	bank, ok := parseBankVar(w, r, "Capacity")
+	if !ok {
+		return
+	}
+	capacity := 0
+	if value := r.FormValue("capacity"); value != "" {
+		var err error
+		if capacity, err = strconv.Atoi(value); err != nil {
+			ReturnJSONError(w, "Capacity", FuelGauge.ErrInvalidCapacity, http.StatusBadRequest, false)
+			return
+		}
+	}
+	approveCapacity(w, r, bank, capacity)
+}
+
+func apiApproveCapacity(w http.ResponseWriter, r *http.Request) {
+	bank, ok := parseBankVar(w, r, "Capacity")
+	if !ok {
+		return
+	}
+	var request APICapacityRequest
+	if decodeRequest(w, r, "Capacity", &request) {
+		approveCapacity(w, r, bank, request.Capacity)
+	}
+}
+
+/**
+The fuel gauge only changes its capacity when an operator approves it, as a bad test would throw the state of charge
+out. When the estimate is used the latest test is marked as approved.
+*/
+func approveCapacity(w http.ResponseWriter, r *http.Request, bank int, capacity int) {
+	if healthTracker == nil {
+		ReturnJSONErrorString(w, "Capacity", "the state of health tracker is not running", http.StatusServiceUnavailable, false)
+		return
+	}
+	_, left, right := fuelgauge.Capacity()
+	health, err := healthTracker.Health(bank, float64([]int16{left, right}[bank]))
+	if err != nil {
+		ReturnJSONError(w, "Capacity", err, http.StatusInternalServerError, true)
+		return
+	}
+	fromTests := capacity == 0
+	if fromTests {
+		if health.EstimatedAh == nil {
+			ReturnJSONErrorString(w, "Capacity", "there are no capacity tests for this bank yet", http.StatusBadRequest, false)
+			return
+		}
+		capacity = int(math.Round(*health.EstimatedAh))
+	}
+	if err = fuelgauge.SetCapacity(FuelGauge.WebOrigin(r), bank, capacity); err != nil {
+		returnCommandResult(w, "Capacity", err)
+		return
+	}
+	if fromTests {
+		if err = store.ApproveCapacityTest(health.Tests[0].ID, Auth.FromRequest(r).Name, time.Now()); err != nil {
+			log.Println("Failed to mark capacity test", health.Tests[0].ID, "as approved -", err)
+		}
+	}
+	returnCommandResult(w, "Capacity", nil)
+}
@@ -0,0 +1,100 @@
+package Storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+/**
+Alarm is one row of the alarms table. Cleared and Acknowledged are not valid until the alarm has been cleared or
+acknowledged.
+*/
+type Alarm struct {
+	ID             int64
+	Rule           string
+	Severity       string
+	Source         string
+	Message        string
+	Value          float64
+	Threshold      float64
+	Raised         time.Time
+	Cleared        sql.NullTime
+	Acknowledged   sql.NullTime
+	AcknowledgedBy string
+}
+
+const alarmColumns = `id, rule, severity, source, message, value, threshold, raised, cleared, acknowledged, acknowledged_by`
+
+func (store *sqlStore) AddAlarm(alarm Alarm) (int64, error) {
+	result, err := store.db.Exec(`insert into alarms (rule, severity, source, message, value, threshold, raised) values (?,?,?,?,?,?,?)`,
+		alarm.Rule, alarm.Severity, alarm.Source, alarm.Message, alarm.Value, alarm.Threshold, alarm.Raised.Format(TimeFormat))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (store *sqlStore) ClearAlarm(id int64, when time.Time) error {
+	_, err := store.db.Exec(`update alarms set cleared = ? where id = ? and cleared is null`, when.Format(TimeFormat), id)
+	return err
+}
+
+/**
+Record who acknowledged the alarm. Returns sql.ErrNoRows if there is no such alarm or it was already acknowledged.
+*/
+func (store *sqlStore) AcknowledgeAlarm(id int64, user string, when time.Time) error {
+	result, err := store.db.Exec(`update alarms set acknowledged = ?, acknowledged_by = ? where id = ? and acknowledged is null`, when.Format(TimeFormat), user, id)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (store *sqlStore) GetAlarm(id int64) (Alarm, error) {
+	alarms, err := store.queryAlarms(`select `+alarmColumns+` from alarms where id = ?`, id)
+	if err != nil {
+		return Alarm{}, err
+	}
+	if len(alarms) == 0 {
+		return Alarm{}, sql.ErrNoRows
+	}
+	return alarms[0], nil
+}
+
+/**
+Return the alarms that have not been cleared, oldest first
+*/
+func (store *sqlStore) GetActiveAlarms() ([]Alarm, error) {
+	return store.queryAlarms(`select ` + alarmColumns + ` from alarms where cleared is null order by raised, id`)
+}
+
+/**
+Return the alarms raised between start and end, most recent first
+*/
+func (store *sqlStore) GetAlarms(start time.Time, end time.Time) ([]Alarm, error) {
+	return store.queryAlarms(`select `+alarmColumns+` from alarms where raised between ? and ? order by raised desc, id desc`,
+		start.Format(TimeFormat), end.Format(TimeFormat))
+}
+
+func (store *sqlStore) queryAlarms(sSQL string, args ...interface{}) ([]Alarm, error) {
+	rows, err := store.db.Query(sSQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var alarms []Alarm
+	for rows.Next() {
+		var alarm Alarm
+		if err = rows.Scan(&alarm.ID, &alarm.Rule, &alarm.Severity, &alarm.Source, &alarm.Message, &alarm.Value, &alarm.Threshold,
+			&alarm.Raised, &alarm.Cleared, &alarm.Acknowledged, &alarm.AcknowledgedBy); err != nil {
+			return nil, err
+		}
+		alarms = append(alarms, alarm)
+	}
+	return alarms, rows.Err()
+}
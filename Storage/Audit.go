@@ -0,0 +1,76 @@
+package Storage
+
+import (
+	"strings"
+	"time"
+)
+
+// AuditTable is written through the store and forward queue so commands are still recorded while the database is down
+const AuditTable = "audit"
+
+var AuditColumns = []string{"source", "user_name", "action", "parameters", "previous_state", "result", "error"}
+
+/**
+AuditEntry is one row of the audit table, recording a command sent to the relays or controllers
+*/
+type AuditEntry struct {
+	ID            int64     `json:"id"`
+	Logged        time.Time `json:"logged"`
+	Source        string    `json:"source"`
+	User          string    `json:"user"`
+	Action        string    `json:"action"`
+	Parameters    string    `json:"parameters"`
+	PreviousState string    `json:"previous_state"`
+	Result        string    `json:"result"`
+	Error         string    `json:"error,omitempty"`
+}
+
+/**
+AuditFilter selects audit entries. Blank strings match anything.
+*/
+type AuditFilter struct {
+	Start  time.Time
+	End    time.Time
+	Source string
+	User   string
+	Action string
+	Limit  int
+}
+
+/**
+Return the audit entries matching the filter, most recent first
+*/
+func (store *sqlStore) GetAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	conditions := []string{"logged between ? and ?"}
+	args := []interface{}{filter.Start.Format(TimeFormat), filter.End.Format(TimeFormat)}
+	for _, match := range []struct {
+		column string
+		value  string
+	}{{"source", filter.Source}, {"user_name", filter.User}, {"action", filter.Action}} {
+		if match.value != "" {
+			conditions = append(conditions, match.column+" = ?")
+			args = append(args, match.value)
+		}
+	}
+	sSQL := `select id, logged, source, user_name, action, parameters, previous_state, result, error from audit where ` +
+		strings.Join(conditions, " and ") + ` order by logged desc, id desc`
+	if filter.Limit > 0 {
+		sSQL += ` limit ?`
+		args = append(args, filter.Limit)
+	}
+	rows, err := store.db.Query(sSQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var entries []AuditEntry
+	for rows.Next() {
+		var entry AuditEntry
+		if err = rows.Scan(&entry.ID, &entry.Logged, &entry.Source, &entry.User, &entry.Action, &entry.Parameters,
+			&entry.PreviousState, &entry.Result, &entry.Error); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,124 @@
+package Storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+/**
+CapacityTest is one row of the capacity_tests table, the charge a bank delivered from a full charge down to a deep
+discharge. A test is open until the deep discharge is reached. DeliveredAh is the charge taken out less the charge put
+back in during the test allowing for the charging efficiency. Approved is set once an operator has used the result
+as the bank's capacity.
+*/
+type CapacityTest struct {
+	ID            int64      `json:"id"`
+	Bank          int        `json:"bank"`
+	FullCharge    time.Time  `json:"full_charge"`
+	DeepDischarge *time.Time `json:"deep_discharge,omitempty"`
+	DischargedAh  float64    `json:"discharged_ah"`
+	ChargedAh     float64    `json:"charged_ah"`
+	DeliveredAh   float64    `json:"delivered_ah"`
+	RatedAh       float64    `json:"rated_ah"`
+	Approved      *time.Time `json:"approved,omitempty"`
+	ApprovedBy    string     `json:"approved_by,omitempty"`
+}
+
+const capacityTestColumns = `id, bank, full_charge, deep_discharge, discharged_ah, charged_ah, delivered_ah, rated_ah, approved, approved_by`
+
+func (store *sqlStore) queryCapacityTests(sSQL string, args ...interface{}) ([]CapacityTest, error) {
+	rows, err := store.db.Query(sSQL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var tests []CapacityTest
+	for rows.Next() {
+		var test CapacityTest
+		if err = rows.Scan(&test.ID, &test.Bank, &test.FullCharge, &test.DeepDischarge, &test.DischargedAh, &test.ChargedAh,
+			&test.DeliveredAh, &test.RatedAh, &test.Approved, &test.ApprovedBy); err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+	}
+	return tests, rows.Err()
+}
+
+/**
+Return the bank's open capacity test. Returns sql.ErrNoRows if there is none.
+*/
+func (store *sqlStore) GetOpenCapacityTest(bank int) (CapacityTest, error) {
+	tests, err := store.queryCapacityTests(`select `+capacityTestColumns+` from capacity_tests where bank = ? and deep_discharge is null order by id desc limit 1`, bank)
+	if err != nil {
+		return CapacityTest{}, err
+	}
+	if len(tests) == 0 {
+		return CapacityTest{}, sql.ErrNoRows
+	}
+	return tests[0], nil
+}
+
+/**
+Start a capacity test from a full charge. A test already open for the bank starts again from the new full charge.
+*/
+func (store *sqlStore) StartCapacityTest(bank int, fullCharge time.Time) error {
+	result, err := store.db.Exec(`update capacity_tests set full_charge = ? where bank = ? and deep_discharge is null`, fullCharge.Format(TimeFormat), bank)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows > 0 {
+		return err
+	}
+	_, err = store.db.Exec(`insert into capacity_tests (bank, full_charge) values (?, ?)`, bank, fullCharge.Format(TimeFormat))
+	return err
+}
+
+/**
+Record the deep discharge and the charge delivered, closing the test
+*/
+func (store *sqlStore) CompleteCapacityTest(test CapacityTest) error {
+	if test.DeepDischarge == nil {
+		return fmt.Errorf("capacity test %d has no deep discharge time", test.ID)
+	}
+	_, err := store.db.Exec(`update capacity_tests set deep_discharge = ?, discharged_ah = ?, charged_ah = ?, delivered_ah = ?, rated_ah = ? where id = ?`,
+		test.DeepDischarge.Format(TimeFormat), test.DischargedAh, test.ChargedAh, test.DeliveredAh, test.RatedAh, test.ID)
+	return err
+}
+
+/**
+Return the most recent completed capacity tests of the bank, newest first
+*/
+func (store *sqlStore) GetCapacityTests(bank int, limit int) ([]CapacityTest, error) {
+	return store.queryCapacityTests(`select `+capacityTestColumns+` from capacity_tests where bank = ? and deep_discharge is not null order by deep_discharge desc limit ?`, bank, limit)
+}
+
+/**
+Record that an operator has set the bank capacity from the test
+*/
+func (store *sqlStore) ApproveCapacityTest(id int64, user string, when time.Time) error {
+	_, err := store.db.Exec(`update capacity_tests set approved = ?, approved_by = ? where id = ?`, when.Format(TimeFormat), user, id)
+	return err
+}
+
+/**
+Return the charge in Ah taken out of and put into a bank between start and end from the logged current. The current is
+averaged over each minute so the rows can be a second or a minute apart. Minutes with nothing logged count as zero.
+*/
+func (store *sqlStore) GetChargeBetween(bank int, start time.Time, end time.Time) (discharged float64, charged float64, err error) {
+	if bank < 0 || bank > 1 {
+		return 0, 0, fmt.Errorf("%w - bank %d is not 0 or 1", ErrInvalidQuery, bank)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HistoryTimeout)
+	defer cancel()
+	channel := fmt.Sprintf("channel_%d", bank)
+	source, args, err := store.rangeSource(ctx, "current", channel, start, end)
+	if err != nil {
+		return 0, 0, historyError(ctx, err)
+	}
+	err = store.db.QueryRowContext(ctx, `select coalesce(sum(discharged), 0) / 60.0, coalesce(sum(charged), 0) / 60.0 from (select
+avg(case when `+channel+` < 0 then -`+channel+` else 0 end) discharged, avg(case when `+channel+` > 0 then `+channel+` else 0 end) charged
+from `+source+` e group by `+store.dialect.bucket("logged", 60)+`) m`, args...).Scan(&discharged, &charged)
+	return discharged, charged, historyError(ctx, err)
+}
@@ -0,0 +1,57 @@
+package Storage
+
+import (
+	"time"
+)
+
+// CellAnalyticsTable is written through the store and forward queue once a day with each cell's weakest cell ranking
+const CellAnalyticsTable = "cell_analytics"
+
+var CellAnalyticsColumns = []string{"day", "cell_number", "discharge_samples", "mean_deviation", "mean_z_score", "times_lowest",
+	"weakest_rank", "min_volts", "max_volts"}
+
+/**
+CellAnalyticsDay is one row of the cell_analytics table, how one cell compared with the rest of its bank while
+discharging over a day. Rank 1 is the weakest cell in the bank.
+*/
+type CellAnalyticsDay struct {
+	Day           time.Time `json:"day"`
+	Cell          int       `json:"cell"`
+	Samples       int       `json:"samples"`
+	MeanDeviation float64   `json:"mean_deviation"`
+	MeanZScore    float64   `json:"mean_z_score"`
+	TimesLowest   int       `json:"times_lowest"`
+	Rank          int       `json:"rank"`
+	MinVolts      float64   `json:"min_volts"`
+	MaxVolts      float64   `json:"max_volts"`
+}
+
+/**
+Return the value of each column for Insert
+*/
+func (row CellAnalyticsDay) Values() []interface{} {
+	return []interface{}{row.Day.Format("2006-01-02"), row.Cell, row.Samples, row.MeanDeviation, row.MeanZScore, row.TimesLowest,
+		row.Rank, row.MinVolts, row.MaxVolts}
+}
+
+/**
+Return the daily cell analytics for the days from start to end, by day then bank and rank
+*/
+func (store *sqlStore) GetCellAnalytics(start time.Time, end time.Time) ([]CellAnalyticsDay, error) {
+	rows, err := store.db.Query(`select day, cell_number, discharge_samples, mean_deviation, mean_z_score, times_lowest, weakest_rank, min_volts, max_volts
+from cell_analytics where day between ? and ? order by day, cell_number >= 100, weakest_rank`, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var days []CellAnalyticsDay
+	for rows.Next() {
+		var day CellAnalyticsDay
+		if err = rows.Scan(&day.Day, &day.Cell, &day.Samples, &day.MeanDeviation, &day.MeanZScore, &day.TimesLowest, &day.Rank,
+			&day.MinVolts, &day.MaxVolts); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
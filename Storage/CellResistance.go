@@ -0,0 +1,60 @@
+package Storage
+
+import (
+	"time"
+)
+
+// CellResistanceTable is written through the store and forward queue with each cell's resistance after a current step
+const CellResistanceTable = "cell_resistance"
+
+var CellResistanceColumns = []string{"cell_number", "milliohms", "uncertainty", "confidence", "step_amps"}
+
+/**
+CellResistance is one row of the cell_resistance table, a cell's internal resistance worked out from one step in the
+bank current
+*/
+type CellResistance struct {
+	Logged      time.Time `json:"logged"`
+	Cell        int       `json:"cell"`
+	Milliohms   float64   `json:"milliohms"`
+	Uncertainty float64   `json:"uncertainty"`
+	Confidence  float64   `json:"confidence"`
+	StepAmps    float64   `json:"step_amps"`
+}
+
+/**
+Return the value of each column for Insert
+*/
+func (row CellResistance) Values() []interface{} {
+	return []interface{}{row.Cell, row.Milliohms, row.Uncertainty, row.Confidence, row.StepAmps}
+}
+
+/**
+Return the resistance estimates between start and end in time order. Cell 0 returns every cell.
+*/
+func (store *sqlStore) GetCellResistance(start time.Time, end time.Time, cell int) ([]CellResistance, error) {
+	sSQL := `select logged, cell_number, milliohms, uncertainty, confidence, step_amps from cell_resistance where logged between ? and ?`
+	args := []interface{}{start.Format(TimeFormat), end.Format(TimeFormat)}
+	if cell != 0 {
+		if err := checkCell(cell); err != nil {
+			return nil, err
+		}
+		sSQL += ` and cell_number = ?`
+		args = append(args, cell)
+	}
+	rows, err := store.db.Query(sSQL+` order by logged, cell_number`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var estimates []CellResistance
+	for rows.Next() {
+		var estimate CellResistance
+		if err = rows.Scan(&estimate.Logged, &estimate.Cell, &estimate.Milliohms, &estimate.Uncertainty, &estimate.Confidence,
+			&estimate.StepAmps); err != nil {
+			return nil, err
+		}
+		estimates = append(estimates, estimate)
+	}
+	return estimates, rows.Err()
+}
@@ -0,0 +1,62 @@
+package Storage
+
+import (
+	"time"
+)
+
+// ChargeDriftTable is written through the store and forward queue each time a bank's charge is reset at full charge
+const ChargeDriftTable = "charge_drift"
+
+var ChargeDriftColumns = []string{"bank", "counter_ah", "capacity_ah", "drift_ah", "discharged_ah", "charged_ah", "cycle_efficiency", "efficiency"}
+
+/**
+ChargeDrift is one row of the charge_drift table. CounterAh is what the fuel gauge counter read when every cell in the
+bank was found full and DriftAh how far that was below the capacity. DischargedAh and ChargedAh are the charge out and
+in since the previous full charge, and CycleEfficiency the charging efficiency they show. It is missing when there was
+no previous full charge or too little charge went through the bank. Efficiency is the charging efficiency in use
+afterwards.
+*/
+type ChargeDrift struct {
+	Logged          time.Time `json:"logged"`
+	Bank            int       `json:"bank"`
+	CounterAh       float64   `json:"counter_ah"`
+	CapacityAh      float64   `json:"capacity_ah"`
+	DriftAh         float64   `json:"drift_ah"`
+	DischargedAh    float64   `json:"discharged_ah"`
+	ChargedAh       float64   `json:"charged_ah"`
+	CycleEfficiency *float64  `json:"cycle_efficiency,omitempty"`
+	Efficiency      float64   `json:"efficiency"`
+}
+
+/**
+Return the value of each column for Insert
+*/
+func (row ChargeDrift) Values() []interface{} {
+	var cycleEfficiency interface{}
+	if row.CycleEfficiency != nil {
+		cycleEfficiency = *row.CycleEfficiency
+	}
+	return []interface{}{row.Bank, row.CounterAh, row.CapacityAh, row.DriftAh, row.DischargedAh, row.ChargedAh, cycleEfficiency, row.Efficiency}
+}
+
+/**
+Return the latest charge resets of the bank, newest first
+*/
+func (store *sqlStore) GetChargeDrift(bank int, limit int) ([]ChargeDrift, error) {
+	rows, err := store.db.Query(`select logged, bank, counter_ah, capacity_ah, drift_ah, discharged_ah, charged_ah, cycle_efficiency, efficiency
+from charge_drift where bank = ? order by logged desc limit ?`, bank, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var drifts []ChargeDrift
+	for rows.Next() {
+		var drift ChargeDrift
+		if err = rows.Scan(&drift.Logged, &drift.Bank, &drift.CounterAh, &drift.CapacityAh, &drift.DriftAh, &drift.DischargedAh,
+			&drift.ChargedAh, &drift.CycleEfficiency, &drift.Efficiency); err != nil {
+			return nil, err
+		}
+		drifts = append(drifts, drift)
+	}
+	return drifts, rows.Err()
+}
@@ -0,0 +1,62 @@
+package Storage
+
+import (
+	"time"
+)
+
+/**
+EnergyDay is one row of the energy table, the energy and charge that went into and out of a bank, or the battery as
+the inverter sees it, over a day. Source is bank0, bank1 or inverter.
+*/
+type EnergyDay struct {
+	Day    time.Time
+	Source string
+	WhIn   float64
+	WhOut  float64
+	AhIn   float64
+	AhOut  float64
+}
+
+/**
+Replace the rows saved for the day. The current day is saved over and over as it goes along so it is not lost on a
+restart.
+*/
+func (store *sqlStore) SaveEnergyDay(day time.Time, rows []EnergyDay) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`delete from energy where day = ?`, day.Format("2006-01-02")); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, row := range rows {
+		if _, err = tx.Exec(`insert into energy (day, source, wh_in, wh_out, ah_in, ah_out) values (?, ?, ?, ?, ?, ?)`,
+			row.Day.Format("2006-01-02"), row.Source, row.WhIn, row.WhOut, row.AhIn, row.AhOut); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/**
+Return the energy rows for the days from start to end in day order
+*/
+func (store *sqlStore) GetEnergy(start time.Time, end time.Time) ([]EnergyDay, error) {
+	rows, err := store.db.Query(`select day, source, wh_in, wh_out, ah_in, ah_out from energy where day between ? and ? order by day, source`,
+		start.Format("2006-01-02"), end.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var days []EnergyDay
+	for rows.Next() {
+		var day EnergyDay
+		if err = rows.Scan(&day.Day, &day.Source, &day.WhIn, &day.WhOut, &day.AhIn, &day.AhOut); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
@@ -0,0 +1,213 @@
+package Storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The data sets that can be exported. Each comes from one logging table.
+const (
+	ExportCells        = "cells"
+	ExportTemperatures = "temperatures"
+	ExportCurrent      = "current"
+	ExportInverter     = "inverter"
+)
+
+// Longest range that can be exported as raw rows. Averaged exports can cover the same ranges as the history queries.
+const maxRawExportSpan = 31 * 24 * time.Hour
+
+/**
+ExportQuery selects a data set between Start and End. Cells are the database cell numbers (1..38 and 101..138) for the
+cells and temperatures sets, default all. Bucket is zero for the raw rows or one of the history bucket sizes to
+export averages.
+*/
+type ExportQuery struct {
+	Data   string
+	Cells  []int
+	Start  time.Time
+	End    time.Time
+	Bucket time.Duration
+}
+
+type exportColumn struct {
+	column string
+	name   string
+	scale  float64
+}
+
+var inverterExportColumns = []exportColumn{
+	{"volts", "inverter_volts", 1},
+	{"amps", "inverter_amps", 1},
+	{"soc", "inverter_soc", 1},
+	{"v_setpoint", "inverter_charge_setpoint_volts", 1},
+	{"frequency", "inverter_frequency_hz", 1},
+	{"generator_running", "generator_running", 1},
+}
+
+/**
+Return the table and columns for the query's data set, checking the query on the way.
+*/
+func (query *ExportQuery) columns() (string, []exportColumn, error) {
+	maxSpan := MaxHistorySpan(query.Bucket)
+	if query.Bucket == 0 {
+		maxSpan = maxRawExportSpan
+	} else if bucketName(query.Bucket) == "" {
+		return "", nil, fmt.Errorf("%w - bucket must be raw, 15s, 1m, 1h or 1d", ErrInvalidQuery)
+	}
+	if err := ValidateTimeRange(query.Start, query.End, maxSpan); err != nil {
+		return "", nil, err
+	}
+	if len(query.Cells) == 0 {
+		for _, base := range []int{0, 100} {
+			for cell := 1; cell <= CellsPerBank; cell++ {
+				query.Cells = append(query.Cells, base+cell)
+			}
+		}
+	}
+	for _, cell := range query.Cells {
+		if err := checkCell(cell); err != nil {
+			return "", nil, err
+		}
+	}
+	var columns []exportColumn
+	add := func(seriesName string, cells []int) {
+		series := historySeriesList[seriesName]
+		for _, cell := range cells {
+			column, name := series.column(cell)
+			columns = append(columns, exportColumn{column, name, series.scale})
+		}
+	}
+	switch query.Data {
+	case ExportCells:
+		add(SeriesCellVolts, query.Cells)
+		// Include the total of each bank that has a cell in the export
+		var inBank [2]bool
+		for _, cell := range query.Cells {
+			inBank[cell/100] = true
+		}
+		var banks []int
+		for bank, found := range inBank {
+			if found {
+				banks = append(banks, bank)
+			}
+		}
+		add(SeriesBankVolts, banks)
+		return "voltage", columns, nil
+	case ExportTemperatures:
+		add(SeriesTemperature, query.Cells)
+		return "temperature", columns, nil
+	case ExportCurrent:
+		add(SeriesCurrent, []int{0, 1})
+		add(SeriesCharge, []int{0, 1})
+		return "current", columns, nil
+	case ExportInverter:
+		return "inverter", inverterExportColumns, nil
+	}
+	return "", nil, fmt.Errorf("%w - data must be %s, %s, %s or %s", ErrInvalidQuery, ExportCells, ExportTemperatures, ExportCurrent, ExportInverter)
+}
+
+/**
+Return the end of the window of rows read in one go starting at from. Windows always end on a bucket boundary so no
+bucket is split between two windows.
+*/
+func exportWindowEnd(from time.Time, bucket time.Duration) time.Time {
+	switch {
+	case bucket == 0:
+		return from.Truncate(time.Hour).Add(time.Hour)
+	case bucket == 24*time.Hour:
+		return time.Date(from.Year(), from.Month(), from.Day()+31, 0, 0, 0, 0, from.Location())
+	default:
+		window := 240 * bucket
+		return from.Truncate(window).Add(window)
+	}
+}
+
+/**
+Export a data set from the live and archive tables. The column names are passed to header once the first window has
+been read, so a failing query is returned before anything is sent, then each row to row in time order. The range is
+read a window at a time so memory use stays small and the database is not held while the rows are being sent, which
+matters for SQLite with its single connection. Stops early if ctx is cancelled.
+*/
+func (store *sqlStore) Export(ctx context.Context, query ExportQuery, header func(columns []string) error, row func(logged time.Time, values []sql.NullFloat64) error) error {
+	table, columns, err := query.columns()
+	if err != nil {
+		return err
+	}
+	var names, selectColumns, tableColumns []string
+	for _, column := range columns {
+		names = append(names, column.name)
+		tableColumns = append(tableColumns, column.column)
+		if query.Bucket == 0 {
+			selectColumns = append(selectColumns, fmt.Sprintf("%s / %.1f", column.column, column.scale))
+		} else {
+			selectColumns = append(selectColumns, fmt.Sprintf("avg(%s) / %.1f", column.column, column.scale))
+		}
+	}
+
+	type exportRow struct {
+		logged int64
+		values []sql.NullFloat64
+	}
+	headerSent := false
+	for from := query.Start; from.Before(query.End); {
+		to := exportWindowEnd(from, query.Bucket)
+		if to.After(query.End) {
+			to = query.End.Add(time.Second)
+		}
+		// Times are stored to the second so the window is from..to-1s and the next one starts at to
+		source, args, err := store.rangeSource(ctx, table, strings.Join(tableColumns, ", "), from, to.Add(-time.Second))
+		if err != nil {
+			return err
+		}
+		var sSQL string
+		switch query.Bucket {
+		case 0:
+			sSQL = `select unix_timestamp(logged), ` + strings.Join(selectColumns, ", ") + ` from ` + source + ` e order by logged`
+		case 24 * time.Hour:
+			sSQL = `select min(unix_timestamp(logged)), ` + strings.Join(selectColumns, ", ") + ` from ` + source + ` e group by date(logged) order by 1`
+		default:
+			sSQL = `select min(unix_timestamp(logged)), ` + strings.Join(selectColumns, ", ") + ` from ` + source + ` e group by ` +
+				store.dialect.bucket("logged", int(query.Bucket.Seconds())) + ` order by 1`
+		}
+		rows, err := store.db.QueryContext(ctx, sSQL, args...)
+		if err != nil {
+			return err
+		}
+		var window []exportRow
+		for rows.Next() {
+			r := exportRow{values: make([]sql.NullFloat64, len(columns))}
+			destinations := []interface{}{&r.logged}
+			for i := range r.values {
+				destinations = append(destinations, &r.values[i])
+			}
+			if err = rows.Scan(destinations...); err != nil {
+				closeRows(rows)
+				return err
+			}
+			window = append(window, r)
+		}
+		closeRows(rows)
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if !headerSent {
+			if err = header(names); err != nil {
+				return err
+			}
+			headerSent = true
+		}
+		for _, r := range window {
+			if err = row(bucketStart(r.logged, query.Bucket), r.values); err != nil {
+				return err
+			}
+		}
+		from = to
+	}
+	if !headerSent {
+		return header(names)
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package Storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidQuery is wrapped by every error caused by the history query itself rather than the database
+var ErrInvalidQuery = errors.New("invalid history query")
+
+// ErrQueryTimeout is returned when a history query takes longer than HistoryTimeout
+var ErrQueryTimeout = errors.New("history query took too long - use a shorter range or a larger bucket")
+
+// HistoryTimeout is the longest a history query may run. It is kept below the web server write timeout so the caller
+// still has time to send an error.
+var HistoryTimeout = 10 * time.Second
+
+const (
+	DefaultHistoryLimit = 5000
+	MaxHistoryLimit     = 50000
+	// How long the oldest row in a live table is remembered before looking again
+	archiveBoundaryCache = 10 * time.Minute
+)
+
+// The data series that can be queried. Each is a set of columns in one of the logging tables.
+const (
+	SeriesBankVolts   = "bank_volts"
+	SeriesCurrent     = "current"
+	SeriesCharge      = "charge"
+	SeriesCellVolts   = "cell_volts"
+	SeriesTemperature = "temperature"
+)
+
+type historySeries struct {
+	table   string
+	scale   float64
+	perCell bool
+	// Column in the table and the name it is returned as
+	column func(cell int) (string, string)
+}
+
+var historySeriesList = map[string]historySeries{
+	SeriesBankVolts: {table: "voltage", scale: 10, column: func(bank int) (string, string) {
+		return fmt.Sprintf("bank_%d", bank), fmt.Sprintf("bank%d_volts", bank)
+	}},
+	SeriesCurrent: {table: "current", scale: 1, column: func(bank int) (string, string) {
+		return fmt.Sprintf("channel_%d", bank), fmt.Sprintf("bank%d_amps", bank)
+	}},
+	SeriesCharge: {table: "current", scale: 1, column: func(bank int) (string, string) {
+		return fmt.Sprintf("level_of_charge_%d", bank), fmt.Sprintf("bank%d_charge_ah", bank)
+	}},
+	SeriesCellVolts: {table: "voltage", scale: 10000, perCell: true, column: func(cell int) (string, string) {
+		return fmt.Sprintf("cell_%03d", cell), CellName(cell) + "_volts"
+	}},
+	SeriesTemperature: {table: "temperature", scale: 10, perCell: true, column: func(cell int) (string, string) {
+		return fmt.Sprintf("temp_%03d", cell), CellName(cell) + "_temp"
+	}},
+}
+
+// The bucket sizes that can be asked for and the longest range allowed for each so a query cannot scan the whole
+// database. A zero bucket returns the raw rows.
+var historyBuckets = []struct {
+	name    string
+	bucket  time.Duration
+	maxSpan time.Duration
+}{
+	{"raw", 0, 24 * time.Hour},
+	{"15s", 15 * time.Second, 7 * 24 * time.Hour},
+	{"1m", time.Minute, 31 * 24 * time.Hour},
+	{"1h", time.Hour, 366 * 24 * time.Hour},
+	{"1d", 24 * time.Hour, 10 * 366 * 24 * time.Hour},
+}
+
+/**
+HistoryQuery selects one series between Start and End. Cells are the database cell numbers (1..38 and 101..138) for
+the per cell series and are ignored for the bank series which always return both banks. All cells are returned if
+none are given.
+*/
+type HistoryQuery struct {
+	Series string
+	Cells  []int
+	Start  time.Time
+	End    time.Time
+	Bucket time.Duration
+	Limit  int
+}
+
+type HistoryPoint struct {
+	Time time.Time `json:"time"`
+	// One value per column. Min and Max are left out for raw rows. Missing readings are null.
+	Avg []*float64 `json:"avg"`
+	Min []*float64 `json:"min,omitempty"`
+	Max []*float64 `json:"max,omitempty"`
+}
+
+type HistoryResult struct {
+	Series  string         `json:"series"`
+	Bucket  string         `json:"bucket"`
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	Columns []string       `json:"columns"`
+	Points  []HistoryPoint `json:"points"`
+	// Set if there were more rows than the limit
+	Truncated bool `json:"truncated"`
+}
+
+/**
+Name a cell by its bank and its number in the bank, e.g. bank1_cell07 for cell 107.
+*/
+func CellName(cell int) string {
+	return fmt.Sprintf("bank%d_cell%02d", cell/100, cell%100)
+}
+
+func checkCell(cell int) error {
+	if cell < 0 || cell/100 > 1 || cell%100 < 1 || cell%100 > CellsPerBank {
+		return fmt.Errorf("%w - cell %d is not 1..%d or 101..%d", ErrInvalidQuery, cell, CellsPerBank, 100+CellsPerBank)
+	}
+	return nil
+}
+
+/**
+Return the bucket size for one of raw, 15s, 1m, 1h or 1d.
+*/
+func ParseBucket(name string) (time.Duration, error) {
+	for _, b := range historyBuckets {
+		if b.name == name {
+			return b.bucket, nil
+		}
+	}
+	return 0, fmt.Errorf("%w - bucket must be raw, 15s, 1m, 1h or 1d", ErrInvalidQuery)
+}
+
+/**
+Return the longest range that may be queried with the given bucket size.
+*/
+func MaxHistorySpan(bucket time.Duration) time.Duration {
+	for _, b := range historyBuckets {
+		if b.bucket >= bucket {
+			return b.maxSpan
+		}
+	}
+	return historyBuckets[len(historyBuckets)-1].maxSpan
+}
+
+func bucketName(bucket time.Duration) string {
+	for _, b := range historyBuckets {
+		if b.bucket == bucket {
+			return b.name
+		}
+	}
+	return ""
+}
+
+/**
+Check the range is the right way round and no longer than maxSpan.
+*/
+func ValidateTimeRange(start time.Time, end time.Time, maxSpan time.Duration) error {
+	if start.IsZero() || end.IsZero() {
+		return fmt.Errorf("%w - start and end must both be given", ErrInvalidQuery)
+	}
+	if !start.Before(end) {
+		return fmt.Errorf("%w - start must be before end", ErrInvalidQuery)
+	}
+	if maxSpan > 0 && end.Sub(start) > maxSpan {
+		return fmt.Errorf("%w - the range may not be longer than %v", ErrInvalidQuery, maxSpan)
+	}
+	return nil
+}
+
+/**
+Check the query and fill in the defaults.
+*/
+func (query *HistoryQuery) validate() (historySeries, error) {
+	series, found := historySeriesList[query.Series]
+	if !found {
+		return series, fmt.Errorf("%w - series must be one of %s, %s, %s, %s or %s", ErrInvalidQuery,
+			SeriesBankVolts, SeriesCurrent, SeriesCharge, SeriesCellVolts, SeriesTemperature)
+	}
+	name := bucketName(query.Bucket)
+	if name == "" {
+		return series, fmt.Errorf("%w - bucket must be raw, 15s, 1m, 1h or 1d", ErrInvalidQuery)
+	}
+	if err := ValidateTimeRange(query.Start, query.End, MaxHistorySpan(query.Bucket)); err != nil {
+		return series, fmt.Errorf("%w using %s buckets", err, name)
+	}
+	if query.Limit == 0 {
+		query.Limit = DefaultHistoryLimit
+	}
+	if query.Limit < 0 || query.Limit > MaxHistoryLimit {
+		return series, fmt.Errorf("%w - limit must be 1 to %d", ErrInvalidQuery, MaxHistoryLimit)
+	}
+	if !series.perCell {
+		query.Cells = []int{0, 1}
+	} else if len(query.Cells) == 0 {
+		for _, base := range []int{0, 100} {
+			for cell := 1; cell <= CellsPerBank; cell++ {
+				query.Cells = append(query.Cells, base+cell)
+			}
+		}
+	} else {
+		for _, cell := range query.Cells {
+			if err := checkCell(cell); err != nil {
+				return series, err
+			}
+		}
+	}
+	return series, nil
+}
+
+/**
+Return the time of the oldest row in a live table. Anything older is in the matching _archive table. An empty live
+table gives the end of time so everything is read from the archive.
+*/
+func (store *sqlStore) archiveBoundary(ctx context.Context, table string) (string, error) {
+	store.mu.Lock()
+	boundary, found := store.boundaries[table]
+	store.mu.Unlock()
+	if found && time.Since(boundary.checked) < archiveBoundaryCache {
+		return boundary.oldest, nil
+	}
+	var oldest sql.NullTime
+	err := store.db.QueryRowContext(ctx, `select logged from `+table+` order by logged limit 1`).Scan(&oldest)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	boundary.checked = time.Now()
+	boundary.oldest = "9999-12-31 23:59:59"
+	if oldest.Valid {
+		boundary.oldest = oldest.Time.Format(TimeFormat)
+	}
+	store.mu.Lock()
+	store.boundaries[table] = boundary
+	store.mu.Unlock()
+	return boundary.oldest, nil
+}
+
+/**
+Return a derived table with the given columns of a logging table between start and end along with its arguments.
+The archive table is read for any part of the range older than the oldest row in the live table so ranges across the
+boundary are joined up.
+*/
+func (store *sqlStore) rangeSource(ctx context.Context, table string, columns string, start time.Time, end time.Time) (string, []interface{}, error) {
+	return store.unionSource(ctx, table, columns, columns, start, end)
+}
+
+/**
+Return a derived table with the given columns of a logging table and the minimum and maximum of each as <column>_min
+and <column>_max. Live rows are their own minimum and maximum while the archive has them for each minute once the
+retention job has added the columns.
+*/
+func (store *sqlStore) extremeSource(ctx context.Context, table string, columns []string, start time.Time, end time.Time) (string, []interface{}, error) {
+	var live, archive []string
+	extremes := store.hasExtremes(table)
+	for _, column := range columns {
+		live = append(live, column, column+" "+column+"_min", column+" "+column+"_max")
+		if extremes {
+			archive = append(archive, column, "coalesce("+column+"_min, "+column+") "+column+"_min",
+				"coalesce("+column+"_max, "+column+") "+column+"_max")
+		} else {
+			archive = append(archive, column, column+" "+column+"_min", column+" "+column+"_max")
+		}
+	}
+	return store.unionSource(ctx, table, strings.Join(live, ", "), strings.Join(archive, ", "), start, end)
+}
+
+/**
+rangeSource selecting liveColumns from the live table and archiveColumns, which must give the same columns, from the
+archive table
+*/
+func (store *sqlStore) unionSource(ctx context.Context, table string, liveColumns string, archiveColumns string, start time.Time, end time.Time) (string, []interface{}, error) {
+	sStart := start.Format(TimeFormat)
+	sEnd := end.Format(TimeFormat)
+	boundary, err := store.archiveBoundary(ctx, table)
+	if err != nil {
+		return "", nil, err
+	}
+	live := `select logged, ` + liveColumns + ` from ` + table + ` where logged between ? and ?`
+	archive := `select logged, ` + archiveColumns + ` from ` + table + `_archive where logged >= ? and logged < ?`
+	switch {
+	case sStart >= boundary:
+		return `(` + live + `)`, []interface{}{sStart, sEnd}, nil
+	case sEnd < boundary:
+		return `(select logged, ` + archiveColumns + ` from ` + table + `_archive where logged between ? and ?)`, []interface{}{sStart, sEnd}, nil
+	default:
+		return `(` + archive + ` union all ` + live + `)`, []interface{}{sStart, boundary, boundary, sEnd}, nil
+	}
+}
+
+/**
+Turn the error from a query that ran out of time into ErrQueryTimeout.
+*/
+func historyError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrQueryTimeout
+	}
+	return err
+}
+
+/**
+Return one series between the start and end of the query, either as the raw rows or the average, minimum and maximum
+over each bucket. Only placeholders are used for the values. Column names come from the validated cell numbers.
+*/
+func (store *sqlStore) QueryHistory(query HistoryQuery) (HistoryResult, error) {
+	series, err := query.validate()
+	if err != nil {
+		return HistoryResult{}, err
+	}
+	result := HistoryResult{Series: query.Series, Bucket: bucketName(query.Bucket), Start: query.Start, End: query.End,
+		Points: []HistoryPoint{}}
+	var tableColumns, selectColumns []string
+	for _, cell := range query.Cells {
+		column, name := series.column(cell)
+		tableColumns = append(tableColumns, column)
+		result.Columns = append(result.Columns, name)
+		scale := fmt.Sprintf(" / %.1f", series.scale)
+		if query.Bucket == 0 {
+			selectColumns = append(selectColumns, column+scale)
+		} else {
+			selectColumns = append(selectColumns, "avg("+column+")"+scale, "min("+column+"_min)"+scale, "max("+column+"_max)"+scale)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HistoryTimeout)
+	defer cancel()
+	var source string
+	var args []interface{}
+	if query.Bucket == 0 {
+		source, args, err = store.rangeSource(ctx, series.table, strings.Join(tableColumns, ", "), query.Start, query.End)
+	} else {
+		source, args, err = store.extremeSource(ctx, series.table, tableColumns, query.Start, query.End)
+	}
+	if err != nil {
+		return result, historyError(ctx, err)
+	}
+	var sSQL string
+	switch query.Bucket {
+	case 0:
+		sSQL = `select unix_timestamp(logged), ` + strings.Join(selectColumns, ", ") + ` from ` + source + ` h order by logged limit ?`
+	case 24 * time.Hour:
+		// Days are grouped by the local date rather than UTC
+		sSQL = `select min(unix_timestamp(logged)), ` + strings.Join(selectColumns, ", ") + ` from ` + source + ` h group by date(logged) order by 1 limit ?`
+	default:
+		sSQL = `select min(unix_timestamp(logged)), ` + strings.Join(selectColumns, ", ") + ` from ` + source + ` h group by ` +
+			store.dialect.bucket("logged", int(query.Bucket.Seconds())) + ` order by 1 limit ?`
+	}
+	// Ask for one more row than the limit to find out if there are more
+	rows, err := store.db.QueryContext(ctx, sSQL, append(args, query.Limit+1)...)
+	if err != nil {
+		return result, historyError(ctx, err)
+	}
+	defer closeRows(rows)
+	values := make([]sql.NullFloat64, len(selectColumns))
+	var logged int64
+	destinations := []interface{}{&logged}
+	for i := range values {
+		destinations = append(destinations, &values[i])
+	}
+	for rows.Next() {
+		if len(result.Points) == query.Limit {
+			result.Truncated = true
+			break
+		}
+		if err = rows.Scan(destinations...); err != nil {
+			return result, historyError(ctx, err)
+		}
+		result.Points = append(result.Points, newHistoryPoint(logged, query.Bucket, values))
+	}
+	return result, historyError(ctx, rows.Err())
+}
+
+/**
+Return the start of the bucket holding the unix time logged. Days start at local midnight.
+*/
+func bucketStart(logged int64, bucket time.Duration) time.Time {
+	t := time.Unix(logged, 0)
+	switch {
+	case bucket == 24*time.Hour:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	case bucket > 0:
+		return time.Unix(logged-(logged%int64(bucket.Seconds())), 0)
+	}
+	return t
+}
+
+/**
+Build a point from the scanned values which are either one value per column or average, minimum and maximum for
+each column.
+*/
+func newHistoryPoint(logged int64, bucket time.Duration, values []sql.NullFloat64) HistoryPoint {
+	point := HistoryPoint{Time: bucketStart(logged, bucket)}
+	value := func(v sql.NullFloat64) *float64 {
+		if !v.Valid {
+			return nil
+		}
+		return &v.Float64
+	}
+	if bucket == 0 {
+		for _, v := range values {
+			point.Avg = append(point.Avg, value(v))
+		}
+		return point
+	}
+	for i := 0; i < len(values); i += 3 {
+		point.Avg = append(point.Avg, value(values[i]))
+		point.Min = append(point.Min, value(values[i+1]))
+		point.Max = append(point.Max, value(values[i+2]))
+	}
+	return point
+}
@@ -0,0 +1,223 @@
+package Storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	"log"
+	"strings"
+	"time"
+)
+
+/**
+MySQL stores everything in a MySQL or MariaDB server. The full charge slope calculation uses the ChargingDataLoad
+stored procedure and the Slope() UDF installed in the battery database.
+*/
+type MySQL struct {
+	sqlStore
+}
+
+/**
+Connect to the MySQL/MariaDB server. The connection is tested before returning.
+*/
+func OpenMySQL(login string, password string, server string, port string, database string) (*MySQL, error) {
+	// Connection string needs the additional parameter of parseTime=true in order to read dat/time values into sql.NullTime variables
+	var sConnectionString = login + ":" + password + "@tcp(" + server + ":" + port + ")/" + database + "?parseTime=true&timeout=5s"
+	db, err := sql.Open("mysql", sConnectionString)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	// The alarms, audit, inverter, cell analytics, cell resistance, capacity test, state of charge, charge drift, energy and report tables were added after the rest of the database so create them if they are not there yet
+	_, err = db.Exec(`create table if not exists alarms (
+    id bigint not null auto_increment primary key,
+    rule varchar(50) not null,
+    severity varchar(10) not null,
+    source varchar(50) not null,
+    message varchar(255) not null,
+    value double,
+    threshold double,
+    raised datetime not null,
+    cleared datetime null,
+    acknowledged datetime null,
+    acknowledged_by varchar(50) not null default '',
+    index alarms_raised (raised))`)
+	if err != nil {
+		log.Println("Failed to create the alarms table -", err)
+	}
+	_, err = db.Exec(`create table if not exists audit (
+    id bigint not null auto_increment primary key,
+    logged datetime not null,
+    source varchar(20) not null,
+    user_name varchar(50) not null default '',
+    action varchar(50) not null,
+    parameters varchar(255) not null default '',
+    previous_state varchar(255) not null default '',
+    result varchar(20) not null,
+    error varchar(255) not null default '',
+    index audit_logged (logged))`)
+	if err != nil {
+		log.Println("Failed to create the audit table -", err)
+	}
+	_, err = db.Exec(`create table if not exists inverter (
+    logged datetime not null,
+    volts float,
+    amps float,
+    soc float,
+    v_setpoint float,
+    frequency double,
+    generator_running tinyint,
+    index inverter_logged (logged))`)
+	if err != nil {
+		log.Println("Failed to create the inverter table -", err)
+	}
+	_, err = db.Exec(`create table if not exists cell_analytics (
+    logged datetime not null,
+    day date not null,
+    cell_number int not null,
+    discharge_samples int not null,
+    mean_deviation double,
+    mean_z_score double,
+    times_lowest int not null,
+    weakest_rank int not null,
+    min_volts double,
+    max_volts double,
+    index cell_analytics_day (day))`)
+	if err != nil {
+		log.Println("Failed to create the cell_analytics table -", err)
+	}
+	_, err = db.Exec(`create table if not exists cell_resistance (
+    logged datetime not null,
+    cell_number int not null,
+    milliohms double not null,
+    uncertainty double not null,
+    confidence double not null,
+    step_amps double not null,
+    index cell_resistance_logged (logged))`)
+	if err != nil {
+		log.Println("Failed to create the cell_resistance table -", err)
+	}
+	_, err = db.Exec(`create table if not exists capacity_tests (
+    id bigint not null auto_increment primary key,
+    bank tinyint not null,
+    full_charge datetime not null,
+    deep_discharge datetime null,
+    discharged_ah double not null default 0,
+    charged_ah double not null default 0,
+    delivered_ah double not null default 0,
+    rated_ah double not null default 0,
+    approved datetime null,
+    approved_by varchar(50) not null default '',
+    index capacity_tests_bank (bank, deep_discharge))`)
+	if err != nil {
+		log.Println("Failed to create the capacity_tests table -", err)
+	}
+	_, err = db.Exec(`create table if not exists soc_estimates (
+    logged datetime not null,
+    bank tinyint not null,
+    soc double not null,
+    uncertainty double not null,
+    counter double not null,
+    source varchar(20) not null,
+    last_anchor datetime null,
+    index soc_estimates_bank (bank, logged))`)
+	if err != nil {
+		log.Println("Failed to create the soc_estimates table -", err)
+	}
+	_, err = db.Exec(`create table if not exists charge_drift (
+    logged datetime not null,
+    bank tinyint not null,
+    counter_ah double not null,
+    capacity_ah double not null,
+    drift_ah double not null,
+    discharged_ah double not null,
+    charged_ah double not null,
+    cycle_efficiency double null,
+    efficiency double not null,
+    index charge_drift_bank (bank, logged))`)
+	if err != nil {
+		log.Println("Failed to create the charge_drift table -", err)
+	}
+	_, err = db.Exec(`create table if not exists energy (
+    day date not null,
+    source varchar(10) not null,
+    wh_in double not null,
+    wh_out double not null,
+    ah_in double not null,
+    ah_out double not null,
+    primary key (day, source))`)
+	if err != nil {
+		log.Println("Failed to create the energy table -", err)
+	}
+	_, err = db.Exec(`create table if not exists reports (
+    id bigint not null auto_increment primary key,
+    kind varchar(10) not null,
+    period_start datetime not null,
+    period_end datetime not null,
+    generated datetime not null,
+    body mediumtext not null,
+    index reports_period (kind, period_start))`)
+	if err != nil {
+		log.Println("Failed to create the reports table -", err)
+	}
+	// Older data is moved to the archive tables which have the same layout as the live ones
+	for _, table := range []string{"voltage", "temperature", "current", "inverter"} {
+		if _, err = db.Exec(`create table if not exists ` + table + `_archive like ` + table); err != nil {
+			log.Println("Failed to create the", table+"_archive table -", err)
+		}
+	}
+	d := dialect{
+		bucket: func(column string, seconds int) string {
+			return fmt.Sprintf("unix_timestamp(%s) DIV %d", column, seconds)
+		},
+		sameSecond: func(column1 string, column2 string) string {
+			return fmt.Sprintf("%s = from_unixtime(round(unix_timestamp(%s)))", column1, column2)
+		},
+		minute: func(column string) string {
+			return fmt.Sprintf("date_format(%s, '%%Y-%%m-%%d %%H:%%i:00')", column)
+		},
+		addColumns: func(table string, columns []string) []string {
+			// One statement so a large table is only rebuilt once
+			return []string{`alter table ` + table + ` add column ` + strings.Join(columns, ", add column ")}
+		},
+	}
+	store := new(MySQL)
+	store.sqlStore = newSQLStore(db, d)
+	if err = store.findArchiveExtremes(); err != nil {
+		log.Println("Failed to look at the archive tables -", err)
+	}
+	return store, nil
+}
+
+/**
+The stored procedure loads the data into a temporary table which only exists on the connection that called it, so
+everything here has to run on the same connection.
+*/
+func (store *MySQL) CellVoltageSlopes(bank int, when time.Time, span int) (rows int64, slopes []sql.NullFloat64, err error) {
+	ctx := context.Background()
+	conn, err := store.db.Conn(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	err = conn.QueryRowContext(ctx, "call ChargingDataLoad(?,?,?)", when.Format(TimeFormat), span, bank).Scan(&rows)
+	if err != nil {
+		return 0, nil, err
+	}
+	slopes = make([]sql.NullFloat64, CellsPerBank)
+	for cell := range slopes {
+		if err = conn.QueryRowContext(ctx, "select Slope(?)", cell+1).Scan(&slopes[cell]); err != nil {
+			return rows, nil, err
+		}
+	}
+	return rows, slopes, nil
+}
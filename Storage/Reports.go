@@ -0,0 +1,108 @@
+package Storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+/**
+SavedReport is one row of the reports table. Body is the report as JSON and is only filled in by GetReport.
+*/
+type SavedReport struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Generated time.Time `json:"generated"`
+	Body      string    `json:"-"`
+}
+
+/**
+Save a report, replacing any already saved for the same kind and period. Returns its id.
+*/
+func (store *sqlStore) SaveReport(report SavedReport) (int64, error) {
+	if _, err := store.db.Exec(`delete from reports where kind = ? and period_start = ?`, report.Kind, report.Start.Format(TimeFormat)); err != nil {
+		return 0, err
+	}
+	result, err := store.db.Exec(`insert into reports (kind, period_start, period_end, generated, body) values (?, ?, ?, ?, ?)`,
+		report.Kind, report.Start.Format(TimeFormat), report.End.Format(TimeFormat), report.Generated.Format(TimeFormat), report.Body)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+/**
+Return the most recent reports, newest first, without their bodies. A blank kind returns every kind.
+*/
+func (store *sqlStore) GetReports(kind string, limit int) ([]SavedReport, error) {
+	sSQL := `select id, kind, period_start, period_end, generated from reports`
+	var args []interface{}
+	if kind != "" {
+		sSQL += ` where kind = ?`
+		args = append(args, kind)
+	}
+	rows, err := store.db.Query(sSQL+` order by period_start desc, id desc limit ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var reports []SavedReport
+	for rows.Next() {
+		var report SavedReport
+		if err = rows.Scan(&report.ID, &report.Kind, &report.Start, &report.End, &report.Generated); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+/**
+Return the report with its body. Returns sql.ErrNoRows if there is no such report.
+*/
+func (store *sqlStore) GetReport(id int64) (SavedReport, error) {
+	var report SavedReport
+	err := store.db.QueryRow(`select id, kind, period_start, period_end, generated, body from reports where id = ?`, id).Scan(
+		&report.ID, &report.Kind, &report.Start, &report.End, &report.Generated, &report.Body)
+	return report, err
+}
+
+/**
+True if a report of the kind has been saved for the period starting at start
+*/
+func (store *sqlStore) HaveReport(kind string, start time.Time) (bool, error) {
+	var id int64
+	err := store.db.QueryRow(`select id from reports where kind = ? and period_start = ?`, kind, start.Format(TimeFormat)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+/**
+Return the lowest and highest estimated state of charge of the bank between start and end and the number of estimates
+at or above full, which are saved once a minute. min and max are not valid if there are no estimates.
+*/
+func (store *sqlStore) GetSOCSummary(bank int, start time.Time, end time.Time, full float64) (min sql.NullFloat64, max sql.NullFloat64, atFull int, err error) {
+	err = store.db.QueryRow(`select min(soc), max(soc), coalesce(sum(case when soc >= ? then 1 else 0 end), 0) from soc_estimates
+where bank = ? and logged between ? and ?`, full, bank, start.Format(TimeFormat), end.Format(TimeFormat)).Scan(&min, &max, &atFull)
+	return min, max, atFull, err
+}
+
+/**
+Return the number of minutes between start and end in which the inverter reported the generator running
+*/
+func (store *sqlStore) GetGeneratorMinutes(start time.Time, end time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HistoryTimeout)
+	defer cancel()
+	source, args, err := store.rangeSource(ctx, "inverter", "generator_running", start, end)
+	if err != nil {
+		return 0, historyError(ctx, err)
+	}
+	var minutes int
+	err = store.db.QueryRowContext(ctx, `select count(*) from (select `+store.dialect.bucket("logged", 60)+` minute from `+source+
+		` i where generator_running = 1 group by 1) g`, args...).Scan(&minutes)
+	return minutes, historyError(ctx, err)
+}
@@ -0,0 +1,256 @@
+package Storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ArchiveTables are the logging tables that have an _archive table
+var ArchiveTables = []string{"voltage", "temperature", "current", "inverter"}
+
+/**
+RetentionBatch is what one ArchiveBatch or PurgeBatch did. Removed rows were deleted from the table, Written are the
+one minute rows added to the archive table in their place. More is set if there are still rows older than the cutoff.
+*/
+type RetentionBatch struct {
+	Start   time.Time
+	End     time.Time
+	Removed int64
+	Written int64
+	More    bool
+}
+
+func checkArchiveTable(table string) error {
+	for _, archived := range ArchiveTables {
+		if table == archived {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not an archived table", table)
+}
+
+/**
+Return the value columns of a table, leaving out logged, and whether each holds integers
+*/
+func valueColumns(db *sql.DB, table string) (columns []string, integer []bool, err error) {
+	rows, err := db.Query(`select * from ` + table + ` limit 0`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeRows(rows)
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, column := range types {
+		if column.Name() == "logged" {
+			continue
+		}
+		columns = append(columns, column.Name())
+		integer = append(integer, strings.Contains(strings.ToUpper(column.DatabaseTypeName()), "INT"))
+	}
+	return columns, integer, nil
+}
+
+/**
+Return the minimum and maximum columns, with their types, missing from the table's archive
+*/
+func (store *sqlStore) missingExtremes(table string) ([]string, error) {
+	columns, _, err := valueColumns(store.db, table)
+	if err != nil {
+		return nil, err
+	}
+	archived, _, err := valueColumns(store.db, table+"_archive")
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[string]bool)
+	for _, column := range archived {
+		have[column] = true
+	}
+	var missing []string
+	for _, column := range columns {
+		for _, extreme := range []string{column + "_min", column + "_max"} {
+			if !have[extreme] {
+				missing = append(missing, extreme+" double")
+			}
+		}
+	}
+	return missing, nil
+}
+
+/**
+Note which archive tables have the minimum and maximum columns. Only looks at the tables so it is quick.
+*/
+func (store *sqlStore) findArchiveExtremes() error {
+	for _, table := range ArchiveTables {
+		missing, err := store.missingExtremes(table)
+		if err != nil {
+			return err
+		}
+		store.mu.Lock()
+		store.extremes[table] = len(missing) == 0
+		store.mu.Unlock()
+	}
+	return nil
+}
+
+func (store *sqlStore) hasExtremes(table string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.extremes[table]
+}
+
+/**
+The archive tables hold one minute averages in the same columns as the live tables along with the minimum and maximum
+over the minute in <column>_min and <column>_max. Add those to archive tables made before they were needed. This
+rebuilds the table on some databases, which can take a long time for a large archive, so it is left to the retention
+job rather than done on start up. Rows already in the archive without them are read as their own minimum and maximum.
+*/
+func (store *sqlStore) PrepareArchive() error {
+	for _, table := range ArchiveTables {
+		missing, err := store.missingExtremes(table)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			log.Println("Adding the minimum and maximum columns to", table+"_archive", "- this can take a while for a large table")
+			for _, statement := range store.dialect.addColumns(table+"_archive", missing) {
+				if _, err = store.db.Exec(statement); err != nil {
+					return fmt.Errorf("adding the minimum and maximum columns to %s_archive - %w", table, err)
+				}
+			}
+			log.Println("Added the minimum and maximum columns to", table+"_archive")
+		}
+		store.mu.Lock()
+		store.extremes[table] = true
+		store.mu.Unlock()
+	}
+	return nil
+}
+
+/**
+Return the oldest time in the table. Not valid if the table is empty.
+*/
+func (store *sqlStore) oldestLogged(table string) (sql.NullTime, error) {
+	var oldest sql.NullTime
+	err := store.db.QueryRow(`select logged from ` + table + ` order by logged limit 1`).Scan(&oldest)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return oldest, err
+}
+
+/**
+Forget the cached oldest row of the live table after rows have been moved out of it
+*/
+func (store *sqlStore) forgetBoundary(table string) {
+	store.mu.Lock()
+	delete(store.boundaries, table)
+	store.mu.Unlock()
+}
+
+/**
+Move up to span of the oldest rows in the live table that are older than before into its archive table as one minute
+averages, minimums and maximums. The span starts on a whole minute and the rows are moved in one transaction.
+*/
+func (store *sqlStore) ArchiveBatch(table string, before time.Time, span time.Duration) (RetentionBatch, error) {
+	var batch RetentionBatch
+	if err := checkArchiveTable(table); err != nil {
+		return batch, err
+	}
+	if !store.hasExtremes(table) {
+		return batch, fmt.Errorf("%s_archive does not have the minimum and maximum columns yet - call PrepareArchive first", table)
+	}
+	oldest, err := store.oldestLogged(table)
+	if err != nil || !oldest.Valid {
+		return batch, err
+	}
+	before = before.Truncate(time.Minute)
+	// Times come back in whatever zone the driver gives them so work on the formatted wall clock time
+	start, err := time.ParseInLocation(TimeFormat, oldest.Time.Format(TimeFormat), before.Location())
+	if err != nil || !start.Before(before) {
+		return batch, err
+	}
+	batch.Start = start.Truncate(time.Minute)
+	batch.End = batch.Start.Add(span)
+	if !batch.End.Before(before) {
+		batch.End = before
+	}
+	batch.More = batch.End.Before(before)
+
+	columns, integer, err := valueColumns(store.db, table)
+	if err != nil {
+		return batch, err
+	}
+	insertColumns := append([]string{"logged"}, columns...)
+	selectColumns := []string{store.dialect.minute("logged")}
+	for i, column := range columns {
+		if integer[i] {
+			selectColumns = append(selectColumns, "round(avg("+column+"))")
+		} else {
+			selectColumns = append(selectColumns, "avg("+column+")")
+		}
+	}
+	for _, column := range columns {
+		insertColumns = append(insertColumns, column+"_min", column+"_max")
+		selectColumns = append(selectColumns, "min("+column+")", "max("+column+")")
+	}
+	sStart, sEnd := batch.Start.Format(TimeFormat), batch.End.Format(TimeFormat)
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return batch, err
+	}
+	result, err := tx.Exec(`insert into `+table+`_archive (`+strings.Join(insertColumns, ", ")+`) select `+strings.Join(selectColumns, ", ")+
+		` from `+table+` where logged >= ? and logged < ? group by 1`, sStart, sEnd)
+	if err == nil {
+		batch.Written, err = result.RowsAffected()
+	}
+	if err == nil {
+		if result, err = tx.Exec(`delete from `+table+` where logged >= ? and logged < ?`, sStart, sEnd); err == nil {
+			batch.Removed, err = result.RowsAffected()
+		}
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return batch, err
+	}
+	if err = tx.Commit(); err != nil {
+		return batch, err
+	}
+	store.forgetBoundary(table)
+	return batch, nil
+}
+
+/**
+Delete up to span of the oldest rows in the archive table that are older than before
+*/
+func (store *sqlStore) PurgeBatch(table string, before time.Time, span time.Duration) (RetentionBatch, error) {
+	var batch RetentionBatch
+	if err := checkArchiveTable(table); err != nil {
+		return batch, err
+	}
+	oldest, err := store.oldestLogged(table + "_archive")
+	if err != nil || !oldest.Valid {
+		return batch, err
+	}
+	start, err := time.ParseInLocation(TimeFormat, oldest.Time.Format(TimeFormat), before.Location())
+	if err != nil || !start.Before(before) {
+		return batch, err
+	}
+	batch.Start = start
+	batch.End = start.Add(span)
+	if !batch.End.Before(before) {
+		batch.End = before
+	}
+	batch.More = batch.End.Before(before)
+	result, err := store.db.Exec(`delete from `+table+`_archive where logged < ?`, batch.End.Format(TimeFormat))
+	if err == nil {
+		batch.Removed, err = result.RowsAffected()
+	}
+	return batch, err
+}
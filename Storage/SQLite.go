@@ -0,0 +1,234 @@
+package Storage
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
+)
+
+const sqliteDriver = "sqlite3_battery"
+
+func init() {
+	// Register a SQLite driver with the MySQL functions the battery monitor uses in its queries.
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("now", func() string {
+				return time.Now().Format(TimeFormat)
+			}, false); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("unix_timestamp", func(when string) int64 {
+				t, err := time.ParseInLocation(TimeFormat, when, time.Local)
+				if err != nil {
+					return 0
+				}
+				return t.Unix()
+			}, true)
+		},
+	})
+}
+
+/**
+SQLite stores everything in a local SQLite file so small sites do not need a database server.
+*/
+type SQLite struct {
+	sqlStore
+}
+
+/**
+Build the column list for a table with one column per cell in both banks. Cells are 001..038 and 101..138
+*/
+func cellColumns(prefix string, columnType string) string {
+	var columns []string
+	for _, base := range []int{0, 100} {
+		for cell := 1; cell <= CellsPerBank; cell++ {
+			columns = append(columns, fmt.Sprintf("%s_%03d %s", prefix, base+cell, columnType))
+		}
+	}
+	return strings.Join(columns, ", ")
+}
+
+/**
+Open (creating if needed) the SQLite database file. New databases are given the tables and the default system
+parameters and serial numbers.
+*/
+func OpenSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open(sqliteDriver, "file:"+path+"?_loc=auto&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer so keep everything on a single connection
+	db.SetMaxOpenConns(1)
+
+	schema := []string{
+		`create table if not exists voltage (logged datetime not null default (datetime('now','localtime')), ` + cellColumns("cell", "integer") + `, bank_0 integer, bank_1 integer)`,
+		`create index if not exists voltage_logged on voltage (logged)`,
+		`create table if not exists temperature (logged datetime not null default (datetime('now','localtime')), ` + cellColumns("temp", "real") + `)`,
+		`create index if not exists temperature_logged on temperature (logged)`,
+		`create table if not exists current (logged datetime not null, channel_0 real, channel_1 real, level_of_charge_0 real, level_of_charge_1 real)`,
+		`create index if not exists current_logged on current (logged)`,
+		`create table if not exists inverter (logged datetime not null, volts real, amps real, soc real, v_setpoint real, frequency real, generator_running integer)`,
+		`create index if not exists inverter_logged on inverter (logged)`,
+		`create table if not exists voltage_archive (logged datetime not null, ` + cellColumns("cell", "integer") + `, bank_0 integer, bank_1 integer)`,
+		`create index if not exists voltage_archive_logged on voltage_archive (logged)`,
+		`create table if not exists temperature_archive (logged datetime not null, ` + cellColumns("temp", "real") + `)`,
+		`create index if not exists temperature_archive_logged on temperature_archive (logged)`,
+		`create table if not exists current_archive (logged datetime not null, channel_0 real, channel_1 real, level_of_charge_0 real, level_of_charge_1 real)`,
+		`create index if not exists current_archive_logged on current_archive (logged)`,
+		`create table if not exists inverter_archive (logged datetime not null, volts real, amps real, soc real, v_setpoint real, frequency real, generator_running integer)`,
+		`create index if not exists inverter_archive_logged on inverter_archive (logged)`,
+		`create table if not exists system_parameters (name varchar(50) primary key, integer_value integer, double_value double, date_value datetime, string_value varchar(255))`,
+		`create table if not exists alarms (id integer primary key autoincrement, rule varchar(50) not null, severity varchar(10) not null, source varchar(50) not null, message varchar(255) not null, value double, threshold double, raised datetime not null, cleared datetime, acknowledged datetime, acknowledged_by varchar(50) not null default '')`,
+		`create index if not exists alarms_raised on alarms (raised)`,
+		`create table if not exists audit (id integer primary key autoincrement, logged datetime not null, source varchar(20) not null, user_name varchar(50) not null default '', action varchar(50) not null, parameters varchar(255) not null default '', previous_state varchar(255) not null default '', result varchar(20) not null, error varchar(255) not null default '')`,
+		`create index if not exists audit_logged on audit (logged)`,
+		`create table if not exists cell_analytics (logged datetime not null, day date not null, cell_number integer not null, discharge_samples integer not null, mean_deviation real, mean_z_score real, times_lowest integer not null, weakest_rank integer not null, min_volts real, max_volts real)`,
+		`create index if not exists cell_analytics_day on cell_analytics (day)`,
+		`create table if not exists cell_resistance (logged datetime not null, cell_number integer not null, milliohms real not null, uncertainty real not null, confidence real not null, step_amps real not null)`,
+		`create index if not exists cell_resistance_logged on cell_resistance (logged)`,
+		`create table if not exists capacity_tests (id integer primary key autoincrement, bank integer not null, full_charge datetime not null, deep_discharge datetime, discharged_ah real not null default 0, charged_ah real not null default 0, delivered_ah real not null default 0, rated_ah real not null default 0, approved datetime, approved_by varchar(50) not null default '')`,
+		`create table if not exists soc_estimates (logged datetime not null, bank integer not null, soc real not null, uncertainty real not null, counter real not null, source varchar(20) not null, last_anchor datetime)`,
+		`create index if not exists soc_estimates_bank on soc_estimates (bank, logged)`,
+		`create table if not exists charge_drift (logged datetime not null, bank integer not null, counter_ah real not null, capacity_ah real not null, drift_ah real not null, discharged_ah real not null, charged_ah real not null, cycle_efficiency real, efficiency real not null)`,
+		`create index if not exists charge_drift_bank on charge_drift (bank, logged)`,
+		`create table if not exists energy (day date not null, source varchar(10) not null, wh_in real not null, wh_out real not null, ah_in real not null, ah_out real not null, primary key (day, source))`,
+		`create table if not exists reports (id integer primary key autoincrement, kind varchar(10) not null, period_start datetime not null, period_end datetime not null, generated datetime not null, body text not null)`,
+		`create index if not exists reports_period on reports (kind, period_start)`,
+		`create table if not exists serial_numbers (cell_number integer primary key, serial_number varchar(20) not null default '', install_date datetime, full_charge integer not null default 0, full_charge_detected datetime)`,
+	}
+	for _, statement := range schema {
+		if _, err = db.Exec(statement); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+
+	now := time.Now().Format(TimeFormat)
+	parameters := []struct {
+		name    string
+		integer interface{}
+		double  interface{}
+		date    interface{}
+	}{
+		{"bank0_full", 0, nil, now},
+		{"bank1_full", 0, nil, now},
+		{"capacity_0", 1000, nil, nil},
+		{"capacity_1", 1000, nil, nil},
+		{"charge_in_counter_0", nil, 0.0, nil},
+		{"charge_in_counter_1", nil, 0.0, nil},
+		{"charge_out_counter_0", nil, 0.0, nil},
+		{"charge_out_counter_1", nil, 0.0, nil},
+		{"charge0_efficiency", nil, 0.9, nil},
+		{"charge1_efficiency", nil, 0.9, nil},
+		{"full_charge_min_rows", 30, nil, nil},
+		{"full_charge_scan_mins", 30, nil, nil},
+		{"full_charge_threshold", nil, 0.001, nil},
+	}
+	for _, p := range parameters {
+		_, err = db.Exec(`insert or ignore into system_parameters (name, integer_value, double_value, date_value) values (?,?,?,?)`, p.name, p.integer, p.double, p.date)
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	for _, base := range []int{0, 100} {
+		for cell := 1; cell <= CellsPerBank; cell++ {
+			_, err = db.Exec(`insert or ignore into serial_numbers (cell_number, install_date) values (?,?)`, base+cell, now)
+			if err != nil {
+				_ = db.Close()
+				return nil, err
+			}
+		}
+	}
+
+	d := dialect{
+		bucket: func(column string, seconds int) string {
+			return fmt.Sprintf("unix_timestamp(%s) / %d", column, seconds)
+		},
+		sameSecond: func(column1 string, column2 string) string {
+			return fmt.Sprintf("%s = %s", column1, column2)
+		},
+		minute: func(column string) string {
+			return fmt.Sprintf("strftime('%%Y-%%m-%%d %%H:%%M:00', %s)", column)
+		},
+		addColumns: func(table string, columns []string) []string {
+			// SQLite only adds one column at a time
+			var statements []string
+			for _, column := range columns {
+				statements = append(statements, `alter table `+table+` add column `+column)
+			}
+			return statements
+		},
+	}
+	store := new(SQLite)
+	store.sqlStore = newSQLStore(db, d)
+	if err = store.findArchiveExtremes(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+/**
+Calculate the least squares slope of each cell voltage, in volts per minute, over the span minutes up to when. Only
+readings taken while the bank was charging are used.
+*/
+func (store *SQLite) CellVoltageSlopes(bank int, when time.Time, span int) (int64, []sql.NullFloat64, error) {
+	columns := make([]string, CellsPerBank)
+	for cell := range columns {
+		columns[cell] = fmt.Sprintf("v.cell_%03d", (bank*100)+cell+1)
+	}
+	rows, err := store.db.Query(fmt.Sprintf(`select unix_timestamp(v.logged), %s
+  from voltage v join current i on i.logged = v.logged
+ where v.logged between ? and ? and i.channel_%d > 0`, strings.Join(columns, ","), bank),
+		when.Add(-time.Duration(span)*time.Minute).Format(TimeFormat), when.Format(TimeFormat))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer closeRows(rows)
+
+	// Running sums for the regression of volts against minutes
+	var n int64
+	var sumT, sumTT float64
+	sumV := make([]float64, CellsPerBank)
+	sumTV := make([]float64, CellsPerBank)
+	var t0 int64 = -1
+	values := make([]sql.NullInt64, CellsPerBank+1)
+	pointers := make([]interface{}, len(values))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return 0, nil, err
+		}
+		if t0 < 0 {
+			t0 = values[0].Int64
+		}
+		t := float64(values[0].Int64-t0) / 60.0
+		n++
+		sumT += t
+		sumTT += t * t
+		for cell := 0; cell < CellsPerBank; cell++ {
+			v := float64(values[cell+1].Int64) / 10000.0
+			sumV[cell] += v
+			sumTV[cell] += t * v
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	slopes := make([]sql.NullFloat64, CellsPerBank)
+	denominator := (float64(n) * sumTT) - (sumT * sumT)
+	if n < 2 || denominator == 0 {
+		return n, slopes, nil
+	}
+	for cell := range slopes {
+		slopes[cell].Float64 = ((float64(n) * sumTV[cell]) - (sumT * sumV[cell])) / denominator
+		slopes[cell].Valid = true
+	}
+	return n, slopes, nil
+}
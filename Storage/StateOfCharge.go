@@ -0,0 +1,45 @@
+package Storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SOCEstimateTable is written through the store and forward queue with each bank's estimated state of charge
+const SOCEstimateTable = "soc_estimates"
+
+var SOCEstimateColumns = []string{"bank", "soc", "uncertainty", "counter", "source", "last_anchor"}
+
+/**
+SOCEstimate is one row of the soc_estimates table. SOC, Uncertainty and Counter, the fuel gauge's own figure, are in %.
+*/
+type SOCEstimate struct {
+	Logged      time.Time
+	Bank        int
+	SOC         float64
+	Uncertainty float64
+	Counter     float64
+	Source      string
+	LastAnchor  sql.NullTime
+}
+
+/**
+Return the value of each column for Insert
+*/
+func (row SOCEstimate) Values() []interface{} {
+	var lastAnchor interface{}
+	if row.LastAnchor.Valid {
+		lastAnchor = row.LastAnchor.Time.Format(TimeFormat)
+	}
+	return []interface{}{row.Bank, row.SOC, row.Uncertainty, row.Counter, row.Source, lastAnchor}
+}
+
+/**
+Return the latest state of charge estimate saved for the bank. Returns sql.ErrNoRows if there is none.
+*/
+func (store *sqlStore) GetLatestSOCEstimate(bank int) (SOCEstimate, error) {
+	var estimate SOCEstimate
+	err := store.db.QueryRow(`select logged, bank, soc, uncertainty, counter, source, last_anchor from soc_estimates where bank = ? order by logged desc limit 1`,
+		bank).Scan(&estimate.Logged, &estimate.Bank, &estimate.SOC, &estimate.Uncertainty, &estimate.Counter, &estimate.Source, &estimate.LastAnchor)
+	return estimate, err
+}
@@ -0,0 +1,506 @@
+package Storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TimeFormat is the layout used to pass date/time values to the database. Times are always local.
+const TimeFormat = "2006-01-02 15:04:05"
+
+// CellsPerBank is the number of cells in each bank. They are numbered 1..38 and 101..138 in the database.
+const CellsPerBank = 38
+
+/**
+Store is everything the battery monitor keeps in its database. There is one implementation for MySQL/MariaDB and one
+for an embedded SQLite file.
+*/
+type Store interface {
+	Ping() error
+	Close() error
+
+	// Insert a row into one of the logging tables (voltage, temperature, current).
+	// Logged is the local time as a string in TimeFormat.
+	Insert(table string, logged string, columns []string, values []interface{}) error
+
+	// System parameters
+	GetParameterInt(name string) (int64, error)
+	GetParameterFloat(name string) (float64, error)
+	GetParameterTime(name string) (sql.NullTime, error)
+	SetParameterInt(name string, value int64) error
+	SetParameterFloat(name string, value float64) error
+	AddToParameter(name string, delta float64) error
+	SetFlagParameter(name string) error
+	GetChargingEfficiencies() (map[string]float64, error)
+
+	// Serial numbers and the full charge state of each cell
+	GetSerialNumbers() ([]SerialNumber, error)
+	GetFullChargeFlags() (map[int]bool, error)
+	SetCellFullCharge(cell int, full bool, when time.Time) error
+	ClearFullCharge(bank int) error
+	CountFullCells(first int, last int) (int, error)
+
+	// Current
+	GetLastCharge() (when sql.NullTime, charge0 float32, charge1 float32, err error)
+	GetCurrentHistory(start time.Time, end time.Time, bucket time.Duration) ([]CurrentPoint, error)
+	GetAverageCurrent(since time.Time) (CurrentAverage, error)
+
+	// Voltage
+	GetBankVoltageHistory(start time.Time, end time.Time, bucket time.Duration) ([]VoltagePoint, error)
+	GetAverageBankVoltage(since time.Time) (left float64, right float64, err error)
+	GetCellHistory(cell int, start time.Time, end time.Time, minAmps *float64, maxAmps *float64) ([]CellPoint, error)
+
+	// Historical data from the live and archive tables. See HistoryQuery.
+	QueryHistory(query HistoryQuery) (HistoryResult, error)
+
+	// Stream a data set for export. See ExportQuery.
+	Export(ctx context.Context, query ExportQuery, header func(columns []string) error, row func(logged time.Time, values []sql.NullFloat64) error) error
+
+	// Return the number of charging rows found for the bank in the span minutes up to when and the slope of the
+	// voltage of each cell in that bank over that time. Used to detect cells reaching full charge.
+	CellVoltageSlopes(bank int, when time.Time, span int) (rows int64, slopes []sql.NullFloat64, err error)
+
+	// Alarms
+	AddAlarm(alarm Alarm) (int64, error)
+	ClearAlarm(id int64, when time.Time) error
+	AcknowledgeAlarm(id int64, user string, when time.Time) error
+	GetAlarm(id int64) (Alarm, error)
+	GetActiveAlarms() ([]Alarm, error)
+	GetAlarms(start time.Time, end time.Time) ([]Alarm, error)
+
+	// Audit log of commands. Entries are added with Insert into AuditTable.
+	GetAuditEntries(filter AuditFilter) ([]AuditEntry, error)
+
+	// Daily weakest cell ranking. Rows are added with Insert into CellAnalyticsTable.
+	GetCellAnalytics(start time.Time, end time.Time) ([]CellAnalyticsDay, error)
+
+	// Cell resistance estimates. Rows are added with Insert into CellResistanceTable.
+	GetCellResistance(start time.Time, end time.Time, cell int) ([]CellResistance, error)
+
+	// Capacity tests from full charge to deep discharge, and the charge in and out of a bank over a period
+	GetOpenCapacityTest(bank int) (CapacityTest, error)
+	StartCapacityTest(bank int, fullCharge time.Time) error
+	CompleteCapacityTest(test CapacityTest) error
+	GetCapacityTests(bank int, limit int) ([]CapacityTest, error)
+	ApproveCapacityTest(id int64, user string, when time.Time) error
+	GetChargeBetween(bank int, start time.Time, end time.Time) (discharged float64, charged float64, err error)
+
+	// State of charge estimates. Rows are added with Insert into SOCEstimateTable.
+	GetLatestSOCEstimate(bank int) (SOCEstimate, error)
+
+	// Fuel gauge charge resets at full charge. Rows are added with Insert into ChargeDriftTable.
+	GetChargeDrift(bank int, limit int) ([]ChargeDrift, error)
+
+	// Daily energy in and out of each bank and the battery as the inverter sees it
+	SaveEnergyDay(day time.Time, rows []EnergyDay) error
+	GetEnergy(start time.Time, end time.Time) ([]EnergyDay, error)
+
+	// Summary reports and the figures in them that are not read elsewhere
+	SaveReport(report SavedReport) (int64, error)
+	GetReports(kind string, limit int) ([]SavedReport, error)
+	GetReport(id int64) (SavedReport, error)
+	HaveReport(kind string, start time.Time) (bool, error)
+	GetSOCSummary(bank int, start time.Time, end time.Time, full float64) (min sql.NullFloat64, max sql.NullFloat64, atFull int, err error)
+	GetGeneratorMinutes(start time.Time, end time.Time) (int, error)
+
+	// Moving old rows from the live tables to the archive tables as one minute aggregates, and purging the archive.
+	// PrepareArchive must be called first.
+	PrepareArchive() error
+	ArchiveBatch(table string, before time.Time, span time.Duration) (RetentionBatch, error)
+	PurgeBatch(table string, before time.Time, span time.Duration) (RetentionBatch, error)
+}
+
+type SerialNumber struct {
+	CellNumber         int
+	SerialNumber       string
+	InstallDate        sql.NullTime
+	FullChargeDetected sql.NullTime
+	FullCharge         int
+}
+
+type CurrentPoint struct {
+	Logged   float64
+	Left     float64
+	Right    float64
+	SOCLeft  float64
+	SOCRight float64
+}
+
+type CurrentAverage struct {
+	Current  float64
+	Left     float64
+	Right    float64
+	SOC      float64
+	SOCLeft  float64
+	SOCRight float64
+}
+
+type VoltagePoint struct {
+	Logged float64
+	Left   float64
+	Right  float64
+}
+
+type CellPoint struct {
+	Logged  float64
+	Volts   float64
+	Current float64
+}
+
+/**
+The SQL that differs between the databases
+*/
+type dialect struct {
+	// Expression grouping the given datetime column into buckets of the given number of seconds
+	bucket func(column string, seconds int) string
+	// Join condition matching two datetime columns to the same second
+	sameSecond func(column1 string, column2 string) string
+	// Expression giving the start of the minute holding the given datetime column
+	minute func(column string) string
+	// Statements adding the columns, given with their types, to a table
+	addColumns func(table string, columns []string) []string
+}
+
+/**
+sqlStore implements the parts of Store that are plain SQL and work on both databases.
+*/
+type sqlStore struct {
+	db         *sql.DB
+	dialect    dialect
+	mu         sync.Mutex
+	statements map[string]*sql.Stmt
+	boundaries map[string]tableBoundary
+	// Archive tables that have the minimum and maximum columns
+	extremes map[string]bool
+}
+
+// The oldest row in a live table and when that was looked up
+type tableBoundary struct {
+	oldest  string
+	checked time.Time
+}
+
+func newSQLStore(db *sql.DB, d dialect) sqlStore {
+	return sqlStore{db: db, dialect: d, statements: make(map[string]*sql.Stmt), boundaries: make(map[string]tableBoundary),
+		extremes: make(map[string]bool)}
+}
+
+func (store *sqlStore) Ping() error {
+	return store.db.Ping()
+}
+
+func (store *sqlStore) Close() error {
+	return store.db.Close()
+}
+
+/**
+Return a prepared statement for the given SQL, preparing it the first time it is used.
+*/
+func (store *sqlStore) prepare(sSQL string) (*sql.Stmt, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if stmt, found := store.statements[sSQL]; found {
+		return stmt, nil
+	}
+	stmt, err := store.db.Prepare(sSQL)
+	if err != nil {
+		return nil, err
+	}
+	store.statements[sSQL] = stmt
+	return stmt, nil
+}
+
+func (store *sqlStore) Insert(table string, logged string, columns []string, values []interface{}) error {
+	if len(values) != len(columns) {
+		return fmt.Errorf("%d values given for %d columns in %s", len(values), len(columns), table)
+	}
+	stmt, err := store.prepare("insert into " + table + " (logged," + strings.Join(columns, ",") + ") values (?" + strings.Repeat(",?", len(columns)) + ")")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(append([]interface{}{logged}, values...)...)
+	return err
+}
+
+func (store *sqlStore) GetParameterInt(name string) (value int64, err error) {
+	err = store.db.QueryRow(`select coalesce(integer_value, double_value) from system_parameters where name = ?`, name).Scan(&value)
+	return
+}
+
+func (store *sqlStore) GetParameterFloat(name string) (value float64, err error) {
+	err = store.db.QueryRow(`select coalesce(double_value, integer_value) from system_parameters where name = ?`, name).Scan(&value)
+	return
+}
+
+func (store *sqlStore) GetParameterTime(name string) (value sql.NullTime, err error) {
+	err = store.db.QueryRow(`select date_value from system_parameters where name = ?`, name).Scan(&value)
+	return
+}
+
+func (store *sqlStore) SetParameterInt(name string, value int64) error {
+	_, err := store.db.Exec(`update system_parameters set integer_value = ? where name = ?`, value, name)
+	return err
+}
+
+func (store *sqlStore) SetParameterFloat(name string, value float64) error {
+	_, err := store.db.Exec(`update system_parameters set double_value = ? where name = ?`, value, name)
+	return err
+}
+
+func (store *sqlStore) AddToParameter(name string, delta float64) error {
+	stmt, err := store.prepare(`update system_parameters set double_value = double_value + ? where name = ?`)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(delta, name)
+	return err
+}
+
+/**
+Set a flag parameter and record when it was set. Does nothing if the flag is already set.
+*/
+func (store *sqlStore) SetFlagParameter(name string) error {
+	_, err := store.db.Exec(`update system_parameters set integer_value = 1, date_value = ? where name = ? and integer_value = 0`, time.Now().Format(TimeFormat), name)
+	return err
+}
+
+func (store *sqlStore) GetChargingEfficiencies() (map[string]float64, error) {
+	rows, err := store.db.Query(`select name, double_value from system_parameters where name like 'charge__efficiency' order by name`)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	efficiencies := make(map[string]float64)
+	for rows.Next() {
+		var name string
+		var efficiency float64
+		if err = rows.Scan(&name, &efficiency); err != nil {
+			return nil, err
+		}
+		efficiencies[name] = efficiency
+	}
+	return efficiencies, rows.Err()
+}
+
+func (store *sqlStore) GetSerialNumbers() ([]SerialNumber, error) {
+	rows, err := store.db.Query(`select cell_number, serial_number, install_date, full_charge_detected, full_charge from serial_numbers order by cell_number`)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	var serialNumbers []SerialNumber
+	for rows.Next() {
+		var sn SerialNumber
+		if err = rows.Scan(&sn.CellNumber, &sn.SerialNumber, &sn.InstallDate, &sn.FullChargeDetected, &sn.FullCharge); err != nil {
+			return nil, err
+		}
+		serialNumbers = append(serialNumbers, sn)
+	}
+	return serialNumbers, rows.Err()
+}
+
+func (store *sqlStore) GetFullChargeFlags() (map[int]bool, error) {
+	rows, err := store.db.Query(`select cell_number, full_charge from serial_numbers`)
+	if err != nil {
+		return nil, err
+	}
+	defer closeRows(rows)
+	flags := make(map[int]bool)
+	for rows.Next() {
+		var cell int
+		var full bool
+		if err = rows.Scan(&cell, &full); err != nil {
+			return nil, err
+		}
+		flags[cell] = full
+	}
+	return flags, rows.Err()
+}
+
+func (store *sqlStore) SetCellFullCharge(cell int, full bool, when time.Time) error {
+	_, err := store.db.Exec(`update serial_numbers set full_charge = ?, full_charge_detected = ? where cell_number = ?`, full, when.Format(TimeFormat), cell)
+	return err
+}
+
+/**
+Clear the full charge flags of the bank's cells and of the bank itself so its next full charge is detected. The time
+of the last full charge is kept.
+*/
+func (store *sqlStore) ClearFullCharge(bank int) error {
+	first := (bank * 100) + 1
+	_, err := store.db.Exec(`update serial_numbers set full_charge = 0 where full_charge = 1 and cell_number between ? and ?`, first, first+CellsPerBank-1)
+	if err != nil {
+		return err
+	}
+	_, err = store.db.Exec(`update system_parameters set integer_value = 0 where name = ?`, fmt.Sprintf("bank%d_full", bank))
+	return err
+}
+
+func (store *sqlStore) CountFullCells(first int, last int) (count int, err error) {
+	err = store.db.QueryRow(`select count(*) from serial_numbers where full_charge = 1 and cell_number between ? and ?`, first, last).Scan(&count)
+	return
+}
+
+/**
+Return the charge levels from the most recent current row. The time is not valid if there are no rows.
+*/
+func (store *sqlStore) GetLastCharge() (when sql.NullTime, charge0 float32, charge1 float32, err error) {
+	err = store.db.QueryRow(`select logged, level_of_charge_0, level_of_charge_1 from current order by logged desc limit 1`).Scan(&when, &charge0, &charge1)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+/**
+Return the current readings between start and end. If bucket is not zero the readings are averaged over buckets of
+that length. Older readings come from the archive table.
+*/
+func (store *sqlStore) GetCurrentHistory(start time.Time, end time.Time, bucket time.Duration) ([]CurrentPoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HistoryTimeout)
+	defer cancel()
+	source, args, err := store.rangeSource(ctx, "current", "channel_0, channel_1, level_of_charge_0, level_of_charge_1", start, end)
+	if err != nil {
+		return nil, historyError(ctx, err)
+	}
+	var sSQL string
+	if bucket > 0 {
+		sSQL = `select min(unix_timestamp(logged)) as logged,
+		avg(channel_0) as left_,
+		avg(channel_1) as right_,
+		avg(level_of_charge_0) as soc_left,
+		avg(level_of_charge_1) as soc_right
+		from ` + source + ` i
+		group by ` + store.dialect.bucket("logged", int(bucket.Seconds())) + `
+		order by 1`
+	} else {
+		sSQL = `select unix_timestamp(logged) as logged,
+		channel_0 as left_,
+		channel_1 as right_,
+		level_of_charge_0 as soc_left,
+		level_of_charge_1 as soc_right
+		from ` + source + ` i
+		order by logged`
+	}
+	rows, err := store.db.QueryContext(ctx, sSQL, args...)
+	if err != nil {
+		return nil, historyError(ctx, err)
+	}
+	defer closeRows(rows)
+	var points []CurrentPoint
+	for rows.Next() {
+		var point CurrentPoint
+		if err = rows.Scan(&point.Logged, &point.Left, &point.Right, &point.SOCLeft, &point.SOCRight); err != nil {
+			return nil, historyError(ctx, err)
+		}
+		points = append(points, point)
+	}
+	return points, historyError(ctx, rows.Err())
+}
+
+func (store *sqlStore) GetAverageCurrent(since time.Time) (CurrentAverage, error) {
+	var current, left, right, soc, socLeft, socRight sql.NullFloat64
+	err := store.db.QueryRow(`select avg(channel_0 + channel_1) as current
+			, avg(channel_0) as left_
+			, avg(channel_1) as right_
+			, avg(level_of_charge_0 + level_of_charge_1) as soc
+			, avg(level_of_charge_0) as soc_left
+			, avg(level_of_charge_1) as soc_right
+		from current
+		where logged > ?`, since.Format(TimeFormat)).Scan(&current, &left, &right, &soc, &socLeft, &socRight)
+	return CurrentAverage{
+		Current:  current.Float64,
+		Left:     left.Float64,
+		Right:    right.Float64,
+		SOC:      soc.Float64,
+		SOCLeft:  socLeft.Float64,
+		SOCRight: socRight.Float64,
+	}, err
+}
+
+func (store *sqlStore) GetBankVoltageHistory(start time.Time, end time.Time, bucket time.Duration) ([]VoltagePoint, error) {
+	if bucket < time.Second {
+		bucket = time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HistoryTimeout)
+	defer cancel()
+	source, args, err := store.rangeSource(ctx, "voltage", "bank_0, bank_1", start, end)
+	if err != nil {
+		return nil, historyError(ctx, err)
+	}
+	rows, err := store.db.QueryContext(ctx, `select min(unix_timestamp(logged)) as logged, avg(bank_0) / 10 as left_, avg(bank_1) / 10 as right_
+  from `+source+` v
+ group by `+store.dialect.bucket("logged", int(bucket.Seconds()))+`
+ order by 1`, args...)
+	if err != nil {
+		return nil, historyError(ctx, err)
+	}
+	defer closeRows(rows)
+	var points []VoltagePoint
+	for rows.Next() {
+		var point VoltagePoint
+		if err = rows.Scan(&point.Logged, &point.Left, &point.Right); err != nil {
+			return nil, historyError(ctx, err)
+		}
+		points = append(points, point)
+	}
+	return points, historyError(ctx, rows.Err())
+}
+
+func (store *sqlStore) GetAverageBankVoltage(since time.Time) (float64, float64, error) {
+	var left, right sql.NullFloat64
+	err := store.db.QueryRow(`select avg(bank_0) / 10 as vLeft, avg(bank_1) / 10 as vRight from voltage where logged > ?`, since.Format(TimeFormat)).Scan(&left, &right)
+	return left.Float64, right.Float64, err
+}
+
+/**
+Return the voltage of one cell with the current through its bank, averaged over 15 second buckets. Cells are numbered
+1..38 and 101..138. Any part of the range older than the live tables is read from the archive tables.
+*/
+func (store *sqlStore) GetCellHistory(cell int, start time.Time, end time.Time, minAmps *float64, maxAmps *float64) ([]CellPoint, error) {
+	if err := checkCell(cell); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HistoryTimeout)
+	defer cancel()
+	voltageSource, voltageArgs, err := store.rangeSource(ctx, "voltage", fmt.Sprintf("cell_%03d", cell), start, end)
+	if err != nil {
+		return nil, historyError(ctx, err)
+	}
+	currentSource, currentArgs, err := store.rangeSource(ctx, "current", fmt.Sprintf("channel_%d", cell/100), start, end)
+	if err != nil {
+		return nil, historyError(ctx, err)
+	}
+	args := append(voltageArgs, currentArgs...)
+	currentTerm := ""
+	if minAmps != nil && maxAmps != nil {
+		currentTerm = fmt.Sprintf(" where i.channel_%d > ? and i.channel_%d < ?", cell/100, cell/100)
+		args = append(args, *minAmps, *maxAmps)
+	}
+	sSQL := fmt.Sprintf(`select min(unix_timestamp(v.logged)) as logged, avg(cell_%03d) / 10000 as volts, avg(i.channel_%d) as amps
+    from `+voltageSource+` v join `+currentSource+` i on `+store.dialect.sameSecond("i.logged", "v.logged")+currentTerm+`
+   group by `+store.dialect.bucket("v.logged", 15)+`
+   order by 1`, cell, cell/100)
+	rows, err := store.db.QueryContext(ctx, sSQL, args...)
+	if err != nil {
+		return nil, historyError(ctx, err)
+	}
+	defer closeRows(rows)
+	var points []CellPoint
+	for rows.Next() {
+		var point CellPoint
+		if err = rows.Scan(&point.Logged, &point.Volts, &point.Current); err != nil {
+			return nil, historyError(ctx, err)
+		}
+		points = append(points, point)
+	}
+	return points, historyError(ctx, rows.Err())
+}
+
+func closeRows(rows *sql.Rows) {
+	_ = rows.Close()
+}
@@ -0,0 +1,295 @@
+package StoreAndForward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const timeFormat = "2006-01-02 15:04:05"
+const replayBatch = 500
+const retryInterval = 10 * time.Second
+
+/**
+One buffered row. The logged time is kept as a local time string so it is written exactly as now() would have.
+*/
+type record struct {
+	Table   string        `json:"t"`
+	Logged  string        `json:"l"`
+	Columns []string      `json:"c"`
+	Values  []interface{} `json:"v"`
+}
+
+/**
+Database is where the queue sends the rows
+*/
+type Database interface {
+	Insert(table string, logged string, columns []string, values []interface{}) error
+	Ping() error
+}
+
+/**
+Queue writes logged rows to the database. If the database cannot be reached the rows are appended to an on-disk
+write-ahead file instead and replayed in order, with their original timestamps, once the database comes back.
+While there is anything in the file new rows are also appended to it so the order is always preserved.
+*/
+type Queue struct {
+	mu      sync.Mutex
+	db      Database
+	path    string
+	file    *os.File
+	pending int   // Rows in the file not yet written to the database
+	offset  int64 // Position in the file of the next row to replay
+	online  bool
+}
+
+/**
+Create a new queue writing to the given database and buffering in the given file. Anything left in the file by a
+previous run is replayed by Run.
+*/
+func New(db Database, path string) (*Queue, error) {
+	queue := new(Queue)
+	queue.db = db
+	queue.path = path
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	queue.file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	size, err := queue.trimPartialLine()
+	if err != nil {
+		_ = queue.file.Close()
+		return nil, err
+	}
+	if sOffset, err := os.ReadFile(queue.positionFile()); err == nil {
+		queue.offset, _ = strconv.ParseInt(strings.TrimSpace(string(sOffset)), 10, 64)
+	}
+	if queue.offset > size {
+		queue.offset = size
+	}
+	records, _, err := queue.read(queue.offset, -1)
+	if err != nil {
+		_ = queue.file.Close()
+		return nil, err
+	}
+	queue.pending = len(records)
+	if queue.pending > 0 {
+		log.Println(queue.pending, "rows are waiting in", path, "to be written to the database")
+	}
+	queue.online = queue.pending == 0
+	return queue, nil
+}
+
+/**
+Cut off a partial last line left by a crash or power loss during a write, so the next row is not joined onto it and
+lost with it. Returns the size of the file afterwards.
+*/
+func (queue *Queue) trimPartialLine() (int64, error) {
+	info, err := queue.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	end := size
+	block := make([]byte, 4096)
+	for end > 0 {
+		start := end - int64(len(block))
+		if start < 0 {
+			start = 0
+		}
+		if _, err = queue.file.ReadAt(block[:end-start], start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(block[:end-start], '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if end < size {
+		log.Println("Dropping a partial row at the end of", queue.path)
+		if err = queue.file.Truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	return end, nil
+}
+
+func (queue *Queue) positionFile() string {
+	return queue.path + ".pos"
+}
+
+/**
+Write a row to the given table. The logged column is set to the current time.
+*/
+func (queue *Queue) Insert(table string, columns []string, values ...interface{}) error {
+	rec := record{Table: table, Logged: time.Now().Format(timeFormat), Columns: columns, Values: values}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.online && queue.pending == 0 {
+		err := queue.exec(&rec)
+		if err == nil {
+			return nil
+		}
+		if queue.db.Ping() == nil {
+			// The database is there so it did not like this row. Buffering it will not help.
+			return err
+		}
+		log.Println("Lost the database connection, buffering data in", queue.path, "-", err)
+		queue.online = false
+	}
+	return queue.append(&rec)
+}
+
+func (queue *Queue) append(rec *record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = queue.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	queue.pending++
+	return queue.file.Sync()
+}
+
+func (queue *Queue) exec(rec *record) error {
+	return queue.db.Insert(rec.Table, rec.Logged, rec.Columns, rec.Values)
+}
+
+/**
+Read up to max rows from the file starting at the given offset. Returns the rows and the offset following each one.
+A max of -1 reads everything.
+*/
+func (queue *Queue) read(offset int64, max int) ([]record, []int64, error) {
+	reader, err := os.Open(queue.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	if _, err = reader.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	var records []record
+	var offsets []int64
+	buffered := bufio.NewReader(reader)
+	for max < 0 || len(records) < max {
+		line, err := buffered.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial last line is a write cut off by a crash or power loss.
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		offset += int64(len(line))
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Println("Skipping a corrupt row in", queue.path, "-", err)
+			continue
+		}
+		records = append(records, rec)
+		offsets = append(offsets, offset)
+	}
+	return records, offsets, nil
+}
+
+func (queue *Queue) savePosition() {
+	if err := os.WriteFile(queue.positionFile(), []byte(strconv.FormatInt(queue.offset, 10)), 0644); err != nil {
+		log.Println("Failed to save the replay position -", err)
+	}
+}
+
+/**
+Write everything in the file to the database. Returns when the file is empty or the database cannot be reached.
+Rows are read in batches so new rows can still be added while a long outage is being replayed.
+*/
+func (queue *Queue) replay() {
+	for {
+		queue.mu.Lock()
+		records, offsets, err := queue.read(queue.offset, replayBatch)
+		if err != nil {
+			queue.mu.Unlock()
+			log.Println("Failed to read the buffered data -", err)
+			return
+		}
+		if len(records) == 0 {
+			// All caught up so start the file again.
+			if err := queue.file.Truncate(0); err != nil {
+				log.Println(err)
+			}
+			queue.offset = 0
+			queue.pending = 0
+			queue.savePosition()
+			if !queue.online {
+				log.Println("All buffered data has been written to the database")
+			}
+			queue.online = true
+			queue.mu.Unlock()
+			return
+		}
+		queue.mu.Unlock()
+
+		for i := range records {
+			queue.mu.Lock()
+			err := queue.exec(&records[i])
+			if err != nil && queue.db.Ping() != nil {
+				queue.savePosition()
+				queue.mu.Unlock()
+				return
+			}
+			if err != nil {
+				log.Println("Discarding a buffered", records[i].Table, "row logged at", records[i].Logged, "-", err)
+			}
+			queue.offset = offsets[i]
+			queue.pending--
+			queue.mu.Unlock()
+		}
+		queue.mu.Lock()
+		queue.savePosition()
+		queue.mu.Unlock()
+	}
+}
+
+/**
+Watch the database connection and replay the buffered rows when it is available. Never returns.
+*/
+func (queue *Queue) Run() {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		queue.mu.Lock()
+		waiting := queue.pending > 0
+		queue.mu.Unlock()
+		if waiting {
+			if err := queue.db.Ping(); err == nil {
+				log.Println("Database is available, replaying the buffered data")
+				queue.replay()
+			}
+		}
+		<-ticker.C
+	}
+}
+
+/**
+The number of rows waiting to be written to the database
+*/
+func (queue *Queue) Pending() int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.pending
+}
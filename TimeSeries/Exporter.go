@@ -0,0 +1,141 @@
+package TimeSeries
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const minRetryDelay = time.Second
+const maxRetryDelay = time.Minute
+
+/**
+Exporter collects points and sends them to the writer in batches. A batch is sent when it is full or when the flush
+interval has passed. If the writer fails the batch is kept and retried with an increasing delay. Points are held in
+memory so if the destination is down for long enough to fill the buffer the oldest points are dropped.
+*/
+type Exporter struct {
+	mu            sync.Mutex
+	writer        Writer
+	buffer        []Point
+	first         uint64 // Sequence number of the first point in the buffer
+	batchSize     int
+	maxBuffered   int
+	flushInterval time.Duration
+	ready         chan bool
+	dropped       int
+}
+
+func New(writer Writer, batchSize int, maxBuffered int, flushInterval time.Duration) *Exporter {
+	exporter := new(Exporter)
+	exporter.writer = writer
+	exporter.batchSize = batchSize
+	exporter.maxBuffered = maxBuffered
+	if exporter.maxBuffered < batchSize {
+		exporter.maxBuffered = batchSize
+	}
+	exporter.flushInterval = flushInterval
+	exporter.ready = make(chan bool, 1)
+	return exporter
+}
+
+/**
+Queue points for export. Never blocks.
+*/
+func (exporter *Exporter) Add(points ...Point) {
+	exporter.mu.Lock()
+	exporter.buffer = append(exporter.buffer, points...)
+	if over := len(exporter.buffer) - exporter.maxBuffered; over > 0 {
+		if exporter.dropped == 0 {
+			log.Println("Time series export buffer is full, dropping the oldest points")
+		}
+		exporter.dropped += over
+		exporter.first += uint64(over)
+		exporter.buffer = append(exporter.buffer[:0], exporter.buffer[over:]...)
+	}
+	full := len(exporter.buffer) >= exporter.batchSize
+	exporter.mu.Unlock()
+	if full {
+		select {
+		case exporter.ready <- true:
+		default:
+		}
+	}
+}
+
+/**
+Take the next batch from the front of the buffer without removing it. Also returns the sequence number of the first
+point in the batch.
+*/
+func (exporter *Exporter) nextBatch() ([]Point, uint64) {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	n := len(exporter.buffer)
+	if n > exporter.batchSize {
+		n = exporter.batchSize
+	}
+	batch := make([]Point, n)
+	copy(batch, exporter.buffer)
+	return batch, exporter.first
+}
+
+/**
+Remove a batch that has been sent. Any of it that was dropped while it was being sent has already gone from the front
+of the buffer so only remove what is left.
+*/
+func (exporter *Exporter) sent(first uint64, n int) {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	if end := first + uint64(n); end > exporter.first {
+		remove := int(end - exporter.first)
+		if remove > len(exporter.buffer) {
+			remove = len(exporter.buffer)
+		}
+		exporter.buffer = append(exporter.buffer[:0], exporter.buffer[remove:]...)
+		exporter.first += uint64(remove)
+	}
+	if exporter.dropped > 0 {
+		log.Println(exporter.dropped, "time series points were dropped while the export destination was unavailable")
+		exporter.dropped = 0
+	}
+}
+
+/**
+Send everything that is buffered. Returns false if the writer failed.
+*/
+func (exporter *Exporter) flush() bool {
+	for {
+		batch, first := exporter.nextBatch()
+		if len(batch) == 0 {
+			return true
+		}
+		if err := exporter.writer.Write(batch); err != nil {
+			log.Println("Time series export failed -", err)
+			return false
+		}
+		exporter.sent(first, len(batch))
+	}
+}
+
+/**
+Send the batches as they fill up or the flush interval passes. Never returns.
+*/
+func (exporter *Exporter) Run() {
+	retryDelay := minRetryDelay
+	ticker := time.NewTicker(exporter.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-exporter.ready:
+		}
+		for !exporter.flush() {
+			time.Sleep(retryDelay)
+			retryDelay *= 2
+			if retryDelay > maxRetryDelay {
+				retryDelay = maxRetryDelay
+			}
+		}
+		retryDelay = minRetryDelay
+	}
+}
@@ -0,0 +1,71 @@
+package TimeSeries
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+Point is one measurement at one time. The tags identify the series (bank, cell, device, sensor) and the fields hold
+the values.
+*/
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]float64
+	Time        time.Time
+}
+
+var measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+var tagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/**
+Return the point as one line of InfluxDB line protocol with a nanosecond timestamp. Tags and fields are sorted by
+key as Influx recommends. Fields that are not a number are left out and a point with no fields at all returns an empty
+string as Influx would reject it.
+*/
+func (point *Point) LineProtocol() string {
+	var line strings.Builder
+	line.WriteString(measurementEscaper.Replace(point.Measurement))
+	for _, key := range sortedKeys(point.Tags) {
+		line.WriteByte(',')
+		line.WriteString(tagEscaper.Replace(key))
+		line.WriteByte('=')
+		line.WriteString(tagEscaper.Replace(point.Tags[key]))
+	}
+	fields := make([]string, 0, len(point.Fields))
+	for key, value := range point.Fields {
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			fields = append(fields, key)
+		}
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	sort.Strings(fields)
+	for i, key := range fields {
+		if i == 0 {
+			line.WriteByte(' ')
+		} else {
+			line.WriteByte(',')
+		}
+		line.WriteString(tagEscaper.Replace(key))
+		line.WriteByte('=')
+		line.WriteString(strconv.FormatFloat(point.Fields[key], 'f', -1, 64))
+	}
+	line.WriteByte(' ')
+	line.WriteString(strconv.FormatInt(point.Time.UnixNano(), 10))
+	return line.String()
+}
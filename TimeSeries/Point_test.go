@@ -0,0 +1,35 @@
+package TimeSeries
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLineProtocol(t *testing.T) {
+	when := time.Unix(1700000000, 5)
+	tests := []struct {
+		name  string
+		point Point
+		want  string
+	}{
+		{"plain", Point{Measurement: "cell", Tags: map[string]string{"cell": "2", "bank": "0"}, Fields: map[string]float64{"volts": 3.3, "amps": -1},
+			Time: when}, `cell,bank=0,cell=2 amps=-1,volts=3.3 1700000000000000005`},
+		{"escaped measurement", Point{Measurement: "my cell,x", Fields: map[string]float64{"v": 1}, Time: when},
+			`my\ cell\,x v=1 1700000000000000005`},
+		{"escaped tag key and value", Point{Measurement: "m", Tags: map[string]string{"a b,c=d": "e f,g=h"}, Fields: map[string]float64{"v": 1},
+			Time: when}, `m,a\ b\,c\=d=e\ f\,g\=h v=1 1700000000000000005`},
+		{"escaped field key", Point{Measurement: "m", Fields: map[string]float64{"x y,z=w": 2.5}, Time: when},
+			`m x\ y\,z\=w=2.5 1700000000000000005`},
+		{"not a number left out", Point{Measurement: "m", Fields: map[string]float64{"v": 1, "nan": math.NaN(), "inf": math.Inf(-1)}, Time: when},
+			`m v=1 1700000000000000005`},
+		{"no fields", Point{Measurement: "m", Tags: map[string]string{"a": "b"}, Fields: map[string]float64{"nan": math.NaN()}, Time: when}, ``},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.point.LineProtocol(); got != test.want {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}
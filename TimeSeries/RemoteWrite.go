@@ -0,0 +1,133 @@
+package TimeSeries
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"time"
+)
+
+/**
+RemoteWrite sends the points to a Prometheus remote-write receiver (Prometheus with --web.enable-remote-write-receiver,
+VictoriaMetrics, Mimir etc.). Each field becomes its own series named prefix_measurement_field with the tags as labels.
+
+The request is a snappy compressed protobuf WriteRequest. Both are simple enough to encode here rather than pulling in
+the Prometheus and snappy libraries. The snappy block is written as literals only, which every decoder accepts.
+*/
+type RemoteWrite struct {
+	url    string
+	prefix string
+	client *http.Client
+}
+
+func NewRemoteWrite(url string, prefix string) *RemoteWrite {
+	writer := new(RemoteWrite)
+	writer.url = url
+	writer.prefix = prefix
+	writer.client = &http.Client{Timeout: 10 * time.Second}
+	return writer
+}
+
+func (writer *RemoteWrite) Write(points []Point) error {
+	body := snappyLiterals(writer.writeRequest(points))
+	request, err := http.NewRequest(http.MethodPost, writer.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	return post(writer.client, request)
+}
+
+func (writer *RemoteWrite) metricName(measurement string, field string) string {
+	name := measurement + "_" + field
+	if writer.prefix != "" {
+		name = writer.prefix + "_" + name
+	}
+	return name
+}
+
+/**
+Encode the points as a prometheus.WriteRequest
+
+	message WriteRequest { repeated TimeSeries timeseries = 1; }
+	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+	message Label { string name = 1; string value = 2; }
+	message Sample { double value = 1; int64 timestamp = 2; }
+*/
+func (writer *RemoteWrite) writeRequest(points []Point) []byte {
+	var request []byte
+	for _, point := range points {
+		for field, value := range point.Fields {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			labels := map[string]string{"__name__": writer.metricName(point.Measurement, field)}
+			for name, tag := range point.Tags {
+				labels[name] = tag
+			}
+			var series []byte
+			for _, name := range sortedKeys(labels) {
+				var label []byte
+				label = appendBytes(label, 1, []byte(name))
+				label = appendBytes(label, 2, []byte(labels[name]))
+				series = appendBytes(series, 1, label)
+			}
+			var sample []byte
+			sample = appendKey(sample, 1, 1)
+			var bits [8]byte
+			binary.LittleEndian.PutUint64(bits[:], math.Float64bits(value))
+			sample = append(sample, bits[:]...)
+			sample = appendKey(sample, 2, 0)
+			sample = appendVarint(sample, uint64(point.Time.UnixNano()/int64(time.Millisecond)))
+			series = appendBytes(series, 2, sample)
+			request = appendBytes(request, 1, series)
+		}
+	}
+	return request
+}
+
+func appendVarint(buffer []byte, value uint64) []byte {
+	for value >= 0x80 {
+		buffer = append(buffer, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(buffer, byte(value))
+}
+
+func appendKey(buffer []byte, field int, wireType int) []byte {
+	return appendVarint(buffer, uint64(field<<3|wireType))
+}
+
+func appendBytes(buffer []byte, field int, value []byte) []byte {
+	buffer = appendKey(buffer, field, 2)
+	buffer = appendVarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+/**
+Wrap the data in a snappy block made only of literals of up to 64k each
+*/
+func snappyLiterals(data []byte) []byte {
+	block := appendVarint(make([]byte, 0, len(data)+(len(data)/65536+1)*3+10), uint64(len(data)))
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > 65536 {
+			chunk = chunk[:65536]
+		}
+		n := len(chunk) - 1
+		switch {
+		case n < 60:
+			block = append(block, byte(n<<2))
+		case n < 256:
+			block = append(block, 60<<2, byte(n))
+		default:
+			block = append(block, 61<<2, byte(n), byte(n>>8))
+		}
+		block = append(block, chunk...)
+		data = data[len(chunk):]
+	}
+	return block
+}
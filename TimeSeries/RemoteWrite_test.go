@@ -0,0 +1,139 @@
+package TimeSeries
+
+import (
+	"bytes"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSample struct {
+	value     float64
+	timestamp int64
+}
+
+type testSeries struct {
+	labels  map[string]string
+	samples []testSample
+}
+
+/**
+Decode a WriteRequest with the protobuf wire decoder, failing the test on anything that is not in the schema
+*/
+func decodeWriteRequest(t *testing.T, data []byte) []testSeries {
+	t.Helper()
+	var series []testSeries
+	forEachField(t, data, func(number protowire.Number, wireType protowire.Type, value []byte) {
+		if number != 1 || wireType != protowire.BytesType {
+			t.Fatalf("WriteRequest has field %d of type %d", number, wireType)
+		}
+		one := testSeries{labels: make(map[string]string)}
+		forEachField(t, value, func(number protowire.Number, wireType protowire.Type, value []byte) {
+			switch {
+			case number == 1 && wireType == protowire.BytesType:
+				var name, label string
+				forEachField(t, value, func(number protowire.Number, wireType protowire.Type, value []byte) {
+					switch {
+					case number == 1 && wireType == protowire.BytesType:
+						name = string(value)
+					case number == 2 && wireType == protowire.BytesType:
+						label = string(value)
+					default:
+						t.Fatalf("Label has field %d of type %d", number, wireType)
+					}
+				})
+				one.labels[name] = label
+			case number == 2 && wireType == protowire.BytesType:
+				var sample testSample
+				forEachField(t, value, func(number protowire.Number, wireType protowire.Type, value []byte) {
+					switch {
+					case number == 1 && wireType == protowire.Fixed64Type:
+						bits, _ := protowire.ConsumeFixed64(value)
+						sample.value = math.Float64frombits(bits)
+					case number == 2 && wireType == protowire.VarintType:
+						timestamp, _ := protowire.ConsumeVarint(value)
+						sample.timestamp = int64(timestamp)
+					default:
+						t.Fatalf("Sample has field %d of type %d", number, wireType)
+					}
+				})
+				one.samples = append(one.samples, sample)
+			default:
+				t.Fatalf("TimeSeries has field %d of type %d", number, wireType)
+			}
+		})
+		series = append(series, one)
+	})
+	return series
+}
+
+/**
+Call found with each field of the message. Length delimited values are passed without their length and the others
+as their raw bytes.
+*/
+func forEachField(t *testing.T, data []byte, found func(protowire.Number, protowire.Type, []byte)) {
+	t.Helper()
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		data = data[n:]
+		size := protowire.ConsumeFieldValue(number, wireType, data)
+		if size < 0 {
+			t.Fatal(protowire.ParseError(size))
+		}
+		value := data[:size]
+		if wireType == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		found(number, wireType, value)
+		data = data[size:]
+	}
+}
+
+func TestRemoteWriteRoundTrip(t *testing.T) {
+	when := time.Date(2026, 3, 1, 12, 0, 0, 250*int(time.Millisecond), time.UTC)
+	points := []Point{
+		{Measurement: "cell", Tags: map[string]string{"bank": "0", "cell": "12"}, Fields: map[string]float64{"volts": 3.325}, Time: when},
+		{Measurement: "bank", Tags: map[string]string{"bank": "1"}, Fields: map[string]float64{"amps": -42.5, "bad": math.NaN(), "worse": math.Inf(1)},
+			Time: when.Add(time.Second)},
+	}
+	writer := NewRemoteWrite("http://localhost/api/v1/write", "battery")
+	encoded := writer.writeRequest(points)
+
+	decoded, err := snappy.Decode(nil, snappyLiterals(encoded))
+	if err != nil {
+		t.Fatal("snappy could not decode the block -", err)
+	}
+	if !bytes.Equal(decoded, encoded) {
+		t.Fatal("the snappy block did not decode to the request")
+	}
+
+	want := []testSeries{
+		{labels: map[string]string{"__name__": "battery_cell_volts", "bank": "0", "cell": "12"},
+			samples: []testSample{{3.325, when.UnixNano() / int64(time.Millisecond)}}},
+		{labels: map[string]string{"__name__": "battery_bank_amps", "bank": "1"},
+			samples: []testSample{{-42.5, when.Add(time.Second).UnixNano() / int64(time.Millisecond)}}},
+	}
+	if got := decodeWriteRequest(t, decoded); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestSnappyLiteralsLengths(t *testing.T) {
+	// Cover each literal length encoding and a block split into several 64k literals
+	for _, size := range []int{0, 1, 60, 61, 256, 257, 65536, 65537, 200000} {
+		data := []byte(strings.Repeat("0123456789abcdef", size/16+1)[:size])
+		decoded, err := snappy.Decode(nil, snappyLiterals(data))
+		if err != nil {
+			t.Errorf("%d bytes - %v", size, err)
+		} else if !bytes.Equal(decoded, data) {
+			t.Errorf("%d bytes did not round trip", size)
+		}
+	}
+}
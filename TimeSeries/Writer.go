@@ -0,0 +1,114 @@
+package TimeSeries
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/**
+Writer sends a batch of points to wherever they are being exported to. A batch that returns an error is retried.
+*/
+type Writer interface {
+	Write(points []Point) error
+}
+
+/**
+Format the points as line protocol, one per line
+*/
+func lineProtocol(points []Point) []byte {
+	var buffer bytes.Buffer
+	for i := range points {
+		if line := points[i].LineProtocol(); line != "" {
+			buffer.WriteString(line)
+			buffer.WriteByte('\n')
+		}
+	}
+	return buffer.Bytes()
+}
+
+/**
+InfluxHTTP posts line protocol to an InfluxDB write endpoint. Use http://host:8086/write?db=battery for InfluxDB 1.x or
+http://host:8086/api/v2/write?org=site&bucket=battery with a token for 2.x.
+*/
+type InfluxHTTP struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func NewInfluxHTTP(url string, token string) *InfluxHTTP {
+	writer := new(InfluxHTTP)
+	writer.url = url
+	writer.token = token
+	writer.client = &http.Client{Timeout: 10 * time.Second}
+	return writer
+}
+
+func (writer *InfluxHTTP) Write(points []Point) error {
+	body := lineProtocol(points)
+	if len(body) == 0 {
+		return nil
+	}
+	request, err := http.NewRequest(http.MethodPost, writer.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if writer.token != "" {
+		request.Header.Set("Authorization", "Token "+writer.token)
+	}
+	return post(writer.client, request)
+}
+
+/**
+Send the request and turn anything other than a 2xx response into an error
+*/
+func post(client *http.Client, request *http.Request) error {
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	if response.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s returned %s - %s", request.URL.Host, response.Status, strings.TrimSpace(string(message)))
+	}
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	return nil
+}
+
+/**
+File appends line protocol to a file so it can be picked up by Telegraf or loaded with the influx CLI.
+*/
+type File struct {
+	path string
+}
+
+func NewFile(path string) *File {
+	writer := new(File)
+	writer.path = path
+	return writer
+}
+
+func (writer *File) Write(points []Point) error {
+	file, err := os.OpenFile(writer.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(lineProtocol(points))
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
@@ -5,10 +5,17 @@ go 1.16
 require (
 	github.com/IanAber/SMACanMessages v0.0.0-20220324225941-122bdd7703db
 	github.com/brutella/can v0.0.2
+	github.com/eclipse/paho.mqtt.golang v1.4.2
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/goburrow/modbus v0.1.0
 	github.com/goburrow/serial v0.1.0 // indirect
+	github.com/golang/snappy v0.0.4
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
+	github.com/mattn/go-sqlite3 v1.14.15
+	golang.org/x/crypto v0.10.0
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	google.golang.org/protobuf v1.28.1
 	periph.io/x/periph v3.6.8+incompatible
 )